@@ -13,6 +13,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"syscall"
 	"time"
 
@@ -22,11 +23,13 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"clyde/internal/cleanup"
+	"clyde/pkg/cache"
 	"clyde/pkg/hf"
 	"clyde/pkg/metrics"
 	"clyde/pkg/oci"
 	"clyde/pkg/pip"
 	"clyde/pkg/registry"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 	"clyde/pkg/state"
 	"clyde/pkg/web"
@@ -55,6 +58,8 @@ type RegistryCmd struct {
 	ContainerdSock               string           `arg:"--containerd-sock,env:CONTAINERD_SOCK" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
 	ContainerdNamespace          string           `arg:"--containerd-namespace,env:CONTAINERD_NAMESPACE" default:"k8s.io" help:"Containerd namespace to fetch images from."`
 	ContainerdContentPath        string           `arg:"--containerd-content-path,env:CONTAINERD_CONTENT_PATH" default:"/var/lib/containerd/io.containerd.content.v1.content" help:"Path to Containerd content store"`
+	OCILayoutDirs                []string         `arg:"--oci-layout-dirs,env:OCI_LAYOUT_DIRS" help:"OCI image layout directories to serve images from instead of containerd, if slice is empty containerd is used."`
+	OCILayoutPollInterval        time.Duration    `arg:"--oci-layout-poll-interval,env:OCI_LAYOUT_POLL_INTERVAL" default:"5s" help:"Interval at which OCI image layout directories are scanned for changes."`
 	DataDir                      string           `arg:"--data-dir,env:DATA_DIR" default:"/var/lib/clyde" help:"Directory where Clyde persists data."`
 	RouterAddr                   string           `arg:"--router-addr,env:ROUTER_ADDR" default:":5001" help:"address to serve router."`
 	RegistryAddr                 string           `arg:"--registry-addr,env:REGISTRY_ADDR" default:":5000" help:"address to server image registry."`
@@ -62,11 +67,36 @@ type RegistryCmd struct {
 	RegistryFilters              []*regexp.Regexp `arg:"--registry-filters,env:REGISTRY_FILTERS" help:"Regular expressions to filter out tags/registries, if slice is empty all registries/tags are resolved."`
 	MirrorResolveTimeout         time.Duration    `arg:"--mirror-resolve-timeout,env:MIRROR_RESOLVE_TIMEOUT" default:"20ms" help:"Max duration spent finding a mirror."`
 	MirrorResolveRetries         int              `arg:"--mirror-resolve-retries,env:MIRROR_RESOLVE_RETRIES" default:"3" help:"Max amount of mirrors to attempt."`
+	MirrorSwarmConcurrency       int              `arg:"--mirror-swarm-concurrency,env:MIRROR_SWARM_CONCURRENCY" default:"0" help:"Amount of blob ranges to fetch in parallel from different mirrors, swarming is disabled when less than two."`
+	MirrorSwarmChunkSize         int64            `arg:"--mirror-swarm-chunk-size,env:MIRROR_SWARM_CHUNK_SIZE" default:"8388608" help:"Size in bytes of each blob range fetched when swarming."`
+	MirrorSwarmStallTimeout      time.Duration    `arg:"--mirror-swarm-stall-timeout,env:MIRROR_SWARM_STALL_TIMEOUT" default:"5s" help:"Duration after which a slow blob range is reassigned to another mirror."`
+	UpstreamLeaseTimeout         time.Duration    `arg:"--upstream-lease-timeout,env:UPSTREAM_LEASE_TIMEOUT" default:"10s" help:"Max duration spent waiting for another node to fetch content from upstream before fetching it."`
+	UpstreamLeaseLookupTimeout   time.Duration    `arg:"--upstream-lease-lookup-timeout,env:UPSTREAM_LEASE_LOOKUP_TIMEOUT" default:"500ms" help:"Max duration spent finding another node that fetches content from upstream."`
+	ClusterListing               bool             `arg:"--cluster-listing,env:CLUSTER_LISTING" default:"false" help:"When true tag and repository listings are merged from all peers in the cluster."`
+	PushEnabled                  bool             `arg:"--push-enabled,env:PUSH_ENABLED" default:"false" help:"When true images can be pushed to the registry, which requires basic auth to be configured."`
+	PushNamespace                string           `arg:"--push-namespace,env:PUSH_NAMESPACE" default:"clyde.local" help:"Registry name that pushed images are stored under, which must not be a mirrored registry."`
+	PushMaxUploadSize            int64            `arg:"--push-max-upload-size,env:PUSH_MAX_UPLOAD_SIZE" default:"10737418240" help:"Maximum size in bytes of a single pushed blob."`
 	DebugWebEnabled              bool             `arg:"--debug-web-enabled,env:DEBUG_WEB_ENABLED" default:"true" help:"When true enables debug web page."`
 
-	EnablePipProxy   bool   `arg:"--enable-pip-proxy,env:ENABLE_PIP_PROXY" default:"false" help:"Enable pip proxy endpoint"`
-	PipProxyPath     string `arg:"--pip-proxy-path,env:PIP_PROXY_PATH" default:"/simple/" help:"Path prefix for pip simple index"`
-	PipFallbackIndex string `arg:"--pip-fallback-index,env:PIP_FALLBACK_INDEX" default:"https://pypi.org/simple" help:"Upstream index to use when package is not found in P2P"`
+	EnablePipProxy         bool          `arg:"--enable-pip-proxy,env:ENABLE_PIP_PROXY" default:"false" help:"Enable pip proxy endpoint"`
+	PipProxyPath           string        `arg:"--pip-proxy-path,env:PIP_PROXY_PATH" default:"/simple/" help:"Path prefix for pip simple index"`
+	PipFallbackIndex       string        `arg:"--pip-fallback-index,env:PIP_FALLBACK_INDEX" default:"https://pypi.org/simple" help:"Upstream index to use when package is not found in P2P"`
+	PipUpstreamsPath       string        `arg:"--pip-upstreams-path,env:PIP_UPSTREAMS_PATH" help:"Path to a JSON file with the ordered list of upstream Python indexes, the index URL is the only upstream when not set."`
+	PipIndexTTL            time.Duration `arg:"--pip-index-ttl,env:PIP_INDEX_TTL" default:"10m" help:"Duration for which cached project indexes are served before they are revalidated with the upstream indexes."`
+	PipIndexStaleIfError   time.Duration `arg:"--pip-index-stale-if-error,env:PIP_INDEX_STALE_IF_ERROR" default:"24h" help:"Duration after the index TTL for which stale project indexes are served when the upstream indexes fail."`
+	PipCacheMaxBytes       int64         `arg:"--pip-cache-max-bytes,env:PIP_CACHE_MAX_BYTES" default:"0" help:"Maximum size in bytes of the pip cache before files are evicted, the size is not limited when zero."`
+	PipCacheMaxDiskPercent float64       `arg:"--pip-cache-max-disk-percent,env:PIP_CACHE_MAX_DISK_PERCENT" default:"0" help:"Maximum size of the pip cache as a percentage of its filesystem before files are evicted, the size is not limited when zero. Only supported on Linux."`
+	PipCachePinned         []string      `arg:"--pip-cache-pinned,env:PIP_CACHE_PINNED" help:"Patterns of pip cache files that are never evicted."`
+
+	HFAccessTTL           time.Duration `arg:"--hf-access-ttl,env:HF_ACCESS_TTL" default:"5m" help:"Duration for which access checks of gated and private Hugging Face repositories are cached."`
+	HFCacheMaxBytes       int64         `arg:"--hf-cache-max-bytes,env:HF_CACHE_MAX_BYTES" default:"0" help:"Maximum size in bytes of the Hugging Face cache before files are evicted, the size is not limited when zero."`
+	HFCacheMaxDiskPercent float64       `arg:"--hf-cache-max-disk-percent,env:HF_CACHE_MAX_DISK_PERCENT" default:"0" help:"Maximum size of the Hugging Face cache as a percentage of its filesystem before files are evicted, the size is not limited when zero. Only supported on Linux."`
+	HFCachePinned         []string      `arg:"--hf-cache-pinned,env:HF_CACHE_PINNED" help:"Patterns of Hugging Face cache files that are never evicted, a pattern matching a repository directory pins all of its files."`
+
+	CacheEvictionPolicy  string        `arg:"--cache-eviction-policy,env:CACHE_EVICTION_POLICY" default:"lru" help:"Policy that selects the pip and Hugging Face cache files that are evicted first, either lru or lfu."`
+	CacheCollectInterval time.Duration `arg:"--cache-collect-interval,env:CACHE_COLLECT_INTERVAL" default:"1m" help:"Interval at which the pip and Hugging Face caches are collected, which removes unreferenced files and evicts files above the quota."`
+	CacheRescanInterval  time.Duration `arg:"--cache-rescan-interval,env:CACHE_RESCAN_INTERVAL" default:"1m" help:"Interval at which the pip and Hugging Face caches are rescanned to advertise changes that were not watched."`
+	ReconcileInterval    time.Duration `arg:"--reconcile-interval,env:RECONCILE_INTERVAL" default:"10m" help:"Interval at which the advertised keys are reconciled with the contents of the store and the pip and Hugging Face caches."`
 	PipConfigurationCmd
 	HFConfigurationCmd
 }
@@ -184,6 +214,13 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 	if err != nil {
 		return err
 	}
+	if args.PushEnabled && regFilter != nil {
+		if slices.Contains(regFilter.Whitelist, args.PushNamespace) {
+			return fmt.Errorf("push namespace %s cannot be a mirrored registry", args.PushNamespace)
+		}
+		// Pushed images are not mirrored but have to be served.
+		regFilter.Whitelist = append(regFilter.Whitelist, args.PushNamespace)
+	}
 	if regFilter != nil {
 		filters = append(filters, *regFilter)
 	}
@@ -191,14 +228,24 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 		filters = append(filters, oci.RegexFilter{Regex: r})
 	}
 
-	ociStore, err := oci.NewContainerd(ctx, args.ContainerdSock, args.ContainerdNamespace, oci.WithContentPath(args.ContainerdContentPath))
-	if err != nil {
-		return err
-	}
-	defer ociStore.Close()
-	err = ociStore.Verify(ctx, args.ContainerdRegistryConfigPath)
-	if err != nil {
-		return err
+	var ociStore oci.Store
+	if len(args.OCILayoutDirs) > 0 {
+		layoutStore, err := oci.NewLayout(args.OCILayoutDirs, oci.WithPollInterval(args.OCILayoutPollInterval))
+		if err != nil {
+			return err
+		}
+		ociStore = layoutStore
+	} else {
+		containerdStore, err := oci.NewContainerd(ctx, args.ContainerdSock, args.ContainerdNamespace, oci.WithContentPath(args.ContainerdContentPath))
+		if err != nil {
+			return err
+		}
+		defer containerdStore.Close()
+		err = containerdStore.Verify(ctx, args.ContainerdRegistryConfigPath)
+		if err != nil {
+			return err
+		}
+		ociStore = containerdStore
 	}
 
 	_, registryPort, err := net.SplitHostPort(args.RegistryAddr)
@@ -220,43 +267,123 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 		return router.Run(ctx)
 	})
 
+	self, err := router.Self()
+	if err != nil {
+		return err
+	}
+	leaser, err := routing.NewLeaser(router, routing.WithLeaseTimeouts(args.UpstreamLeaseTimeout, args.UpstreamLeaseLookupTimeout), routing.WithLeaseSelf(self))
+	if err != nil {
+		return err
+	}
+	contentRelay, err := relay.NewRelay(router, relay.WithDir(filepath.Join(args.DataDir, "relay")))
+	if err != nil {
+		return err
+	}
+
+	hfEviction := cache.Eviction{
+		Policy:         cache.EvictionPolicy(args.CacheEvictionPolicy),
+		Pinned:         args.HFCachePinned,
+		MaxBytes:       args.HFCacheMaxBytes,
+		MaxDiskPercent: args.HFCacheMaxDiskPercent,
+	}
+	err = hfEviction.Validate()
+	if err != nil {
+		return err
+	}
 	hfClient := hf.NewHFClient(
 		router,
 		args.HFCacheDir,
+		hf.WithHFCacheEviction(hfEviction),
+		hf.WithHFLeaser(leaser),
+		hf.WithHFRelay(contentRelay),
+		hf.WithHFAccessPolicy(args.HFAccessTTL),
+		hf.WithHFBasicAuth(username, password),
 		hf.WithHFRetries(5),
 		hf.WithHFTimeout(300*time.Second),
 		hf.WithHFLogger(log),
 	)
 
+	var pipUpstreams []pip.Upstream
+	if args.PipUpstreamsPath != "" {
+		pipUpstreams, err = pip.LoadUpstreams(args.PipUpstreamsPath)
+		if err != nil {
+			return err
+		}
+	}
+	pipEviction := cache.Eviction{
+		Policy:         cache.EvictionPolicy(args.CacheEvictionPolicy),
+		Pinned:         args.PipCachePinned,
+		MaxBytes:       args.PipCacheMaxBytes,
+		MaxDiskPercent: args.PipCacheMaxDiskPercent,
+	}
+	err = pipEviction.Validate()
+	if err != nil {
+		return err
+	}
 	pipClient := pip.NewPipClient(
 		router,
 		args.PipCacheDir,
 		args.IndexURL,
+		pip.WithCacheEviction(pipEviction),
+		pip.WithLeaser(leaser),
+		pip.WithRelay(contentRelay),
+		pip.WithUpstreams(pipUpstreams...),
+		pip.WithIndexFreshness(args.PipIndexTTL, args.PipIndexStaleIfError),
 		pip.WithResolveTimeout(300*time.Second),
 		pip.WithResolveRetries(5),
 		pip.WithLogger(log),
 	)
 
+	reconcileStats := &state.ReconcileStatistics{}
+	referrersIdx := oci.NewReferrersIndex()
 	g.Go(func() error {
 		err := state.Track(ctx, ociStore, router,
 			state.WithRegistryFilters(filters),
 			state.WithPipClient(pipClient),
 			state.WithHfClient(hfClient),
+			state.WithRelay(contentRelay),
+			state.WithCacheRescanInterval(args.CacheRescanInterval),
+			state.WithReconcileInterval(args.ReconcileInterval),
+			state.WithReconcileStatistics(reconcileStats),
+			state.WithReferrersIndex(referrersIdx),
 		)
 		if err != nil && !errors.Is(err, context.Canceled) {
 			return err
 		}
 		return nil
 	})
+	g.Go(func() error {
+		err := pipClient.RunCacheCollection(ctx, args.CacheCollectInterval)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		err := hfClient.RunCacheCollection(ctx, args.CacheCollectInterval)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		return nil
+	})
 
 	registryOpts := []registry.RegistryOption{
 		registry.WithRegistryFilters(filters),
 		registry.WithResolveTimeout(args.MirrorResolveTimeout),
+		registry.WithSwarm(args.MirrorSwarmConcurrency, args.MirrorSwarmChunkSize, args.MirrorSwarmStallTimeout),
 		registry.WithBasicAuth(username, password),
+		registry.WithUploadDir(filepath.Join(args.DataDir, "uploads")),
+		registry.WithClusterListing(args.ClusterListing),
+		registry.WithLeaser(leaser),
+		registry.WithRelay(contentRelay),
+		registry.WithReferrersIndex(referrersIdx),
 		registry.WithOCIClient(ociClient),
 		registry.WithPipClient(pipClient),
 		registry.WithHfClient(hfClient),
 	}
+	if args.PushEnabled {
+		registryOpts = append(registryOpts, registry.WithPush(args.PushNamespace, args.PushMaxUploadSize))
+	}
 	reg, err := registry.NewRegistry(ociStore, router, registryOpts...)
 	if err != nil {
 		return err
@@ -295,6 +422,7 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 		webOpts := []web.WebOption{
 			web.WithOCIClient(ociClient),
 			web.WithRegistryFilters(filters),
+			web.WithReconcileStatistics(reconcileStats),
 		}
 		mirror := &url.URL{
 			Scheme: "http",
@@ -0,0 +1,597 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"clyde/internal/option"
+)
+
+const (
+	blobsDirName = "blobs"
+	// tmpSuffix ends the names of temporary files, which are never listed.
+	tmpSuffix = ".partial"
+)
+
+type Config struct {
+	// BlobDepth is the number of leading elements of names that the blobs directory of the names is stored under.
+	BlobDepth int
+	Eviction  Eviction
+}
+
+type Option = option.Option[Config]
+
+// WithBlobDepth stores blobs in a directory under the leading elements of the names that refer to them instead of a
+// single blobs directory, like the cache of huggingface_hub stores the blobs of each repository.
+func WithBlobDepth(depth int) Option {
+	return func(cfg *Config) error {
+		if depth < 0 {
+			return fmt.Errorf("blob depth %d can not be negative", depth)
+		}
+		cfg.BlobDepth = depth
+		return nil
+	}
+}
+
+// Info describes a name in the store.
+type Info struct {
+	ModTime time.Time
+	// Name is the slash separated path of the file relative to the store.
+	Name string
+	// Digest is the digest of the blob that the name refers to, which is empty for files stored at their name.
+	Digest string
+	Size   int64
+}
+
+// Store is a cache of files on disk. Content is stored once in a blob named by its digest, and names are links to the
+// blobs so that content shared by multiple names is stored once. Files that are not addressed by their content, such
+// as metadata, are stored at their name. All files are written to a temporary file which is renamed once complete,
+// so that a partially written file is never read.
+type Store struct {
+	locks    map[string]*keyLock
+	accesses map[string]access
+	// linked are the blobs that names were linked to since the running collections listed the store.
+	linked     map[string]struct{}
+	dir        string
+	eviction   Eviction
+	blobDepth  int
+	collecting int
+	mx         sync.Mutex
+}
+
+type keyLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func New(dir string, opts ...Option) (*Store, error) {
+	cfg := Config{}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:       dir,
+		blobDepth: cfg.BlobDepth,
+		eviction:  cfg.Eviction,
+		locks:     map[string]*keyLock{},
+		accesses:  map[string]access{},
+	}
+	return s, nil
+}
+
+// Dir returns the directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Lock locks the key until the returned function is called.
+func (s *Store) Lock(key string) func() {
+	l := s.keyLock(key)
+	l.ch <- struct{}{}
+	return func() {
+		<-l.ch
+		s.releaseKeyLock(key)
+	}
+}
+
+// Claim coalesces concurrent fetches of the name within the process, for content with or without a known digest.
+// The first caller owns the fetch and has to call the returned function once the name is stored or the fetch failed.
+// Other callers wait until then and are not owners, after which the name is served from the store when the fetch
+// succeeded. An error is returned when the context is done while waiting.
+func (s *Store) Claim(ctx context.Context, name string) (func(), bool, error) {
+	key := "claim:" + name
+	if release, ok := s.tryLock(key); ok {
+		return release, true, nil
+	}
+	l := s.keyLock(key)
+	defer s.releaseKeyLock(key)
+	select {
+	case l.ch <- struct{}{}:
+		<-l.ch
+		return nil, false, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// tryLock locks the key when it is not locked.
+func (s *Store) tryLock(key string) (func(), bool) {
+	l := s.keyLock(key)
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			s.releaseKeyLock(key)
+		}, true
+	default:
+		s.releaseKeyLock(key)
+		return nil, false
+	}
+}
+
+func (s *Store) keyLock(key string) *keyLock {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	l, ok := s.locks[key]
+	if !ok {
+		l = &keyLock{ch: make(chan struct{}, 1)}
+		s.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (s *Store) releaseKeyLock(key string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	l := s.locks[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(s.locks, key)
+	}
+}
+
+// path returns the path of the name, which has to be a local slash separated path.
+func (s *Store) path(name string) (string, error) {
+	if name == "" || !filepath.IsLocal(filepath.FromSlash(name)) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// blobDir returns the directory that the blobs of the name are stored in.
+func (s *Store) blobDir(name string) (string, error) {
+	elems := strings.Split(name, "/")
+	if len(elems) <= s.blobDepth {
+		return "", fmt.Errorf("name %s has less than %d directories that blobs are stored under", name, s.blobDepth)
+	}
+	return filepath.Join(s.dir, filepath.Join(elems[:s.blobDepth]...), blobsDirName), nil
+}
+
+// blobPath returns the path of the blob with the digest that the name refers to.
+func (s *Store) blobPath(name, digest string) (string, error) {
+	if digest == "" || !filepath.IsLocal(digest) || strings.ContainsAny(digest, `/\`) || strings.HasPrefix(digest, ".") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	dir, err := s.blobDir(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, digest), nil
+}
+
+// HasBlob returns true when the blob with the digest that the name would refer to is stored.
+func (s *Store) HasBlob(name, digest string) bool {
+	p, err := s.blobPath(name, digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// Writer writes content to a temporary file in the store, which is moved to its blob when it is committed. Content
+// is always hashed with sha256 so that it can be verified before it is committed.
+type Writer struct {
+	store  *Store
+	file   *os.File
+	hash   hash.Hash
+	unlock func()
+	name   string
+	digest string
+}
+
+// Create returns a writer for the content of the name. The blob is named by the digest, or by the sha256 hex digest
+// of the content when the digest is empty. Content of a blob that is stored or is being written by another writer
+// is not written again, and the name is linked to the blob of the other writer once that is committed.
+func (s *Store) Create(name, digest string) (*Writer, error) {
+	if _, err := s.path(name); err != nil {
+		return nil, err
+	}
+	dir, err := s.blobDir(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		store:  s,
+		hash:   sha256.New(),
+		name:   name,
+		digest: digest,
+	}
+	prefix := "." + filepath.Base(name)
+	if digest != "" {
+		blobPath, err := s.blobPath(name, digest)
+		if err != nil {
+			return nil, err
+		}
+		unlock, ok := s.tryLock(blobPath)
+		if !ok {
+			return w, nil
+		}
+		if _, err := os.Stat(blobPath); err == nil {
+			unlock()
+			return w, nil
+		}
+		w.unlock = unlock
+		prefix = "." + digest
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	w.file, err = os.CreateTemp(dir, prefix+".*"+tmpSuffix)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.file == nil {
+		w.hash.Write(p)
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// Sum returns the sha256 hex digest of the content written so far.
+func (w *Writer) Sum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// Commit moves the content to its blob and links the name to it. The writer is aborted when it fails.
+func (w *Writer) Commit() error {
+	digest := w.digest
+	if digest == "" {
+		digest = w.Sum()
+	}
+	blobPath, err := w.store.blobPath(w.name, digest)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if w.unlock == nil {
+		// Waits for the writer of the blob when the content was not written by this writer.
+		w.unlock = w.store.Lock(blobPath)
+	}
+	defer w.Abort()
+
+	if w.file != nil {
+		err := w.file.Close()
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(blobPath); err == nil {
+			//nolint: errcheck // Ignore error.
+			os.Remove(w.file.Name())
+		} else if err := os.Rename(w.file.Name(), blobPath); err != nil {
+			return err
+		}
+		w.file = nil
+	} else if _, err := os.Stat(blobPath); err != nil {
+		return fmt.Errorf("blob %s of %s was not written", digest, w.name)
+	}
+	return w.store.link(w.name, blobPath)
+}
+
+// Abort removes the temporary file. It has no effect once the writer is committed.
+func (w *Writer) Abort() {
+	if w.file != nil {
+		//nolint: errcheck // The file may already be closed.
+		w.file.Close()
+		//nolint: errcheck // Ignore error.
+		os.Remove(w.file.Name())
+		w.file = nil
+	}
+	if w.unlock != nil {
+		w.unlock()
+		w.unlock = nil
+	}
+}
+
+// link points the name to the blob. The link is created next to the name and renamed so that it replaces an
+// existing name atomically.
+func (s *Store) link(name, blobPath string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(p), blobPath)
+	if err != nil {
+		return err
+	}
+	tmpLink := filepath.Join(filepath.Dir(p), fmt.Sprintf(".%s.%s%s", filepath.Base(p), rand.Text(), tmpSuffix))
+	err = os.Symlink(target, tmpLink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpLink, p)
+	if err != nil {
+		return errors.Join(err, os.Remove(tmpLink))
+	}
+	s.recordLink(blobPath)
+	s.touch(name)
+	return nil
+}
+
+// WriteFile writes the data at the name. The file is written to a temporary file which is renamed once written.
+func (s *Store) WriteFile(name string, data []byte) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return errors.Join(err, os.Remove(f.Name()))
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Join(err, os.Remove(f.Name()))
+	}
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		return errors.Join(err, os.Remove(f.Name()))
+	}
+	s.touch(name)
+	return nil
+}
+
+// ReadFile returns the content of the name.
+func (s *Store) ReadFile(name string) ([]byte, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	s.touch(name)
+	return b, nil
+}
+
+// Stat returns the information of the name, with the size and modification time of the blob it refers to.
+func (s *Store) Stat(name string) (Info, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return Info{}, err
+	}
+	if fi.IsDir() {
+		return Info{}, fmt.Errorf("name %s is a directory", name)
+	}
+	info := Info{
+		Name:    name,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if blobPath, ok := s.linkedBlob(p); ok {
+		info.Digest = filepath.Base(blobPath)
+	}
+	return info, nil
+}
+
+// linkedBlob returns the path of the blob that the file at the path links to.
+func (s *Store) linkedBlob(p string) (string, bool) {
+	target, err := os.Readlink(p)
+	if err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(p), target)
+	}
+	if filepath.Base(filepath.Dir(target)) != blobsDirName {
+		return "", false
+	}
+	return target, true
+}
+
+// Open opens the content of the name for reading.
+func (s *Store) Open(name string) (*os.File, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	s.touch(name)
+	return f, nil
+}
+
+// OpenRange opens the length of content of the name starting at the offset, or the remaining content when the
+// length is negative.
+func (s *Store) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", offset)
+	}
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		length = max(fi.Size()-offset, 0)
+	}
+	rc := struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.NewSectionReader(f, offset, length),
+		Closer: f,
+	}
+	return rc, nil
+}
+
+// List returns the information of all names in the store.
+func (s *Store) List() ([]Info, error) {
+	return s.list(s.dir)
+}
+
+// ListDir returns the information of all names in the directory of the name.
+func (s *Store) ListDir(name string) ([]Info, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.list(p)
+}
+
+func (s *Store) list(root string) ([]Info, error) {
+	infos := []Info{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == root {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if d.Name() == blobsDirName && strings.Count(rel, "/") == s.blobDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), tmpSuffix) {
+			return nil
+		}
+		info, err := s.Stat(rel)
+		if err != nil {
+			// Links to blobs that were removed are not listed.
+			return nil
+		}
+		infos = append(infos, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Delete removes the name, and the blob that it refers to once no other names refer to it.
+func (s *Store) Delete(name string) error {
+	return s.delete(name, nil)
+}
+
+// delete removes the name, and the blob that it refers to once no other names refer to it. The names that refer to
+// the blob are looked up in the references when they are given, instead of listing the directory of the blob.
+func (s *Store) delete(name string, refs blobRefs) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	s.forget(name)
+	blobPath, ok := s.linkedBlob(p)
+	if !ok {
+		return os.Remove(p)
+	}
+	unlock := s.Lock(blobPath)
+	defer unlock()
+
+	err = os.Remove(p)
+	if err != nil {
+		return err
+	}
+	referenced := false
+	if refs != nil {
+		referenced = refs.remove(blobPath, name) || s.linkedSince(blobPath)
+	} else {
+		referenced, err = s.referenced(blobPath)
+		if err != nil {
+			return err
+		}
+	}
+	if referenced {
+		return nil
+	}
+	err = os.Remove(blobPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// referenced returns true when a name refers to the blob. Only names under the directory of the blobs directory can
+// refer to the blob.
+func (s *Store) referenced(blobPath string) (bool, error) {
+	infos, err := s.list(filepath.Dir(filepath.Dir(blobPath)))
+	if err != nil {
+		return false, err
+	}
+	for _, info := range infos {
+		p, err := s.path(info.Name)
+		if err != nil {
+			continue
+		}
+		if target, ok := s.linkedBlob(p); ok && target == blobPath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
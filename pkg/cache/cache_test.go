@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeContent(t *testing.T, s *Store, name, digest string, content []byte) {
+	t.Helper()
+
+	w, err := s.Create(name, digest)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.Equal(t, sha256Hex(content), w.Sum())
+	require.NoError(t, w.Commit())
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+
+	// Names with the same content refer to the same blob.
+	content := []byte("hello world")
+	writeContent(t, s, "foo-1.0.whl", "", content)
+	writeContent(t, s, "sub/copy.whl", sha256Hex(content), content)
+	b, err := os.ReadFile(filepath.Join(dir, "blobs", sha256Hex(content)))
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	info, err := s.Stat("sub/copy.whl")
+	require.NoError(t, err)
+	require.Equal(t, "sub/copy.whl", info.Name)
+	require.Equal(t, sha256Hex(content), info.Digest)
+	require.Equal(t, int64(len(content)), info.Size)
+
+	err = s.WriteFile("foo.json", []byte("{}"))
+	require.NoError(t, err)
+	info, err = s.Stat("foo.json")
+	require.NoError(t, err)
+	require.Empty(t, info.Digest)
+	b, err = s.ReadFile("foo.json")
+	require.NoError(t, err)
+	require.Equal(t, []byte("{}"), b)
+
+	// Aborted writes leave no files behind and temporary files are never listed.
+	w, err := s.Create("aborted.whl", "")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.NoError(t, err)
+	infos, err := s.List()
+	require.NoError(t, err)
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	slices.Sort(names)
+	require.Equal(t, []string{"foo-1.0.whl", "foo.json", "sub/copy.whl"}, names)
+	w.Abort()
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	rc, err := s.OpenRange("foo-1.0.whl", 6, -1)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, []byte("world"), b)
+	rc, err = s.OpenRange("foo-1.0.whl", 2, 3)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, []byte("llo"), b)
+
+	// Blobs are removed once no name refers to them.
+	require.NoError(t, s.Delete("foo-1.0.whl"))
+	require.FileExists(t, filepath.Join(dir, "blobs", sha256Hex(content)))
+	require.NoError(t, s.Delete("sub/copy.whl"))
+	require.NoFileExists(t, filepath.Join(dir, "blobs", sha256Hex(content)))
+	require.NoError(t, s.Delete("foo.json"))
+	infos, err = s.List()
+	require.NoError(t, err)
+	require.Empty(t, infos)
+
+	_, err = s.Create("../escape.whl", "")
+	require.EqualError(t, err, `invalid name "../escape.whl"`)
+	_, err = s.Create("foo-1.0.whl", "../digest")
+	require.EqualError(t, err, `invalid digest "../digest"`)
+}
+
+func TestStoreCoalescesWriters(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+
+	content := []byte("shared content")
+	digest := sha256Hex(content)
+	first, err := s.Create("first.whl", digest)
+	require.NoError(t, err)
+	// The content of the second writer is not written as the first writer is writing the blob.
+	second, err := s.Create("second.whl", digest)
+	require.NoError(t, err)
+	require.Nil(t, second.file)
+
+	committed := make(chan error)
+	go func() {
+		_, err := second.Write(content)
+		if err != nil {
+			committed <- err
+			return
+		}
+		committed <- second.Commit()
+	}()
+	select {
+	case <-committed:
+		t.Fatal("second writer committed before the blob was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = first.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, first.Commit())
+	require.NoError(t, <-committed)
+	b, err := s.ReadFile("second.whl")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+
+	// The name is not linked when the writer of the blob aborts.
+	first, err = s.Create("third.whl", sha256Hex([]byte("other")))
+	require.NoError(t, err)
+	second, err = s.Create("fourth.whl", sha256Hex([]byte("other")))
+	require.NoError(t, err)
+	first.Abort()
+	require.ErrorContains(t, second.Commit(), "was not written")
+	_, err = s.Stat("fourth.whl")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestStoreClaim(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+
+	release, owner, err := s.Claim(t.Context(), "foo-1.0.whl")
+	require.NoError(t, err)
+	require.True(t, owner)
+	// Other names are claimed independently.
+	releaseOther, owner, err := s.Claim(t.Context(), "bar-1.0.whl")
+	require.NoError(t, err)
+	require.True(t, owner)
+	releaseOther()
+
+	// Waiting for a claim is canceled with the context.
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = s.Claim(ctx, "foo-1.0.whl")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Concurrent claims wait for the owner and find the stored name.
+	results := make(chan error, 3)
+	for range 3 {
+		go func() {
+			_, owner, err := s.Claim(t.Context(), "foo-1.0.whl")
+			if err == nil && owner {
+				err = errors.New("claim is owned twice")
+			}
+			if err == nil {
+				_, err = s.ReadFile("foo-1.0.whl")
+			}
+			results <- err
+		}()
+	}
+	select {
+	case err := <-results:
+		t.Fatalf("claim returned before it was released: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, s.WriteFile("foo-1.0.whl", []byte("content")))
+	release()
+	for range 3 {
+		require.NoError(t, <-results)
+	}
+
+	release, owner, err = s.Claim(t.Context(), "foo-1.0.whl")
+	require.NoError(t, err)
+	require.True(t, owner)
+	release()
+}
+
+func TestStoreBlobDepth(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(t.TempDir(), WithBlobDepth(-1))
+	require.EqualError(t, err, "blob depth -1 can not be negative")
+
+	dir := t.TempDir()
+	s, err := New(dir, WithBlobDepth(1))
+	require.NoError(t, err)
+	writeContent(t, s, "models--org--model/snapshots/abc/model.bin", "etag", []byte("model"))
+	require.FileExists(t, filepath.Join(dir, "models--org--model", "blobs", "etag"))
+	require.True(t, s.HasBlob("models--org--model/snapshots/def/model.bin", "etag"))
+	require.False(t, s.HasBlob("models--org--other/snapshots/abc/model.bin", "etag"))
+	_, err = s.Create("model.bin", "etag")
+	require.EqualError(t, err, "name model.bin has less than 1 directories that blobs are stored under")
+
+	infos, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, "etag", infos[0].Digest)
+}
+
+func TestStoreCollect(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+
+	writeContent(t, s, "kept.whl", "", []byte("kept"))
+	// Blobs that no name refers to are removed.
+	writeContent(t, s, "orphan.whl", "", []byte("orphan"))
+	require.NoError(t, os.Remove(filepath.Join(dir, "orphan.whl")))
+	// Names that refer to blobs that were removed are removed.
+	writeContent(t, s, "dangling.whl", "", []byte("dangling"))
+	require.NoError(t, os.Remove(filepath.Join(dir, "blobs", sha256Hex([]byte("dangling")))))
+	// Temporary files are removed once they are no longer written to.
+	staleTmp := filepath.Join(dir, ".stale.whl.1"+tmpSuffix)
+	require.NoError(t, os.WriteFile(staleTmp, []byte("stale"), 0o644))
+	require.NoError(t, os.Chtimes(staleTmp, time.Now().Add(-2*staleTmpAge), time.Now().Add(-2*staleTmpAge)))
+	activeTmp := filepath.Join(dir, ".active.whl.1"+tmpSuffix)
+	require.NoError(t, os.WriteFile(activeTmp, []byte("active"), 0o644))
+
+	removed, err := s.Collect()
+	require.NoError(t, err)
+	require.Equal(t, []Info{{Name: "dangling.whl", Digest: sha256Hex([]byte("dangling"))}}, removed)
+	require.NoFileExists(t, filepath.Join(dir, "blobs", sha256Hex([]byte("orphan"))))
+	require.NoFileExists(t, staleTmp)
+	require.FileExists(t, activeTmp)
+	b, err := s.ReadFile("kept.whl")
+	require.NoError(t, err)
+	require.Equal(t, []byte("kept"), b)
+}
+
+func TestStoreCollectLinkedSince(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+
+	content := []byte("shared")
+	blobPath := filepath.Join(dir, "blobs", sha256Hex(content))
+	writeContent(t, s, "old.whl", "", content)
+	orphan := []byte("orphan")
+	writeContent(t, s, "orphan.whl", "", orphan)
+	require.NoError(t, os.Remove(filepath.Join(dir, "orphan.whl")))
+
+	// Blobs that names are linked to after the store was listed are kept.
+	done := s.startCollect()
+	refs := blobRefs{}
+	refs.add(blobPath, "old.whl")
+	writeContent(t, s, "new.whl", "", content)
+	writeContent(t, s, "relinked.whl", "", orphan)
+	require.NoError(t, s.delete("old.whl", refs))
+	require.NoError(t, s.removeOrphan(filepath.Join(dir, "blobs", sha256Hex(orphan))))
+	done()
+	b, err := s.ReadFile("new.whl")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	b, err = s.ReadFile("relinked.whl")
+	require.NoError(t, err)
+	require.Equal(t, orphan, b)
+
+	// Blobs without names are removed without listing the store.
+	done = s.startCollect()
+	refs = blobRefs{}
+	refs.add(blobPath, "new.whl")
+	require.NoError(t, s.delete("new.whl", refs))
+	done()
+	require.NoFileExists(t, blobPath)
+}
+
+func TestStoreEviction(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(t.TempDir(), WithEviction(Eviction{Policy: "fifo"}))
+	require.EqualError(t, err, "unknown eviction policy fifo")
+	_, err = New(t.TempDir(), WithEviction(Eviction{MaxDiskPercent: 101}))
+	require.EqualError(t, err, "max disk percent 101 has to be between 0 and 100")
+	_, err = New(t.TempDir(), WithEviction(Eviction{Pinned: []string{"["}}))
+	require.EqualError(t, err, `invalid pinned pattern "[": syntax error in pattern`)
+
+	s, err := New(t.TempDir(), WithEviction(Eviction{MaxDiskPercent: 100}))
+	require.NoError(t, err)
+	limit, err := s.limit()
+	require.NoError(t, err)
+	require.Positive(t, limit)
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name     string
+		policy   EvictionPolicy
+		expected []string
+	}{
+		{
+			name:     "least recently used",
+			policy:   EvictionPolicyLRU,
+			expected: []string{"b.whl"},
+		},
+		{
+			name:     "least frequently used",
+			policy:   EvictionPolicyLFU,
+			expected: []string{"a.whl", "copy/a.whl"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			eviction := Eviction{
+				Policy:   tt.policy,
+				MaxBytes: 8,
+				Pinned:   []string{"pinned"},
+			}
+			s, err := New(t.TempDir(), WithEviction(eviction))
+			require.NoError(t, err)
+
+			// Names that share a blob are evicted together, and the blob is only counted once.
+			writeContent(t, s, "a.whl", "", []byte("aaaa"))
+			writeContent(t, s, "copy/a.whl", "", []byte("aaaa"))
+			writeContent(t, s, "b.whl", "", []byte("bbbb"))
+			writeContent(t, s, "pinned/c.whl", "", []byte("cccc"))
+			for range 3 {
+				_, err := s.ReadFile("b.whl")
+				require.NoError(t, err)
+			}
+			// The pinned name is the least recently and least frequently used.
+			_, err = s.ReadFile("a.whl")
+			require.NoError(t, err)
+			removed, err := s.Collect()
+			require.NoError(t, err)
+			names := []string{}
+			for _, info := range removed {
+				names = append(names, info.Name)
+			}
+			require.Equal(t, tt.expected, names)
+		})
+	}
+}
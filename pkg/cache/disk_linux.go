@@ -0,0 +1,17 @@
+//go:build linux
+
+package cache
+
+import (
+	"syscall"
+)
+
+// diskSize returns the size in bytes of the filesystem that the directory is stored on.
+func diskSize(dir string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// diskSize is only supported on Linux, other platforms can only limit the store by its size in bytes.
+func diskSize(dir string) (int64, error) {
+	return 0, fmt.Errorf("max disk percent is not supported on this platform: %w", errors.ErrUnsupported)
+}
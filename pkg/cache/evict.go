@@ -0,0 +1,406 @@
+package cache
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EvictionPolicy selects the entries that are evicted first once the store exceeds its quota.
+type EvictionPolicy string
+
+const (
+	// EvictionPolicyLRU evicts the least recently used entries first.
+	EvictionPolicyLRU EvictionPolicy = "lru"
+	// EvictionPolicyLFU evicts the least frequently used entries first, and the least recently used of those first.
+	EvictionPolicyLFU EvictionPolicy = "lfu"
+)
+
+// staleTmpAge is the duration after which temporary files that are not written to are left behind by a writer that
+// did not complete.
+const staleTmpAge = time.Hour
+
+// Eviction configures the quota of the store and how entries are evicted to stay within it. The store is not limited
+// when neither quota is set.
+type Eviction struct {
+	Policy EvictionPolicy
+	// Pinned are patterns of names that are never evicted, as matched by path.Match. A pattern that matches a directory
+	// pins all names in it.
+	Pinned []string
+	// MaxBytes is the maximum size of the store in bytes.
+	MaxBytes int64
+	// MaxDiskPercent is the maximum size of the store as a percentage of the size of the filesystem it is stored on.
+	// It is only supported on Linux.
+	MaxDiskPercent float64
+}
+
+// Validate returns an error when the eviction configuration is invalid.
+func (e Eviction) Validate() error {
+	switch e.Policy {
+	case "", EvictionPolicyLRU, EvictionPolicyLFU:
+	default:
+		return fmt.Errorf("unknown eviction policy %s", e.Policy)
+	}
+	if e.MaxBytes < 0 {
+		return fmt.Errorf("max bytes %d can not be negative", e.MaxBytes)
+	}
+	if e.MaxDiskPercent < 0 || e.MaxDiskPercent > 100 {
+		return fmt.Errorf("max disk percent %v has to be between 0 and 100", e.MaxDiskPercent)
+	}
+	for _, pattern := range e.Pinned {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pinned pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// WithEviction evicts entries of the store when it is collected once it exceeds its quota.
+func WithEviction(eviction Eviction) Option {
+	return func(cfg *Config) error {
+		err := eviction.Validate()
+		if err != nil {
+			return err
+		}
+		if eviction.Policy == "" {
+			eviction.Policy = EvictionPolicyLRU
+		}
+		cfg.Eviction = eviction
+		return nil
+	}
+}
+
+// access is the usage of a name since the store was created.
+type access struct {
+	last  time.Time
+	count uint64
+}
+
+// touch records an access of the name.
+func (s *Store) touch(name string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	a := s.accesses[name]
+	a.last = time.Now()
+	a.count++
+	s.accesses[name] = a
+}
+
+// forget removes the accesses of the name.
+func (s *Store) forget(name string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	delete(s.accesses, name)
+}
+
+// entry is content that is removed as a whole, which is a blob with the names that refer to it or a file stored at
+// its name.
+type entry struct {
+	last   time.Time
+	names  []Info
+	size   int64
+	count  uint64
+	pinned bool
+}
+
+// Collect removes names that refer to blobs that were removed, blobs that no name refers to and temporary files left
+// behind by writers that did not complete. Entries are then evicted by the eviction policy until the store is within
+// its quota. The removed names are returned, also when collecting fails part way.
+func (s *Store) Collect() ([]Info, error) {
+	done := s.startCollect()
+	defer done()
+
+	removed, err := s.collectGarbage()
+	if err != nil {
+		return removed, err
+	}
+	evicted, err := s.evict()
+	return append(removed, evicted...), err
+}
+
+func (s *Store) collectGarbage() ([]Info, error) {
+	removed := []Info{}
+	blobs := []string{}
+	linked := map[string]struct{}{}
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == s.dir {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), tmpSuffix) {
+			fi, err := d.Info()
+			if err == nil && time.Since(fi.ModTime()) > staleTmpAge {
+				//nolint: errcheck // Ignore error as the file is removed on the next collection.
+				os.Remove(p)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.isBlob(rel) {
+			blobs = append(blobs, p)
+			return nil
+		}
+		blobPath, ok := s.linkedBlob(p)
+		if !ok {
+			return nil
+		}
+		linked[blobPath] = struct{}{}
+		if _, err := os.Stat(blobPath); err == nil {
+			return nil
+		}
+		ok, err = s.removeDangling(p, blobPath)
+		if err != nil {
+			return err
+		}
+		if ok {
+			removed = append(removed, Info{Name: rel, Digest: filepath.Base(blobPath)})
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	for _, blobPath := range blobs {
+		if _, ok := linked[blobPath]; ok {
+			continue
+		}
+		err := s.removeOrphan(blobPath)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// isBlob returns true when the name is a blob in a blobs directory.
+func (s *Store) isBlob(name string) bool {
+	elems := strings.Split(name, "/")
+	return len(elems) == s.blobDepth+2 && elems[s.blobDepth] == blobsDirName
+}
+
+// removeDangling removes the link at the path when the blob it refers to does not exist. The blob is locked so that
+// a link to a blob that is being written is not removed.
+func (s *Store) removeDangling(p, blobPath string) (bool, error) {
+	unlock := s.Lock(blobPath)
+	defer unlock()
+
+	if _, err := os.Stat(blobPath); err == nil {
+		return false, nil
+	}
+	err := os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeOrphan removes the blob that no name referred to when the store was listed, unless a name was linked to it
+// since. Blobs that are being written are skipped.
+func (s *Store) removeOrphan(blobPath string) error {
+	unlock, ok := s.tryLock(blobPath)
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	if s.linkedSince(blobPath) {
+		return nil
+	}
+	err := os.Remove(blobPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) evict() ([]Info, error) {
+	infos, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*entry{}
+	refs := blobRefs{}
+	listed := map[string]struct{}{}
+	usage := int64(0)
+	s.mx.Lock()
+	for _, info := range infos {
+		listed[info.Name] = struct{}{}
+		key := info.Name
+		if info.Digest != "" {
+			blobPath, err := s.blobPath(info.Name, info.Digest)
+			if err == nil {
+				key = blobPath
+				refs.add(blobPath, info.Name)
+			}
+		}
+		e, ok := entries[key]
+		if !ok {
+			e = &entry{size: info.Size, last: info.ModTime}
+			entries[key] = e
+			usage += info.Size
+		}
+		e.names = append(e.names, info)
+		e.pinned = e.pinned || s.isPinned(info.Name)
+		if a, ok := s.accesses[info.Name]; ok {
+			if a.last.After(e.last) {
+				e.last = a.last
+			}
+			e.count += a.count
+		}
+	}
+	// Accesses of names that were removed outside of the store are forgotten.
+	for name := range s.accesses {
+		if _, ok := listed[name]; !ok {
+			delete(s.accesses, name)
+		}
+	}
+	s.mx.Unlock()
+
+	limit, err := s.limit()
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 || usage <= limit {
+		return nil, nil
+	}
+	candidates := []*entry{}
+	for _, e := range entries {
+		if !e.pinned {
+			candidates = append(candidates, e)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b *entry) int {
+		if s.eviction.Policy == EvictionPolicyLFU {
+			if c := cmp.Compare(a.count, b.count); c != 0 {
+				return c
+			}
+		}
+		return a.last.Compare(b.last)
+	})
+	removed := []Info{}
+	for _, e := range candidates {
+		if usage <= limit {
+			break
+		}
+		for _, info := range e.names {
+			err := s.delete(info.Name, refs)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, info)
+		}
+		usage -= e.size
+	}
+	return removed, nil
+}
+
+// blobRefs are the names that refer to each blob when the store was listed.
+type blobRefs map[string]map[string]struct{}
+
+func (r blobRefs) add(blobPath, name string) {
+	if _, ok := r[blobPath]; !ok {
+		r[blobPath] = map[string]struct{}{}
+	}
+	r[blobPath][name] = struct{}{}
+}
+
+// remove removes the name and returns true when other names still refer to the blob.
+func (r blobRefs) remove(blobPath, name string) bool {
+	delete(r[blobPath], name)
+	return len(r[blobPath]) > 0
+}
+
+// startCollect records the blobs that names are linked to until the returned function is called, so that blobs that
+// are linked after the store was listed are not removed.
+func (s *Store) startCollect() func() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.collecting == 0 {
+		s.linked = map[string]struct{}{}
+	}
+	s.collecting++
+	return func() {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		s.collecting--
+		if s.collecting == 0 {
+			s.linked = nil
+		}
+	}
+}
+
+func (s *Store) recordLink(blobPath string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.linked != nil {
+		s.linked[blobPath] = struct{}{}
+	}
+}
+
+// linkedSince returns true when a name was linked to the blob since the store was listed for the collection.
+func (s *Store) linkedSince(blobPath string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	_, ok := s.linked[blobPath]
+	return ok
+}
+
+// isPinned returns true when the name or a directory of it matches a pinned pattern.
+func (s *Store) isPinned(name string) bool {
+	for _, pattern := range s.eviction.Pinned {
+		for p := name; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// limit returns the maximum size of the store in bytes, which is zero when the store is not limited.
+func (s *Store) limit() (int64, error) {
+	limit := s.eviction.MaxBytes
+	if s.eviction.MaxDiskPercent == 0 {
+		return limit, nil
+	}
+	diskSize, err := diskSize(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return limit, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	diskLimit := int64(float64(diskSize) * s.eviction.MaxDiskPercent / 100)
+	if limit == 0 || diskLimit < limit {
+		limit = diskLimit
+	}
+	return limit, nil
+}
@@ -0,0 +1,155 @@
+package hf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// accessPolicy decides whether a file may be served from the cache or by peers. Files of gated and private
+// repositories are only served to requests with a token that upstream grants access to the repository.
+// Whether a repository requires a token and whether a token has access to it are remembered for the TTL,
+// so that requests for public repositories and repeated requests with the same token are not sent upstream.
+type accessPolicy struct {
+	client  *http.Client
+	repos   map[string]accessEntry
+	tokens  map[string]accessEntry
+	baseURL string
+	ttl     time.Duration
+	mx      sync.Mutex
+}
+
+type accessEntry struct {
+	expires time.Time
+	// allowed is set when the repository is public or when the token has access to the repository.
+	allowed bool
+}
+
+func newAccessPolicy(client *http.Client, baseURL string, ttl time.Duration) *accessPolicy {
+	return &accessPolicy{
+		client:  client,
+		baseURL: baseURL,
+		ttl:     ttl,
+		repos:   map[string]accessEntry{},
+		tokens:  map[string]accessEntry{},
+	}
+}
+
+// authorize returns true when the request with the authorization header may be served the file of the repository.
+func (p *accessPolicy) authorize(ctx context.Context, authorization, repo, revision, filename string) (bool, error) {
+	public, err := p.isPublic(ctx, repo, revision, filename)
+	if err != nil {
+		return false, err
+	}
+	if public {
+		return true, nil
+	}
+	if authorization == "" {
+		return false, nil
+	}
+
+	// Tokens are only kept as hashes so that they cannot be read from memory.
+	sum := sha256.Sum256([]byte(authorization))
+	tokenKey := hex.EncodeToString(sum[:]) + "/" + repo
+	if entry, ok := p.get(p.tokens, tokenKey); ok && time.Now().Before(entry.expires) {
+		return entry.allowed, nil
+	}
+	allowed, err := p.probe(ctx, authorization, repo, revision, filename)
+	if err != nil {
+		return false, err
+	}
+	p.pruneTokens()
+	p.set(p.tokens, tokenKey, allowed)
+	return allowed, nil
+}
+
+// isPublic returns true when the file of the repository can be fetched from upstream without a token.
+// A repository that was public is still considered public when upstream cannot be reached after the TTL expired.
+func (p *accessPolicy) isPublic(ctx context.Context, repo, revision, filename string) (bool, error) {
+	entry, ok := p.get(p.repos, repo)
+	if ok && time.Now().Before(entry.expires) {
+		return entry.allowed, nil
+	}
+	public, err := p.probe(ctx, "", repo, revision, filename)
+	if err != nil {
+		if ok && entry.allowed {
+			return true, nil
+		}
+		return false, err
+	}
+	p.set(p.repos, repo, public)
+	return public, nil
+}
+
+// requireAuth remembers that upstream denied a request for the repository that was made without a token.
+func (p *accessPolicy) requireAuth(repo string) {
+	p.set(p.repos, repo, false)
+}
+
+// probe asks upstream for the metadata of the file without following the redirect to its content.
+func (p *accessPolicy) probe(ctx context.Context, authorization, repo, revision, filename string) (bool, error) {
+	u := fmt.Sprintf("%s/%s/resolve/%s/%s", p.baseURL, repo, url.PathEscape(revision), filename)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return false, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	client := *p.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < http.StatusBadRequest:
+		return true, nil
+	// Upstream responds with not found to requests for private repositories that are not authorized.
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("upstream returned %s when checking access to %s", resp.Status, repo)
+	}
+}
+
+func (p *accessPolicy) get(entries map[string]accessEntry, key string) (accessEntry, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	entry, ok := entries[key]
+	return entry, ok
+}
+
+func (p *accessPolicy) set(entries map[string]accessEntry, key string, allowed bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	entries[key] = accessEntry{
+		allowed: allowed,
+		expires: time.Now().Add(p.ttl),
+	}
+}
+
+// pruneTokens removes the expired results of tokens, which are never requested again once a token is rotated.
+// Expired results of repositories are kept as they are used when upstream cannot be reached.
+func (p *accessPolicy) pruneTokens() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	now := time.Now()
+	for k, entry := range p.tokens {
+		if now.After(entry.expires) {
+			delete(p.tokens, k)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package hf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	t.Parallel()
+
+	var probes atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		switch {
+		case r.URL.Path == "/org/public/resolve/main/model.bin":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/org/gated/resolve/main/model.bin" && r.Header.Get("Authorization") == "Bearer valid":
+			w.Header().Set("Location", "/cdn/model.bin")
+			w.WriteHeader(http.StatusFound)
+		case r.URL.Path == "/org/gated/resolve/main/model.bin":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/org/private/resolve/main/model.bin":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	policy := newAccessPolicy(upstream.Client(), upstream.URL, time.Minute)
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name          string
+		authorization string
+		repo          string
+		expected      bool
+	}{
+		{
+			name:     "public without token",
+			repo:     "org/public",
+			expected: true,
+		},
+		{
+			name:     "gated without token",
+			repo:     "org/gated",
+			expected: false,
+		},
+		{
+			name:          "gated with invalid token",
+			authorization: "Bearer invalid",
+			repo:          "org/gated",
+			expected:      false,
+		},
+		{
+			name:          "gated with valid token",
+			authorization: "Bearer valid",
+			repo:          "org/gated",
+			expected:      true,
+		},
+		{
+			name:          "private with invalid token",
+			authorization: "Bearer invalid",
+			repo:          "org/private",
+			expected:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := policy.authorize(t.Context(), tt.authorization, tt.repo, "main", "model.bin")
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, allowed)
+		})
+	}
+
+	// Results are cached so that repeated requests are not sent upstream.
+	count := probes.Load()
+	for _, tt := range tests {
+		allowed, err := policy.authorize(t.Context(), tt.authorization, tt.repo, "main", "model.bin")
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, allowed)
+	}
+	require.Equal(t, count, probes.Load())
+
+	_, err := policy.authorize(t.Context(), "", "org/unknown", "main", "model.bin")
+	require.EqualError(t, err, "upstream returned 500 Internal Server Error when checking access to org/unknown")
+}
+
+func TestAccessPolicyExpired(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/org/public/resolve/main/model.bin" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	policy := newAccessPolicy(upstream.Client(), upstream.URL, 0)
+
+	allowed, err := policy.authorize(t.Context(), "", "org/public", "main", "model.bin")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	allowed, err = policy.authorize(t.Context(), "", "org/gated", "main", "model.bin")
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	// Repositories that were public stay public while upstream cannot be reached, gated repositories are denied.
+	upstream.Close()
+	allowed, err = policy.authorize(t.Context(), "", "org/public", "main", "model.bin")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	_, err = policy.authorize(t.Context(), "Bearer valid", "org/gated", "main", "model.bin")
+	require.Error(t, err)
+
+	policy.requireAuth("org/public")
+	allowed, err = policy.authorize(t.Context(), "", "org/public", "main", "model.bin")
+	require.Error(t, err)
+	require.False(t, allowed)
+}
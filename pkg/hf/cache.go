@@ -0,0 +1,201 @@
+package hf
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"clyde/pkg/cache"
+)
+
+const (
+	HeaderRepoCommit = "X-Repo-Commit"
+	HeaderLinkedEtag = "X-Linked-Etag"
+	HeaderEtag       = "ETag"
+)
+
+var commitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// cachedFile is a file resolved from a revision of a repository, which is stored in the huggingface_hub cache layout.
+// https://huggingface.co/docs/huggingface_hub/guides/manage-cache
+type cachedFile struct {
+	// repoDir is the name of the directory of the repository in the cache.
+	repoDir string
+	// repo is the name of the repository as it is written in the request path.
+	repo     string
+	revision string
+	filename string
+	// shared is set when the file is advertised to peers once it is cached.
+	shared bool
+}
+
+// key returns the key of the file at the commit, so that peers never serve the file of another revision.
+func (f *cachedFile) key(commit string) string {
+	return fmt.Sprintf("hf:/huggingface/%s/resolve/%s/%s", f.repo, commit, f.filename)
+}
+
+// refKey returns the key of the named revision, which is advertised by peers that can resolve it to a commit.
+func (f *cachedFile) refKey() string {
+	return refKey(f.repo, f.revision)
+}
+
+func refKey(repo, revision string) string {
+	return fmt.Sprintf("hf:/huggingface/%s/refs/%s", repo, revision)
+}
+
+// snapshotName returns the name of the file in the snapshot of the commit in the cache.
+func (f *cachedFile) snapshotName(commit string) string {
+	return path.Join(f.repoDir, "snapshots", commit, f.filename)
+}
+
+func refName(repoDir, revision string) string {
+	return path.Join(repoDir, "refs", revision)
+}
+
+// cacheKey returns the key that is advertised for the name in the cache. Chunks of a xorb are advertised by the key
+// of the xorb as peers serve any range of chunks that they have cached. Snapshot files are advertised by the same key
+// as when they are cached by the handler.
+func cacheKey(name string) (string, bool) {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 3 {
+		return "", false
+	}
+	if parts[0] == xetDirName {
+		hash, _, ok := strings.Cut(parts[2], "/")
+		if parts[1] != "xorbs" || !ok || !xetHashRegex.MatchString(hash) {
+			return "", false
+		}
+		return xorbKey(hash), true
+	}
+	repo, ok := parseRepoDir(parts[0])
+	if !ok {
+		return "", false
+	}
+	switch parts[1] {
+	case "refs":
+		// Refs are advertised so that peers can resolve named revisions when upstream cannot be reached.
+		if strings.HasPrefix(path.Base(parts[2]), ".") {
+			return "", false
+		}
+		return refKey(repo.path(), parts[2]), true
+	case "snapshots":
+		return fmt.Sprintf("hf:/huggingface/%s/resolve/%s", repo.path(), parts[2]), true
+	default:
+		return "", false
+	}
+}
+
+// fileMetadata returns the commit and etag of a resolved file from the response headers.
+// The linked etag is preferred as it is the hash of the LFS content and not of its pointer file.
+func fileMetadata(header http.Header, revision string) (string, string, error) {
+	commit := header.Get(HeaderRepoCommit)
+	if commit == "" && commitRegex.MatchString(revision) {
+		commit = revision
+	}
+	if !commitRegex.MatchString(commit) {
+		return "", "", fmt.Errorf("invalid repository commit %q", commit)
+	}
+	etag := header.Get(HeaderLinkedEtag)
+	if etag == "" {
+		etag = header.Get(HeaderEtag)
+	}
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	if etag == "" || !filepath.IsLocal(etag) || strings.ContainsAny(etag, `/\`) {
+		return "", "", fmt.Errorf("invalid etag %q", etag)
+	}
+	return commit, etag, nil
+}
+
+// setFileMetadata sets the headers that clients and peers need to place a resolved file in their cache.
+func setFileMetadata(header http.Header, commit, etag string) {
+	header.Set(HeaderRepoCommit, commit)
+	header.Set(HeaderEtag, fmt.Sprintf("%q", etag))
+	header.Set(HeaderLinkedEtag, fmt.Sprintf("%q", etag))
+}
+
+// snapshotMetadata returns the headers of a file served from a snapshot in the cache.
+// The etag is the digest of the blob that the snapshot file links to, which is unknown for files that are not links.
+func snapshotMetadata(info cache.Info, commit string) http.Header {
+	header := http.Header{}
+	if !commitRegex.MatchString(commit) {
+		return header
+	}
+	if info.Digest == "" {
+		header.Set(HeaderRepoCommit, commit)
+		return header
+	}
+	setFileMetadata(header, commit, info.Digest)
+	return header
+}
+
+// cacheWriter writes the content of a resolved file to the blob of its etag, which the snapshot file is linked to
+// once complete so that a partially written file is never served. The blob is not written again when it exists.
+type cacheWriter struct {
+	file   *cachedFile
+	store  *cache.Store
+	w      *cache.Writer
+	commit string
+	etag   string
+}
+
+func newCacheWriter(store *cache.Store, file *cachedFile, header http.Header) (*cacheWriter, error) {
+	if !filepath.IsLocal(file.filename) || !filepath.IsLocal(file.revision) {
+		return nil, fmt.Errorf("invalid file %s at revision %s", file.filename, file.revision)
+	}
+	commit, etag, err := fileMetadata(header, file.revision)
+	if err != nil {
+		return nil, err
+	}
+	w, err := store.Create(file.snapshotName(commit), etag)
+	if err != nil {
+		return nil, err
+	}
+	c := &cacheWriter{
+		file:   file,
+		store:  store,
+		w:      w,
+		commit: commit,
+		etag:   etag,
+	}
+	return c, nil
+}
+
+// Keys returns the keys to advertise once the file is cached, which include the named revision that was written.
+func (c *cacheWriter) Keys() []string {
+	keys := []string{c.file.key(c.commit)}
+	if c.file.revision != c.commit {
+		keys = append(keys, c.file.refKey())
+	}
+	return keys
+}
+
+// Header returns the metadata of the file being written.
+func (c *cacheWriter) Header() http.Header {
+	header := http.Header{}
+	setFileMetadata(header, c.commit, c.etag)
+	return header
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Commit moves the blob into the cache, links the snapshot file to it and points the revision to the commit.
+func (c *cacheWriter) Commit() error {
+	err := c.w.Commit()
+	if err != nil {
+		return err
+	}
+	if c.file.revision == c.commit {
+		return nil
+	}
+	return c.store.WriteFile(refName(c.file.repoDir, c.file.revision), []byte(c.commit))
+}
+
+// Abort removes the partially written blob.
+func (c *cacheWriter) Abort() {
+	c.w.Abort()
+}
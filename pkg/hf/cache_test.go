@@ -0,0 +1,159 @@
+package hf
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"clyde/pkg/cache"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMetadata(t *testing.T) {
+	t.Parallel()
+
+	commit := "0123456789abcdef0123456789abcdef01234567"
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		header         map[string]string
+		revision       string
+		expectedCommit string
+		expectedEtag   string
+		expectedErr    string
+	}{
+		{
+			name: "linked etag is preferred",
+			header: map[string]string{
+				HeaderRepoCommit: commit,
+				HeaderEtag:       `"pointer"`,
+				HeaderLinkedEtag: `"content"`,
+			},
+			revision:       "main",
+			expectedCommit: commit,
+			expectedEtag:   "content",
+		},
+		{
+			name: "weak etag",
+			header: map[string]string{
+				HeaderRepoCommit: commit,
+				HeaderEtag:       `W/"content"`,
+			},
+			revision:       "main",
+			expectedCommit: commit,
+			expectedEtag:   "content",
+		},
+		{
+			name: "commit from revision",
+			header: map[string]string{
+				HeaderEtag: `"content"`,
+			},
+			revision:       commit,
+			expectedCommit: commit,
+			expectedEtag:   "content",
+		},
+		{
+			name: "missing commit",
+			header: map[string]string{
+				HeaderEtag: `"content"`,
+			},
+			revision:    "main",
+			expectedErr: `invalid repository commit ""`,
+		},
+		{
+			name: "etag with path",
+			header: map[string]string{
+				HeaderRepoCommit: commit,
+				HeaderEtag:       `"../content"`,
+			},
+			revision:    "main",
+			expectedErr: `invalid etag "../content"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			commit, etag, err := fileMetadata(header, tt.revision)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedCommit, commit)
+			require.Equal(t, tt.expectedEtag, etag)
+		})
+	}
+}
+
+func TestCacheWriter(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	store, err := cache.New(tmp, cache.WithBlobDepth(1))
+	require.NoError(t, err)
+	repoDir := filepath.Join(tmp, "models--org--model")
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	header := http.Header{}
+	setFileMetadata(header, commit, "content-etag")
+	file := &cachedFile{repoDir: "models--org--model", revision: "main", filename: "sub/model.bin"}
+
+	w, err := newCacheWriter(store, file, header)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(repoDir, "blobs", "content-etag"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, w.Commit())
+
+	snapshotFile := filepath.Join(repoDir, "snapshots", commit, "sub", "model.bin")
+	b, err := os.ReadFile(snapshotFile)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+	target, err := os.Readlink(snapshotFile)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("..", "..", "..", "blobs", "content-etag"), target)
+	b, err = os.ReadFile(filepath.Join(repoDir, "refs", "main"))
+	require.NoError(t, err)
+	require.Equal(t, commit, string(b))
+	info, err := store.Stat(path.Join("models--org--model", "snapshots", commit, "sub", "model.bin"))
+	require.NoError(t, err)
+	require.Equal(t, header, snapshotMetadata(info, commit))
+
+	// An existing blob is linked from other files without being written again.
+	file = &cachedFile{repoDir: "models--org--model", revision: commit, filename: "copy.bin"}
+	w, err = newCacheWriter(store, file, header)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("ignored"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit())
+	b, err = os.ReadFile(filepath.Join(repoDir, "snapshots", commit, "copy.bin"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+
+	// An aborted write leaves nothing behind.
+	setFileMetadata(header, commit, "other-etag")
+	file = &cachedFile{repoDir: "models--org--model", revision: "main", filename: "other.bin"}
+	w, err = newCacheWriter(store, file, header)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.NoError(t, err)
+	w.Abort()
+	entries, err := os.ReadDir(filepath.Join(repoDir, "blobs"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "content-etag", entries[0].Name())
+	_, err = os.Lstat(filepath.Join(repoDir, "snapshots", commit, "other.bin"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = newCacheWriter(store, &cachedFile{repoDir: "models--org--model", revision: "main", filename: "../model.bin"}, header)
+	require.EqualError(t, err, "invalid file ../model.bin at revision main")
+}
@@ -0,0 +1,32 @@
+package hf
+
+import (
+	"context"
+	"time"
+)
+
+// RunCacheCollection collects the cache at the interval until the context is cancelled, which evicts files once the
+// cache exceeds its quota. The keys of removed files are withdrawn by the cache tracker once it finds them removed.
+func (h *HFClient) RunCacheCollection(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			err := h.collectCache()
+			if err != nil {
+				h.Log.Error(err, "could not collect HF cache")
+			}
+		}
+	}
+}
+
+func (h *HFClient) collectCache() error {
+	removed, err := h.store.Collect()
+	if len(removed) > 0 {
+		h.Log.Info("removed files from HF cache", "files", len(removed))
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package hf
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"clyde/pkg/cache"
+	"clyde/pkg/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectCache(t *testing.T) {
+	t.Parallel()
+
+	self := netip.MustParseAddrPort("10.0.0.1:5000")
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, self)
+	eviction := cache.Eviction{
+		MaxBytes: 4,
+		Pinned:   []string{"models--org--model"},
+	}
+	client := NewHFClient(router, t.TempDir(), WithHFCacheEviction(eviction))
+	otherXorb := strings.Repeat("2", 64)
+	require.NoError(t, client.store.WriteFile(client.xet.chunkName(testXorb, 0), []byte("aa")))
+	require.NoError(t, client.store.WriteFile(client.xet.chunkName(testXorb, 1), []byte("bb")))
+	require.NoError(t, client.store.WriteFile(client.xet.chunkName(otherXorb, 0), []byte("cc")))
+	require.NoError(t, client.store.WriteFile("models--org--model/snapshots/abc/config.json", []byte("{}")))
+	_, err := client.store.ReadFile(client.xet.chunkName(otherXorb, 0))
+	require.NoError(t, err)
+
+	// The xorb is no longer found by the cache tracker once all of its chunks are evicted.
+	require.NoError(t, client.collectCache())
+	keys, err := client.WalkHFCacheDir(t.Context())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{xorbKey(otherXorb), "hf:/huggingface/org/model/resolve/abc/config.json"}, keys)
+}
@@ -1,10 +1,13 @@
 package hf
 
 import (
+	"clyde/pkg/cache"
 	"clyde/pkg/httpx"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,20 +25,34 @@ type HFClient struct {
 	Log            logr.Logger
 	HFCacheDir     string
 	Router         routing.Router
+	Leaser         *routing.Leaser
+	Relay          *relay.Relay
 	Client         *http.Client
 	ResolveTimeout time.Duration
 	ResolveRetries int
 	BaseURL        string
+	access         *accessPolicy
+	xet            *xetStore
+	store          *cache.Store
+	username       string
+	password       string
 }
 
 type HFConfig struct {
 	Router         routing.Router
+	Leaser         *routing.Leaser
+	Relay          *relay.Relay
 	HFCacheDir     string
+	CacheEviction  cache.Eviction
 	ResolveTimeout time.Duration
 	ResolveRetries int
 	Log            logr.Logger
 	Client         *http.Client
 	BaseURL        string
+	AccessControl  bool
+	AccessTTL      time.Duration
+	Username       string
+	Password       string
 }
 
 type HFOption func(*HFConfig)
@@ -70,6 +87,45 @@ func WithHFBaseURL(url string) HFOption {
 	}
 }
 
+// WithHFLeaser coordinates upstream fetches with the other nodes so that each file is fetched from upstream once.
+func WithHFLeaser(leaser *routing.Leaser) HFOption {
+	return func(cfg *HFConfig) {
+		cfg.Leaser = leaser
+	}
+}
+
+// WithHFRelay lets peers stream files from this node while they are downloaded from upstream.
+func WithHFRelay(relay *relay.Relay) HFOption {
+	return func(cfg *HFConfig) {
+		cfg.Relay = relay
+	}
+}
+
+// WithHFAccessPolicy only serves files of gated and private repositories from the cache or peers to requests
+// with a token that upstream grants access to the repository. The results of the checks are cached for the TTL.
+func WithHFAccessPolicy(ttl time.Duration) HFOption {
+	return func(cfg *HFConfig) {
+		cfg.AccessControl = true
+		cfg.AccessTTL = ttl
+	}
+}
+
+// WithHFCacheEviction evicts cached files once the cache exceeds its quota when the cache is collected.
+func WithHFCacheEviction(eviction cache.Eviction) HFOption {
+	return func(cfg *HFConfig) {
+		cfg.CacheEviction = eviction
+	}
+}
+
+// WithHFBasicAuth authenticates requests between peers with the basic auth credentials of the registry.
+// Peers are only served cached Xet content without the grant of a client when the credentials are configured.
+func WithHFBasicAuth(username, password string) HFOption {
+	return func(cfg *HFConfig) {
+		cfg.Username = username
+		cfg.Password = password
+	}
+}
+
 func NewHFClient(router routing.Router, cacheDir string, opts ...HFOption) *HFClient {
 	cfg := HFConfig{
 		Router:         router,
@@ -90,14 +146,32 @@ func NewHFClient(router routing.Router, cacheDir string, opts ...HFOption) *HFCl
 		}
 	}
 
+	var access *accessPolicy
+	if cfg.AccessControl {
+		access = newAccessPolicy(cfg.Client, cfg.BaseURL, cfg.AccessTTL)
+	}
+	// Blobs are stored in the directory of each repository like the cache of huggingface_hub.
+	store, err := cache.New(cfg.HFCacheDir, cache.WithBlobDepth(1), cache.WithEviction(cfg.CacheEviction))
+	if err != nil {
+		cfg.Log.Error(err, "invalid HF cache eviction, files will not be evicted")
+		store, _ = cache.New(cfg.HFCacheDir, cache.WithBlobDepth(1))
+	}
+
 	return &HFClient{
+		access:         access,
+		xet:            newXetStore(store),
+		store:          store,
 		Router:         cfg.Router,
+		Leaser:         cfg.Leaser,
+		Relay:          cfg.Relay,
 		HFCacheDir:     cfg.HFCacheDir,
 		ResolveTimeout: cfg.ResolveTimeout,
 		ResolveRetries: cfg.ResolveRetries,
 		Log:            cfg.Log,
 		Client:         cfg.Client,
 		BaseURL:        cfg.BaseURL,
+		username:       cfg.Username,
+		password:       cfg.Password,
 	}
 }
 
@@ -105,6 +179,10 @@ func (h *HFClient) HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http
 	start := time.Now()
 	h.Log.Info("Original path", "path", req.URL.Path)
 	cleanPath := path.Clean(req.URL.Path)
+	if strings.HasPrefix(cleanPath, xetPathPrefix) {
+		h.serveXet(rw, req, strings.TrimPrefix(cleanPath, xetPathPrefix))
+		return
+	}
 
 	h.Log.Info("incoming huggingface request",
 		"cleanPath", cleanPath,
@@ -126,6 +204,27 @@ func (h *HFClient) HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http
 
 	h.Log.Info("computed P2P key", "key", key, "isResolve", isResolve, "isBlob", isBlob, "isXetAPI", isXetAPI)
 
+	parts := strings.Split(strings.TrimPrefix(cleanPath, "/huggingface/"), "/")
+	h.Log.Info("parsed path parts", "parts", parts)
+
+	isResolveCache := parts[0] == "api" && len(parts) > 1 && parts[1] == "resolve-cache"
+	var repo repoID
+	var repoParts []string
+	var repoOK bool
+	if isResolveCache {
+		repo, repoParts, repoOK = parseAPIRepo(parts[2:])
+	} else if parts[0] == "api" {
+		repo, repoParts, repoOK = parseAPIRepo(parts[1:])
+	} else {
+		repo, repoParts, repoOK = parseRepo(parts)
+	}
+	h.Log.Info("parsed repository", "repoType", repo.repoType, "repo", repo.name, "parts", repoParts)
+
+	if repoOK && parts[0] != "api" && len(repoParts) == 2 && repoParts[0] == "refs" {
+		h.serveRef(rw, repo, repoParts[1])
+		return
+	}
+
 	if !isResolve && !isBlob && !isAPI {
 		h.Log.Info("unsupported huggingface request", "path", cleanPath)
 		http.Error(rw, "unsupported huggingface request", http.StatusBadRequest)
@@ -137,39 +236,36 @@ func (h *HFClient) HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http
 	var cacheFilePath string
 	var fileExists bool
 	var filename string
+	var file *cachedFile
+	var commit string
+	authorized := true
 
-	parts := strings.Split(strings.TrimPrefix(cleanPath, "/huggingface/"), "/")
-	h.Log.Info("parsed path parts", "parts", parts)
-
-	if len(parts) >= 2 {
+	if repoOK {
 		var orgModel string
-		var modelDir string
-		if isResolve {
-			orgModel = fmt.Sprintf("models--%s--%s", parts[0], parts[1])
-			modelDir = filepath.Join(h.HFCacheDir, orgModel)
-			h.Log.Info("derived modelDir", "orgModel", orgModel, "modelDir", modelDir)
-		} else if isAPI {
-			orgModel = fmt.Sprintf("models--%s--%s", parts[2], parts[3])
-			modelDir = filepath.Join(h.HFCacheDir, orgModel)
-			h.Log.Info("derived modelDir", "orgModel", orgModel, "modelDir", modelDir)
+		if isResolve || isAPI {
+			orgModel = repo.dirName()
+			h.Log.Info("derived repository directory", "orgModel", orgModel)
 		}
 
-		if isResolve && len(parts) >= 5 {
-			ref := parts[3]
-			filename = strings.Join(parts[4:], "/")
-			refFile := filepath.Join(modelDir, "refs", "main")
+		if isResolve && len(repoParts) >= 3 && repoParts[0] == "resolve" {
+			ref := repoParts[1]
+			filename = strings.Join(repoParts[2:], "/")
+			file = &cachedFile{repoDir: orgModel, repo: repo.path(), revision: ref, filename: filename}
 
-			h.Log.Info("checking snapshot ref file", "refFile", refFile, "ref", ref, "filename", filename)
+			h.Log.Info("resolving revision", "ref", ref, "filename", filename)
 
-			if shaBytes, err := os.ReadFile(refFile); err == nil {
-				sha := strings.TrimSpace(string(shaBytes))
-				snapshotFile := filepath.Join(modelDir, "snapshots", sha, filename)
-				h.Log.Info("snapshot ref resolved", "sha", sha, "snapshotFile", snapshotFile)
+			sha, err := h.resolveRevision(req, file)
+			if err == nil {
+				commit = sha
+				key = file.key(sha)
+				authorized = h.authorized(req, file.repo, sha, filename)
+				snapshotFile := file.snapshotName(sha)
+				h.Log.Info("snapshot ref resolved", "sha", sha, "snapshotFile", snapshotFile, "key", key)
 
-				if _, err := os.Stat(snapshotFile); err == nil {
+				if info, err := h.store.Stat(snapshotFile); err == nil && authorized {
 					h.Log.Info("serving locally (file exists in HF cache)",
 						"orgModel", orgModel, "ref", ref, "sha", sha, "file", filename, "snapshotFile", snapshotFile)
-					http.ServeFile(rw, req, snapshotFile)
+					h.serveCached(rw, req, info, sha)
 					return
 				} else {
 					cacheFilePath = snapshotFile
@@ -177,19 +273,17 @@ func (h *HFClient) HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http
 					h.Log.Info("file missing, will use snapshotFile for P2P", "snapshotFile", snapshotFile)
 				}
 			} else {
-				h.Log.Info("Cached missed for ref file", "refFile", refFile)
+				h.Log.Info("revision could not be resolved to a commit", "ref", ref, "error", err.Error())
 			}
-		} else if isAPI && len(parts) > 5 {
-			sha := parts[5]
-			key_parts := strings.Split(key, "/")
-			h.Log.Info("key path parts", "parts", key_parts)
-			filename = key_parts[len(key_parts)-1]
-			snapshotFile := filepath.Join(modelDir, "snapshots", sha, filename)
+		} else if isResolveCache && len(repoParts) >= 2 {
+			sha := repoParts[0]
+			filename = strings.Join(repoParts[1:], "/")
+			snapshotFile := path.Join(orgModel, "snapshots", sha, filename)
 			h.Log.Info("snapshot ref resolved", "sha", sha, "snapshotFile", snapshotFile)
-			if _, err := os.Stat(snapshotFile); err == nil {
+			if info, err := h.store.Stat(snapshotFile); err == nil && h.authorized(req, repo.path(), sha, filename) {
 				h.Log.Info("serving locally (file exists in HF cache)",
 					"orgModel", orgModel, "sha", sha, "file", filename)
-				http.ServeFile(rw, req, snapshotFile)
+				h.serveCached(rw, req, info, sha)
 				return
 			} else {
 				cacheFilePath = snapshotFile
@@ -198,10 +292,12 @@ func (h *HFClient) HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http
 		}
 
 		if isBlob && len(parts) >= 3 {
-			blobFile := filepath.Join(modelDir, "blobs", parts[len(parts)-1])
+			etag := parts[len(parts)-1]
+			blobFile := path.Join(orgModel, "blobs", etag)
 			h.Log.Info("checking blob file", "blobFile", blobFile)
 
-			if _, err := os.Stat(blobFile); err == nil {
+			// Blobs are stored next to the snapshots of the repository that link to them.
+			if h.store.HasBlob(path.Join(orgModel, "snapshots"), etag) {
 				h.Log.Info("blob exists in local HF cache, skipping P2P/upstream",
 					"orgModel", orgModel, "file", parts[len(parts)-1])
 				return
@@ -219,54 +315,296 @@ func (h *HFClient) HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http
 		"tokenizer_config.json":        true,
 		"generation_config.json":       true,
 	}
-	if isResolve && cacheFilePath != "" && req.Method == "GET" && !excludeFiles[filename] {
-		ctx, cancel := context.WithTimeout(req.Context(), h.ResolveTimeout)
-		defer cancel()
-
+	p2pEnabled := isResolve && commit != "" && authorized && req.Method == "GET" && !excludeFiles[filename]
+	if p2pEnabled && h.serveFromRelay(rw, req, key) {
+		h.Log.Info("request completed from relayed download", "duration", time.Since(start))
+		return
+	}
+	if p2pEnabled {
+		file.shared = true
 		h.Log.Info("attempting P2P resolution", "key", key, "cacheFilePath", cacheFilePath, "fileExists", fileExists)
-
-		balancer, err := h.Router.Lookup(ctx, key, h.ResolveRetries)
-		if err == nil {
-			for attempt := range h.ResolveRetries {
-				peer, peerErr := balancer.Next()
-				if peerErr != nil {
-					h.Log.Info("no more peers available", "key", key, "error", peerErr)
-					break
-				}
-				h.Log.Info("got peer from P2P resolution",
-					"peer", peer,
-					"attempt", attempt+1,
-					"key", key,
-					"cacheFilePath", cacheFilePath)
-
-				if err := h.forwardRequest(req, rw, peer.String(), key, cacheFilePath, isResolve); err == nil {
-					h.Log.Info("served huggingface resource from peer",
-						"peer", peer,
-						"key", key)
-					h.Log.Info("request completed via P2P", "duration", time.Since(start))
-					return
-				} else {
-					h.Log.Error(err, "peer lookup failed",
-						"key", key,
-						"peer", peer,
-						"attempt", attempt+1)
-					balancer.Remove(peer)
-				}
-			}
-		} else {
-			h.Log.Error(err, "failed to resolve P2P peers", "key", key)
+		if h.serveFromPeers(rw, req, key, file) {
+			h.Log.Info("request completed via P2P", "duration", time.Since(start))
+			return
 		}
 	} else {
 		h.Log.Info("Cache file not available on local node or not resolve requests")
 	}
 
+	// Concurrent requests for the file on this node share one fetch.
+	if commit != "" && cacheFilePath != "" && authorized && req.Method == "GET" {
+		release, owner, err := h.store.Claim(req.Context(), cacheFilePath)
+		if err != nil {
+			h.Log.Error(err, "failed to wait for fetch of file", "file", cacheFilePath)
+			http.Error(rw, fmt.Sprintf("failed to wait for fetch of file: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if owner {
+			defer release()
+		} else if info, err := h.store.Stat(cacheFilePath); err == nil {
+			h.Log.Info("serving file fetched by another request on this node", "file", cacheFilePath)
+			h.serveCached(rw, req, info, commit)
+			return
+		}
+	}
+
+	var lease *routing.Lease
+	if h.Leaser != nil && p2pEnabled {
+		var owner bool
+		var err error
+		lease, owner, err = h.Leaser.Acquire(req.Context(), key)
+		if err != nil {
+			h.Log.Error(err, "failed to acquire upstream lease", "key", key)
+			http.Error(rw, fmt.Sprintf("failed to acquire upstream lease: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if !owner {
+			h.Log.Info("file fetched by another request", "key", key)
+			if h.serveFromPeers(rw, req, key, file) {
+				h.Log.Info("request completed after waiting for upstream fetch", "duration", time.Since(start))
+				return
+			}
+		}
+	}
+
 	h.Log.Info("falling back to upstream", "path", cleanPath, "cacheFilePath", cacheFilePath)
-	if h.serveFromFallback(rw, req, cleanPath, isResolve, isBlob, isAPI, key) {
-		h.Log.Info("request completed via fallback", "duration", time.Since(start))
+	cachedKeys, err := h.serveFromFallback(rw, req, cleanPath, file, isResolve, isBlob, isAPI)
+	if req.Method == "GET" {
+		go h.advertiseFetched(lease, file, cachedKeys, err)
+	}
+	h.Log.Info("request completed via fallback", "duration", time.Since(start))
+}
+
+// serveFromRelay streams a file that is being downloaded from upstream by this node.
+func (h *HFClient) serveFromRelay(rw httpx.ResponseWriter, req *http.Request, key string) bool {
+	if h.Relay == nil {
+		return false
+	}
+	transfer, ok := h.Relay.Get(key)
+	if !ok {
+		return false
+	}
+	h.Log.Info("serving file while it is downloaded", "key", key)
+	if err := relay.ServeTransfer(rw, req, transfer); err != nil {
+		h.Log.Error(err, "failed to relay file", "key", key)
+	}
+	return true
+}
+
+func (h *HFClient) serveFromPeers(rw http.ResponseWriter, req *http.Request, key string, file *cachedFile) bool {
+	ctx, cancel := context.WithTimeout(req.Context(), h.ResolveTimeout)
+	defer cancel()
+
+	balancer, err := h.Router.Lookup(ctx, key, h.ResolveRetries)
+	if err != nil {
+		h.Log.Error(err, "failed to resolve P2P peers", "key", key)
+		return false
+	}
+	for attempt := range h.ResolveRetries {
+		peer, peerErr := balancer.Next()
+		if peerErr != nil {
+			h.Log.Info("no more peers available", "key", key, "error", peerErr)
+			return false
+		}
+		h.Log.Info("got peer from P2P resolution",
+			"peer", peer,
+			"attempt", attempt+1,
+			"key", key)
+
+		if err := h.forwardRequest(req, rw, peer.String(), key, file); err != nil {
+			h.Log.Error(err, "peer lookup failed",
+				"key", key,
+				"peer", peer,
+				"attempt", attempt+1)
+			balancer.Remove(peer)
+			continue
+		}
+		h.Log.Info("served huggingface resource from peer",
+			"peer", peer,
+			"key", key)
+		return true
 	}
+	return false
 }
 
-func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request, cleanPath string, isResolve, isBlob, isAPI bool, key string) bool {
+// advertiseFetched advertises the file fetched from upstream once it is cached and then releases the lease,
+// so that requests waiting for the fetch find the file through the router.
+func (h *HFClient) advertiseFetched(lease *routing.Lease, file *cachedFile, cachedKeys []string, fetchErr error) {
+	if len(cachedKeys) > 0 && file.shared {
+		h.advertiseCached(cachedKeys)
+	}
+	if lease == nil {
+		return
+	}
+	if fetchErr == nil && len(cachedKeys) == 0 {
+		fetchErr = errors.New("file fetched from upstream was not cached")
+	}
+	lease.Release(context.Background(), fetchErr)
+}
+
+func (h *HFClient) advertiseCached(keys []string) {
+	if err := h.Router.Advertise(context.Background(), keys); err != nil {
+		h.Log.Error(err, "failed to advertise keys", "keys", keys)
+	} else {
+		h.Log.Info("advertised keys successfully", "keys", keys)
+	}
+}
+
+// authorized returns true when the file may be served to the request from the cache or by peers. Requests that are
+// not authorized are proxied to upstream, which decides whether the request has access to the file.
+func (h *HFClient) authorized(req *http.Request, repo, commit, filename string) bool {
+	if h.access == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), h.ResolveTimeout)
+	defer cancel()
+	ok, err := h.access.authorize(ctx, req.Header.Get("Authorization"), repo, commit, filename)
+	if err != nil {
+		h.Log.Error(err, "could not check access to repository", "repo", repo)
+		return false
+	}
+	if !ok {
+		h.Log.Info("request does not have access to repository, proxying to upstream", "repo", repo)
+	}
+	return ok
+}
+
+// resolveRevision returns the commit of the revision that the file is requested at. A commit is used as is and
+// a named revision is read from the refs in the cache. Revisions that are not cached are resolved against upstream,
+// and against peers that have the revision cached when upstream cannot be reached.
+func (h *HFClient) resolveRevision(req *http.Request, file *cachedFile) (string, error) {
+	if commitRegex.MatchString(file.revision) {
+		return file.revision, nil
+	}
+	if !filepath.IsLocal(file.revision) {
+		return "", fmt.Errorf("invalid revision %s", file.revision)
+	}
+	b, err := h.store.ReadFile(refName(file.repoDir, file.revision))
+	if err == nil {
+		// Refs are written by the cache so the commit is trusted as long as it names a snapshot.
+		commit := strings.TrimSpace(string(b))
+		if commit != "" && filepath.IsLocal(commit) && !strings.ContainsAny(commit, `/\`) {
+			return commit, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.ResolveTimeout)
+	defer cancel()
+	commit, upstreamErr := h.resolveRevisionUpstream(ctx, req, file)
+	if upstreamErr == nil {
+		return commit, nil
+	}
+	h.Log.Info("could not resolve revision against upstream", "revision", file.revision, "error", upstreamErr.Error())
+	commit, peerErr := h.resolveRevisionPeers(ctx, file)
+	if peerErr == nil {
+		return commit, nil
+	}
+	return "", errors.Join(upstreamErr, peerErr)
+}
+
+// resolveRevisionUpstream reads the commit from the metadata of the file, without following the redirect to its content.
+func (h *HFClient) resolveRevisionUpstream(ctx context.Context, req *http.Request, file *cachedFile) (string, error) {
+	u := fmt.Sprintf("%s/%s/resolve/%s/%s", h.BaseURL, file.repo, url.PathEscape(file.revision), file.filename)
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return "", err
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		upstreamReq.Header.Set("Authorization", auth)
+	}
+	upstreamReq.Header.Set("Accept-Encoding", "identity")
+	client := *h.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(upstreamReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	commit := resp.Header.Get(HeaderRepoCommit)
+	if !commitRegex.MatchString(commit) {
+		return "", fmt.Errorf("upstream returned invalid repository commit %q", commit)
+	}
+	return commit, nil
+}
+
+// resolveRevisionPeers reads the commit of the revision from the refs cached by peers.
+func (h *HFClient) resolveRevisionPeers(ctx context.Context, file *cachedFile) (string, error) {
+	key := file.refKey()
+	balancer, err := h.Router.Lookup(ctx, key, h.ResolveRetries)
+	if err != nil {
+		return "", err
+	}
+	for range h.ResolveRetries {
+		peer, err := balancer.Next()
+		if err != nil {
+			return "", err
+		}
+		commit, err := h.fetchPeerRef(ctx, peer.String(), key)
+		if err != nil {
+			h.Log.Error(err, "peer could not resolve revision", "key", key, "peer", peer)
+			balancer.Remove(peer)
+			continue
+		}
+		return commit, nil
+	}
+	return "", fmt.Errorf("revision %s could not be resolved by peers", file.revision)
+}
+
+func (h *HFClient) fetchPeerRef(ctx context.Context, peerAddr, key string) (string, error) {
+	u := url.URL{
+		Scheme: "http",
+		Host:   peerAddr,
+		Path:   strings.TrimPrefix(key, "hf:"),
+	}
+	peerReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := h.Client.Do(peerReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("peer returned %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	commit := strings.TrimSpace(string(b))
+	if !commitRegex.MatchString(commit) {
+		return "", fmt.Errorf("peer returned invalid repository commit %q", commit)
+	}
+	return commit, nil
+}
+
+// serveRef writes the commit of a revision cached on this node, so that peers can resolve the revision.
+// Refs are never resolved against upstream or other peers as that is done by the requesting node.
+func (h *HFClient) serveRef(rw httpx.ResponseWriter, repo repoID, revision string) {
+	if !filepath.IsLocal(revision) {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("invalid revision %s", revision))
+		return
+	}
+	b, err := h.store.ReadFile(refName(repo.dirName(), revision))
+	if err != nil {
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("revision %s of %s is not cached", revision, repo.path()))
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	//nolint: errcheck // Ignore error.
+	rw.Write(b)
+}
+
+// serveFromFallback proxies the request to upstream. A resolved file is written through to the cache
+// and relayed to peers while it is downloaded when it is shared. It returns the keys of the file when it was cached.
+func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request, cleanPath string, file *cachedFile, isResolve, isBlob, isAPI bool) ([]string, error) {
 	h.Log.Info("serveFromFallback started",
 		"path", cleanPath,
 		"method", req.Method,
@@ -298,10 +636,15 @@ func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request,
 		Proxy:           http.ProxyFromEnvironment,
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
+	// The commit and etag of a resolved file are set on the first response, which redirects to the content of LFS files.
+	var redirectHeader http.Header
 	client := &http.Client{
 		Timeout:   30 * time.Minute,
 		Transport: tr,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) == 1 && req.Response != nil {
+				redirectHeader = req.Response.Header
+			}
 			if req.Method == "HEAD" && isXetURL(req.URL.String()) {
 				h.Log.Info("CheckRedirect hit: preventing redirect for HEAD request")
 				return http.ErrUseLastResponse
@@ -319,7 +662,7 @@ func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request,
 	if err != nil {
 		h.Log.Error(err, "failed to create upstream request", "url", upstreamURL)
 		http.Error(rw, fmt.Sprintf("failed to create request: %v", err), http.StatusInternalServerError)
-		return true
+		return nil, err
 	}
 
 	h.Log.Info("copying original request headers to upstream request")
@@ -334,12 +677,17 @@ func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request,
 	if req.Method == "HEAD" {
 		reqUpstream.Header.Set("Accept-Encoding", "identity")
 	}
+	// Xet tokens are decoded by the transport so that their CAS URL can be rewritten.
+	isXetToken := strings.Contains(cleanPath, "/xet-read-token/")
+	if isXetToken {
+		reqUpstream.Header.Del("Accept-Encoding")
+	}
 
 	resp, err := client.Do(reqUpstream)
 	if err != nil {
 		h.Log.Error(err, "failed to fetch from upstream", "url", upstreamURL)
 		http.Error(rw, fmt.Sprintf("failed to fetch from upstream: %v", err), http.StatusBadGateway)
-		return true
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -351,13 +699,14 @@ func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request,
 			rw.Header().Add(k, v)
 		}
 	}
+	h.rewriteXetHeader(req, rw.Header())
 
 	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
 		if req.Method == "HEAD" {
 			rw.WriteHeader(resp.StatusCode)
 			h.Log.Info("HEAD redirect successfully proxied and completed", "status", resp.StatusCode,
 				"location", rw.Header().Get("Location"), "duration", time.Since(start))
-			return true
+			return nil, nil
 		}
 		h.Log.Error(nil, "UNEXPECTED 3XX STATUS ON GET: Internal redirect failed to resolve content. Proceeding to write status.",
 			"status", resp.StatusCode, "location", resp.Header.Get("Location"))
@@ -367,35 +716,82 @@ func (h *HFClient) serveFromFallback(rw http.ResponseWriter, req *http.Request,
 		rw.WriteHeader(resp.StatusCode)
 		h.Log.Info("HEAD request completed (non-redirect path)", "status", resp.StatusCode,
 			"content-length", resp.ContentLength, "duration", time.Since(start))
-		return true
+		return nil, nil
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
 		h.Log.Error(nil, "upstream returned 404 not found", "upstreamURL", upstreamURL)
 	}
+	if h.access != nil && file != nil && req.Header.Get("Authorization") == "" &&
+		(resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		h.access.requireAuth(file.repo)
+	}
+	if isXetToken && req.Method == "GET" && resp.StatusCode == http.StatusOK {
+		return nil, h.serveXetToken(rw, req, resp)
+	}
 
 	rw.WriteHeader(resp.StatusCode)
 
-	if req.Method == "GET" {
-		n, err := io.Copy(rw, resp.Body)
+	if req.Method != "GET" {
+		h.Log.Info("request handler execution flow completed", "duration", time.Since(start))
+		return nil, nil
+	}
+
+	var dst io.Writer = rw
+	var cache *cacheWriter
+	var transfer *relay.Transfer
+	// Encoded content is not cached or relayed as it is not the content of the file.
+	if file != nil && resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "" {
+		metadataHeader := resp.Header
+		if redirectHeader != nil {
+			metadataHeader = redirectHeader
+		}
+		cache, err = newCacheWriter(h.store, file, metadataHeader)
 		if err != nil {
-			h.Log.Error(err, "failed to stream response to client", "file", filepath.Base(cleanPath), "bytesCopied", n)
+			h.Log.Info("file is not cached", "file", file.filename, "error", err.Error())
 		} else {
-			h.Log.Info("File streamed successfully", "file", filepath.Base(cleanPath), "bytes", n)
+			dst = io.MultiWriter(rw, cache)
 		}
-		go func() {
-			if err := h.Router.Advertise(context.Background(), []string{key}); err != nil {
-				h.Log.Error(err, "failed to advertise key", "key", key)
-			} else {
-				h.Log.Info("advertised key successfully", "key", key)
-			}
-		}()
-
-		h.Log.Info("file cached and served successfully", "file", cleanPath, "bytes", n)
 	}
-
-	h.Log.Info("request handler execution flow completed", "duration", time.Since(start))
-	return true
+	if cache != nil && file.shared && h.Relay != nil {
+		relayKey := cache.Keys()[0]
+		transfer, err = h.Relay.Start(req.Context(), relayKey, resp.ContentLength, cache.Header())
+		if err != nil {
+			h.Log.Info("file is not relayed to peers", "key", relayKey, "error", err.Error())
+		} else {
+			dst = io.MultiWriter(rw, cache, transfer)
+		}
+	}
+	n, err := io.Copy(dst, resp.Body)
+	if err != nil {
+		if cache != nil {
+			cache.Abort()
+		}
+		if transfer != nil {
+			transfer.Finish(req.Context(), err)
+		}
+		h.Log.Error(err, "failed to stream response to client", "file", filepath.Base(cleanPath), "bytesCopied", n)
+		return nil, err
+	}
+	h.Log.Info("File streamed successfully", "file", filepath.Base(cleanPath), "bytes", n)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	if cache == nil {
+		h.Log.Info("request handler execution flow completed", "duration", time.Since(start))
+		return nil, nil
+	}
+	// The transfer fails when the file could not be cached, as peers would not find it once the transfer is removed.
+	err = cache.Commit()
+	if transfer != nil {
+		transfer.Finish(req.Context(), err)
+	}
+	if err != nil {
+		h.Log.Error(err, "failed to cache file", "file", file.filename)
+		return nil, nil
+	}
+	h.Log.Info("file cached and served successfully", "file", cleanPath, "bytes", n, "duration", time.Since(start))
+	return cache.Keys(), nil
 }
 
 func isXetURL(rawURL string) bool {
@@ -413,7 +809,9 @@ func isXetURL(rawURL string) bool {
 	return false
 }
 
-func (h *HFClient) forwardRequest(req *http.Request, rw http.ResponseWriter, peerAddr, key string, _ string, isResolve bool) error {
+// forwardRequest streams the response of the peer to the client. A resolved file is written through
+// to the cache with the metadata set by the peer and advertised once it is cached.
+func (h *HFClient) forwardRequest(req *http.Request, rw http.ResponseWriter, peerAddr, key string, file *cachedFile) error {
 	start := time.Now()
 	var u *url.URL
 
@@ -431,12 +829,6 @@ func (h *HFClient) forwardRequest(req *http.Request, rw http.ResponseWriter, pee
 			Host:   peerAddr,
 			Path:   strings.TrimPrefix(key, "hf:"),
 		}
-	} else if isResolve {
-		u = &url.URL{
-			Scheme: "http",
-			Host:   peerAddr,
-			Path:   req.URL.Path,
-		}
 	} else {
 		u = &url.URL{
 			Scheme: "http",
@@ -501,29 +893,60 @@ func (h *HFClient) forwardRequest(req *http.Request, rw http.ResponseWriter, pee
 			"url", u.String(),
 			"contentLength", resp.ContentLength,
 		)
-	} else {
-		bytesCopied, err := io.Copy(rw, resp.Body)
+		return nil
+	}
+
+	var dst io.Writer = rw
+	var cache *cacheWriter
+	if file != nil && resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "" {
+		cache, err = newCacheWriter(h.store, file, resp.Header)
 		if err != nil {
-			h.Log.Error(err, "failed streaming peer response to client", "url", u.String(), "bytesCopied", bytesCopied)
-			return err
+			h.Log.Info("file is not cached", "file", file.filename, "error", err.Error())
+		} else {
+			dst = io.MultiWriter(rw, cache)
 		}
-		h.Log.Info("successfully forwarded response",
-			"peer", peerAddr,
-			"bytesCopied", bytesCopied,
-			"duration", time.Since(start),
-			"url", u.String(),
-		)
 	}
-
-	if err := h.Router.Advertise(context.Background(), []string{key}); err != nil {
-		h.Log.Error(err, "failed to advertise key", "key", key)
-	} else {
-		h.Log.Info("advertised key successfully", "key", key)
+	bytesCopied, err := io.Copy(dst, resp.Body)
+	if err != nil {
+		if cache != nil {
+			cache.Abort()
+		}
+		h.Log.Error(err, "failed streaming peer response to client", "url", u.String(), "bytesCopied", bytesCopied)
+		return err
 	}
+	h.Log.Info("successfully forwarded response",
+		"peer", peerAddr,
+		"bytesCopied", bytesCopied,
+		"duration", time.Since(start),
+		"url", u.String(),
+	)
 
+	if cache == nil {
+		return nil
+	}
+	err = cache.Commit()
+	if err != nil {
+		h.Log.Error(err, "failed to cache file", "file", file.filename)
+		return nil
+	}
+	if file.shared {
+		h.advertiseCached(cache.Keys())
+	}
 	return nil
 }
 
+// serveCached serves a file from the snapshot of the commit in the cache with the metadata of the file.
+func (h *HFClient) serveCached(rw http.ResponseWriter, req *http.Request, info cache.Info, commit string) {
+	f, err := h.store.Open(info.Name)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("failed to open cached file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	copyHeader(rw.Header(), snapshotMetadata(info, commit))
+	http.ServeContent(rw, req, path.Base(info.Name), info.ModTime, f)
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -532,74 +955,37 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
+func (h *HFClient) CacheDir() string {
+	return h.HFCacheDir
+}
+
 func (h *HFClient) WalkHFCacheDir(ctx context.Context) ([]string, error) {
 	var keys []string
 
 	h.Log.Info("Starting WalkHFCacheDir", "root", h.HFCacheDir)
 
-	err := filepath.Walk(h.HFCacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			h.Log.Error(err, "Error walking path", "path", path)
-			return err
-		}
-
-		h.Log.V(4).Info("Visiting", "path", path, "isDir", info.IsDir())
-
-		if info.IsDir() {
-			return nil
-		}
-
-		if !strings.Contains(path, "/snapshots/") {
-			h.Log.V(4).Info("Skipping (not snapshot)", "path", path)
-			return nil
-		}
+	infos, err := h.store.List()
+	if err != nil {
+		h.Log.Error(err, "Failed to walk HF cache dir")
+		return nil, fmt.Errorf("failed to walk HF cache dir: %w", err)
+	}
 
-		lower := strings.ToLower(info.Name())
-		if !(strings.HasSuffix(lower, ".bin") ||
-			strings.HasSuffix(lower, ".json") ||
-			strings.HasSuffix(lower, ".msgpack") ||
-			strings.HasSuffix(lower, ".onnx") ||
-			strings.HasSuffix(lower, ".safetensors") ||
-			strings.HasSuffix(lower, ".md")) {
+	seen := map[string]struct{}{}
+	for _, info := range infos {
+		h.Log.V(4).Info("Visiting", "name", info.Name, "digest", info.Digest)
 
-			h.Log.V(4).Info("Skipping (unsupported extension)", "file", info.Name())
-			return nil
+		key, ok := cacheKey(info.Name)
+		if !ok {
+			h.Log.V(4).Info("Skipping", "name", info.Name)
+			continue
 		}
-
-		relPath, err := filepath.Rel(h.HFCacheDir, path)
-		if err != nil {
-			h.Log.Error(err, "Failed to compute relative path", "path", path)
-			return fmt.Errorf("failed to compute relative path: %w", err)
+		// Xorbs are advertised once for all of their chunks.
+		if _, ok := seen[key]; ok {
+			continue
 		}
-
-		relPath = filepath.ToSlash(relPath)
-		h.Log.V(4).Info("Relative path", "relPath", relPath)
-
-		parts := strings.SplitN(relPath, "/", 3)
-		if len(parts) < 3 {
-			h.Log.V(4).Info("Skipping (malformed path)", "relPath", relPath)
-			return nil
-		}
-
-		modelDir := parts[0]
-		rest := strings.TrimPrefix(relPath, modelDir+"/")
-
-		modelPath := strings.TrimPrefix(modelDir, "models--")
-		modelPath = strings.ReplaceAll(modelPath, "--", "/")
-		modelPath = "/huggingface/" + modelPath
-
-		rest = strings.Replace(rest, "snapshots/", "resolve/", 1)
-
-		key := fmt.Sprintf("hf:%s/%s", modelPath, rest)
-		h.Log.V(4).Info("Discovered HF key", "key", key, "path", path)
-
+		seen[key] = struct{}{}
+		h.Log.V(4).Info("Discovered HF key", "key", key, "name", info.Name)
 		keys = append(keys, key)
-		return nil
-	})
-
-	if err != nil {
-		h.Log.Error(err, "Failed to walk HF cache dir")
-		return nil, fmt.Errorf("failed to walk HF cache dir: %w", err)
 	}
 
 	h.Log.Info("Completed WalkHFCacheDir", "totalKeys", len(keys))
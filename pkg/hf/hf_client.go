@@ -9,5 +9,8 @@ import (
 
 type Hf interface {
 	HuggingFaceRegistryHandler(rw httpx.ResponseWriter, req *http.Request)
+	PrefetchHandler(rw httpx.ResponseWriter, req *http.Request)
 	WalkHFCacheDir(ctx context.Context) ([]string, error)
+	// CacheDir returns the directory that files are cached in.
+	CacheDir() string
 }
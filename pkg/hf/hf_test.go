@@ -7,11 +7,13 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"clyde/pkg/httpx"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 
 	"github.com/go-logr/logr"
@@ -166,7 +168,7 @@ func TestHFHandler_ResolveP2PHit_Local(t *testing.T) {
 
 	peerAddr := netip.MustParseAddrPort(peer.Listener.Addr().String())
 	resolver := map[string][]netip.AddrPort{
-		"hf:/huggingface/org/model/resolve/main/model.bin": {peerAddr},
+		"hf:/huggingface/org/model/resolve/abc123def456/model.bin": {peerAddr},
 	}
 
 	router := routing.NewMemoryRouter(resolver, netip.AddrPort{})
@@ -322,14 +324,20 @@ func TestWalkHFCacheDir(t *testing.T) {
 	sha := "abc123"
 	createTempHFFile(t, modelDir, "snapshots/"+sha+"/model.safetensors", "data")
 	createTempHFFile(t, modelDir, "snapshots/"+sha+"/config.json", "cfg")
+	createTempHFFile(t, modelDir, "snapshots/"+sha+"/tokenizer.model", "tokenizer")
 	createTempHFFile(t, modelDir, "blobs/sha256-deadbeef", "blob")
+	createTempHFFile(t, modelDir, "refs/main", sha)
+	datasetDir := filepath.Join(tmp, "datasets--org--data")
+	createTempHFFile(t, datasetDir, "snapshots/"+sha+"/train/00.parquet", "rows")
+	createTempHFFile(t, datasetDir, "refs/main", sha)
+	createTempHFFile(t, tmp, ".locks/models--org--model/lock.json", "")
 
 	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
 	client := newTestHFClient(t, tmp, router)
 
 	keys, err := client.WalkHFCacheDir(t.Context())
 	require.NoError(t, err)
-	require.Len(t, keys, 2)
+	require.Len(t, keys, 6)
 
 	found := map[string]bool{}
 	for _, k := range keys {
@@ -337,4 +345,442 @@ func TestWalkHFCacheDir(t *testing.T) {
 	}
 	require.True(t, found["hf:/huggingface/org/model/resolve/"+sha+"/model.safetensors"])
 	require.True(t, found["hf:/huggingface/org/model/resolve/"+sha+"/config.json"])
+	// All snapshot files are found by the key that the handler advertises them by once they are cached.
+	file := cachedFile{repoDir: "models--org--model", repo: "org/model", filename: "tokenizer.model"}
+	require.True(t, found[file.key(sha)])
+	require.True(t, found["hf:/huggingface/org/model/refs/main"])
+	require.True(t, found["hf:/huggingface/datasets/org/data/resolve/"+sha+"/train/00.parquet"])
+	require.True(t, found["hf:/huggingface/datasets/org/data/refs/main"])
+}
+
+func TestHFHandler_ResolveRelay(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	content := "upstream-content-relayed-to-peers"
+	unblockCh := make(chan struct{})
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.Header().Set(HeaderEtag, `"relayed-etag"`)
+		_, _ = w.Write([]byte(content[:8]))
+		w.(http.Flusher).Flush()
+		<-unblockCh
+		_, _ = w.Write([]byte(content[8:]))
+	}))
+	defer upstream.Close()
+
+	modelDir := filepath.Join(tmp, "models--org--model")
+	refsDir := filepath.Join(modelDir, "refs")
+	snapshotsDir := filepath.Join(modelDir, "snapshots")
+
+	require.NoError(t, os.MkdirAll(refsDir, 0755))
+	require.NoError(t, os.MkdirAll(snapshotsDir, 0755))
+
+	require.NoError(t, os.WriteFile(filepath.Join(refsDir, "main"), []byte(commit), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(snapshotsDir, commit), 0755))
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	hfRelay, err := relay.NewRelay(router, relay.WithDir(t.TempDir()))
+	require.NoError(t, err)
+
+	client := NewHFClient(
+		router,
+		tmp,
+		WithHFBaseURL(upstream.URL),
+		WithHFRelay(hfRelay),
+	)
+
+	key := "hf:/huggingface/org/model/resolve/" + commit + "/model.bin"
+	bodies := make(chan string, 2)
+	get := func() {
+		rw := newTestResponseWriter()
+		req := httptest.NewRequest(http.MethodGet,
+			"/huggingface/org/model/resolve/main/model.bin", nil)
+		client.HuggingFaceRegistryHandler(rw, req)
+		resp := rw.Result()
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		bodies <- string(body)
+	}
+
+	go get()
+	require.Eventually(t, func() bool {
+		_, ok := hfRelay.Get(key)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := router.Get(key)
+	require.True(t, ok)
+
+	// The second request is served from the download in progress.
+	go get()
+	time.Sleep(50 * time.Millisecond)
+	close(unblockCh)
+	require.Equal(t, content, <-bodies)
+	require.Equal(t, content, <-bodies)
+
+	b, err := os.ReadFile(filepath.Join(modelDir, "snapshots", commit, "model.bin"))
+	require.NoError(t, err)
+	require.Equal(t, content, string(b))
+}
+
+func TestHFHandler_ResolveUpstreamCache(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	key := "hf:/huggingface/org/model/resolve/" + commit + "/model.bin"
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	// The metadata is set on the redirect response and not on the response of the content.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/org/model/resolve/main/model.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.Header().Set(HeaderLinkedEtag, `"content-etag"`)
+		http.Redirect(w, r, "/cdn/model.bin", http.StatusFound)
+	})
+	mux.HandleFunc("/cdn/model.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderEtag, `"cdn-etag"`)
+		_, _ = w.Write([]byte("upstream-content"))
+		_, ok := router.Get(key)
+		require.False(t, ok)
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	client := NewHFClient(router, tmp, WithHFBaseURL(upstream.URL))
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/huggingface/org/model/resolve/main/model.bin", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "upstream-content", string(body))
+
+	modelDir := filepath.Join(tmp, "models--org--model")
+	b, err := os.ReadFile(filepath.Join(modelDir, "blobs", "content-etag"))
+	require.NoError(t, err)
+	require.Equal(t, "upstream-content", string(b))
+	b, err = os.ReadFile(filepath.Join(modelDir, "snapshots", commit, "model.bin"))
+	require.NoError(t, err)
+	require.Equal(t, "upstream-content", string(b))
+	b, err = os.ReadFile(filepath.Join(modelDir, "refs", "main"))
+	require.NoError(t, err)
+	require.Equal(t, commit, string(b))
+	require.Eventually(t, func() bool {
+		_, ok := router.Get(key)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := router.Get("hf:/huggingface/org/model/refs/main")
+	require.True(t, ok)
+
+	// The cached file is served with its metadata.
+	rw = newTestResponseWriter()
+	req = httptest.NewRequest(http.MethodGet, "/huggingface/org/model/resolve/main/model.bin", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	resp = rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, commit, resp.Header.Get(HeaderRepoCommit))
+	require.Equal(t, `"content-etag"`, resp.Header.Get(HeaderEtag))
+}
+
+func TestHFHandler_ResolveUpstreamInterrupted(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	key := "hf:/huggingface/org/model/resolve/" + commit + "/model.bin"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.Header().Set(HeaderEtag, `"content-etag"`)
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("partial"))
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	client := NewHFClient(router, tmp, WithHFBaseURL(upstream.URL))
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/huggingface/org/model/resolve/main/model.bin", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+
+	modelDir := filepath.Join(tmp, "models--org--model")
+	entries, err := os.ReadDir(filepath.Join(modelDir, "blobs"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	_, err = os.Lstat(filepath.Join(modelDir, "snapshots", commit, "model.bin"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	time.Sleep(50 * time.Millisecond)
+	_, ok := router.Get(key)
+	require.False(t, ok)
+}
+
+func TestHFHandler_ResolvePeerCache(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	key := "hf:/huggingface/org/model/resolve/" + commit + "/model.bin"
+	refKey := "hf:/huggingface/org/model/refs/main"
+
+	// Upstream cannot be reached so the revision is resolved by the peer.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/huggingface/org/model/refs/main", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(commit))
+	})
+	mux.HandleFunc("/huggingface/org/model/resolve/"+commit+"/model.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.Header().Set(HeaderEtag, `"content-etag"`)
+		_, _ = w.Write([]byte("peer-content"))
+	})
+	peer := httptest.NewServer(mux)
+	defer peer.Close()
+
+	peerAddr := netip.MustParseAddrPort(peer.Listener.Addr().String())
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{key: {peerAddr}, refKey: {peerAddr}}, netip.AddrPort{})
+	client := NewHFClient(router, tmp, WithHFBaseURL("http://invalid-upstream"))
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/huggingface/org/model/resolve/main/model.bin", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "peer-content", string(body))
+
+	modelDir := filepath.Join(tmp, "models--org--model")
+	b, err := os.ReadFile(filepath.Join(modelDir, "snapshots", commit, "model.bin"))
+	require.NoError(t, err)
+	require.Equal(t, "peer-content", string(b))
+	b, err = os.ReadFile(filepath.Join(modelDir, "refs", "main"))
+	require.NoError(t, err)
+	require.Equal(t, commit, string(b))
+}
+
+func TestHFHandler_ResolveRevision(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mainCommit := "1111111111111111111111111111111111111111"
+	tagCommit := "2222222222222222222222222222222222222222"
+	upstreamCommit := "3333333333333333333333333333333333333333"
+
+	modelDir := filepath.Join(tmp, "models--org--model")
+	createTempHFFile(t, modelDir, "refs/main", mainCommit)
+	createTempHFFile(t, modelDir, "refs/v1.0", tagCommit)
+	createTempHFFile(t, modelDir, "snapshots/"+mainCommit+"/model.bin", "main-content")
+	createTempHFFile(t, modelDir, "snapshots/"+tagCommit+"/model.bin", "tag-content")
+	createTempHFFile(t, modelDir, "snapshots/"+upstreamCommit+"/model.bin", "upstream-content")
+
+	// Upstream only resolves revisions, the content of all files is cached.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/org/model/resolve/dev/model.bin" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(HeaderRepoCommit, upstreamCommit)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	client := NewHFClient(router, tmp, WithHFBaseURL(upstream.URL))
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		revision       string
+		expectedBody   string
+		expectedCommit string
+	}{
+		{
+			name:           "commit",
+			revision:       tagCommit,
+			expectedBody:   "tag-content",
+			expectedCommit: tagCommit,
+		},
+		{
+			name:           "main",
+			revision:       "main",
+			expectedBody:   "main-content",
+			expectedCommit: mainCommit,
+		},
+		{
+			name:           "tag",
+			revision:       "v1.0",
+			expectedBody:   "tag-content",
+			expectedCommit: tagCommit,
+		},
+		{
+			name:           "resolved against upstream",
+			revision:       "dev",
+			expectedBody:   "upstream-content",
+			expectedCommit: upstreamCommit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := newTestResponseWriter()
+			req := httptest.NewRequest(http.MethodGet, "/huggingface/org/model/resolve/"+tt.revision+"/model.bin", nil)
+			client.HuggingFaceRegistryHandler(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedBody, string(body))
+			require.Equal(t, tt.expectedCommit, resp.Header.Get(HeaderRepoCommit))
+		})
+	}
+}
+
+func TestHFHandler_Ref(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	createTempHFFile(t, filepath.Join(tmp, "models--org--model"), "refs/main", commit)
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	client := NewHFClient(router, tmp, WithHFBaseURL("http://invalid-upstream"))
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/huggingface/org/model/refs/main", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, commit, rw.Body.String())
+
+	// Refs that are not cached are never resolved by the node that is asked.
+	rw = newTestResponseWriter()
+	req = httptest.NewRequest(http.MethodGet, "/huggingface/org/model/refs/dev", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	require.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestHFHandler_ResolveDataset(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	key := "hf:/huggingface/datasets/org/data/resolve/" + commit + "/train/00.parquet"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/datasets/org/data/resolve/main/train/00.parquet" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.Header().Set(HeaderEtag, `"rows-etag"`)
+		_, _ = w.Write([]byte("rows"))
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	client := NewHFClient(router, tmp, WithHFBaseURL(upstream.URL))
+	get := func() *http.Response {
+		rw := newTestResponseWriter()
+		req := httptest.NewRequest(http.MethodGet, "/huggingface/datasets/org/data/resolve/main/train/00.parquet", nil)
+		client.HuggingFaceRegistryHandler(rw, req)
+		return rw.Result()
+	}
+
+	resp := get()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "rows", string(body))
+
+	datasetDir := filepath.Join(tmp, "datasets--org--data")
+	b, err := os.ReadFile(filepath.Join(datasetDir, "snapshots", commit, "train", "00.parquet"))
+	require.NoError(t, err)
+	require.Equal(t, "rows", string(b))
+	b, err = os.ReadFile(filepath.Join(datasetDir, "refs", "main"))
+	require.NoError(t, err)
+	require.Equal(t, commit, string(b))
+	require.Eventually(t, func() bool {
+		_, ok := router.Get(key)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := router.Get("hf:/huggingface/datasets/org/data/refs/main")
+	require.True(t, ok)
+
+	// The dataset is served from the cache once upstream is gone.
+	upstream.Close()
+	resp = get()
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "rows", string(body))
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/huggingface/datasets/org/data/refs/main", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	require.Equal(t, commit, rw.Body.String())
+}
+
+func TestHFHandler_ResolveGated(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	createTempHFFile(t, filepath.Join(tmp, "models--org--gated"), "snapshots/"+commit+"/model.bin", "gated-content")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Only the access check is expected as the file is cached.
+		require.Equal(t, http.MethodHead, r.Method)
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	client := NewHFClient(router, tmp, WithHFBaseURL(upstream.URL), WithHFAccessPolicy(time.Minute))
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "without token",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "invalid token",
+			authorization:  "Bearer invalid",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "valid token",
+			authorization:  "Bearer valid",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "gated-content",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := newTestResponseWriter()
+			req := httptest.NewRequest(http.MethodGet, "/huggingface/org/gated/resolve/"+commit+"/model.bin", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			client.HuggingFaceRegistryHandler(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedBody, string(body))
+		})
+	}
 }
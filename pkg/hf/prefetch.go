@@ -0,0 +1,265 @@
+package hf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"clyde/pkg/httpx"
+)
+
+// PrefetchRequest is the body of a request to prefetch the files of a repository onto the node.
+type PrefetchRequest struct {
+	Repo string `json:"repo"`
+	// RepoType is one of model, dataset or space and defaults to model when empty.
+	RepoType string `json:"repoType,omitempty"`
+	// Revision defaults to main when empty.
+	Revision string `json:"revision,omitempty"`
+	// Include and Exclude are glob patterns matched against the paths of the files in the repository.
+	// All files are included when Include is empty.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Token is sent to upstream to access gated and private repositories. It is part of the body as the
+	// authorization header of the request authenticates the request to the node.
+	Token string `json:"token,omitempty"`
+}
+
+// PrefetchProgress is written as a JSON line for each file prefetched.
+// The last line either reports that the prefetch is done or the error that caused it to fail.
+type PrefetchProgress struct {
+	File   string `json:"file,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	// Duration is the time in milliseconds it took to fetch the file.
+	Duration int64 `json:"duration,omitempty"`
+	Done     bool  `json:"done,omitempty"`
+}
+
+type repoInfo struct {
+	Sha      string `json:"sha"`
+	Siblings []struct {
+		Filename string `json:"rfilename"`
+	} `json:"siblings"`
+}
+
+// PrefetchHandler downloads the files of a repository into the cache. Files are fetched through this node so that
+// they are fetched from peers before upstream, and are advertised once they are cached.
+func (h *HFClient) PrefetchHandler(rw httpx.ResponseWriter, req *http.Request) {
+	prefetchReq := PrefetchRequest{}
+	err := json.NewDecoder(io.LimitReader(req.Body, 1024*1024)).Decode(&prefetchReq)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("could not decode prefetch request: %w", err))
+		return
+	}
+	if prefetchReq.RepoType == "" {
+		prefetchReq.RepoType = RepoTypeModel
+	}
+	if prefetchReq.Revision == "" {
+		prefetchReq.Revision = "main"
+	}
+	repo, _, ok := parseAPIRepo(append([]string{prefetchReq.RepoType + "s"}, strings.Split(prefetchReq.Repo, "/")...))
+	if !ok || repo.name != prefetchReq.Repo || !filepath.IsLocal(repo.name) {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("invalid %s repository %q", prefetchReq.RepoType, prefetchReq.Repo))
+		return
+	}
+	if !filepath.IsLocal(prefetchReq.Revision) {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("invalid revision %s", prefetchReq.Revision))
+		return
+	}
+	patterns := map[string][]*regexp.Regexp{}
+	for name, globs := range map[string][]string{"include": prefetchReq.Include, "exclude": prefetchReq.Exclude} {
+		for _, glob := range globs {
+			re, err := globRegexp(glob)
+			if err != nil {
+				rw.WriteError(http.StatusBadRequest, fmt.Errorf("invalid %s pattern %q: %w", name, glob, err))
+				return
+			}
+			patterns[name] = append(patterns[name], re)
+		}
+	}
+
+	// Files are fetched through this node so that the request is handled like any other client request.
+	localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		rw.WriteError(http.StatusInternalServerError, errors.New("could not determine local address"))
+		return
+	}
+	proxy := &url.URL{
+		Scheme: "http",
+		Host:   localAddr.String(),
+	}
+	if req.TLS != nil {
+		proxy.Scheme = "https"
+	}
+	authorization := ""
+	if prefetchReq.Token != "" {
+		authorization = "Bearer " + prefetchReq.Token
+	}
+
+	log := h.Log.WithValues("repo", repo.path(), "revision", prefetchReq.Revision)
+	log.Info("prefetching repository")
+	info, err := h.fetchRepoInfo(req.Context(), proxy, authorization, repo, prefetchReq.Revision)
+	if err != nil {
+		log.Error(err, "could not list repository files")
+		rw.WriteError(http.StatusBadGateway, err)
+		return
+	}
+	if !commitRegex.MatchString(info.Sha) {
+		rw.WriteError(http.StatusBadGateway, fmt.Errorf("upstream returned invalid repository commit %q", info.Sha))
+		return
+	}
+
+	rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeNDJSON)
+	rw.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(rw)
+	writeProgress := func(progress PrefetchProgress) {
+		err := enc.Encode(progress)
+		if err != nil {
+			log.Error(err, "could not write prefetch progress")
+			return
+		}
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	// The revision is cached so that the prefetched files are found by clients that request the revision by name.
+	if prefetchReq.Revision != info.Sha {
+		err := h.store.WriteFile(refName(repo.dirName(), prefetchReq.Revision), []byte(info.Sha))
+		if err != nil {
+			log.Error(err, "could not cache revision")
+		} else {
+			h.advertiseCached([]string{refKey(repo.path(), prefetchReq.Revision)})
+		}
+	}
+
+	failed := 0
+	for _, sibling := range info.Siblings {
+		if !matchesAny(patterns["include"], sibling.Filename, true) || matchesAny(patterns["exclude"], sibling.Filename, false) {
+			continue
+		}
+		start := time.Now()
+		size, err := h.prefetchFile(req.Context(), proxy, authorization, repo, info.Sha, sibling.Filename)
+		if err != nil {
+			failed++
+			log.Error(err, "could not prefetch file", "file", sibling.Filename)
+			writeProgress(PrefetchProgress{File: sibling.Filename, Commit: info.Sha, Error: err.Error()})
+			continue
+		}
+		writeProgress(PrefetchProgress{
+			File:     sibling.Filename,
+			Commit:   info.Sha,
+			Size:     size,
+			Duration: time.Since(start).Milliseconds(),
+		})
+	}
+	if failed > 0 {
+		err := fmt.Errorf("%d files of %s could not be prefetched", failed, repo.path())
+		log.Error(err, "prefetch failed")
+		writeProgress(PrefetchProgress{Error: err.Error()})
+		return
+	}
+	log.Info("prefetch successful", "commit", info.Sha)
+	writeProgress(PrefetchProgress{Commit: info.Sha, Done: true})
+}
+
+// fetchRepoInfo lists the files of the repository at the revision through the API.
+func (h *HFClient) fetchRepoInfo(ctx context.Context, proxy *url.URL, authorization string, repo repoID, revision string) (repoInfo, error) {
+	u := proxy.JoinPath("huggingface", "api", repo.repoType+"s", repo.name, "revision", revision)
+	resp, err := h.prefetchGet(ctx, u, authorization)
+	if err != nil {
+		return repoInfo{}, err
+	}
+	defer resp.Body.Close()
+	info := repoInfo{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return repoInfo{}, fmt.Errorf("could not decode repository info: %w", err)
+	}
+	return info, nil
+}
+
+// prefetchFile fetches the file at the commit and returns its size.
+func (h *HFClient) prefetchFile(ctx context.Context, proxy *url.URL, authorization string, repo repoID, commit, filename string) (int64, error) {
+	u := proxy.JoinPath(append([]string{"huggingface", repo.path(), "resolve", commit}, strings.Split(filename, "/")...)...)
+	resp, err := h.prefetchGet(ctx, u, authorization)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(io.Discard, resp.Body)
+}
+
+func (h *HFClient) prefetchGet(ctx context.Context, u *url.URL, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request for %s returned %s", u.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// globRegexp compiles a glob pattern in which wildcards also match path separators, as the patterns of
+// huggingface_hub do. A pattern ending with a separator matches all files in the directory.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	if strings.HasSuffix(glob, "/") {
+		glob += "*"
+	}
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func matchesAny(patterns []*regexp.Regexp, filename string, matchEmpty bool) bool {
+	if len(patterns) == 0 {
+		return matchEmpty
+	}
+	for _, re := range patterns {
+		if re.MatchString(filename) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package hf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/routing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		glob     string
+		filename string
+		expected bool
+	}{
+		{"*.json", "config.json", true},
+		{"*.json", "sub/config.json", true},
+		{"*.json", "config.json.bak", false},
+		{"model-0000?.safetensors", "model-00001.safetensors", true},
+		{"onnx/", "onnx/model.onnx", true},
+		{"onnx/", "model.onnx", false},
+		{"[!a]*.bin", "a.bin", false},
+		{"[!a]*.bin", "b.bin", true},
+		{"config.json", "configXjson", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob+" "+tt.filename, func(t *testing.T) {
+			t.Parallel()
+
+			re, err := globRegexp(tt.glob)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, re.MatchString(tt.filename))
+		})
+	}
+
+	_, err := globRegexp("[a")
+	require.EqualError(t, err, "unterminated character class")
+}
+
+func TestPrefetchHandler(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	files := []string{"config.json", "model.safetensors", "README.md", "onnx/model.onnx", "missing.bin"}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/models/org/model/revision/main" {
+			require.Equal(t, "Bearer hf-token", r.Header.Get("Authorization"))
+			siblings := []map[string]string{}
+			for _, f := range files {
+				siblings = append(siblings, map[string]string{"rfilename": f})
+			}
+			//nolint: errcheck // Ignore error.
+			json.NewEncoder(w).Encode(map[string]any{"sha": commit, "siblings": siblings})
+			return
+		}
+		filename, ok := strings.CutPrefix(r.URL.Path, "/org/model/resolve/"+commit+"/")
+		if !ok || filename == "missing.bin" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(HeaderRepoCommit, commit)
+		w.Header().Set(HeaderEtag, fmt.Sprintf(`"%x"`, filename))
+		_, _ = w.Write([]byte("content of " + filename))
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	client := NewHFClient(router, tmp, WithHFBaseURL(upstream.URL), WithHFLogger(logr.Discard()))
+	mux := httpx.NewServeMux(logr.Discard())
+	mux.Handle("GET /huggingface/", client.HuggingFaceRegistryHandler)
+	mux.Handle("POST /huggingface/_prefetch", client.PrefetchHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name             string
+		body             string
+		expectedStatus   int
+		expectedFiles    []string
+		expectedProgress PrefetchProgress
+	}{
+		{
+			name:             "include and exclude",
+			body:             `{"repo": "org/model", "include": ["*.json", "*.safetensors", "onnx/"], "exclude": ["*.md"], "token": "hf-token"}`,
+			expectedStatus:   http.StatusOK,
+			expectedFiles:    []string{"config.json", "model.safetensors", "onnx/model.onnx"},
+			expectedProgress: PrefetchProgress{Commit: commit, Done: true},
+		},
+		{
+			name:             "file missing upstream",
+			body:             `{"repo": "org/model", "revision": "main", "include": ["config.json", "missing.bin"], "token": "hf-token"}`,
+			expectedStatus:   http.StatusOK,
+			expectedFiles:    []string{"config.json", "missing.bin"},
+			expectedProgress: PrefetchProgress{Error: "1 files of org/model could not be prefetched"},
+		},
+		{
+			name:           "invalid repository",
+			body:           `{"repo": "../model"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid pattern",
+			body:           `{"repo": "org/model", "include": ["[a"]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, srv.URL+"/huggingface/_prefetch", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, httpx.ContentTypeNDJSON, resp.Header.Get(httpx.HeaderContentType))
+
+			progress := []PrefetchProgress{}
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				p := PrefetchProgress{}
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), &p))
+				progress = append(progress, p)
+			}
+			require.NoError(t, scanner.Err())
+			require.Len(t, progress, len(tt.expectedFiles)+1)
+			for i, f := range tt.expectedFiles {
+				require.Equal(t, f, progress[i].File)
+				require.Equal(t, commit, progress[i].Commit)
+				if progress[i].Error != "" {
+					continue
+				}
+				require.Equal(t, int64(len("content of "+f)), progress[i].Size)
+				b, err := os.ReadFile(filepath.Join(tmp, "models--org--model", "snapshots", commit, f))
+				require.NoError(t, err)
+				require.Equal(t, "content of "+f, string(b))
+			}
+			require.Equal(t, tt.expectedProgress, progress[len(progress)-1])
+		})
+	}
+
+	b, err := os.ReadFile(filepath.Join(tmp, "models--org--model", "refs", "main"))
+	require.NoError(t, err)
+	require.Equal(t, commit, string(b))
+	for _, key := range []string{
+		"hf:/huggingface/org/model/refs/main",
+		"hf:/huggingface/org/model/resolve/" + commit + "/model.safetensors",
+		"hf:/huggingface/org/model/resolve/" + commit + "/onnx/model.onnx",
+	} {
+		require.Eventually(t, func() bool {
+			_, ok := router.Get(key)
+			return ok
+		}, time.Second, 10*time.Millisecond, key)
+	}
+	_, err = os.Stat(filepath.Join(tmp, "models--org--model", "snapshots", commit, "README.md"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
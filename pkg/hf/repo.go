@@ -0,0 +1,77 @@
+package hf
+
+import (
+	"strings"
+)
+
+// Repository types of the Hugging Face Hub.
+const (
+	RepoTypeModel   = "model"
+	RepoTypeDataset = "dataset"
+	RepoTypeSpace   = "space"
+)
+
+var repoTypes = []string{RepoTypeModel, RepoTypeDataset, RepoTypeSpace}
+
+// repoID identifies a repository of the Hugging Face Hub by its type and its name, which includes the namespace.
+type repoID struct {
+	repoType string
+	name     string
+}
+
+// parseRepo returns the repository that the parts of a Hub path start with and the parts that follow it.
+// Paths of datasets and Spaces are prefixed with their type while paths of models are not.
+func parseRepo(parts []string) (repoID, []string, bool) {
+	repoType := RepoTypeModel
+	if len(parts) > 0 && (parts[0] == RepoTypeDataset+"s" || parts[0] == RepoTypeSpace+"s") {
+		repoType = strings.TrimSuffix(parts[0], "s")
+		parts = parts[1:]
+	}
+	return splitRepo(repoType, parts)
+}
+
+// parseAPIRepo returns the repository that the parts of an API path start with and the parts that follow it.
+// API paths are always prefixed with the type of the repository.
+func parseAPIRepo(parts []string) (repoID, []string, bool) {
+	if len(parts) == 0 {
+		return repoID{}, nil, false
+	}
+	for _, repoType := range repoTypes {
+		if parts[0] == repoType+"s" {
+			return splitRepo(repoType, parts[1:])
+		}
+	}
+	return repoID{}, nil, false
+}
+
+func splitRepo(repoType string, parts []string) (repoID, []string, bool) {
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return repoID{}, nil, false
+	}
+	return repoID{repoType: repoType, name: parts[0] + "/" + parts[1]}, parts[2:], true
+}
+
+// parseRepoDir returns the repository that a directory in the cache belongs to.
+func parseRepoDir(dirName string) (repoID, bool) {
+	for _, repoType := range repoTypes {
+		name, ok := strings.CutPrefix(dirName, repoType+"s--")
+		if !ok {
+			continue
+		}
+		return repoID{repoType: repoType, name: strings.ReplaceAll(name, "--", "/")}, true
+	}
+	return repoID{}, false
+}
+
+// path returns the path of the repository in Hub URLs and keys.
+func (r repoID) path() string {
+	if r.repoType == RepoTypeModel {
+		return r.name
+	}
+	return r.repoType + "s/" + r.name
+}
+
+// dirName returns the name of the directory of the repository in the cache.
+func (r repoID) dirName() string {
+	return r.repoType + "s--" + strings.ReplaceAll(r.name, "/", "--")
+}
@@ -0,0 +1,106 @@
+package hf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRepo(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name            string
+		path            string
+		api             bool
+		expectedOK      bool
+		expectedRepo    repoID
+		expectedParts   []string
+		expectedPath    string
+		expectedDirName string
+	}{
+		{
+			name:            "model",
+			path:            "org/model/resolve/main/config.json",
+			expectedOK:      true,
+			expectedRepo:    repoID{repoType: RepoTypeModel, name: "org/model"},
+			expectedParts:   []string{"resolve", "main", "config.json"},
+			expectedPath:    "org/model",
+			expectedDirName: "models--org--model",
+		},
+		{
+			name:            "dataset",
+			path:            "datasets/org/data/resolve/main/train/00.parquet",
+			expectedOK:      true,
+			expectedRepo:    repoID{repoType: RepoTypeDataset, name: "org/data"},
+			expectedParts:   []string{"resolve", "main", "train", "00.parquet"},
+			expectedPath:    "datasets/org/data",
+			expectedDirName: "datasets--org--data",
+		},
+		{
+			name:            "space",
+			path:            "spaces/org/app/refs/main",
+			expectedOK:      true,
+			expectedRepo:    repoID{repoType: RepoTypeSpace, name: "org/app"},
+			expectedParts:   []string{"refs", "main"},
+			expectedPath:    "spaces/org/app",
+			expectedDirName: "spaces--org--app",
+		},
+		{
+			name:            "api model",
+			path:            "models/org/model/revision/main",
+			api:             true,
+			expectedOK:      true,
+			expectedRepo:    repoID{repoType: RepoTypeModel, name: "org/model"},
+			expectedParts:   []string{"revision", "main"},
+			expectedPath:    "org/model",
+			expectedDirName: "models--org--model",
+		},
+		{
+			name:            "api dataset",
+			path:            "datasets/org/data/tree/main",
+			api:             true,
+			expectedOK:      true,
+			expectedRepo:    repoID{repoType: RepoTypeDataset, name: "org/data"},
+			expectedParts:   []string{"tree", "main"},
+			expectedPath:    "datasets/org/data",
+			expectedDirName: "datasets--org--data",
+		},
+		{
+			name: "api without type",
+			path: "org/model/revision/main",
+			api:  true,
+		},
+		{
+			name: "dataset without name",
+			path: "datasets/org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			parse := parseRepo
+			if tt.api {
+				parse = parseAPIRepo
+			}
+			repo, parts, ok := parse(strings.Split(tt.path, "/"))
+			require.Equal(t, tt.expectedOK, ok)
+			if !tt.expectedOK {
+				return
+			}
+			require.Equal(t, tt.expectedRepo, repo)
+			require.Equal(t, tt.expectedParts, parts)
+			require.Equal(t, tt.expectedPath, repo.path())
+			require.Equal(t, tt.expectedDirName, repo.dirName())
+			dirRepo, ok := parseRepoDir(repo.dirName())
+			require.True(t, ok)
+			require.Equal(t, repo, dirRepo)
+		})
+	}
+
+	_, ok := parseRepoDir(".locks")
+	require.False(t, ok)
+}
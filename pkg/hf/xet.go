@@ -0,0 +1,802 @@
+package hf
+
+import (
+	"clyde/pkg/cache"
+	"clyde/pkg/httpx"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderXetCasURL = "X-Xet-Cas-Url"
+	// headerMirrored marks requests from peers, which are only served with content that the node has cached.
+	// It has the same value as the header the registry uses for mirrored requests. The header can be set by any
+	// client, so it is only trusted to skip the access policy when the request has the basic auth credentials of peers.
+	headerMirrored = "X-Clyde-Mirrored"
+
+	xetPathPrefix = "/huggingface/_xet/"
+	// xetDirName is the directory in the cache that Xet content is stored in, which is not a repository directory.
+	xetDirName = "xet"
+	// xetChunkHeaderSize is the size of the header that precedes each serialized chunk in a xorb.
+	xetChunkHeaderSize = 8
+	// xetMaxChunkSize is the largest size of a chunk, before and after compression.
+	xetMaxChunkSize = 128 * 1024
+	// xetMaxCompressionScheme is the highest compression scheme of chunks, which are uncompressed (0),
+	// LZ4 compressed (1), or byte grouped and LZ4 compressed (2).
+	xetMaxCompressionScheme = 2
+	// xetFetchTTL is how long fetch URLs of xorbs are kept, which is longer than upstream signs them for.
+	xetFetchTTL = time.Hour
+)
+
+var xetHashRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// xetStore caches the content of files stored with the Xet protocol. Files are reconstructed by clients from ranges
+// of chunks in xorbs, which are listed by the reconstruction of the file. Chunks are stored individually by the hash
+// of their xorb and their index in it, so that chunks that are deduplicated between files and revisions are only
+// stored once and any range of chunks can be served from chunks fetched for other ranges.
+type xetStore struct {
+	// casURLs are the upstream CAS servers that clients are redirected from, by the identifier in the rewritten URL.
+	casURLs map[string]string
+	// fetches are the upstream URLs of chunk ranges from reconstructions returned to clients.
+	fetches map[string]xetFetch
+	// tokens are the grants of the Xet access tokens returned by upstream, by the hash of the authorization header.
+	tokens map[string]xetToken
+	// files are the repositories that the reconstruction of a file was fetched from upstream for, by file hash.
+	files map[string]map[repoID]struct{}
+	// grants are when the fetch URLs of chunk ranges returned to clients expire, by grant and range.
+	grants map[string]time.Time
+	store  *cache.Store
+	mx     sync.Mutex
+}
+
+// xetToken is the repository that an access token returned by upstream grants access to.
+type xetToken struct {
+	expires time.Time
+	repo    repoID
+}
+
+type xetFetch struct {
+	seen     time.Time
+	url      string
+	urlRange xetRange
+}
+
+type xetRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+type xetFetchInfo struct {
+	URL      string   `json:"url"`
+	Range    xetRange `json:"range"`
+	URLRange xetRange `json:"url_range"`
+}
+
+func newXetStore(store *cache.Store) *xetStore {
+	return &xetStore{
+		store:   store,
+		casURLs: map[string]string{},
+		fetches: map[string]xetFetch{},
+		tokens:  map[string]xetToken{},
+		files:   map[string]map[repoID]struct{}{},
+		grants:  map[string]time.Time{},
+	}
+}
+
+// authorizationKey returns the key of the authorization header, which is only kept as a hash.
+func authorizationKey(authorization string) string {
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
+
+// xorbKey returns the key advertised by nodes that have chunks of the xorb cached.
+func xorbKey(hash string) string {
+	return "hf:" + xetPathPrefix + "xorbs/" + hash
+}
+
+// proxyURL returns the URL that clients reach this node at.
+func proxyURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, req.Host)
+}
+
+func xetBaseURL(req *http.Request) string {
+	return proxyURL(req) + strings.TrimSuffix(xetPathPrefix, "/")
+}
+
+// rewriteCASURL returns the URL that clients use to reach the upstream CAS server through this node.
+func (s *xetStore) rewriteCASURL(req *http.Request, casURL string) string {
+	sum := sha256.Sum256([]byte(casURL))
+	id := hex.EncodeToString(sum[:8])
+	s.mx.Lock()
+	s.casURLs[id] = casURL
+	s.mx.Unlock()
+	return fmt.Sprintf("%s/cas/%s", xetBaseURL(req), id)
+}
+
+func (s *xetStore) casURL(id string) (string, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	casURL, ok := s.casURLs[id]
+	return casURL, ok
+}
+
+// rewriteToken rewrites the CAS URL of a Xet access token returned by upstream, and remembers that the token
+// grants access to the repository until it expires.
+func (s *xetStore) rewriteToken(req *http.Request, b []byte, repo repoID) ([]byte, error) {
+	token := map[string]json.RawMessage{}
+	err := json.Unmarshal(b, &token)
+	if err != nil {
+		return nil, err
+	}
+	var casURL string
+	err = json.Unmarshal(token["casUrl"], &casURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CAS URL in Xet token: %w", err)
+	}
+	var accessToken string
+	err = json.Unmarshal(token["accessToken"], &accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access token in Xet token: %w", err)
+	}
+	var exp int64
+	err = json.Unmarshal(token["exp"], &exp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry in Xet token: %w", err)
+	}
+	now := time.Now()
+	s.mx.Lock()
+	for k, t := range s.tokens {
+		if now.After(t.expires) {
+			delete(s.tokens, k)
+		}
+	}
+	s.tokens[authorizationKey("Bearer "+accessToken)] = xetToken{
+		repo:    repo,
+		expires: time.Unix(exp, 0),
+	}
+	s.mx.Unlock()
+	token["casUrl"], err = json.Marshal(s.rewriteCASURL(req, casURL))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(token)
+}
+
+// token returns the grant of the access token in the authorization header.
+func (s *xetStore) token(authorization string) (xetToken, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	t, ok := s.tokens[authorizationKey(authorization)]
+	if !ok || time.Now().After(t.expires) {
+		return xetToken{}, false
+	}
+	return t, true
+}
+
+// addFile remembers that the reconstruction of the file was fetched from upstream with the authorization header.
+func (s *xetStore) addFile(authorization, fileHash string) {
+	t, ok := s.token(authorization)
+	if !ok {
+		return
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.files[fileHash]; !ok {
+		s.files[fileHash] = map[repoID]struct{}{}
+	}
+	s.files[fileHash][t.repo] = struct{}{}
+}
+
+// hasFile returns true when the reconstruction of the file was fetched from upstream for the repository that the
+// access token in the authorization header grants access to.
+func (s *xetStore) hasFile(authorization, fileHash string) bool {
+	t, ok := s.token(authorization)
+	if !ok {
+		return false
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	_, ok = s.files[fileHash][t.repo]
+	return ok
+}
+
+// granted returns true when the fetch URL of the chunk range was returned to a client with the grant.
+func (s *xetStore) granted(grant, hash, chunkRange string) bool {
+	if grant == "" {
+		return false
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	expires, ok := s.grants[grant+"/"+hash+"/"+chunkRange]
+	return ok && time.Now().Before(expires)
+}
+
+// rewriteReconstruction points the chunk ranges of a reconstruction to this node and remembers where to fetch them.
+// The fetch URLs carry a grant so that only clients that were returned the reconstruction can fetch the ranges.
+func (s *xetStore) rewriteReconstruction(req *http.Request, b []byte) ([]byte, error) {
+	reconstruction := map[string]json.RawMessage{}
+	err := json.Unmarshal(b, &reconstruction)
+	if err != nil {
+		return nil, err
+	}
+	fetchInfo := map[string][]xetFetchInfo{}
+	err = json.Unmarshal(reconstruction["fetch_info"], &fetchInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fetch info in Xet reconstruction: %w", err)
+	}
+
+	grant := rand.Text()
+	now := time.Now()
+	s.mx.Lock()
+	for k, fetch := range s.fetches {
+		if now.Sub(fetch.seen) > xetFetchTTL {
+			delete(s.fetches, k)
+		}
+	}
+	for k, expires := range s.grants {
+		if now.After(expires) {
+			delete(s.grants, k)
+		}
+	}
+	for hash, infos := range fetchInfo {
+		if !xetHashRegex.MatchString(hash) {
+			s.mx.Unlock()
+			return nil, fmt.Errorf("invalid xorb hash %q", hash)
+		}
+		for i, info := range infos {
+			chunkRange := fmt.Sprintf("%d-%d", info.Range.Start, info.Range.End)
+			s.fetches[hash+"/"+chunkRange] = xetFetch{
+				url:      info.URL,
+				urlRange: info.URLRange,
+				seen:     now,
+			}
+			s.grants[grant+"/"+hash+"/"+chunkRange] = now.Add(xetFetchTTL)
+			infos[i].URL = fmt.Sprintf("%s/xorbs/%s/%s?grant=%s", xetBaseURL(req), hash, chunkRange, grant)
+		}
+	}
+	s.mx.Unlock()
+
+	reconstruction["fetch_info"], err = json.Marshal(fetchInfo)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(reconstruction)
+}
+
+func (s *xetStore) fetch(hash string, start, end uint64) (xetFetch, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	fetch, ok := s.fetches[fmt.Sprintf("%s/%d-%d", hash, start, end)]
+	return fetch, ok
+}
+
+func (s *xetStore) reconstructionName(fileHash string) string {
+	return path.Join(xetDirName, "reconstructions", fileHash+".json")
+}
+
+func (s *xetStore) chunkName(hash string, index uint64) string {
+	return path.Join(xetDirName, "xorbs", hash, strconv.FormatUint(index, 10))
+}
+
+// chunkFiles returns the names of the chunk range and their total size when all chunks are cached. An error is
+// returned when a cached chunk is not a valid serialized chunk.
+func (s *xetStore) chunkFiles(hash string, start, end uint64) ([]string, int64, bool, error) {
+	names := []string{}
+	var size int64
+	for i := start; i < end; i++ {
+		info, err := s.store.Stat(s.chunkName(hash, i))
+		if err != nil {
+			return nil, 0, false, nil
+		}
+		err = s.validateChunkFile(info)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		names = append(names, info.Name)
+		size += info.Size
+	}
+	return names, size, true, nil
+}
+
+func (s *xetStore) validateChunkFile(info cache.Info) error {
+	rc, err := s.store.OpenRange(info.Name, 0, xetChunkHeaderSize)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	header, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if len(header) < xetChunkHeaderSize {
+		return fmt.Errorf("chunk %s is shorter than its header", info.Name)
+	}
+	size, err := parseChunkHeader(header)
+	if err != nil {
+		return fmt.Errorf("invalid chunk %s: %w", info.Name, err)
+	}
+	if int64(size) != info.Size {
+		return fmt.Errorf("chunk %s has size %d instead of %d", info.Name, info.Size, size)
+	}
+	return nil
+}
+
+// removeXorb removes all cached chunks of the xorb.
+func (s *xetStore) removeXorb(hash string) error {
+	infos, err := s.store.ListDir(path.Join(xetDirName, "xorbs", hash))
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, info := range infos {
+		errs = append(errs, s.store.Delete(info.Name))
+	}
+	return errors.Join(errs...)
+}
+
+// parseChunkHeader returns the size of the serialized chunk that the header precedes, or an error when the header
+// does not describe a valid chunk.
+func parseChunkHeader(header []byte) (int, error) {
+	version := header[0]
+	compressedSize := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+	scheme := header[4]
+	uncompressedSize := int(header[5]) | int(header[6])<<8 | int(header[7])<<16
+	switch {
+	case version != 0:
+		return 0, fmt.Errorf("unsupported chunk version %d", version)
+	case scheme > xetMaxCompressionScheme:
+		return 0, fmt.Errorf("unsupported compression scheme %d", scheme)
+	case compressedSize == 0 || compressedSize > xetMaxChunkSize:
+		return 0, fmt.Errorf("invalid compressed size %d", compressedSize)
+	case uncompressedSize == 0 || uncompressedSize > xetMaxChunkSize:
+		return 0, fmt.Errorf("invalid uncompressed size %d", uncompressedSize)
+	case scheme == 0 && compressedSize != uncompressedSize:
+		return 0, fmt.Errorf("uncompressed chunk has compressed size %d and uncompressed size %d", compressedSize, uncompressedSize)
+	}
+	return xetChunkHeaderSize + compressedSize, nil
+}
+
+// chunkWriter splits a stream of serialized chunks of a xorb and writes each complete chunk to the client once its
+// header has been validated. A stream with an invalid chunk is aborted before the chunk is written, and the chunks
+// that were cached from the stream are removed. Chunks are only cached when the writer has a store. Errors of the
+// cache are recorded instead of returned so that the stream to the client is not interrupted by the cache.
+type chunkWriter struct {
+	err      error
+	cacheErr error
+	out      io.Writer
+	store    *xetStore
+	hash     string
+	buf      []byte
+	cached   []string
+	index    uint64
+	end      uint64
+}
+
+func newChunkWriter(out io.Writer, store *xetStore, hash string, start, end uint64) *chunkWriter {
+	return &chunkWriter{
+		out:   out,
+		store: store,
+		hash:  hash,
+		index: start,
+		end:   end,
+	}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= xetChunkHeaderSize {
+		size, err := parseChunkHeader(w.buf[:xetChunkHeaderSize])
+		if err != nil {
+			return 0, w.fail(fmt.Errorf("chunk %d of xorb %s is invalid: %w", w.index, w.hash, err))
+		}
+		if len(w.buf) < size {
+			break
+		}
+		if w.index >= w.end {
+			return 0, w.fail(fmt.Errorf("xorb %s contains more chunks than the requested range", w.hash))
+		}
+		_, err = w.out.Write(w.buf[:size])
+		if err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.cache(w.buf[:size])
+		w.buf = append(w.buf[:0], w.buf[size:]...)
+		w.index++
+	}
+	return len(p), nil
+}
+
+func (w *chunkWriter) cache(chunk []byte) {
+	if w.store == nil || w.cacheErr != nil {
+		return
+	}
+	name := w.store.chunkName(w.hash, w.index)
+	if _, err := w.store.store.Stat(name); err == nil {
+		return
+	}
+	err := w.store.store.WriteFile(name, chunk)
+	if err != nil {
+		w.cacheErr = err
+		return
+	}
+	w.cached = append(w.cached, name)
+}
+
+// fail aborts the stream and removes the chunks that were cached from it.
+func (w *chunkWriter) fail(err error) error {
+	w.err = err
+	if w.store != nil {
+		for _, name := range w.cached {
+			//nolint: errcheck // Ignore error.
+			w.store.store.Delete(name)
+		}
+	}
+	w.cached = nil
+	return err
+}
+
+// Close returns an error when the stream did not contain exactly the requested chunks or they were not cached.
+func (w *chunkWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.cacheErr != nil {
+		return w.cacheErr
+	}
+	if len(w.buf) > 0 || w.index != w.end {
+		return fmt.Errorf("xorb %s ended before chunk %d of the requested range", w.hash, w.end)
+	}
+	return nil
+}
+
+// serveXet serves the requests of the Xet protocol that clients are redirected to by the rewritten URLs.
+func (h *HFClient) serveXet(rw httpx.ResponseWriter, req *http.Request, xetPath string) {
+	parts := strings.Split(xetPath, "/")
+	switch {
+	case len(parts) == 5 && parts[0] == "cas" && parts[2] == "v1" && parts[3] == "reconstructions":
+		h.serveXetReconstruction(rw, req, parts[1], parts[4])
+	case len(parts) == 3 && parts[0] == "xorbs":
+		h.serveXetXorb(rw, req, parts[1], parts[2])
+	default:
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("unsupported xet request %s", xetPath))
+	}
+}
+
+// serveXetReconstruction proxies the reconstruction of a file to the upstream CAS server. Reconstructions of whole
+// files are cached so that files with cached chunks can be reconstructed when upstream cannot be reached.
+// Cached reconstructions are only served to requests with a token, which has to be granted access to a repository
+// that the reconstruction was fetched for when the access policy is enabled.
+func (h *HFClient) serveXetReconstruction(rw httpx.ResponseWriter, req *http.Request, casID, fileHash string) {
+	if !xetHashRegex.MatchString(fileHash) {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("invalid file hash %s", fileHash))
+		return
+	}
+	cacheable := req.Header.Get("Range") == ""
+	authorization := req.Header.Get("Authorization")
+
+	b, status, err := h.fetchXetReconstruction(req, casID, fileHash)
+	if err != nil {
+		h.Log.Error(err, "could not fetch reconstruction from upstream", "fileHash", fileHash)
+		if !cacheable {
+			rw.WriteError(http.StatusBadGateway, err)
+			return
+		}
+		if authorization == "" || (h.access != nil && !h.xet.hasFile(authorization, fileHash)) {
+			rw.WriteError(http.StatusBadGateway, fmt.Errorf("request is not authorized for the cached reconstruction of %s", fileHash))
+			return
+		}
+		b, err = h.store.ReadFile(h.xet.reconstructionName(fileHash))
+		if err != nil {
+			rw.WriteError(http.StatusBadGateway, fmt.Errorf("reconstruction of %s is not cached", fileHash))
+			return
+		}
+		status = http.StatusOK
+		h.Log.Info("serving cached reconstruction", "fileHash", fileHash)
+	} else if status != http.StatusOK {
+		rw.WriteHeader(status)
+		//nolint: errcheck // Ignore error.
+		rw.Write(b)
+		return
+	} else if cacheable {
+		h.xet.addFile(authorization, fileHash)
+		err := h.store.WriteFile(h.xet.reconstructionName(fileHash), b)
+		if err != nil {
+			h.Log.Error(err, "could not cache reconstruction", "fileHash", fileHash)
+		}
+	}
+
+	rewritten, err := h.xet.rewriteReconstruction(req, b)
+	if err != nil {
+		rw.WriteError(http.StatusBadGateway, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(rewritten)))
+	rw.WriteHeader(status)
+	//nolint: errcheck // Ignore error.
+	rw.Write(rewritten)
+}
+
+func (h *HFClient) fetchXetReconstruction(req *http.Request, casID, fileHash string) ([]byte, int, error) {
+	casURL, ok := h.xet.casURL(casID)
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown CAS server %s", casID)
+	}
+	ctx := req.Context()
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/reconstructions/%s", casURL, fileHash), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, k := range []string{"Authorization", "Range", "User-Agent"} {
+		if v := req.Header.Get(k); v != "" {
+			upstreamReq.Header.Set(k, v)
+		}
+	}
+	resp, err := h.Client.Do(upstreamReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, 0, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, resp.StatusCode, nil
+}
+
+// serveXetXorb serves a range of chunks of a xorb from the cache, from peers, or from the upstream URL that the
+// range was listed with in a reconstruction. Only chunks fetched from upstream are cached and advertised. When the
+// access policy is enabled, clients have to present the grant of the fetch URL that they were returned, while peers
+// authenticated with the basic auth credentials are only served chunks that are cached.
+func (h *HFClient) serveXetXorb(rw httpx.ResponseWriter, req *http.Request, hash, chunkRange string) {
+	startStr, endStr, ok := strings.Cut(chunkRange, "-")
+	start, startErr := strconv.ParseUint(startStr, 10, 64)
+	end, endErr := strconv.ParseUint(endStr, 10, 64)
+	if !ok || startErr != nil || endErr != nil || start >= end || !xetHashRegex.MatchString(hash) {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("invalid xorb range %s/%s", hash, chunkRange))
+		return
+	}
+	mirrored := req.Header.Get(headerMirrored) == "true"
+	if h.access != nil && !(mirrored && h.validPeerAuth(req)) && !h.xet.granted(req.URL.Query().Get("grant"), hash, chunkRange) {
+		rw.WriteError(http.StatusForbidden, fmt.Errorf("request is not granted xorb range %s/%s", hash, chunkRange))
+		return
+	}
+
+	files, size, ok, err := h.xet.chunkFiles(hash, start, end)
+	if err != nil {
+		h.Log.Error(err, "removing invalid cached xorb", "hash", hash)
+		h.withdrawXorb(req.Context(), hash)
+	}
+	if ok {
+		h.Log.Info("serving xorb range from cache", "hash", hash, "range", chunkRange)
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		rw.WriteHeader(http.StatusOK)
+		for _, name := range files {
+			f, err := h.store.Open(name)
+			if err != nil {
+				h.Log.Error(err, "could not read chunk", "name", name)
+				return
+			}
+			_, err = io.Copy(rw, f)
+			f.Close()
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	if mirrored {
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("xorb range %s/%s is not cached", hash, chunkRange))
+		return
+	}
+
+	if h.fetchXorbFromPeers(rw, req, hash, start, end) {
+		return
+	}
+	fetch, ok := h.xet.fetch(hash, start, end)
+	if !ok {
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("xorb range %s/%s is not known", hash, chunkRange))
+		return
+	}
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fetch.url, nil)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	upstreamReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", fetch.urlRange.Start, fetch.urlRange.End))
+	err = h.copyXorb(rw, upstreamReq, hash, start, end, true)
+	if err != nil {
+		h.Log.Error(err, "could not fetch xorb range from upstream", "hash", hash, "range", chunkRange)
+		if !rw.HeadersWritten() {
+			rw.WriteError(http.StatusBadGateway, err)
+		}
+	}
+}
+
+func (h *HFClient) fetchXorbFromPeers(rw httpx.ResponseWriter, req *http.Request, hash string, start, end uint64) bool {
+	ctx, cancel := context.WithTimeout(req.Context(), h.ResolveTimeout)
+	defer cancel()
+
+	key := xorbKey(hash)
+	balancer, err := h.Router.Lookup(ctx, key, h.ResolveRetries)
+	if err != nil {
+		return false
+	}
+	for range h.ResolveRetries {
+		peer, err := balancer.Next()
+		if err != nil {
+			return false
+		}
+		u := fmt.Sprintf("http://%s%sxorbs/%s/%d-%d", peer.String(), xetPathPrefix, hash, start, end)
+		peerReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u, nil)
+		if err != nil {
+			return false
+		}
+		peerReq.Header.Set(headerMirrored, "true")
+		if h.peerAuthConfigured() {
+			peerReq.SetBasicAuth(h.username, h.password)
+		}
+		err = h.copyXorb(rw, peerReq, hash, start, end, false)
+		if err == nil {
+			h.Log.Info("served xorb range from peer", "hash", hash, "peer", peer)
+			return true
+		}
+		h.Log.Error(err, "could not fetch xorb range from peer", "hash", hash, "peer", peer)
+		if rw.HeadersWritten() {
+			return true
+		}
+		balancer.Remove(peer)
+	}
+	return false
+}
+
+// peerAuthConfigured returns true if requests between peers are authenticated with basic auth credentials.
+func (h *HFClient) peerAuthConfigured() bool {
+	return h.username != "" || h.password != ""
+}
+
+// validPeerAuth returns true if the request has the basic auth credentials of peers.
+// Unlike the registry, requests are not trusted as peers when the credentials are not configured.
+func (h *HFClient) validPeerAuth(req *http.Request) bool {
+	if !h.peerAuthConfigured() {
+		return false
+	}
+	username, password, ok := req.BasicAuth()
+	return ok && h.username == username && h.password == password
+}
+
+// withdrawXorb removes the cached chunks of the xorb and stops advertising it.
+func (h *HFClient) withdrawXorb(ctx context.Context, hash string) {
+	err := h.xet.removeXorb(hash)
+	if err != nil {
+		h.Log.Error(err, "could not remove cached xorb", "hash", hash)
+	}
+	err = h.Router.Withdraw(ctx, []string{xorbKey(hash)})
+	if err != nil {
+		h.Log.Error(err, "could not withdraw xorb", "hash", hash)
+	}
+}
+
+// copyXorb streams the validated chunk range to the client. When the range is cached, the chunks are stored while
+// they are streamed and the xorb is advertised once the range has been stored completely.
+func (h *HFClient) copyXorb(rw httpx.ResponseWriter, req *http.Request, hash string, start, end uint64, cached bool) error {
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if resp.ContentLength >= 0 {
+		rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	rw.WriteHeader(http.StatusOK)
+	var store *xetStore
+	if cached {
+		store = h.xet
+	}
+	chunks := newChunkWriter(rw, store, hash, start, end)
+	_, err = io.Copy(chunks, resp.Body)
+	if err != nil {
+		return err
+	}
+	err = chunks.Close()
+	if err != nil {
+		return err
+	}
+	if cached {
+		h.advertiseCached([]string{xorbKey(hash)})
+	}
+	return nil
+}
+
+// serveXetToken writes the Xet access token returned by upstream with the CAS URL pointed to this node.
+func (h *HFClient) serveXetToken(rw http.ResponseWriter, req *http.Request, resp *http.Response) error {
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("failed to read Xet token: %v", err), http.StatusBadGateway)
+		return err
+	}
+	parts := strings.Split(strings.TrimPrefix(path.Clean(req.URL.Path), "/huggingface/api/"), "/")
+	repo, _, ok := parseAPIRepo(parts)
+	if !ok {
+		err := fmt.Errorf("invalid repository in Xet token path %s", req.URL.Path)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	rewritten, err := h.xet.rewriteToken(req, b, repo)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("failed to rewrite Xet token: %v", err), http.StatusBadGateway)
+		return err
+	}
+	rw.Header().Del("Content-Encoding")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(rewritten)))
+	rw.WriteHeader(http.StatusOK)
+	_, err = rw.Write(rewritten)
+	return err
+}
+
+// rewriteXetHeader points the CAS URL and the Xet links in the response headers of upstream to this node.
+func (h *HFClient) rewriteXetHeader(req *http.Request, header http.Header) {
+	if casURL := header.Get(HeaderXetCasURL); casURL != "" {
+		header.Set(HeaderXetCasURL, h.xet.rewriteCASURL(req, casURL))
+	}
+	links := header.Values("Link")
+	if len(links) == 0 {
+		return
+	}
+	header.Del("Link")
+	for _, value := range links {
+		rewritten := []string{}
+		for _, link := range strings.Split(value, ",") {
+			link = strings.TrimSpace(link)
+			target, params, ok := strings.Cut(link, ">")
+			target = strings.TrimPrefix(target, "<")
+			switch {
+			case !ok:
+			case strings.Contains(params, `rel="xet-auth"`) && strings.HasPrefix(target, h.BaseURL+"/"):
+				link = fmt.Sprintf("<%s/huggingface%s>%s", proxyURL(req), strings.TrimPrefix(target, h.BaseURL), params)
+			case strings.Contains(params, `rel="xet-reconstruction-info"`):
+				if casURL, fileHash, ok := strings.Cut(target, "/v1/reconstructions/"); ok {
+					link = fmt.Sprintf("<%s/v1/reconstructions/%s>%s", h.xet.rewriteCASURL(req, casURL), fileHash, params)
+				}
+			}
+			rewritten = append(rewritten, link)
+		}
+		header.Add("Link", strings.Join(rewritten, ", "))
+	}
+}
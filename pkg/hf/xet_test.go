@@ -0,0 +1,440 @@
+package hf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clyde/pkg/cache"
+	"clyde/pkg/httpx"
+	"clyde/pkg/routing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testXorb      = "1111111111111111111111111111111111111111111111111111111111111111"
+	testFileHashA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testFileHashB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// testChunks returns serialized uncompressed chunks and the offset of each chunk in the xorb.
+func testChunks(n int) ([]byte, []int) {
+	xorb := []byte{}
+	offsets := []int{}
+	for i := range n {
+		offsets = append(offsets, len(xorb))
+		data := []byte(fmt.Sprintf("chunk-%d-%s", i, strings.Repeat("x", i*10)))
+		size := len(data)
+		header := []byte{0, byte(size), byte(size >> 8), byte(size >> 16), 0, byte(size), byte(size >> 8), byte(size >> 16)}
+		xorb = append(xorb, header...)
+		xorb = append(xorb, data...)
+	}
+	offsets = append(offsets, len(xorb))
+	return xorb, offsets
+}
+
+// newTestCAS returns a stand-in Xet CAS server that serves the reconstructions of two files which share the middle
+// chunk of a xorb, and the byte ranges of the xorb.
+func newTestCAS(t *testing.T, xorb []byte, offsets []int, xorbRequests *atomic.Int64) *httptest.Server {
+	t.Helper()
+
+	var cas *httptest.Server
+	reconstruction := func(start, end int) map[string]any {
+		return map[string]any{
+			"offset_into_first_range": 0,
+			"terms": []map[string]any{
+				{
+					"hash":            testXorb,
+					"unpacked_length": 100,
+					"range":           map[string]int{"start": start, "end": end},
+				},
+			},
+			"fetch_info": map[string]any{
+				testXorb: []map[string]any{
+					{
+						"range":     map[string]int{"start": start, "end": end},
+						"url":       cas.URL + "/xorbs/default/" + testXorb + "?signature=secret",
+						"url_range": map[string]int{"start": offsets[start], "end": offsets[end] - 1},
+					},
+				},
+			},
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/reconstructions/"+testFileHashA, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer xet-token", r.Header.Get("Authorization"))
+		//nolint: errcheck // Ignore error.
+		json.NewEncoder(w).Encode(reconstruction(0, 2))
+	})
+	mux.HandleFunc("/v1/reconstructions/"+testFileHashB, func(w http.ResponseWriter, r *http.Request) {
+		//nolint: errcheck // Ignore error.
+		json.NewEncoder(w).Encode(reconstruction(1, 3))
+	})
+	mux.HandleFunc("/xorbs/default/"+testXorb, func(w http.ResponseWriter, r *http.Request) {
+		xorbRequests.Add(1)
+		require.Equal(t, "secret", r.URL.Query().Get("signature"))
+		start, end, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-")
+		require.True(t, ok)
+		s, err := strconv.Atoi(start)
+		require.NoError(t, err)
+		e, err := strconv.Atoi(end)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(xorb[s : e+1])
+	})
+	cas = httptest.NewServer(mux)
+	return cas
+}
+
+func getXet(t *testing.T, client *HFClient, u string) (int, []byte) {
+	t.Helper()
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("Authorization", "Bearer xet-token")
+	client.HuggingFaceRegistryHandler(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, b
+}
+
+func TestChunkWriter(t *testing.T) {
+	t.Parallel()
+
+	xorb, offsets := testChunks(3)
+	tmp := t.TempDir()
+	cacheStore, err := cache.New(tmp)
+	require.NoError(t, err)
+	store := newXetStore(cacheStore)
+
+	// Chunks are split correctly when they are written in arbitrary pieces.
+	out := &bytes.Buffer{}
+	w := newChunkWriter(out, store, testXorb, 1, 3)
+	for _, b := range xorb[offsets[1]:] {
+		n, err := w.Write([]byte{b})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+	require.NoError(t, w.Close())
+	require.Equal(t, xorb[offsets[1]:], out.Bytes())
+	for i := 1; i < 3; i++ {
+		b, err := os.ReadFile(filepath.Join(tmp, store.chunkName(testXorb, uint64(i))))
+		require.NoError(t, err)
+		require.Equal(t, xorb[offsets[i]:offsets[i+1]], b)
+	}
+	_, size, ok, err := store.chunkFiles(testXorb, 1, 3)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(offsets[3]-offsets[1]), size)
+	_, _, ok, err = store.chunkFiles(testXorb, 0, 3)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Complete chunks of a truncated stream are stored but the range is incomplete.
+	w = newChunkWriter(io.Discard, store, testXorb, 0, 3)
+	_, err = w.Write(xorb[:offsets[1]+3])
+	require.NoError(t, err)
+	require.EqualError(t, w.Close(), "xorb "+testXorb+" ended before chunk 3 of the requested range")
+	_, _, ok, err = store.chunkFiles(testXorb, 0, 3)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Streams with more chunks than requested are aborted and not stored.
+	cacheStore, err = cache.New(t.TempDir())
+	require.NoError(t, err)
+	store = newXetStore(cacheStore)
+	w = newChunkWriter(io.Discard, store, testXorb, 0, 1)
+	_, err = w.Write(xorb)
+	require.EqualError(t, err, "xorb "+testXorb+" contains more chunks than the requested range")
+	require.Error(t, w.Close())
+	_, _, ok, err = store.chunkFiles(testXorb, 0, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Streams with an invalid chunk are aborted before the chunk is written and stored chunks are removed.
+	invalid := append([]byte{}, xorb...)
+	invalid[offsets[1]+4] = 7
+	out = &bytes.Buffer{}
+	w = newChunkWriter(out, store, testXorb, 0, 3)
+	_, err = w.Write(invalid)
+	require.EqualError(t, err, "chunk 1 of xorb "+testXorb+" is invalid: unsupported compression scheme 7")
+	require.Equal(t, xorb[:offsets[1]], out.Bytes())
+	_, _, ok, err = store.chunkFiles(testXorb, 0, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Chunks are not stored without a store.
+	w = newChunkWriter(io.Discard, nil, testXorb, 0, 3)
+	_, err = w.Write(xorb)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, _, ok, err = store.chunkFiles(testXorb, 0, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Cached chunks that are not valid are reported.
+	require.NoError(t, cacheStore.WriteFile(store.chunkName(testXorb, 0), xorb[:offsets[1]-1]))
+	_, _, ok, err = store.chunkFiles(testXorb, 0, 1)
+	require.Error(t, err)
+	require.False(t, ok)
+}
+
+func TestHFHandler_Xet(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	xorb, offsets := testChunks(3)
+	var xorbRequests atomic.Int64
+	cas := newTestCAS(t, xorb, offsets, &xorbRequests)
+	defer cas.Close()
+
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/models/org/model/xet-read-token/main":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"accessToken":"xet-token","exp":%d,"casUrl":%q}`, time.Now().Add(time.Hour).Unix(), cas.URL)
+		case "/org/model/resolve/main/model.safetensors":
+			w.Header().Set(HeaderRepoCommit, "0123456789abcdef0123456789abcdef01234567")
+			w.Header().Set(HeaderXetCasURL, cas.URL)
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/models/org/model/xet-read-token/main>; rel="xet-auth", <%s/v1/reconstructions/%s>; rel="xet-reconstruction-info"`, "http://"+r.Host, cas.URL, testFileHashA))
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer hub.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	client := NewHFClient(router, tmp, WithHFBaseURL(hub.URL), WithHFLogger(logr.Discard()))
+
+	// The CAS URL of the token points to this node.
+	status, b := getXet(t, client, "/huggingface/api/models/org/model/xet-read-token/main")
+	require.Equal(t, http.StatusOK, status)
+	token := map[string]any{}
+	require.NoError(t, json.Unmarshal(b, &token))
+	require.Equal(t, "xet-token", token["accessToken"])
+	casURL, err := url.Parse(token["casUrl"].(string))
+	require.NoError(t, err)
+	require.Equal(t, "example.com", casURL.Host)
+	require.True(t, strings.HasPrefix(casURL.Path, "/huggingface/_xet/cas/"))
+
+	// The Xet headers of the file metadata point to this node.
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodHead, "/huggingface/org/model/resolve/main/model.safetensors", nil)
+	client.HuggingFaceRegistryHandler(rw, req)
+	require.Equal(t, casURL.String(), rw.Header().Get(HeaderXetCasURL))
+	expectedLink := fmt.Sprintf(`<http://example.com/huggingface/api/models/org/model/xet-read-token/main>; rel="xet-auth", <%s/v1/reconstructions/%s>; rel="xet-reconstruction-info"`, casURL, testFileHashA)
+	require.Equal(t, expectedLink, rw.Header().Get("Link"))
+
+	// The fetch URLs of the reconstruction point to this node without exposing the upstream URL.
+	reconstructionURL := func(fileHash string) string {
+		return casURL.Path + "/v1/reconstructions/" + fileHash
+	}
+	status, b = getXet(t, client, reconstructionURL(testFileHashA))
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, string(b), "secret")
+	reconstruction := struct {
+		Terms     []map[string]any          `json:"terms"`
+		FetchInfo map[string][]xetFetchInfo `json:"fetch_info"`
+	}{}
+	require.NoError(t, json.Unmarshal(b, &reconstruction))
+	require.Len(t, reconstruction.Terms, 1)
+	require.Equal(t, testXorb, reconstruction.Terms[0]["hash"])
+	fetchURL, err := url.Parse(reconstruction.FetchInfo[testXorb][0].URL)
+	require.NoError(t, err)
+	require.Equal(t, "http://example.com/huggingface/_xet/xorbs/"+testXorb+"/0-2", fetchURL.Scheme+"://"+fetchURL.Host+fetchURL.Path)
+	require.NotEmpty(t, fetchURL.Query().Get("grant"))
+
+	// Chunks fetched from upstream are cached and the xorb is advertised.
+	status, b = getXet(t, client, "/huggingface/_xet/xorbs/"+testXorb+"/0-2")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, xorb[:offsets[2]], b)
+	require.Equal(t, int64(1), xorbRequests.Load())
+	require.Eventually(t, func() bool {
+		_, ok := router.Get(xorbKey(testXorb))
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	// Another revision of the file shares a chunk with the first revision.
+	status, _ = getXet(t, client, reconstructionURL(testFileHashB))
+	require.Equal(t, http.StatusOK, status)
+	status, b = getXet(t, client, "/huggingface/_xet/xorbs/"+testXorb+"/1-3")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, xorb[offsets[1]:], b)
+	require.Equal(t, int64(2), xorbRequests.Load())
+
+	// Reconstructions and all ranges of cached chunks are served when upstream cannot be reached.
+	cas.Close()
+	status, b = getXet(t, client, reconstructionURL(testFileHashA))
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, string(b), "/huggingface/_xet/xorbs/"+testXorb+"/0-2")
+	for _, chunkRange := range [][2]int{{0, 2}, {1, 3}, {0, 3}, {2, 3}} {
+		status, b = getXet(t, client, fmt.Sprintf("/huggingface/_xet/xorbs/%s/%d-%d", testXorb, chunkRange[0], chunkRange[1]))
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, xorb[offsets[chunkRange[0]]:offsets[chunkRange[1]]], b)
+	}
+	require.Equal(t, int64(2), xorbRequests.Load())
+
+	keys, err := client.WalkHFCacheDir(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{xorbKey(testXorb)}, keys)
+
+	// Xorbs with invalid cached chunks are removed and withdrawn.
+	require.NoError(t, client.store.WriteFile(client.xet.chunkName(testXorb, 1), []byte("invalid")))
+	status, _ = getXet(t, client, "/huggingface/_xet/xorbs/"+testXorb+"/0-2")
+	require.Equal(t, http.StatusBadGateway, status)
+	provided, err := router.Provided(t.Context())
+	require.NoError(t, err)
+	require.NotContains(t, provided, xorbKey(testXorb))
+	_, _, ok, err := client.xet.chunkFiles(testXorb, 0, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestHFHandler_XetPeer(t *testing.T) {
+	t.Parallel()
+
+	xorb, offsets := testChunks(3)
+
+	// The peer only serves chunks that it has cached, which are not cached again from the peer.
+	// Peers authenticated with the basic auth credentials are served without a grant.
+	peerDir := t.TempDir()
+	peerClient := NewHFClient(routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), peerDir, WithHFAccessPolicy(time.Minute), WithHFBasicAuth("user", "pass"))
+	for i := range 2 {
+		require.NoError(t, peerClient.store.WriteFile(peerClient.xet.chunkName(testXorb, uint64(i)), xorb[offsets[i]:offsets[i+1]]))
+	}
+	mux := httpx.NewServeMux(logr.Discard())
+	mux.Handle("GET /huggingface/", peerClient.HuggingFaceRegistryHandler)
+	peer := httptest.NewServer(mux)
+	defer peer.Close()
+
+	peerAddr := netip.MustParseAddrPort(peer.Listener.Addr().String())
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{xorbKey(testXorb): {peerAddr}}, netip.AddrPort{})
+	client := NewHFClient(router, t.TempDir(), WithHFBaseURL("http://invalid-upstream"), WithHFRetries(1), WithHFBasicAuth("user", "pass"))
+	status, b := getXet(t, client, "/huggingface/_xet/xorbs/"+testXorb+"/0-2")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, xorb[:offsets[2]], b)
+	_, _, ok, err := client.xet.chunkFiles(testXorb, 0, 2)
+	require.NoError(t, err)
+	require.False(t, ok)
+	peers, ok := router.Get(xorbKey(testXorb))
+	require.True(t, ok)
+	require.Equal(t, []netip.AddrPort{peerAddr}, peers)
+
+	status, _ = getXet(t, client, "/huggingface/_xet/xorbs/"+testXorb+"/0-3")
+	require.Equal(t, http.StatusNotFound, status)
+	req := httptest.NewRequest(http.MethodGet, "/huggingface/_xet/xorbs/"+testXorb+"/0-3", nil)
+	req.Header.Set(headerMirrored, "true")
+	req.SetBasicAuth("user", "pass")
+	rw := newTestResponseWriter()
+	peerClient.HuggingFaceRegistryHandler(rw, req)
+	require.Equal(t, http.StatusNotFound, rw.Code)
+
+	status, _ = getXet(t, client, "/huggingface/_xet/xorbs/"+testXorb+"/2-1")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestHFHandler_XetAccess(t *testing.T) {
+	t.Parallel()
+
+	xorb, offsets := testChunks(3)
+	var xorbRequests atomic.Int64
+	cas := newTestCAS(t, xorb, offsets, &xorbRequests)
+	defer cas.Close()
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/models/org/model/xet-read-token/main" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"accessToken":"xet-token","exp":%d,"casUrl":%q}`, time.Now().Add(time.Hour).Unix(), cas.URL)
+	}))
+	defer hub.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	client := NewHFClient(router, t.TempDir(), WithHFBaseURL(hub.URL), WithHFAccessPolicy(time.Minute), WithHFBasicAuth("user", "pass"))
+	getMirrored := func(u, authorization string, mirrored bool) (int, []byte) {
+		rw := newTestResponseWriter()
+		req := httptest.NewRequest(http.MethodGet, u, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if mirrored {
+			req.Header.Set(headerMirrored, "true")
+		}
+		client.HuggingFaceRegistryHandler(rw, req)
+		resp := rw.Result()
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, b
+	}
+	get := func(u, authorization string) (int, []byte) {
+		return getMirrored(u, authorization, false)
+	}
+
+	status, b := get("/huggingface/api/models/org/model/xet-read-token/main", "")
+	require.Equal(t, http.StatusOK, status)
+	token := map[string]any{}
+	require.NoError(t, json.Unmarshal(b, &token))
+	casURL, err := url.Parse(token["casUrl"].(string))
+	require.NoError(t, err)
+	reconstructionURL := casURL.Path + "/v1/reconstructions/" + testFileHashA
+	status, b = get(reconstructionURL, "Bearer xet-token")
+	require.Equal(t, http.StatusOK, status)
+	reconstruction := struct {
+		FetchInfo map[string][]xetFetchInfo `json:"fetch_info"`
+	}{}
+	require.NoError(t, json.Unmarshal(b, &reconstruction))
+	fetchURL, err := url.Parse(reconstruction.FetchInfo[testXorb][0].URL)
+	require.NoError(t, err)
+
+	// Chunk ranges are only served with the grant of the fetch URL.
+	status, _ = get(fetchURL.Path, "")
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = get(fetchURL.Path+"?grant=invalid", "")
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = get("/huggingface/_xet/xorbs/"+testXorb+"/1-3?"+fetchURL.RawQuery, "")
+	require.Equal(t, http.StatusForbidden, status)
+	status, b = get(fetchURL.Path+"?"+fetchURL.RawQuery, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, xorb[:offsets[2]], b)
+
+	// Cached chunk ranges are only served without a grant to peers with the basic auth credentials.
+	status, _ = getMirrored(fetchURL.Path, "", true)
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = getMirrored(fetchURL.Path, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:wrong")), true)
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = get(fetchURL.Path, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	require.Equal(t, http.StatusForbidden, status)
+	status, b = getMirrored(fetchURL.Path, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")), true)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, xorb[:offsets[2]], b)
+
+	// Cached reconstructions are only served to tokens that were granted access to a repository of the file.
+	cas.Close()
+	status, _ = get(reconstructionURL, "")
+	require.Equal(t, http.StatusBadGateway, status)
+	status, _ = get(reconstructionURL, "Bearer other-token")
+	require.Equal(t, http.StatusBadGateway, status)
+	status, b = get(reconstructionURL, "Bearer xet-token")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, string(b), "/huggingface/_xet/xorbs/"+testXorb+"/0-2?grant=")
+}
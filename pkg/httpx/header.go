@@ -13,6 +13,8 @@ const (
 	HeaderAuthorization   = "Authorization"
 	HeaderWWWAuthenticate = "WWW-Authenticate"
 	HeaderXForwardedFor   = "X-Forwarded-For"
+	HeaderLocation        = "Location"
+	HeaderLink            = "Link"
 )
 
 const (
@@ -20,6 +22,7 @@ const (
 	ContentTypeHTML   = "text/html"
 	ContentTypeBinary = "application/octet-stream"
 	ContentTypeJSON   = "application/json"
+	ContentTypeNDJSON = "application/x-ndjson"
 	ContentTypeXML    = "application/xml"
 )
 
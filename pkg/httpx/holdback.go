@@ -0,0 +1,64 @@
+package httpx
+
+import (
+	"io"
+)
+
+// HoldbackWriter holds back the last byte written until the content has been verified. A client that receives the
+// content length detects the response as truncated when the content fails verification, instead of receiving a
+// complete response with corrupt content.
+type HoldbackWriter struct {
+	dst     io.Writer
+	held    []byte
+	written int64
+}
+
+func NewHoldbackWriter(dst io.Writer) *HoldbackWriter {
+	return &HoldbackWriter{
+		dst: dst,
+	}
+}
+
+func (w *HoldbackWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(w.held) > 0 {
+		if _, err := w.dst.Write(w.held); err != nil {
+			return 0, err
+		}
+		w.written += int64(len(w.held))
+		w.held = w.held[:0]
+	}
+	n, err := w.dst.Write(p[:len(p)-1])
+	w.written += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	w.held = append(w.held, p[len(p)-1])
+	return len(p), nil
+}
+
+// Written returns the amount of bytes written to the destination, which does not include the held back byte.
+func (w *HoldbackWriter) Written() int64 {
+	return w.written
+}
+
+// Discard drops the held back byte so that it can be written again from other content.
+func (w *HoldbackWriter) Discard() {
+	w.held = w.held[:0]
+}
+
+// Release writes the held back byte once the content has been verified.
+func (w *HoldbackWriter) Release() error {
+	if len(w.held) == 0 {
+		return nil
+	}
+	n, err := w.dst.Write(w.held)
+	w.written += int64(n)
+	if err != nil {
+		return err
+	}
+	w.held = w.held[:0]
+	return nil
+}
@@ -0,0 +1,32 @@
+package httpx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoldbackWriter(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	w := NewHoldbackWriter(buf)
+	for _, p := range []string{"foo", "", "b", "ar"} {
+		n, err := w.Write([]byte(p))
+		require.NoError(t, err)
+		require.Equal(t, len(p), n)
+	}
+	require.Equal(t, "fooba", buf.String())
+	require.Equal(t, int64(5), w.Written())
+
+	w.Discard()
+	_, err := w.Write([]byte("z"))
+	require.NoError(t, err)
+	require.Equal(t, "fooba", buf.String())
+	require.NoError(t, w.Release())
+	require.Equal(t, "foobaz", buf.String())
+	require.Equal(t, int64(6), w.Written())
+	require.NoError(t, w.Release())
+	require.Equal(t, "foobaz", buf.String())
+}
@@ -26,12 +26,48 @@ var (
 		Help:      "The timestamp of the last successful mirror request.",
 	})
 
+	MirrorDigestMismatchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mirror_digest_mismatch_total",
+		Help:      "Total number of mirrored blobs where the content from peers did not match the digest.",
+	}, []string{"registry"})
+
+	MirrorSwarmPeerBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mirror_swarm_peer_bytes_total",
+		Help:      "Total number of bytes fetched from a peer when swarming blobs.",
+	}, []string{"peer"})
+
+	MirrorSwarmPeerThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mirror_swarm_peer_throughput_bytes_per_second",
+		Help:      "The throughput of the last range fetched from a peer when swarming blobs.",
+	}, []string{"peer"})
+
+	PipHashMismatchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pip_hash_mismatch_total",
+		Help:      "Total number of pip artifacts discarded because their content did not match the hash from the index.",
+	}, []string{"source"})
+
 	ResolveDurHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: namespace,
 		Name:      "resolve_duration_seconds",
 		Help:      "The duration for router to resolve a peer.",
 	}, []string{"router"})
 
+	UpstreamLeasesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_leases_total",
+		Help:      "Total number of upstream fetch leases by how the request was resolved.",
+	}, []string{"result"})
+
+	RelayTransfersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_transfers_total",
+		Help:      "Total number of transfers relayed to peers while being downloaded by result.",
+	}, []string{"result"})
+
 	AdvertisedImageTags = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "advertised_image_tags",
@@ -61,16 +97,43 @@ var (
 		Name:      "advertised_hf_models",
 		Help:      "Number of Hugging Face models advertised to be available.",
 	}, []string{"source"})
+
+	ReconcileDriftKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_drift_keys",
+		Help:      "Number of keys that were missing from or extra to the advertised keys at the last reconciliation.",
+	}, []string{"direction"})
+
+	ReconcileDriftKeysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_drift_keys_total",
+		Help:      "Total number of keys that were advertised or withdrawn by reconciliation.",
+	}, []string{"direction"})
+
+	ReconcileLastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_last_success_timestamp_seconds",
+		Help:      "The timestamp of the last successful reconciliation.",
+	})
 )
 
 func Register() {
 	DefaultRegisterer.MustRegister(MirrorRequestsTotal)
 	DefaultRegisterer.MustRegister(MirrorLastSuccessTimestamp)
+	DefaultRegisterer.MustRegister(MirrorDigestMismatchTotal)
+	DefaultRegisterer.MustRegister(MirrorSwarmPeerBytesTotal)
+	DefaultRegisterer.MustRegister(MirrorSwarmPeerThroughput)
+	DefaultRegisterer.MustRegister(PipHashMismatchTotal)
 	DefaultRegisterer.MustRegister(ResolveDurHistogram)
+	DefaultRegisterer.MustRegister(UpstreamLeasesTotal)
+	DefaultRegisterer.MustRegister(RelayTransfersTotal)
 	DefaultRegisterer.MustRegister(AdvertisedImageTags)
 	DefaultRegisterer.MustRegister(AdvertisedImageDigests)
 	DefaultRegisterer.MustRegister(AdvertisedContentDigests)
 	DefaultRegisterer.MustRegister(AdvertisedPipPackage)
 	DefaultRegisterer.MustRegister(AdvertisedHFModel)
+	DefaultRegisterer.MustRegister(ReconcileDriftKeys)
+	DefaultRegisterer.MustRegister(ReconcileDriftKeysTotal)
+	DefaultRegisterer.MustRegister(ReconcileLastSuccessTimestamp)
 	httpx.RegisterMetrics(DefaultRegisterer)
 }
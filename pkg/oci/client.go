@@ -1,6 +1,7 @@
 package oci
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/platforms"
+	"github.com/go-logr/logr"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
@@ -30,6 +32,9 @@ const (
 	HeaderNamespace    = "OCI-Namespace"
 )
 
+// pullLeaseExpiration bounds how long the content of a pull is protected from garbage collection when the lease is not released.
+const pullLeaseExpiration = 24 * time.Hour
+
 type ClientConfig struct {
 	TLSClientConfig *tls.Config
 }
@@ -83,6 +88,8 @@ type CommonConfig struct {
 }
 
 type PullConfig struct {
+	Store    WritableStore
+	Progress func(PullMetric)
 	CommonConfig
 	Platform ocispec.Platform
 }
@@ -118,6 +125,22 @@ func WithPullPlatform(platform ocispec.Platform) PullOption {
 	}
 }
 
+// WithPullStore persists the pulled content in the store.
+func WithPullStore(store WritableStore) PullOption {
+	return func(cfg *PullConfig) error {
+		cfg.Store = store
+		return nil
+	}
+}
+
+// WithPullProgress calls the function with the metric for each piece of content once it has been pulled.
+func WithPullProgress(progress func(PullMetric)) PullOption {
+	return func(cfg *PullConfig) error {
+		cfg.Progress = progress
+		return nil
+	}
+}
+
 type FetchConfig struct {
 	Range *httpx.Range
 	CommonConfig
@@ -177,6 +200,27 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 		return nil
 	}
 
+	// The pulled content is leased until the image has been created, as content is only protected from garbage
+	// collection by the image that references it.
+	if cfg.Store != nil {
+		var release func(context.Context) error
+		ctx, release, err = cfg.Store.Lease(ctx, pullLeaseExpiration)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			err := release(context.WithoutCancel(ctx))
+			if err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "could not release pull lease", "image", img.String())
+			}
+		}()
+	}
+
+	// Content is labelled without creating the image, which is only created once all of its content is stored so that
+	// an interrupted pull does not leave behind an image with missing content.
+	contentImg := img
+	contentImg.Digest = ""
+	var imgDesc ocispec.Descriptor
 	pullMetrics := []PullMetric{}
 	queue := []DistributionPath{
 		img.DistributionPath(),
@@ -187,6 +231,21 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 
 		start := time.Now()
 		desc, err := func() (ocispec.Descriptor, error) {
+			// Blobs that already exist in the store do not have to be fetched again.
+			if cfg.Store != nil && dist.Kind == DistributionKindBlob {
+				desc, err := cfg.Store.Descriptor(ctx, dist.Digest)
+				if err == nil {
+					err = cfg.Store.Label(ctx, contentImg, desc)
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
+					return desc, nil
+				}
+				if !errors.Is(err, ErrNotFound) {
+					return ocispec.Descriptor{}, err
+				}
+			}
+
 			rc, desc, err := c.Get(ctx, dist, fetchOpt)
 			if err != nil {
 				return ocispec.Descriptor{}, err
@@ -195,10 +254,22 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 
 			switch dist.Kind {
 			case DistributionKindBlob:
-				// Right now we are just discarding the contents because we do not have a writable store.
-				_, copyErr := io.Copy(io.Discard, rc)
-				closeErr := rc.Close()
-				err := errors.Join(copyErr, closeErr)
+				if cfg.Store == nil {
+					_, copyErr := io.Copy(io.Discard, rc)
+					closeErr := rc.Close()
+					err := errors.Join(copyErr, closeErr)
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
+					break
+				}
+				// Content is verified against the requested digest instead of the digest header in the response.
+				desc.Digest = dist.Digest
+				err := cfg.Store.Ingest(ctx, desc, rc)
+				if err != nil {
+					return ocispec.Descriptor{}, err
+				}
+				err = cfg.Store.Label(ctx, contentImg, desc)
 				if err != nil {
 					return ocispec.Descriptor{}, err
 				}
@@ -209,6 +280,34 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 				if err != nil {
 					return ocispec.Descriptor{}, err
 				}
+				// Registries may respond with a generic content type so the manifest type is determined from the content.
+				if !IsManifestsMediatype(desc.MediaType) {
+					mt, err := FingerprintMediaType(bytes.NewReader(b))
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
+					if !IsManifestsMediatype(mt) {
+						return ocispec.Descriptor{}, fmt.Errorf("content %s with media type %s is not a manifest", desc.Digest, mt)
+					}
+					desc.MediaType = mt
+				}
+				// The first manifest resolves the digest of tagged images.
+				if img.Digest == "" {
+					img.Digest = desc.Digest
+				}
+				if desc.Digest == img.Digest {
+					imgDesc = desc
+				}
+				if cfg.Store != nil {
+					err := cfg.Store.Ingest(ctx, desc, bytes.NewReader(b))
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
+					err = cfg.Store.Label(ctx, contentImg, desc)
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
+				}
 				switch desc.MediaType {
 				case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
 					var idx ocispec.Index
@@ -216,7 +315,8 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 						return ocispec.Descriptor{}, err
 					}
 					for _, m := range idx.Manifests {
-						if !platforms.Only(cfg.Platform).Match(*m.Platform) {
+						// Artifacts in an index are not required to have a platform.
+						if m.Platform != nil && !platforms.Only(cfg.Platform).Match(*m.Platform) {
 							continue
 						}
 						queue = append(queue, DistributionPath{
@@ -228,27 +328,19 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 							},
 						})
 					}
-				case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
-					var manifest ocispec.Manifest
-					err := json.Unmarshal(b, &manifest)
+				default:
+					// Image and artifact manifests reference a config, layers or blobs of any media type.
+					children, err := ManifestChildren(b)
 					if err != nil {
 						return ocispec.Descriptor{}, err
 					}
-					queue = append(queue, DistributionPath{
-						Kind: DistributionKindBlob,
-						Reference: Reference{
-							Registry:   dist.Registry,
-							Repository: dist.Repository,
-							Digest:     manifest.Config.Digest,
-						},
-					})
-					for _, layer := range manifest.Layers {
+					for _, child := range children {
 						queue = append(queue, DistributionPath{
 							Kind: DistributionKindBlob,
 							Reference: Reference{
 								Registry:   dist.Registry,
 								Repository: dist.Repository,
-								Digest:     layer.Digest,
+								Digest:     child.Digest,
 							},
 						})
 					}
@@ -267,6 +359,15 @@ func (c *Client) Pull(ctx context.Context, img Image, opts ...PullOption) ([]Pul
 			ContentLength: desc.Size,
 		}
 		pullMetrics = append(pullMetrics, metric)
+		if cfg.Progress != nil {
+			cfg.Progress(metric)
+		}
+	}
+	if cfg.Store != nil && imgDesc.Digest != "" {
+		err := cfg.Store.Label(ctx, img, imgDesc)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return pullMetrics, nil
@@ -305,7 +406,61 @@ func (c *Client) Fetch(ctx context.Context, method string, dist DistributionPath
 
 	tcKey := dist.Registry + dist.Repository
 
-	u := dist.URL()
+	reqHeader := http.Header{}
+	reqHeader.Add(httpx.HeaderAccept, ocispec.MediaTypeImageManifest)
+	reqHeader.Add(httpx.HeaderAccept, images.MediaTypeDockerSchema2Manifest)
+	reqHeader.Add(httpx.HeaderAccept, ocispec.MediaTypeImageIndex)
+	reqHeader.Add(httpx.HeaderAccept, images.MediaTypeDockerSchema2ManifestList)
+	reqHeader.Add(httpx.HeaderAccept, MediaTypeArtifactManifest)
+	if cfg.Range != nil {
+		reqHeader.Add(httpx.HeaderRange, cfg.Range.String())
+	}
+	resp, err := c.do(ctx, method, dist.URL(), tcKey, cfg.CommonConfig, reqHeader)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	err = httpx.CheckResponseStatus(resp, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		httpx.DrainAndClose(resp.Body)
+		return nil, ocispec.Descriptor{}, err
+	}
+
+	// Handle optional headers for blobs.
+	header := resp.Header.Clone()
+	if dist.Kind == DistributionKindBlob {
+		if header.Get(httpx.HeaderContentType) == "" {
+			header.Set(httpx.HeaderContentType, httpx.ContentTypeBinary)
+		}
+		if header.Get(HeaderDockerDigest) == "" {
+			header.Set(HeaderDockerDigest, dist.Digest.String())
+		}
+	}
+	// Referrers are generated by the registry and are not required to have a digest header.
+	if dist.Kind == DistributionKindReferrers && method == http.MethodGet && header.Get(HeaderDockerDigest) == "" {
+		b, err := io.ReadAll(io.LimitReader(resp.Body, ManifestMaxSize))
+		httpx.DrainAndClose(resp.Body)
+		if err != nil {
+			return nil, ocispec.Descriptor{}, err
+		}
+		header.Set(HeaderDockerDigest, digest.FromBytes(b).String())
+		header.Set(httpx.HeaderContentLength, strconv.Itoa(len(b)))
+		desc, err := DescriptorFromHeader(header)
+		if err != nil {
+			return nil, ocispec.Descriptor{}, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), desc, nil
+	}
+
+	desc, err := DescriptorFromHeader(header)
+	if err != nil {
+		httpx.DrainAndClose(resp.Body)
+		return nil, ocispec.Descriptor{}, err
+	}
+	return resp.Body, desc, nil
+}
+
+// do performs the request against the mirror when set and retries it once with a bearer token when the registry requires authentication.
+func (c *Client) do(ctx context.Context, method string, u *url.URL, tcKey string, cfg CommonConfig, header http.Header) (*http.Response, error) {
 	if cfg.Mirror != nil {
 		u.Scheme = cfg.Mirror.Scheme
 		u.Host = cfg.Mirror.Host
@@ -318,18 +473,12 @@ func (c *Client) Fetch(ctx context.Context, method string, dist DistributionPath
 	for range 2 {
 		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 		if err != nil {
-			return nil, ocispec.Descriptor{}, err
+			return nil, err
 		}
 		httpx.CopyHeader(req.Header, cfg.Header)
+		httpx.CopyHeader(req.Header, header)
 		req.SetBasicAuth(cfg.Username, cfg.Password)
 		req.Header.Set(httpx.HeaderUserAgent, "spegel")
-		req.Header.Add(httpx.HeaderAccept, ocispec.MediaTypeImageManifest)
-		req.Header.Add(httpx.HeaderAccept, images.MediaTypeDockerSchema2Manifest)
-		req.Header.Add(httpx.HeaderAccept, ocispec.MediaTypeImageIndex)
-		req.Header.Add(httpx.HeaderAccept, images.MediaTypeDockerSchema2ManifestList)
-		if cfg.Range != nil {
-			req.Header.Add(httpx.HeaderRange, cfg.Range.String())
-		}
 		token, ok := c.tokenCache.Load(tcKey)
 		if ok {
 			//nolint: errcheck // We know it will be a string.
@@ -337,43 +486,22 @@ func (c *Client) Fetch(ctx context.Context, method string, dist DistributionPath
 		}
 		resp, err := c.httpClient.Do(req)
 		if err != nil {
-			return nil, ocispec.Descriptor{}, err
+			return nil, err
 		}
 		if resp.StatusCode == http.StatusUnauthorized {
+			httpx.DrainAndClose(resp.Body)
 			c.tokenCache.Delete(tcKey)
 			wwwAuth := resp.Header.Get(httpx.HeaderWWWAuthenticate)
 			token, err = getBearerToken(ctx, wwwAuth, c.httpClient)
 			if err != nil {
-				return nil, ocispec.Descriptor{}, err
+				return nil, err
 			}
 			c.tokenCache.Store(tcKey, token)
 			continue
 		}
-		err = httpx.CheckResponseStatus(resp, http.StatusOK, http.StatusPartialContent)
-		if err != nil {
-			httpx.DrainAndClose(resp.Body)
-			return nil, ocispec.Descriptor{}, err
-		}
-
-		// Handle optional headers for blobs.
-		header := resp.Header.Clone()
-		if dist.Kind == DistributionKindBlob {
-			if header.Get(httpx.HeaderContentType) == "" {
-				header.Set(httpx.HeaderContentType, httpx.ContentTypeBinary)
-			}
-			if header.Get(HeaderDockerDigest) == "" {
-				header.Set(HeaderDockerDigest, dist.Digest.String())
-			}
-		}
-
-		desc, err := DescriptorFromHeader(header)
-		if err != nil {
-			httpx.DrainAndClose(resp.Body)
-			return nil, ocispec.Descriptor{}, err
-		}
-		return resp.Body, desc, nil
+		return resp, nil
 	}
-	return nil, ocispec.Descriptor{}, errors.New("could not perform request")
+	return nil, errors.New("could not perform request")
 }
 
 func getBearerToken(ctx context.Context, wwwAuth string, client *http.Client) (string, error) {
@@ -1,14 +1,20 @@
 package oci
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry/ocimem"
 	"cuelabs.dev/go/oci/ociregistry/ociserver"
@@ -89,6 +95,46 @@ func TestClient(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, pullResults, 3)
 
+	store := NewMemory()
+	pullResults, err = ociClient.Pull(t.Context(), img, WithPullMirror(mirror), WithPullStore(store))
+	require.NoError(t, err)
+	require.Len(t, pullResults, 3)
+	imgs, err := store.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	require.Equal(t, "docker.io/test/image:latest@"+manifests[0].Digest.String(), imgs[0].String())
+	contents, err := store.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Len(t, contents, 3)
+	for _, refs := range contents {
+		require.Equal(t, []Reference{{Registry: img.Registry, Repository: img.Repository, Digest: refs[0].Digest}}, refs)
+	}
+	for _, blob := range blobs {
+		desc, err := store.Descriptor(t.Context(), blob.Digest)
+		require.NoError(t, err)
+		require.Equal(t, blob.Size, desc.Size)
+	}
+	pullResults, err = ociClient.Pull(t.Context(), img, WithPullMirror(mirror), WithPullStore(store))
+	require.NoError(t, err)
+	require.Len(t, pullResults, 3)
+
+	// The content is leased until the image has been created.
+	leasedStore := &leaseRecordingStore{Memory: NewMemory()}
+	_, err = ociClient.Pull(t.Context(), img, WithPullMirror(mirror), WithPullStore(leasedStore))
+	require.NoError(t, err)
+	require.True(t, leasedStore.released)
+	require.Equal(t, 1, leasedStore.imagesAtRelease)
+
+	// The image is not created when the pull is interrupted.
+	err = mem.DeleteBlob(t.Context(), img.Repository, blobs[1].Digest)
+	require.NoError(t, err)
+	incompleteStore := NewMemory()
+	_, err = ociClient.Pull(t.Context(), img, WithPullMirror(mirror), WithPullStore(incompleteStore))
+	require.Error(t, err)
+	imgs, err = incompleteStore.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, imgs)
+
 	ref := Reference{
 		Registry:   img.Registry,
 		Repository: img.Repository,
@@ -102,6 +148,70 @@ func TestClient(t *testing.T) {
 	require.Equal(t, httpx.ContentTypeBinary, desc.MediaType)
 }
 
+func TestClientPullArtifact(t *testing.T) {
+	t.Parallel()
+
+	img, err := ParseImage("example.com/charts/app:0.1.0", AllowTagOnly())
+	require.NoError(t, err)
+
+	mem := ocimem.New()
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		t.Helper()
+
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		_, err := mem.PushBlob(t.Context(), img.Repository, desc, bytes.NewReader(b))
+		require.NoError(t, err)
+		return desc
+	}
+	marshal := func(v any) []byte {
+		t.Helper()
+
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return b
+	}
+	configDesc := push("application/vnd.cncf.helm.config.v1+json", []byte(`{"name":"app","version":"0.1.0","apiVersion":"v2"}`))
+	chartDesc := push("application/vnd.cncf.helm.chart.content.v1.tar+gzip", []byte("chart"))
+	chart := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{chartDesc}}
+	chart.SchemaVersion = 2
+	chartB := marshal(chart)
+	chartManifestDesc, err := mem.PushManifest(t.Context(), img.Repository, "", chartB, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	emptyDesc := push(ocispec.MediaTypeEmptyJSON, []byte("{}"))
+	wasmDesc := push("application/wasm", []byte("wasm"))
+	wasm := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: "application/vnd.wasm.module.v1", Config: emptyDesc, Layers: []ocispec.Descriptor{wasmDesc}}
+	wasm.SchemaVersion = 2
+	wasmManifestDesc, err := mem.PushManifest(t.Context(), img.Repository, "", marshal(wasm), ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	// Artifacts in the index do not have a platform.
+	idx := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{chartManifestDesc, wasmManifestDesc}}
+	idx.SchemaVersion = 2
+	_, err = mem.PushManifest(t.Context(), img.Repository, img.Tag, marshal(idx), ocispec.MediaTypeImageIndex)
+	require.NoError(t, err)
+	srv := httptest.NewServer(ociserver.New(mem, nil))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	ociClient, err := NewClient()
+	require.NoError(t, err)
+	mirror, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	store := NewMemory()
+	pullResults, err := ociClient.Pull(t.Context(), img, WithPullMirror(mirror), WithPullStore(store))
+	require.NoError(t, err)
+	require.Len(t, pullResults, 7)
+	for _, desc := range []ocispec.Descriptor{chartManifestDesc, wasmManifestDesc} {
+		storeDesc, err := store.Descriptor(t.Context(), desc.Digest)
+		require.NoError(t, err)
+		require.Equal(t, ocispec.MediaTypeImageManifest, storeDesc.MediaType)
+	}
+	for _, desc := range []ocispec.Descriptor{configDesc, chartDesc, emptyDesc, wasmDesc} {
+		_, err := store.Descriptor(t.Context(), desc.Digest)
+		require.NoError(t, err)
+	}
+}
+
 func TestDescriptorHeader(t *testing.T) {
 	t.Parallel()
 
@@ -206,3 +316,39 @@ func TestDescriptorHeader(t *testing.T) {
 		})
 	}
 }
+
+type leaseKey struct{}
+
+// leaseRecordingStore fails writes of content that is not leased and records the images that exist when the lease is released.
+type leaseRecordingStore struct {
+	*Memory
+	released        bool
+	imagesAtRelease int
+}
+
+func (s *leaseRecordingStore) Lease(ctx context.Context, expiration time.Duration) (context.Context, func(context.Context) error, error) {
+	release := func(ctx context.Context) error {
+		imgs, err := s.ListImages(ctx)
+		if err != nil {
+			return err
+		}
+		s.released = true
+		s.imagesAtRelease = len(imgs)
+		return nil
+	}
+	return context.WithValue(ctx, leaseKey{}, true), release, nil
+}
+
+func (s *leaseRecordingStore) Ingest(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	if ctx.Value(leaseKey{}) == nil {
+		return errors.New("content ingested without lease")
+	}
+	return s.Memory.Ingest(ctx, desc, r)
+}
+
+func (s *leaseRecordingStore) Label(ctx context.Context, img Image, desc ocispec.Descriptor) error {
+	if ctx.Value(leaseKey{}) == nil {
+		return errors.New("content labeled without lease")
+	}
+	return s.Memory.Label(ctx, img, desc)
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/leases"
 	"github.com/containerd/containerd/v2/pkg/labels"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/typeurl/v2"
@@ -85,7 +86,7 @@ func WithContentPath(path string) ContainerdOption {
 	}
 }
 
-var _ Store = &Containerd{}
+var _ WritableStore = &Containerd{}
 
 type Containerd struct {
 	client       *client.Client
@@ -193,6 +194,9 @@ func (c *Containerd) ListContent(ctx context.Context) ([][]Reference, error) {
 
 func (c *Containerd) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
 	cImg, err := c.client.ImageService().Get(ctx, ref)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return "", errors.Join(ErrNotFound, err)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -219,7 +223,7 @@ func (c *Containerd) Descriptor(ctx context.Context, dgst digest.Digest) (ocispe
 				return "", err
 			}
 			defer rc.Close()
-			mt, err := FingerprintMediaType(rc)
+			mt, err := DetectMediaType(rc)
 			if err != nil {
 				return "", err
 			}
@@ -267,12 +271,118 @@ func (c *Containerd) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekC
 	}, nil
 }
 
+func (c *Containerd) Ingest(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	ref := "clyde-" + desc.Digest.String()
+	err := content.WriteBlob(ctx, c.client.ContentStore(), ref, r, desc)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Containerd) Lease(ctx context.Context, expiration time.Duration) (context.Context, func(context.Context) error, error) {
+	return c.client.WithLease(ctx, leases.WithRandomID(), leases.WithExpiration(expiration))
+}
+
+func (c *Containerd) Label(ctx context.Context, img Image, desc ocispec.Descriptor) error {
+	cs := c.client.ContentStore()
+	existing, err := cs.Info(ctx, desc.Digest)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return errors.Join(ErrNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	// Content that already existed before the lease is protected until it is referenced by the image.
+	if id, ok := leases.FromContext(ctx); ok {
+		err := c.client.LeasesService().AddResource(ctx, leases.Lease{ID: id}, leases.Resource{ID: desc.Digest.String(), Type: "content"})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Distribution source labels contain a comma separated list of repositories.
+	sourceKey := labels.LabelDistributionSource + "." + img.Registry
+	repos := []string{}
+	if v := existing.Labels[sourceKey]; v != "" {
+		repos = strings.Split(v, ",")
+	}
+	if !slices.Contains(repos, img.Repository) {
+		repos = append(repos, img.Repository)
+	}
+	info := content.Info{
+		Digest: desc.Digest,
+		Labels: map[string]string{
+			sourceKey: strings.Join(repos, ","),
+		},
+	}
+	fields := []string{"labels." + sourceKey}
+
+	// Manifests reference their children so that they are not garbage collected.
+	if IsManifestsMediatype(desc.MediaType) {
+		children, err := c.children(ctx, desc)
+		if err != nil {
+			return err
+		}
+		keys := map[string]int{}
+		for _, child := range children {
+			for _, key := range images.ChildGCLabels(child) {
+				idx := keys[key]
+				keys[key] = idx + 1
+				if strings.HasSuffix(key, ".sha256.") {
+					key = fmt.Sprintf("%s%s", key, child.Digest.Encoded()[:12])
+				} else if idx > 0 || key[len(key)-1] == '.' {
+					key = fmt.Sprintf("%s%d", key, idx)
+				}
+				info.Labels[key] = child.Digest.String()
+				fields = append(fields, "labels."+key)
+			}
+		}
+	}
+	_, err = cs.Update(ctx, info, fields...)
+	if err != nil {
+		return err
+	}
+
+	if desc.Digest != img.Digest {
+		return nil
+	}
+	name, ok := img.TagName()
+	if !ok {
+		name = img.String()
+	}
+	cImg := images.Image{
+		Name:   name,
+		Target: desc,
+	}
+	_, err = c.client.ImageService().Create(ctx, cImg)
+	if errors.Is(err, errdefs.ErrAlreadyExists) {
+		_, err = c.client.ImageService().Update(ctx, cImg, "target")
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// children returns the children of the content, including the blobs of artifact manifests which containerd does not know of.
+func (c *Containerd) children(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	if desc.MediaType != MediaTypeArtifactManifest {
+		return images.Children(ctx, c.client.ContentStore(), desc)
+	}
+	b, err := content.ReadBlob(ctx, c.client.ContentStore(), desc)
+	if err != nil {
+		return nil, err
+	}
+	return ManifestChildren(b)
+}
+
 func (c *Containerd) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
 	log := logr.FromContextOrDiscard(ctx)
 
 	eventCh := make(chan OCIEvent)
 	subCtx, subCancel := context.WithCancel(ctx)
-	eventFilters := []string{`topic~="/images/create|/images/delete",event.name~="^.+/"`, `topic~="/content/create"`}
+	eventFilters := []string{`topic~="/images/create|/images/update|/images/delete",event.name~="^.+/"`, `topic~="/content/create"`}
 	envelopeCh, cErrCh := c.client.EventService().Subscribe(subCtx, eventFilters...)
 
 	// Populate the content index.
@@ -290,7 +400,7 @@ func (c *Containerd) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
 		}
 		refs := []Reference{}
 		handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-			children, err := images.ChildrenHandler(c.client.ContentStore()).Handle(ctx, desc)
+			children, err := c.children(ctx, desc)
 			if errors.Is(err, errdefs.ErrNotFound) {
 				return nil, nil
 			}
@@ -380,48 +490,10 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 		}
 		return events, nil
 	case *eventtypes.ImageCreate:
-		img, err := ParseImage(e.GetName(), AllowTagOnly())
-		if err != nil {
-			return nil, err
-		}
-		// Just advertise the image if it is a tag reference.
-		if img.Digest == "" {
-			return []OCIEvent{{Type: CreateEvent, Reference: img.Reference}}, nil
-		}
-		// Walk the image to index its content.
-		cImg, err := c.client.ImageService().Get(ctx, img.String())
-		if err != nil {
-			return nil, err
-		}
-		refs := []Reference{}
-		events := []OCIEvent{}
-		handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-			children, err := images.ChildrenHandler(c.client.ContentStore()).Handle(ctx, desc)
-			if errors.Is(err, errdefs.ErrNotFound) {
-				return nil, nil
-			}
-			if err != nil {
-				return nil, err
-			}
-			ref := Reference{
-				Registry:   img.Registry,
-				Repository: img.Repository,
-				Digest:     desc.Digest,
-			}
-			refs = append(refs, ref)
-			events = append(events, OCIEvent{Type: CreateEvent, Reference: ref})
-			return children, nil
-		})
-		err = images.Walk(ctx, handler, cImg.Target)
-		if err != nil {
-			return nil, err
-		}
-		contentIdx[img.Digest] = refs
-		// No need to advertise content if we receive content events.
-		if c.features.Has(FeatureContentEvent) {
-			return nil, nil
-		}
-		return events, nil
+		return c.handleImageCreate(ctx, e.GetName(), contentIdx)
+	case *eventtypes.ImageUpdate:
+		// Tags that are moved to another digest, for example by a prefetch or push, are advertised again.
+		return c.handleImageCreate(ctx, e.GetName(), contentIdx)
 	case *eventtypes.ImageDelete:
 		img, err := ParseImage(e.GetName(), AllowTagOnly())
 		if err != nil {
@@ -475,6 +547,52 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 	}
 }
 
+// handleImageCreate returns the events for an image that is created, walking the content of images referenced by digest.
+func (c *Containerd) handleImageCreate(ctx context.Context, name string, contentIdx map[digest.Digest][]Reference) ([]OCIEvent, error) {
+	img, err := ParseImage(name, AllowTagOnly())
+	if err != nil {
+		return nil, err
+	}
+	// Just advertise the image if it is a tag reference.
+	if img.Digest == "" {
+		return []OCIEvent{{Type: CreateEvent, Reference: img.Reference}}, nil
+	}
+	// Walk the image to index its content.
+	cImg, err := c.client.ImageService().Get(ctx, img.String())
+	if err != nil {
+		return nil, err
+	}
+	refs := []Reference{}
+	events := []OCIEvent{}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		children, err := c.children(ctx, desc)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ref := Reference{
+			Registry:   img.Registry,
+			Repository: img.Repository,
+			Digest:     desc.Digest,
+		}
+		refs = append(refs, ref)
+		events = append(events, OCIEvent{Type: CreateEvent, Reference: ref})
+		return children, nil
+	})
+	err = images.Walk(ctx, handler, cImg.Target)
+	if err != nil {
+		return nil, err
+	}
+	contentIdx[img.Digest] = refs
+	// No need to advertise content if we receive content events.
+	if c.features.Has(FeatureContentEvent) {
+		return nil, nil
+	}
+	return events, nil
+}
+
 func containerdFeatures(ctx context.Context, client *client.Client) (Feature, error) {
 	grpcConn, ok := client.Conn().(*grpc.ClientConn)
 	if !ok {
@@ -582,12 +700,14 @@ func contentLabelsToReferences(l map[string]string, dgst digest.Digest) ([]Refer
 		if !strings.HasPrefix(k, labels.LabelDistributionSource) {
 			continue
 		}
-		ref := Reference{
-			Registry:   strings.TrimPrefix(k, labels.LabelDistributionSource+"."),
-			Repository: v,
-			Digest:     dgst,
+		for _, repo := range strings.Split(v, ",") {
+			ref := Reference{
+				Registry:   strings.TrimPrefix(k, labels.LabelDistributionSource+"."),
+				Repository: repo,
+				Digest:     dgst,
+			}
+			refs = append(refs, ref)
 		}
-		refs = append(refs, ref)
 	}
 	if len(refs) == 0 {
 		return nil, fmt.Errorf("no distribution source labels found for %s", dgst)
@@ -191,6 +191,24 @@ func TestContentLabelsToReferences(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "multiple repositories",
+			labels: map[string]string{
+				"containerd.io/distribution.source.ghcr.io": "spegel-org/spegel,clyde-org/clyde",
+			},
+			expected: []Reference{
+				{
+					Registry:   "ghcr.io",
+					Repository: "spegel-org/spegel",
+					Digest:     dgst,
+				},
+				{
+					Registry:   "ghcr.io",
+					Repository: "clyde-org/clyde",
+					Digest:     dgst,
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(t.Name(), func(t *testing.T) {
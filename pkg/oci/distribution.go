@@ -20,6 +20,9 @@ var (
 	manifestRegexTag    = regexp.MustCompile(`/v2/` + repoRegexStr + `/manifests/` + tagRegexStr + `$`)
 	manifestRegexDigest = regexp.MustCompile(`/v2/` + repoRegexStr + `/manifests/(.*)`)
 	blobsRegexDigest    = regexp.MustCompile(`/v2/` + repoRegexStr + `/blobs/(.*)`)
+	referrersRegex      = regexp.MustCompile(`/v2/` + repoRegexStr + `/referrers/(.*)`)
+	uploadsRegex        = regexp.MustCompile(`/v2/` + repoRegexStr + `/blobs/uploads/([a-zA-Z0-9_-]*)$`)
+	tagsListRegex       = regexp.MustCompile(`^/v2/` + repoRegexStr + `/tags/list$`)
 )
 
 // DistributionKind represents the kind of content.
@@ -28,12 +31,16 @@ type DistributionKind string
 const (
 	DistributionKindManifest = "manifests"
 	DistributionKindBlob     = "blobs"
+	// DistributionKindReferrers is the index of manifests which have the digest as subject.
+	DistributionKindReferrers = "referrers"
 )
 
 // DistributionPath contains the individual parameters from a OCI distribution spec request.
 type DistributionPath struct {
 	Reference
 	Kind DistributionKind
+	// ArtifactType filters the referrers by artifact type.
+	ArtifactType string
 }
 
 func NewDistributionPath(ref Reference, kind DistributionKind) (DistributionPath, error) {
@@ -46,6 +53,9 @@ func NewDistributionPath(ref Reference, kind DistributionKind) (DistributionPath
 	if kind == DistributionKindBlob && ref.Tag != "" {
 		return DistributionPath{}, errors.New("tag reference cannot be used for blobs")
 	}
+	if kind == DistributionKindReferrers && ref.Digest == "" {
+		return DistributionPath{}, errors.New("digest reference is required for referrers")
+	}
 	dist := DistributionPath{
 		Kind:      kind,
 		Reference: ref,
@@ -63,11 +73,15 @@ func (d DistributionPath) URL() *url.URL {
 	if ref == "" {
 		ref = d.Tag
 	}
+	rawQuery := fmt.Sprintf("ns=%s", d.Registry)
+	if d.ArtifactType != "" {
+		rawQuery = fmt.Sprintf("%s&artifactType=%s", rawQuery, url.QueryEscape(d.ArtifactType))
+	}
 	return &url.URL{
 		Scheme:   "https",
 		Host:     d.Registry,
 		Path:     fmt.Sprintf("/v2/%s/%s/%s", d.Repository, d.Kind, ref),
-		RawQuery: fmt.Sprintf("ns=%s", d.Registry),
+		RawQuery: rawQuery,
 	}
 }
 
@@ -126,9 +140,76 @@ func ParseDistributionPath(u *url.URL) (DistributionPath, error) {
 		}
 		return dist, nil
 	}
+	comps = referrersRegex.FindStringSubmatch(u.Path)
+	if len(comps) == 3 {
+		dgst, err := digest.Parse(comps[2])
+		if err != nil {
+			return DistributionPath{}, err
+		}
+		ref := Reference{
+			Registry:   registry,
+			Repository: comps[1],
+			Digest:     dgst,
+		}
+		dist, err := NewDistributionPath(ref, DistributionKindReferrers)
+		if err != nil {
+			return DistributionPath{}, err
+		}
+		dist.ArtifactType = u.Query().Get("artifactType")
+		return dist, nil
+	}
 	return DistributionPath{}, errors.New("distribution path could not be parsed")
 }
 
+// UploadPath contains the parameters from a OCI distribution spec blob upload request.
+type UploadPath struct {
+	Registry   string
+	Repository string
+	// ID identifies the upload session and is empty when starting an upload.
+	ID string
+}
+
+// URL returns the path of the upload session without the registry parameter.
+func (u UploadPath) URL() *url.URL {
+	return &url.URL{
+		Path: fmt.Sprintf("/v2/%s/blobs/uploads/%s", u.Repository, u.ID),
+	}
+}
+
+// ParseUploadPath gets the parameters from a blob upload URL which conforms with the OCI distribution spec.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-blobs
+func ParseUploadPath(u *url.URL) (UploadPath, error) {
+	registry := u.Query().Get("ns")
+	if registry == "" {
+		return UploadPath{}, errors.New("registry parameter needs to be set for uploads")
+	}
+	comps := uploadsRegex.FindStringSubmatch(u.Path)
+	if len(comps) != 3 {
+		return UploadPath{}, errors.New("upload path could not be parsed")
+	}
+	upload := UploadPath{
+		Registry:   registry,
+		Repository: comps[1],
+		ID:         comps[2],
+	}
+	return upload, nil
+}
+
+// ParseTagsListPath gets the registry and repository from a tag listing URL which conforms with the OCI distribution spec.
+// The registry is empty when the registry parameter is not set.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-tags
+func ParseTagsListPath(u *url.URL) (Reference, error) {
+	comps := tagsListRegex.FindStringSubmatch(u.Path)
+	if len(comps) != 2 {
+		return Reference{}, errors.New("tags list path could not be parsed")
+	}
+	ref := Reference{
+		Registry:   u.Query().Get("ns"),
+		Repository: comps[1],
+	}
+	return ref, nil
+}
+
 var _ httpx.ResponseError = &DistributionError{}
 
 type DistributionErrorCode string
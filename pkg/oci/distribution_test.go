@@ -52,6 +52,16 @@ func TestParseDistributionPath(t *testing.T) {
 			expectedRef:  "sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369",
 			expectedKind: DistributionKindBlob,
 		},
+		{
+			name:         "referrers digest",
+			registry:     "ghcr.io",
+			path:         "/v2/spegel-org/spegel/referrers/sha256:0a404ca8e119d061cdb2dceee824c914cdc69b31bc7b5956ef5a520436a80d39",
+			expectedName: "spegel-org/spegel",
+			expectedDgst: digest.Digest("sha256:0a404ca8e119d061cdb2dceee824c914cdc69b31bc7b5956ef5a520436a80d39"),
+			expectedTag:  "",
+			expectedRef:  "sha256:0a404ca8e119d061cdb2dceee824c914cdc69b31bc7b5956ef5a520436a80d39",
+			expectedKind: DistributionKindReferrers,
+		},
 		{
 			name:         "manifest with consecutive dashes",
 			registry:     "example.com",
@@ -127,6 +137,14 @@ func TestParseDistributionPathErrors(t *testing.T) {
 			},
 			expectedError: "invalid checksum digest length",
 		},
+		{
+			name: "referrers with tag reference",
+			url: &url.URL{
+				Path:     "/v2/spegel-org/spegel/referrers/v0.0.1",
+				RawQuery: "ns=example.com",
+			},
+			expectedError: "invalid checksum digest format",
+		},
 		{
 			name: "manifest tag with missing registry",
 			url: &url.URL{
@@ -158,3 +176,54 @@ func TestParseDistributionPathErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestDistributionPathArtifactType(t *testing.T) {
+	t.Parallel()
+
+	u := &url.URL{
+		Path:     "/v2/spegel-org/spegel/referrers/sha256:0a404ca8e119d061cdb2dceee824c914cdc69b31bc7b5956ef5a520436a80d39",
+		RawQuery: "ns=ghcr.io&artifactType=application%2Fvnd.dev.cosign.artifact.sig.v1%2Bjson",
+	}
+	dist, err := ParseDistributionPath(u)
+	require.NoError(t, err)
+	require.Equal(t, "application/vnd.dev.cosign.artifact.sig.v1+json", dist.ArtifactType)
+	require.Equal(t, "ns=ghcr.io&artifactType=application%2Fvnd.dev.cosign.artifact.sig.v1%2Bjson", dist.URL().RawQuery)
+
+	_, err = NewDistributionPath(Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Tag: "latest"}, DistributionKindReferrers)
+	require.EqualError(t, err, "digest reference is required for referrers")
+}
+
+func TestParseUploadPath(t *testing.T) {
+	t.Parallel()
+
+	u := &url.URL{Path: "/v2/spegel-org/spegel/blobs/uploads/", RawQuery: "ns=ghcr.io"}
+	upload, err := ParseUploadPath(u)
+	require.NoError(t, err)
+	require.Equal(t, UploadPath{Registry: "ghcr.io", Repository: "spegel-org/spegel"}, upload)
+
+	u = &url.URL{Path: "/v2/spegel-org/spegel/blobs/uploads/ABC123", RawQuery: "ns=ghcr.io"}
+	upload, err = ParseUploadPath(u)
+	require.NoError(t, err)
+	require.Equal(t, "ABC123", upload.ID)
+	require.Equal(t, "/v2/spegel-org/spegel/blobs/uploads/ABC123", upload.URL().String())
+
+	_, err = ParseUploadPath(&url.URL{Path: "/v2/spegel-org/spegel/blobs/uploads/"})
+	require.EqualError(t, err, "registry parameter needs to be set for uploads")
+	_, err = ParseUploadPath(&url.URL{Path: "/v2/spegel-org/spegel/manifests/latest", RawQuery: "ns=ghcr.io"})
+	require.EqualError(t, err, "upload path could not be parsed")
+}
+
+func TestParseTagsListPath(t *testing.T) {
+	t.Parallel()
+
+	ref, err := ParseTagsListPath(&url.URL{Path: "/v2/spegel-org/spegel/tags/list", RawQuery: "ns=ghcr.io"})
+	require.NoError(t, err)
+	require.Equal(t, Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel"}, ref)
+
+	ref, err = ParseTagsListPath(&url.URL{Path: "/v2/spegel-org/spegel/tags/list"})
+	require.NoError(t, err)
+	require.Equal(t, Reference{Repository: "spegel-org/spegel"}, ref)
+
+	_, err = ParseTagsListPath(&url.URL{Path: "/v2/spegel-org/spegel/manifests/latest"})
+	require.EqualError(t, err, "tags list path could not be parsed")
+}
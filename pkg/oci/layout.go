@@ -0,0 +1,444 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/go-logr/logr"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"clyde/internal/option"
+	"clyde/pkg/httpx"
+)
+
+type LayoutConfig struct {
+	PollInterval time.Duration
+}
+
+type LayoutOption = option.Option[LayoutConfig]
+
+// WithPollInterval sets how often the layout directories are scanned for changes.
+func WithPollInterval(interval time.Duration) LayoutOption {
+	return func(c *LayoutConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("poll interval %s has to be larger than zero", interval)
+		}
+		c.PollInterval = interval
+		return nil
+	}
+}
+
+var _ Store = &Layout{}
+
+// Layout is a store backed by one or more OCI image layout directories.
+// https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+type Layout struct {
+	mediaTypeIdx *lru.Cache[digest.Digest, string]
+	dirs         []string
+	pollInterval time.Duration
+}
+
+func NewLayout(dirs []string, opts ...LayoutOption) (*Layout, error) {
+	cfg := LayoutConfig{
+		PollInterval: 5 * time.Second,
+	}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dirs) == 0 {
+		return nil, errors.New("at least one layout directory is required")
+	}
+	for _, dir := range dirs {
+		err := verifyLayout(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mediaTypeIdx, err := lru.New[digest.Digest, string](100)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Layout{
+		dirs:         dirs,
+		mediaTypeIdx: mediaTypeIdx,
+		pollInterval: cfg.PollInterval,
+	}
+	return l, nil
+}
+
+func (l *Layout) Name() string {
+	return "layout"
+}
+
+func (l *Layout) ListImages(ctx context.Context) ([]Image, error) {
+	return l.readImages(ctx), nil
+}
+
+func (l *Layout) ListContent(ctx context.Context) ([][]Reference, error) {
+	scan, err := l.scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	contents := [][]Reference{}
+	for _, dgst := range slices.Sorted(maps.Keys(scan.contents)) {
+		contents = append(contents, scan.contents[dgst])
+	}
+	return contents, nil
+}
+
+func (l *Layout) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	for _, img := range l.readImages(ctx) {
+		tagName, ok := img.TagName()
+		if !ok || tagName != ref {
+			continue
+		}
+		return img.Digest, nil
+	}
+	return "", errors.Join(ErrNotFound, fmt.Errorf("could not resolve tag %s to a digest", ref))
+}
+
+func (l *Layout) Descriptor(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
+	p, err := l.blobPath(dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	mt, ok := l.mediaTypeIdx.Get(dgst)
+	if !ok {
+		mt, err = func() (string, error) {
+			if fi.Size() > ManifestMaxSize {
+				return httpx.ContentTypeBinary, nil
+			}
+			rc, err := l.Open(ctx, dgst)
+			if err != nil {
+				return "", err
+			}
+			defer rc.Close()
+			mt, err := DetectMediaType(rc)
+			if err != nil {
+				return "", err
+			}
+			return mt, nil
+		}()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		l.mediaTypeIdx.Add(dgst, mt)
+	}
+
+	desc := ocispec.Descriptor{
+		Size:      fi.Size(),
+		Digest:    dgst,
+		MediaType: mt,
+	}
+	return desc, nil
+}
+
+func (l *Layout) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	p, err := l.blobPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Join(ErrNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Subscribe scans the layout directories at the poll interval and emits events for the difference between scans.
+func (l *Layout) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	prev, err := l.scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	eventCh := make(chan OCIEvent)
+	go func() {
+		defer close(eventCh)
+		ticker := time.NewTicker(l.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				curr, err := l.scan(ctx)
+				if err != nil {
+					log.Error(err, "could not scan layout directories")
+					continue
+				}
+				for _, event := range diffLayoutScans(prev, curr) {
+					select {
+					case <-ctx.Done():
+						return
+					case eventCh <- event:
+					}
+				}
+				prev = curr
+			}
+		}
+	}()
+	return eventCh, nil
+}
+
+type layoutScan struct {
+	tags     map[string]Reference
+	contents map[digest.Digest][]Reference
+}
+
+// scan walks all images in the layout directories to index the content that exists.
+func (l *Layout) scan(ctx context.Context) (layoutScan, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	imgs := l.readImages(ctx)
+	scan := layoutScan{
+		tags:     map[string]Reference{},
+		contents: map[digest.Digest][]Reference{},
+	}
+	for _, img := range imgs {
+		tagName, ok := img.TagName()
+		if ok {
+			scan.tags[tagName] = Reference{Registry: img.Registry, Repository: img.Repository, Tag: img.Tag}
+		}
+		err := l.walk(img.Digest, func(dgst digest.Digest) {
+			ref := Reference{
+				Registry:   img.Registry,
+				Repository: img.Repository,
+				Digest:     dgst,
+			}
+			if slices.Contains(scan.contents[dgst], ref) {
+				return
+			}
+			scan.contents[dgst] = append(scan.contents[dgst], ref)
+		})
+		if err != nil {
+			log.Error(err, "skipping image that cannot be walked", "image", img.String())
+			continue
+		}
+	}
+	// Manifests without a name, such as referrers, are indexed without a repository.
+	for _, dir := range l.dirs {
+		idx, err := readLayoutIndex(dir)
+		if err != nil {
+			log.Error(err, "skipping layout with index that cannot be read", "layout", dir)
+			continue
+		}
+		for _, desc := range idx.Manifests {
+			if _, ok := layoutImageName(desc); ok {
+				continue
+			}
+			err := l.walk(desc.Digest, func(dgst digest.Digest) {
+				if _, ok := scan.contents[dgst]; ok {
+					return
+				}
+				scan.contents[dgst] = []Reference{{Digest: dgst}}
+			})
+			if err != nil {
+				log.Error(err, "skipping manifest that cannot be walked", "digest", desc.Digest.String())
+				continue
+			}
+		}
+	}
+	return scan, nil
+}
+
+// walk calls the function for the digest and all of its children that exist in the layout.
+func (l *Layout) walk(dgst digest.Digest, fn func(digest.Digest)) error {
+	p, err := l.blobPath(dgst)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fn(dgst)
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > ManifestMaxSize {
+		return nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	mt, err := FingerprintMediaType(bytes.NewReader(b))
+	if err != nil || !IsManifestsMediatype(mt) {
+		//nolint: nilerr // Content that is not a manifest has no children.
+		return nil
+	}
+	children, err := ManifestChildren(b)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		err := l.walk(child.Digest, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImages returns the named images from the index of each layout directory.
+// The image name is read from the containerd image name annotation or the OCI ref name annotation.
+// Directories whose index can not be read are skipped so that they do not hide the images of the other directories.
+func (l *Layout) readImages(ctx context.Context) []Image {
+	log := logr.FromContextOrDiscard(ctx)
+
+	tagDgsts := map[digest.Digest]string{}
+	imgs := []Image{}
+	for _, dir := range l.dirs {
+		idx, err := readLayoutIndex(dir)
+		if err != nil {
+			log.Error(err, "skipping layout with index that cannot be read", "layout", dir)
+			continue
+		}
+		for _, desc := range idx.Manifests {
+			name, ok := layoutImageName(desc)
+			if !ok {
+				continue
+			}
+			img, err := ParseImage(name, WithDigest(desc.Digest))
+			if err != nil {
+				log.Error(err, "skipping image that cannot be parsed", "name", name, "layout", dir)
+				continue
+			}
+			if slices.Contains(imgs, img) {
+				continue
+			}
+			if img.Tag != "" {
+				tagDgsts[img.Digest] = img.Tag
+			}
+			imgs = append(imgs, img)
+		}
+	}
+	// Remove duplicate digest images that already have tags.
+	imgs = slices.DeleteFunc(imgs, func(img Image) bool {
+		if img.Tag != "" {
+			return false
+		}
+		if _, ok := tagDgsts[img.Digest]; ok {
+			return true
+		}
+		return false
+	})
+	return imgs
+}
+
+// blobPath returns the path of the blob in the first layout directory that contains it.
+func (l *Layout) blobPath(dgst digest.Digest) (string, error) {
+	err := dgst.Validate()
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range l.dirs {
+		p := filepath.Join(dir, ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+		_, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return p, nil
+	}
+	return "", errors.Join(ErrNotFound, fmt.Errorf("blob with digest %s not found", dgst))
+}
+
+func readLayoutIndex(dir string) (ocispec.Index, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	if err != nil {
+		return ocispec.Index{}, err
+	}
+	var idx ocispec.Index
+	err = json.Unmarshal(b, &idx)
+	if err != nil {
+		return ocispec.Index{}, fmt.Errorf("could not decode index in layout %s: %w", dir, err)
+	}
+	return idx, nil
+}
+
+func layoutImageName(desc ocispec.Descriptor) (string, bool) {
+	name, ok := desc.Annotations[images.AnnotationImageName]
+	if !ok {
+		name, ok = desc.Annotations[ocispec.AnnotationRefName]
+	}
+	return name, ok
+}
+
+func verifyLayout(dir string) error {
+	b, err := os.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	if err != nil {
+		return fmt.Errorf("could not read layout file in %s: %w", dir, err)
+	}
+	var layout ocispec.ImageLayout
+	err = json.Unmarshal(b, &layout)
+	if err != nil {
+		return fmt.Errorf("could not decode layout file in %s: %w", dir, err)
+	}
+	if layout.Version != ocispec.ImageLayoutVersion {
+		return fmt.Errorf("unsupported image layout version %s in %s", layout.Version, dir)
+	}
+	return nil
+}
+
+func diffLayoutScans(prev, curr layoutScan) []OCIEvent {
+	events := []OCIEvent{}
+	for _, tagName := range slices.Sorted(maps.Keys(curr.tags)) {
+		if _, ok := prev.tags[tagName]; ok {
+			continue
+		}
+		events = append(events, OCIEvent{Type: CreateEvent, Reference: curr.tags[tagName]})
+	}
+	for _, tagName := range slices.Sorted(maps.Keys(prev.tags)) {
+		if _, ok := curr.tags[tagName]; ok {
+			continue
+		}
+		events = append(events, OCIEvent{Type: DeleteEvent, Reference: prev.tags[tagName]})
+	}
+	for _, dgst := range slices.Sorted(maps.Keys(curr.contents)) {
+		if _, ok := prev.contents[dgst]; ok {
+			continue
+		}
+		for _, ref := range curr.contents[dgst] {
+			events = append(events, OCIEvent{Type: CreateEvent, Reference: ref})
+		}
+	}
+	for _, dgst := range slices.Sorted(maps.Keys(prev.contents)) {
+		if _, ok := curr.contents[dgst]; ok {
+			continue
+		}
+		for _, ref := range prev.contents[dgst] {
+			events = append(events, OCIEvent{Type: DeleteEvent, Reference: ref})
+		}
+	}
+	return events
+}
@@ -0,0 +1,199 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	t.Parallel()
+
+	scratchDgst := digest.Digest("sha256:9430beb291fa7b96997711fc486bc46133c719631aefdbeebe58dd3489217bfe")
+	manifestDgst := digest.Digest("sha256:aec8273a5e5aca369fcaa8cecef7bf6c7959d482f5c8cfa2236a6a16e46bbdcf")
+	configDgst := digest.Digest("sha256:68b8a989a3e08ddbdb3a0077d35c0d0e59c9ecf23d0634584def8bdbb7d6824f")
+	layerDgst := digest.Digest("sha256:3caa2469de2a23cbcc209dd0b9d01cd78ff9a0f88741655991d36baede5b0996")
+
+	// Content of the image is split between two layout directories.
+	firstDir := createTestLayout(t, map[string]digest.Digest{"example.com/org/scratch:latest": scratchDgst}, scratchDgst, manifestDgst)
+	secondDir := createTestLayout(t, map[string]digest.Digest{"foo:bar": scratchDgst}, configDgst, layerDgst)
+
+	layout, err := NewLayout([]string{firstDir, secondDir}, WithPollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, "layout", layout.Name())
+
+	imgs, err := layout.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	require.Equal(t, "example.com/org/scratch:latest@"+scratchDgst.String(), imgs[0].String())
+
+	contents, err := layout.ListContent(t.Context())
+	require.NoError(t, err)
+	expectedContents := [][]Reference{}
+	for _, dgst := range []digest.Digest{layerDgst, configDgst, scratchDgst, manifestDgst} {
+		expectedContents = append(expectedContents, []Reference{{Registry: "example.com", Repository: "org/scratch", Digest: dgst}})
+	}
+	require.Equal(t, expectedContents, contents)
+
+	dgst, err := layout.Resolve(t.Context(), "example.com/org/scratch:latest")
+	require.NoError(t, err)
+	require.Equal(t, scratchDgst, dgst)
+	_, err = layout.Resolve(t.Context(), "example.com/org/scratch:missing")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	desc, err := layout.Descriptor(t.Context(), manifestDgst)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+	require.Equal(t, int64(476), desc.Size)
+	desc, err = layout.Descriptor(t.Context(), configDgst)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageConfig, desc.MediaType)
+	_, err = layout.Descriptor(t.Context(), digest.FromString("missing"))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	rc, err := layout.Open(t.Context(), manifestDgst)
+	require.NoError(t, err)
+	_, err = rc.Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	expected, err := os.ReadFile(filepath.Join("testdata", "blobs", "sha256", manifestDgst.Encoded()))
+	require.NoError(t, err)
+	require.Equal(t, expected[2:], b)
+	_, err = layout.Open(t.Context(), digest.FromString("missing"))
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLayoutSubscribe(t *testing.T) {
+	t.Parallel()
+
+	scratchDgst := digest.Digest("sha256:9430beb291fa7b96997711fc486bc46133c719631aefdbeebe58dd3489217bfe")
+	manifestDgst := digest.Digest("sha256:aec8273a5e5aca369fcaa8cecef7bf6c7959d482f5c8cfa2236a6a16e46bbdcf")
+
+	dir := createTestLayout(t, map[string]digest.Digest{}, scratchDgst, manifestDgst)
+	layout, err := NewLayout([]string{dir}, WithPollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	eventCh, err := layout.Subscribe(ctx)
+	require.NoError(t, err)
+
+	writeTestIndex(t, dir, map[string]digest.Digest{"example.com/org/scratch:latest": scratchDgst})
+	expectedRefs := []Reference{
+		{Registry: "example.com", Repository: "org/scratch", Tag: "latest"},
+		{Registry: "example.com", Repository: "org/scratch", Digest: scratchDgst},
+		{Registry: "example.com", Repository: "org/scratch", Digest: manifestDgst},
+	}
+	for _, ref := range expectedRefs {
+		require.Equal(t, OCIEvent{Type: CreateEvent, Reference: ref}, <-eventCh)
+	}
+
+	writeTestIndex(t, dir, map[string]digest.Digest{})
+	for _, ref := range expectedRefs {
+		require.Equal(t, OCIEvent{Type: DeleteEvent, Reference: ref}, <-eventCh)
+	}
+
+	cancel()
+	_, ok := <-eventCh
+	require.False(t, ok)
+}
+
+func TestLayoutUnreadableIndex(t *testing.T) {
+	t.Parallel()
+
+	scratchDgst := digest.Digest("sha256:9430beb291fa7b96997711fc486bc46133c719631aefdbeebe58dd3489217bfe")
+	manifestDgst := digest.Digest("sha256:aec8273a5e5aca369fcaa8cecef7bf6c7959d482f5c8cfa2236a6a16e46bbdcf")
+
+	firstDir := createTestLayout(t, map[string]digest.Digest{"example.com/org/scratch:latest": scratchDgst}, scratchDgst, manifestDgst)
+	secondDir := createTestLayout(t, map[string]digest.Digest{}, scratchDgst, manifestDgst)
+	layout, err := NewLayout([]string{firstDir, secondDir})
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(secondDir, ocispec.ImageIndexFile), []byte("{"), 0o644)
+	require.NoError(t, err)
+	imgs, err := layout.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	require.Equal(t, "example.com/org/scratch:latest@"+scratchDgst.String(), imgs[0].String())
+	dgst, err := layout.Resolve(t.Context(), "example.com/org/scratch:latest")
+	require.NoError(t, err)
+	require.Equal(t, scratchDgst, dgst)
+	contents, err := layout.ListContent(t.Context())
+	require.NoError(t, err)
+	expectedContents := [][]Reference{}
+	for _, dgst := range []digest.Digest{scratchDgst, manifestDgst} {
+		expectedContents = append(expectedContents, []Reference{{Registry: "example.com", Repository: "org/scratch", Digest: dgst}})
+	}
+	require.Equal(t, expectedContents, contents)
+}
+
+func TestNewLayout(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewLayout(nil)
+	require.EqualError(t, err, "at least one layout directory is required")
+
+	dir := t.TempDir()
+	_, err = NewLayout([]string{dir})
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0o644)
+	require.NoError(t, err)
+	_, err = NewLayout([]string{dir})
+	require.EqualError(t, err, "unsupported image layout version 2.0.0 in "+dir)
+
+	_, err = NewLayout([]string{dir}, WithPollInterval(0))
+	require.EqualError(t, err, "poll interval 0s has to be larger than zero")
+}
+
+func createTestLayout(t *testing.T, imgs map[string]digest.Digest, dgsts ...digest.Digest) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	b, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), b, 0o644)
+	require.NoError(t, err)
+	blobDir := filepath.Join(dir, ocispec.ImageBlobsDir, "sha256")
+	err = os.MkdirAll(blobDir, 0o755)
+	require.NoError(t, err)
+	for _, dgst := range dgsts {
+		b, err := os.ReadFile(filepath.Join("testdata", "blobs", "sha256", dgst.Encoded()))
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(blobDir, dgst.Encoded()), b, 0o644)
+		require.NoError(t, err)
+	}
+	writeTestIndex(t, dir, imgs)
+	return dir
+}
+
+func writeTestIndex(t *testing.T, dir string, imgs map[string]digest.Digest) {
+	t.Helper()
+
+	idx := ocispec.Index{
+		Manifests: []ocispec.Descriptor{},
+	}
+	idx.SchemaVersion = 2
+	for name, dgst := range imgs {
+		idx.Manifests = append(idx.Manifests, ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageIndex,
+			Digest:      dgst,
+			Annotations: map[string]string{images.AnnotationImageName: name},
+		})
+	}
+	b, err := json.Marshal(idx)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), b, 0o644)
+	require.NoError(t, err)
+}
@@ -0,0 +1,172 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"clyde/internal/option"
+	"clyde/pkg/httpx"
+)
+
+const (
+	// CatalogKey is advertised by every node so that tag and repository listings can be merged across the cluster.
+	CatalogKey = "oci/catalog"
+
+	listMaxSize = 16 * 1024 * 1024
+)
+
+// TagList is the response body of a tag listing.
+type TagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// Catalog is the response body of a repository listing.
+type Catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// ListTags returns the sorted tags of the images in the repository and if the repository exists.
+// Images from all registries are included when the registry is empty.
+func ListTags(imgs []Image, registry, repository string, filters []Filter) ([]string, bool) {
+	found := false
+	tags := []string{}
+	for _, img := range imgs {
+		if img.Repository != repository || (registry != "" && img.Registry != registry) {
+			continue
+		}
+		if MatchesFilter(img.Reference, filters) {
+			continue
+		}
+		found = true
+		if img.Tag == "" {
+			continue
+		}
+		tags = append(tags, img.Tag)
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags), found
+}
+
+// ListRepositories returns the sorted repositories of the images.
+// Images from all registries are included when the registry is empty.
+func ListRepositories(imgs []Image, registry string, filters []Filter) []string {
+	repos := []string{}
+	for _, img := range imgs {
+		if registry != "" && img.Registry != registry {
+			continue
+		}
+		if MatchesFilter(img.Reference, filters) {
+			continue
+		}
+		repos = append(repos, img.Repository)
+	}
+	slices.Sort(repos)
+	return slices.Compact(repos)
+}
+
+// Paginate returns the sorted entries that come after last, limited to n entries when n is not negative.
+// The returned boolean is true when more entries exist after the returned page.
+func Paginate(entries []string, last string, n int) ([]string, bool) {
+	if last != "" {
+		idx, _ := slices.BinarySearch(entries, last)
+		if idx < len(entries) && entries[idx] == last {
+			idx++
+		}
+		entries = entries[idx:]
+	}
+	if n < 0 || n >= len(entries) {
+		return entries, false
+	}
+	return entries[:n], true
+}
+
+// ListTags returns the tags of the repository from the registry, or from the mirror when set.
+// Only the first page of tags is returned when the registry paginates the response.
+func (c *Client) ListTags(ctx context.Context, registry, repository string, opts ...FetchOption) ([]string, error) {
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     registry,
+		Path:     fmt.Sprintf("/v2/%s/tags/list", repository),
+		RawQuery: fmt.Sprintf("ns=%s", registry),
+	}
+	tagList := TagList{}
+	err := c.list(ctx, u, registry+repository, &tagList, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return tagList.Tags, nil
+}
+
+// ListRepositories returns the repositories in the catalog of the registry, or of the mirror when set.
+// Only the first page of repositories is returned when the registry paginates the response.
+func (c *Client) ListRepositories(ctx context.Context, registry string, opts ...FetchOption) ([]string, error) {
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     registry,
+		Path:     "/v2/_catalog",
+		RawQuery: fmt.Sprintf("ns=%s", registry),
+	}
+	catalog := Catalog{}
+	err := c.list(ctx, u, registry, &catalog, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return catalog.Repositories, nil
+}
+
+// ListReferrers returns the unfiltered referrers of the subject from the registry, or from the mirror when set.
+func (c *Client) ListReferrers(ctx context.Context, registry, repository string, subject digest.Digest, opts ...FetchOption) ([]ocispec.Descriptor, error) {
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     registry,
+		Path:     fmt.Sprintf("/v2/%s/referrers/%s", repository, subject),
+		RawQuery: fmt.Sprintf("ns=%s", registry),
+	}
+	idx := ocispec.Index{}
+	err := c.list(ctx, u, registry+repository, &idx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Manifests, nil
+}
+
+func (c *Client) list(ctx context.Context, u *url.URL, tcKey string, v any, opts ...FetchOption) error {
+	cfg := FetchConfig{}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return err
+	}
+	if cfg.Range != nil {
+		return errors.New("cannot make range requests for listings")
+	}
+	if u.Host == "" && cfg.Mirror == nil {
+		return errors.New("registry or mirror needs to be set for listings")
+	}
+
+	header := http.Header{}
+	header.Set(httpx.HeaderAccept, httpx.ContentTypeJSON)
+	resp, err := c.do(ctx, http.MethodGet, u, tcKey, cfg.CommonConfig, header)
+	if err != nil {
+		return err
+	}
+	defer httpx.DrainAndClose(resp.Body)
+	err = httpx.CheckResponseStatus(resp, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, listMaxSize)).Decode(v)
+	if err != nil {
+		return err
+	}
+	return nil
+}
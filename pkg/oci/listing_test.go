@@ -0,0 +1,152 @@
+package oci
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/httpx"
+)
+
+func TestListTagsAndRepositories(t *testing.T) {
+	t.Parallel()
+
+	imgs := []Image{
+		{Reference: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest", Digest: digest.FromString("1")}},
+		{Reference: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.27", Digest: digest.FromString("1")}},
+		{Reference: Reference{Registry: "docker.io", Repository: "library/nginx", Digest: digest.FromString("2")}},
+		{Reference: Reference{Registry: "ghcr.io", Repository: "library/nginx", Tag: "latest", Digest: digest.FromString("3")}},
+		{Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Tag: "v1", Digest: digest.FromString("4")}},
+		{Reference: Reference{Registry: "quay.io", Repository: "prometheus/prometheus", Tag: "v3", Digest: digest.FromString("5")}},
+	}
+	filters := []Filter{RegexFilter{Regex: regexp.MustCompile(`^quay.io/`)}}
+
+	tags, found := ListTags(imgs, "docker.io", "library/nginx", filters)
+	require.True(t, found)
+	require.Equal(t, []string{"1.27", "latest"}, tags)
+	tags, found = ListTags(imgs, "", "library/nginx", filters)
+	require.True(t, found)
+	require.Equal(t, []string{"1.27", "latest"}, tags)
+	_, found = ListTags(imgs, "docker.io", "spegel-org/spegel", filters)
+	require.False(t, found)
+	_, found = ListTags(imgs, "quay.io", "prometheus/prometheus", filters)
+	require.False(t, found)
+
+	repos := ListRepositories(imgs, "", filters)
+	require.Equal(t, []string{"library/nginx", "spegel-org/spegel"}, repos)
+	repos = ListRepositories(imgs, "docker.io", filters)
+	require.Equal(t, []string{"library/nginx"}, repos)
+}
+
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name            string
+		last            string
+		n               int
+		expectedEntries []string
+		expectedMore    bool
+	}{
+		{
+			name:            "all entries",
+			n:               -1,
+			expectedEntries: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:            "first page",
+			n:               2,
+			expectedEntries: []string{"a", "b"},
+			expectedMore:    true,
+		},
+		{
+			name:            "last page",
+			last:            "b",
+			n:               2,
+			expectedEntries: []string{"c", "d"},
+		},
+		{
+			name:            "last not in entries",
+			last:            "bb",
+			n:               1,
+			expectedEntries: []string{"c"},
+			expectedMore:    true,
+		},
+		{
+			name:            "empty page",
+			n:               0,
+			expectedEntries: []string{},
+			expectedMore:    true,
+		},
+		{
+			name:            "after all entries",
+			last:            "d",
+			n:               -1,
+			expectedEntries: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			entries, more := Paginate([]string{"a", "b", "c", "d"}, tt.last, tt.n)
+			require.Equal(t, tt.expectedEntries, entries)
+			require.Equal(t, tt.expectedMore, more)
+		})
+	}
+}
+
+func TestClientListing(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v2/library/nginx/tags/list", func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("ns") != "docker.io" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeJSON)
+		//nolint: errcheck // Ignore error.
+		rw.Write([]byte(`{"name":"library/nginx","tags":["1.27","latest"]}`))
+	})
+	mux.HandleFunc("GET /v2/_catalog", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeJSON)
+		//nolint: errcheck // Ignore error.
+		rw.Write([]byte(`{"repositories":["library/nginx"]}`))
+	})
+	mux.HandleFunc("GET /v2/library/nginx/referrers/{digest}", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(httpx.HeaderContentType, ocispec.MediaTypeImageIndex)
+		//nolint: errcheck // Ignore error.
+		rw.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + req.PathValue("digest") + `","size":1}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	mirror, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	ociClient, err := NewClient()
+	require.NoError(t, err)
+	tags, err := ociClient.ListTags(t.Context(), "docker.io", "library/nginx", WithFetchMirror(mirror))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.27", "latest"}, tags)
+	repos, err := ociClient.ListRepositories(t.Context(), "", WithFetchMirror(mirror))
+	require.NoError(t, err)
+	require.Equal(t, []string{"library/nginx"}, repos)
+	referrers, err := ociClient.ListReferrers(t.Context(), "docker.io", "library/nginx", digest.FromString("1"), WithFetchMirror(mirror))
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	require.Equal(t, digest.FromString("1"), referrers[0].Digest)
+	_, err = ociClient.ListTags(t.Context(), "docker.io", "library/foo", WithFetchMirror(mirror))
+	require.Error(t, err)
+	_, err = ociClient.ListRepositories(t.Context(), "")
+	require.EqualError(t, err, "registry or mirror needs to be set for listings")
+}
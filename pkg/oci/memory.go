@@ -6,18 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-var _ Store = &Memory{}
+var _ WritableStore = &Memory{}
 
 type Memory struct {
 	descs  map[digest.Digest]ocispec.Descriptor
 	blobs  map[digest.Digest][]byte
 	tags   map[string]digest.Digest
+	labels map[digest.Digest][]Reference
 	images []Image
 	mx     sync.RWMutex
 }
@@ -26,6 +29,7 @@ func NewMemory() *Memory {
 	return &Memory{
 		images: []Image{},
 		tags:   map[string]digest.Digest{},
+		labels: map[digest.Digest][]Reference{},
 		descs:  map[digest.Digest]ocispec.Descriptor{},
 		blobs:  map[digest.Digest][]byte{},
 	}
@@ -52,7 +56,11 @@ func (m *Memory) ListContent(ctx context.Context) ([][]Reference, error) {
 
 	contents := [][]Reference{}
 	for k := range m.blobs {
-		contents = append(contents, []Reference{{Digest: k}})
+		refs, ok := m.labels[k]
+		if !ok {
+			refs = []Reference{{Digest: k}}
+		}
+		contents = append(contents, refs)
 	}
 	return contents, nil
 }
@@ -63,7 +71,7 @@ func (m *Memory) Resolve(ctx context.Context, ref string) (digest.Digest, error)
 
 	dgst, ok := m.tags[ref]
 	if !ok {
-		return "", fmt.Errorf("could not resolve tag %s to a digest", ref)
+		return "", errors.Join(ErrNotFound, fmt.Errorf("could not resolve tag %s to a digest", ref))
 	}
 	return dgst, nil
 }
@@ -130,3 +138,63 @@ func (m *Memory) Write(desc ocispec.Descriptor, b []byte) error {
 	m.blobs[desc.Digest] = b
 	return nil
 }
+
+func (m *Memory) Ingest(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	m.mx.RLock()
+	_, ok := m.blobs[desc.Digest]
+	m.mx.RUnlock()
+	if ok {
+		return nil
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if desc.Size != int64(len(b)) {
+		return fmt.Errorf("unexpected commit size %d, expected %d", len(b), desc.Size)
+	}
+	dgst := desc.Digest.Algorithm().FromBytes(b)
+	if dgst != desc.Digest {
+		return fmt.Errorf("unexpected commit digest %s, expected %s", dgst, desc.Digest)
+	}
+	return m.Write(desc, b)
+}
+
+// Lease returns the context as is, as content is never garbage collected from memory.
+func (m *Memory) Lease(ctx context.Context, expiration time.Duration) (context.Context, func(context.Context) error, error) {
+	return ctx, func(context.Context) error { return nil }, nil
+}
+
+func (m *Memory) Label(ctx context.Context, img Image, desc ocispec.Descriptor) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if _, ok := m.blobs[desc.Digest]; !ok {
+		return errors.Join(ErrNotFound, fmt.Errorf("blob with digest %s not found", desc.Digest))
+	}
+	ref := Reference{
+		Registry:   img.Registry,
+		Repository: img.Repository,
+		Digest:     desc.Digest,
+	}
+	if !slices.Contains(m.labels[desc.Digest], ref) {
+		m.labels[desc.Digest] = append(m.labels[desc.Digest], ref)
+	}
+	if desc.Digest != img.Digest {
+		return nil
+	}
+	// Replace the existing image if the tag is moved to a new digest.
+	m.images = slices.DeleteFunc(m.images, func(existing Image) bool {
+		if img.Tag == "" {
+			return existing.Reference == img.Reference
+		}
+		return existing.Registry == img.Registry && existing.Repository == img.Repository && existing.Tag == img.Tag
+	})
+	m.images = append(m.images, img)
+	tagName, ok := img.TagName()
+	if ok {
+		m.tags[tagName] = img.Digest
+	}
+	return nil
+}
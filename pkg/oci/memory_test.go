@@ -0,0 +1,56 @@
+package oci
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryIngest(t *testing.T) {
+	t.Parallel()
+
+	b := []byte("hello world")
+	desc := ocispec.Descriptor{
+		MediaType: "dummy",
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	img, err := ParseImage("example.com/foo/bar:latest", WithDigest(desc.Digest))
+	require.NoError(t, err)
+
+	m := NewMemory()
+	err = m.Ingest(t.Context(), ocispec.Descriptor{MediaType: "dummy", Digest: digest.FromString("foo"), Size: desc.Size}, bytes.NewReader(b))
+	require.EqualError(t, err, "unexpected commit digest "+desc.Digest.String()+", expected "+digest.FromString("foo").String())
+	err = m.Ingest(t.Context(), ocispec.Descriptor{MediaType: "dummy", Digest: desc.Digest, Size: 1}, bytes.NewReader(b))
+	require.EqualError(t, err, "unexpected commit size 11, expected 1")
+	err = m.Label(t.Context(), img, desc)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	err = m.Ingest(t.Context(), desc, bytes.NewReader(b))
+	require.NoError(t, err)
+	err = m.Ingest(t.Context(), desc, bytes.NewReader(nil))
+	require.NoError(t, err)
+	rc, err := m.Open(t.Context(), desc.Digest)
+	require.NoError(t, err)
+	ingested, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, b, ingested)
+
+	err = m.Label(t.Context(), img, desc)
+	require.NoError(t, err)
+	err = m.Label(t.Context(), img, desc)
+	require.NoError(t, err)
+	imgs, err := m.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []Image{img}, imgs)
+	dgst, err := m.Resolve(t.Context(), "example.com/foo/bar:latest")
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, dgst)
+	contents, err := m.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, [][]Reference{{{Registry: "example.com", Repository: "foo/bar", Digest: desc.Digest}}}, contents)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/opencontainers/go-digest"
@@ -16,10 +17,14 @@ const (
 	// Most registries do not accept manifests larger than 4MB.
 	// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-manifests
 	ManifestMaxSize = 4 * 1024 * 1024
+	// MediaTypeArtifactManifest is the artifact manifest which was removed before the 1.1 release of the image spec.
+	// It is still served by registries that stored artifacts pushed by earlier ORAS and Notation versions.
+	MediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
 )
 
 var (
-	ErrNotFound = errors.New("content not found")
+	ErrNotFound         = errors.New("content not found")
+	ErrUnknownMediaType = errors.New("could not determine media type")
 )
 
 type EventType string
@@ -58,6 +63,23 @@ type Store interface {
 	Subscribe(ctx context.Context) (<-chan OCIEvent, error)
 }
 
+// WritableStore is a store that fetched content can be persisted to.
+type WritableStore interface {
+	Store
+
+	// Ingest writes the content for the descriptor and commits it once the size and digest has been verified.
+	// Content that already exists is not written again.
+	Ingest(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error
+
+	// Label marks committed content as belonging to the image repository.
+	// The image is created when the content is the image manifest.
+	Label(ctx context.Context, img Image, desc ocispec.Descriptor) error
+
+	// Lease returns a context that protects the content ingested or labeled with it from garbage collection.
+	// The protection ends when the returned function is called or when the expiration has passed.
+	Lease(ctx context.Context, expiration time.Duration) (context.Context, func(context.Context) error, error)
+}
+
 // FingerprintMediaType attempts to determine the media type based on the json structure.
 func FingerprintMediaType(r io.Reader) (string, error) {
 	dec := json.NewDecoder(r)
@@ -69,8 +91,9 @@ func FingerprintMediaType(r io.Reader) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// Manifests, indexes and configs are always JSON objects.
 	if tok != json.Delim('{') {
-		return "", errors.New("expected object start")
+		return httpx.ContentTypeBinary, nil
 	}
 
 	if !dec.More() {
@@ -150,13 +173,26 @@ func FingerprintMediaType(r io.Reader) (string, error) {
 				return "", err
 			}
 		}
+	}
+	// The media type is only trusted once the whole object has been decoded, so that malformed content
+	// with a manifest media type is not detected as a manifest.
+	_, err = dec.Token()
+	if err != nil {
+		return "", err
+	}
+	_, err = dec.Token()
+	if !errors.Is(err, io.EOF) {
+		return "", errors.New("unexpected content after JSON object")
+	}
 
-		// Return immediately if schema version and media type is set.
-		if schemaVersion == 2 && mediaType != "" {
-			return mediaType, nil
-		}
+	if schemaVersion == 2 && mediaType != "" {
+		return mediaType, nil
 	}
 
+	// Artifact manifests do not have a schema version.
+	if IsManifestsMediatype(mediaType) {
+		return mediaType, nil
+	}
 	if indexKeys == 1 {
 		return ocispec.MediaTypeImageIndex, nil
 	}
@@ -166,7 +202,63 @@ func FingerprintMediaType(r io.Reader) (string, error) {
 	if configKeys == 3 {
 		return ocispec.MediaTypeImageConfig, nil
 	}
-	return "", errors.New("could not determine media type")
+	return "", ErrUnknownMediaType
+}
+
+// DetectMediaType determines the media type of stored content.
+// JSON which is not a manifest, index or image config, such as the config of a Helm chart or WASM module, is treated as binary.
+// Content which fails to decode as JSON after the first token is also treated as binary, only errors from reading the
+// content and empty content are returned.
+func DetectMediaType(r io.Reader) (string, error) {
+	er := &errReader{r: r}
+	mt, err := FingerprintMediaType(er)
+	if er.err != nil && !errors.Is(er.err, io.EOF) {
+		return "", er.err
+	}
+	if errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if err != nil {
+		return httpx.ContentTypeBinary, nil
+	}
+	return mt, nil
+}
+
+// errReader keeps track of the last error returned by the underlying reader.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// ManifestChildren returns the descriptors referenced by the manifest, index or artifact manifest.
+// The subject is not included as it is not part of the content of the manifest.
+func ManifestChildren(b []byte) ([]ocispec.Descriptor, error) {
+	var manifest struct {
+		Config    *ocispec.Descriptor  `json:"config"`
+		Manifests []ocispec.Descriptor `json:"manifests"`
+		Layers    []ocispec.Descriptor `json:"layers"`
+		Blobs     []ocispec.Descriptor `json:"blobs"`
+	}
+	err := json.Unmarshal(b, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	children := []ocispec.Descriptor{}
+	children = append(children, manifest.Manifests...)
+	if manifest.Config != nil {
+		children = append(children, *manifest.Config)
+	}
+	children = append(children, manifest.Layers...)
+	children = append(children, manifest.Blobs...)
+	return children, nil
 }
 
 func IsManifestsMediatype(mt string) bool {
@@ -174,7 +266,8 @@ func IsManifestsMediatype(mt string) bool {
 	case ocispec.MediaTypeImageIndex,
 		ocispec.MediaTypeImageManifest,
 		images.MediaTypeDockerSchema2ManifestList,
-		images.MediaTypeDockerSchema2Manifest:
+		images.MediaTypeDockerSchema2Manifest,
+		MediaTypeArtifactManifest:
 		return true
 	default:
 		return false
@@ -1,16 +1,20 @@
 package oci
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/httpx"
 )
 
 func TestFingerprintMediaType(t *testing.T) {
@@ -75,6 +79,68 @@ func TestFingerprintMediaType(t *testing.T) {
 
 	_, err = FingerprintMediaType(strings.NewReader("{\"unexpected\":\"value\"}"))
 	require.EqualError(t, err, "could not determine media type")
+
+	_, err = FingerprintMediaType(strings.NewReader(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[}`))
+	require.Error(t, err)
+
+	mt, err = FingerprintMediaType(strings.NewReader(`["not","an","object"]`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	mt, err = FingerprintMediaType(strings.NewReader(`{"mediaType":"application/vnd.oci.artifact.manifest.v1+json","artifactType":"application/vnd.cncf.notary.signature","blobs":[]}`))
+	require.NoError(t, err)
+	require.Equal(t, MediaTypeArtifactManifest, mt)
+
+	mt, err = FingerprintMediaType(strings.NewReader(`{"schemaVersion":2,"artifactType":"application/vnd.wasm.module.v1","config":{"mediaType":"application/vnd.oci.empty.v1+json"},"layers":[]}`))
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageManifest, mt)
+}
+
+func TestDetectMediaType(t *testing.T) {
+	t.Parallel()
+
+	mt, err := DetectMediaType(strings.NewReader(`{"name":"app","version":"0.1.0","apiVersion":"v2"}`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	mt, err = DetectMediaType(strings.NewReader("{}"))
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeEmptyJSON, mt)
+
+	mt, err = DetectMediaType(strings.NewReader(`{"name":"app","version":`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	mt, err = DetectMediaType(strings.NewReader(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",}`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	mt, err = DetectMediaType(strings.NewReader(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	mt, err = DetectMediaType(strings.NewReader(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}{}`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	mt, err = DetectMediaType(strings.NewReader(`{"config":{}"layers":[]}`))
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, mt)
+
+	_, err = DetectMediaType(strings.NewReader(" "))
+	require.ErrorIs(t, err, io.EOF)
+
+	_, err = DetectMediaType(iotest.ErrReader(errors.New("read error")))
+	require.EqualError(t, err, "read error")
+}
+
+func TestManifestChildren(t *testing.T) {
+	t.Parallel()
+
+	b := []byte(`{"mediaType":"application/vnd.oci.artifact.manifest.v1+json","blobs":[{"digest":"sha256:b6d6089ca6c395fd563c2084f5dd7bc56a2f5e6a81413558c5be0083287a77e9"}],"subject":{"digest":"sha256:68b8a989a3e08ddbdb3a0077d35c0d0e59c9ecf23d0634584def8bdbb7d6824f"}}`)
+	children, err := ManifestChildren(b)
+	require.NoError(t, err)
+	require.Equal(t, []ocispec.Descriptor{{Digest: digest.Digest("sha256:b6d6089ca6c395fd563c2084f5dd7bc56a2f5e6a81413558c5be0083287a77e9")}}, children)
 }
 
 func TestIsManifestMediatype(t *testing.T) {
@@ -100,6 +166,10 @@ func TestIsManifestMediatype(t *testing.T) {
 			mt:       images.MediaTypeDockerSchema2Manifest,
 			expected: true,
 		},
+		{
+			mt:       MediaTypeArtifactManifest,
+			expected: true,
+		},
 		{
 			mt:       "foo",
 			expected: false,
@@ -0,0 +1,172 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	HeaderFiltersApplied = "OCI-Filters-Applied"
+)
+
+// ReferrersKey returns the key advertised by peers that have content referring to the subject.
+func ReferrersKey(subject digest.Digest) string {
+	return "referrers/" + subject.String()
+}
+
+// ReadReferrer returns the descriptor of the content as it is listed in a referrers index together with its subject.
+// The subject is empty when the content is not a manifest with a subject.
+func ReadReferrer(ctx context.Context, store Store, dgst digest.Digest) (ocispec.Descriptor, digest.Digest, error) {
+	desc, err := store.Descriptor(ctx, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if !IsManifestsMediatype(desc.MediaType) || desc.Size > ManifestMaxSize {
+		return ocispec.Descriptor{}, "", nil
+	}
+	rc, err := store.Open(ctx, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, ManifestMaxSize))
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	return parseReferrer(desc, b)
+}
+
+func parseReferrer(desc ocispec.Descriptor, b []byte) (ocispec.Descriptor, digest.Digest, error) {
+	var manifest struct {
+		Config       *ocispec.Descriptor `json:"config"`
+		Subject      *ocispec.Descriptor `json:"subject"`
+		Annotations  map[string]string   `json:"annotations"`
+		MediaType    string              `json:"mediaType"`
+		ArtifactType string              `json:"artifactType"`
+	}
+	err := json.Unmarshal(b, &manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if manifest.Subject == nil {
+		return ocispec.Descriptor{}, "", nil
+	}
+	// Image manifests without an artifact type use the config media type.
+	// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+	artifactType := manifest.ArtifactType
+	if artifactType == "" && manifest.Config != nil {
+		artifactType = manifest.Config.MediaType
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	referrer := ocispec.Descriptor{
+		MediaType:    mediaType,
+		ArtifactType: artifactType,
+		Digest:       desc.Digest,
+		Size:         desc.Size,
+		Annotations:  manifest.Annotations,
+	}
+	return referrer, manifest.Subject.Digest, nil
+}
+
+// ReferrersIndex keeps track of the content in a store that refers to a subject. It is kept up to date from the
+// events of the store, so that listing referrers does not require reading all content in the store.
+type ReferrersIndex struct {
+	referrers map[digest.Digest]map[digest.Digest]ocispec.Descriptor
+	subjects  map[digest.Digest]digest.Digest
+	mx        sync.RWMutex
+}
+
+func NewReferrersIndex() *ReferrersIndex {
+	return &ReferrersIndex{
+		referrers: map[digest.Digest]map[digest.Digest]ocispec.Descriptor{},
+		subjects:  map[digest.Digest]digest.Digest{},
+	}
+}
+
+// Add adds the content described by the referrer descriptor as a referrer of the subject.
+func (r *ReferrersIndex) Add(desc ocispec.Descriptor, subject digest.Digest) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.subjects[desc.Digest] = subject
+	if _, ok := r.referrers[subject]; !ok {
+		r.referrers[subject] = map[digest.Digest]ocispec.Descriptor{}
+	}
+	r.referrers[subject][desc.Digest] = desc
+}
+
+// Remove removes the content from the index and returns the subject it referred to, if any.
+func (r *ReferrersIndex) Remove(dgst digest.Digest) (digest.Digest, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	subject, ok := r.subjects[dgst]
+	if !ok {
+		return "", false
+	}
+	delete(r.subjects, dgst)
+	delete(r.referrers[subject], dgst)
+	if len(r.referrers[subject]) == 0 {
+		delete(r.referrers, subject)
+	}
+	return subject, true
+}
+
+// HasReferrers returns true when any content refers to the subject.
+func (r *ReferrersIndex) HasReferrers(subject digest.Digest) bool {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	return len(r.referrers[subject]) > 0
+}
+
+// Replace replaces the contents of the index with the contents of the other index.
+func (r *ReferrersIndex) Replace(other *ReferrersIndex) {
+	other.mx.RLock()
+	referrers := map[digest.Digest]map[digest.Digest]ocispec.Descriptor{}
+	for subject, descs := range other.referrers {
+		referrers[subject] = maps.Clone(descs)
+	}
+	subjects := maps.Clone(other.subjects)
+	other.mx.RUnlock()
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.referrers = referrers
+	r.subjects = subjects
+}
+
+// Referrers returns the descriptors of the content that refers to the subject, sorted by digest.
+// The referrers are filtered by artifact type when it is not empty.
+func (r *ReferrersIndex) Referrers(subject digest.Digest, artifactType string) []ocispec.Descriptor {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	referrers := []ocispec.Descriptor{}
+	for _, desc := range r.referrers[subject] {
+		if artifactType != "" && desc.ArtifactType != artifactType {
+			continue
+		}
+		referrers = append(referrers, desc)
+	}
+	SortReferrers(referrers)
+	return referrers
+}
+
+// SortReferrers sorts the referrer descriptors by digest.
+func SortReferrers(referrers []ocispec.Descriptor) {
+	slices.SortFunc(referrers, func(a, b ocispec.Descriptor) int {
+		return strings.Compare(a.Digest.String(), b.Digest.String())
+	})
+}
@@ -0,0 +1,116 @@
+package oci
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferrersIndex(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemory()
+	write := func(mediaType string, v any) ocispec.Descriptor {
+		t.Helper()
+
+		b, ok := v.([]byte)
+		if !ok {
+			var err error
+			b, err = json.Marshal(v)
+			require.NoError(t, err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		err := store.Write(desc, b)
+		require.NoError(t, err)
+		return desc
+	}
+	emptyDesc := write(ocispec.MediaTypeEmptyJSON, []byte("{}"))
+	configDesc := write(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{}}`))
+	subject := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{}}
+	subject.SchemaVersion = 2
+	subjectDesc := write(ocispec.MediaTypeImageManifest, subject)
+	signature := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+		Config:       emptyDesc,
+		Layers:       []ocispec.Descriptor{emptyDesc},
+		Subject:      &subjectDesc,
+		Annotations:  map[string]string{"foo": "bar"},
+	}
+	signature.SchemaVersion = 2
+	signatureDesc := write(ocispec.MediaTypeImageManifest, signature)
+	sbomConfigDesc := write("application/spdx+json", []byte(`{"spdxVersion":"SPDX-2.3"}`))
+	sbom := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    sbomConfigDesc,
+		Layers:    []ocispec.Descriptor{},
+		Subject:   &subjectDesc,
+	}
+	sbom.SchemaVersion = 2
+	sbomDesc := write(ocispec.MediaTypeImageManifest, sbom)
+
+	idx := NewReferrersIndex()
+	for _, desc := range []ocispec.Descriptor{emptyDesc, configDesc, subjectDesc, signatureDesc, sbomConfigDesc, sbomDesc} {
+		referrer, subjectDgst, err := ReadReferrer(t.Context(), store, desc.Digest)
+		require.NoError(t, err)
+		if subjectDgst != "" {
+			idx.Add(referrer, subjectDgst)
+		}
+	}
+
+	referrers := idx.Referrers(subjectDesc.Digest, "")
+	expected := []ocispec.Descriptor{
+		{
+			MediaType:    ocispec.MediaTypeImageManifest,
+			ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+			Digest:       signatureDesc.Digest,
+			Size:         signatureDesc.Size,
+			Annotations:  map[string]string{"foo": "bar"},
+		},
+		{
+			MediaType:    ocispec.MediaTypeImageManifest,
+			ArtifactType: "application/spdx+json",
+			Digest:       sbomDesc.Digest,
+			Size:         sbomDesc.Size,
+		},
+	}
+	if expected[0].Digest > expected[1].Digest {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	require.Equal(t, expected, referrers)
+
+	referrers = idx.Referrers(subjectDesc.Digest, "application/spdx+json")
+	require.Len(t, referrers, 1)
+	require.Equal(t, sbomDesc.Digest, referrers[0].Digest)
+
+	referrers = idx.Referrers(signatureDesc.Digest, "")
+	require.Empty(t, referrers)
+
+	replaced := NewReferrersIndex()
+	replaced.Replace(idx)
+	require.Len(t, replaced.Referrers(subjectDesc.Digest, ""), 2)
+
+	subjectDgst, ok := idx.Remove(signatureDesc.Digest)
+	require.True(t, ok)
+	require.Equal(t, subjectDesc.Digest, subjectDgst)
+	require.True(t, idx.HasReferrers(subjectDesc.Digest))
+	_, ok = idx.Remove(signatureDesc.Digest)
+	require.False(t, ok)
+	_, ok = idx.Remove(sbomDesc.Digest)
+	require.True(t, ok)
+	require.False(t, idx.HasReferrers(subjectDesc.Digest))
+	require.Empty(t, idx.Referrers(subjectDesc.Digest, ""))
+	require.Len(t, replaced.Referrers(subjectDesc.Digest, ""), 2)
+
+	_, subjectDgst, err := ReadReferrer(t.Context(), store, signatureDesc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, subjectDesc.Digest, subjectDgst)
+	_, subjectDgst, err = ReadReferrer(t.Context(), store, configDesc.Digest)
+	require.NoError(t, err)
+	require.Empty(t, subjectDgst)
+
+	require.Equal(t, "referrers/"+subjectDesc.Digest.String(), ReferrersKey(subjectDesc.Digest))
+}
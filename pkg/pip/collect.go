@@ -0,0 +1,49 @@
+package pip
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// cacheKeys returns the keys that are advertised for the name in the cache.
+func cacheKeys(name string) []string {
+	keys := []string{}
+	lower := strings.ToLower(path.Base(name))
+	if isCacheable(lower) {
+		keys = append(keys, fmt.Sprintf("pip:%s", lower))
+	}
+	// Indexes are advertised by the name of their project.
+	if project, ok := strings.CutSuffix(lower, ".json"); ok {
+		keys = append(keys, fmt.Sprintf("pip:%s", project))
+	}
+	return keys
+}
+
+// RunCacheCollection collects the cache at the interval until the context is cancelled, which evicts files once the
+// cache exceeds its quota. The keys of removed files are withdrawn by the cache tracker once it finds them removed.
+func (p *PipClient) RunCacheCollection(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			err := p.collectCache()
+			if err != nil {
+				p.Log.Error(err, "could not collect pip cache")
+			}
+		}
+	}
+}
+
+func (p *PipClient) collectCache() error {
+	removed, err := p.store.Collect()
+	if len(removed) > 0 {
+		p.Log.Info("removed files from pip cache", "files", len(removed))
+	}
+	return err
+}
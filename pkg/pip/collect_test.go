@@ -0,0 +1,42 @@
+package pip
+
+import (
+	"net/netip"
+	"testing"
+
+	"clyde/pkg/cache"
+	"clyde/pkg/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectCache(t *testing.T) {
+	t.Parallel()
+
+	self := netip.MustParseAddrPort("10.0.0.1:5000")
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, self)
+	eviction := cache.Eviction{
+		MaxBytes: 9,
+		Pinned:   []string{"pinned-*"},
+	}
+	client := NewPipClient(router, t.TempDir(), "https://pypi.org/simple/", WithCacheEviction(eviction))
+	for name, content := range map[string]string{
+		"pinned-1.0.whl": "pinned",
+		"old-1.0.whl":    "old",
+		"new-1.0.whl":    "new",
+	} {
+		w, err := client.store.Create(name, "")
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, w.Commit())
+	}
+	_, err := client.store.ReadFile("new-1.0.whl")
+	require.NoError(t, err)
+
+	// The least recently used file that is not pinned is evicted, which the cache tracker finds when it walks the cache.
+	require.NoError(t, client.collectCache())
+	keys, err := client.WalkPipDir(t.Context())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"pip:pinned-1.0.whl", "pip:new-1.0.whl"}, keys)
+}
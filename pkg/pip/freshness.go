@@ -0,0 +1,256 @@
+package pip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"clyde/pkg/routing"
+)
+
+// headerMirrored is set on requests between peers for indexes, which are only served from the cache of the peer.
+const headerMirrored = "X-Clyde-Mirrored"
+
+// indexFreshness records when an index was fetched from the upstreams and the validators returned by each upstream,
+// so that a stale index can be revalidated with conditional requests.
+type indexFreshness struct {
+	Fetched    time.Time                  `json:"fetched"`
+	Validators map[string]indexValidators `json:"validators,omitempty"`
+}
+
+type indexValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+}
+
+// fromUpstream returns the files of the index that are listed by the upstream.
+func (idx *projectIndex) fromUpstream(upstream string) projectIndex {
+	files := []indexFile{}
+	for _, f := range idx.Files {
+		if f.Upstream == upstream {
+			files = append(files, f)
+		}
+	}
+	return projectIndex{Name: idx.Name, Files: files, Versions: idx.Versions}
+}
+
+func (p *PipClient) isFresh(idx projectIndex) bool {
+	return time.Since(idx.Freshness.Fetched) < p.IndexTTL
+}
+
+// canServeStale returns true when a stale index may be served because the upstreams failed.
+func (p *PipClient) canServeStale(idx projectIndex) bool {
+	return time.Since(idx.Freshness.Fetched) < p.IndexTTL+p.IndexStaleIfError
+}
+
+// serveIndex serves the index of a project. A fresh cached index is served as is. Otherwise the freshest copy of the
+// peers is served when it is fresh, before the index is revalidated with the upstreams. The best known copy is served
+// when the upstreams fail and it has been stale for less than the stale-if-error duration.
+func (p *PipClient) serveIndex(rw http.ResponseWriter, req *http.Request, name, key string) {
+	cached, hasCached := p.loadIndex(name)
+	// Peers only serve the index they have cached so that requests for an index do not fan out across the cluster.
+	if req.Header.Get(headerMirrored) == "true" {
+		if !hasCached {
+			http.Error(rw, fmt.Sprintf("index of %s is not cached", name), http.StatusNotFound)
+			return
+		}
+		p.writeIndex(rw, req, name, cached)
+		return
+	}
+	if hasCached && p.isFresh(cached) {
+		p.Log.Info("serving index from local cache", "name", name)
+		p.writeIndex(rw, req, name, cached)
+		return
+	}
+
+	var base *projectIndex
+	if hasCached {
+		base = &cached
+	}
+	if idx, ok := p.fetchIndexFromPeers(req.Context(), key, name); ok && (base == nil || idx.Freshness.Fetched.After(base.Freshness.Fetched)) {
+		p.storeIndex(name, idx)
+		if p.isFresh(idx) {
+			p.Log.Info("serving index from peer", "name", name)
+			p.writeIndex(rw, req, name, idx)
+			return
+		}
+		base = &idx
+	}
+
+	var lease *routing.Lease
+	if p.Leaser != nil {
+		var owner bool
+		var err error
+		lease, owner, err = p.Leaser.Acquire(req.Context(), key)
+		if err != nil {
+			p.Log.Error(err, "failed to acquire upstream lease", "key", key)
+			http.Error(rw, fmt.Sprintf("failed to acquire upstream lease: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if !owner {
+			p.Log.Info("index fetched by another request", "key", key)
+			if idx, ok := p.loadIndex(name); ok && p.isFresh(idx) {
+				p.writeIndex(rw, req, name, idx)
+				return
+			}
+			if idx, ok := p.fetchIndexFromPeers(req.Context(), key, name); ok && p.isFresh(idx) {
+				p.storeIndex(name, idx)
+				p.writeIndex(rw, req, name, idx)
+				return
+			}
+		}
+	}
+
+	p.Log.Info("revalidating index with upstreams", "name", name, "conditional", base != nil)
+	idx, found, err := p.fetchIndexes(req.Context(), name, base)
+	switch {
+	case err != nil && base != nil && p.canServeStale(*base):
+		p.Log.Error(err, "serving stale index as upstreams failed", "name", name, "fetched", base.Freshness.Fetched)
+		p.writeIndex(rw, req, name, *base)
+		go p.advertiseFetched(lease, "", err)
+	case !found && err != nil:
+		p.Log.Error(err, "failed to fetch index from upstreams", "name", name)
+		http.Error(rw, fmt.Sprintf("failed to fetch index from upstreams: %v", err), http.StatusBadGateway)
+		go p.advertiseFetched(lease, "", err)
+	case !found:
+		http.Error(rw, fmt.Sprintf("project %s not found", name), http.StatusNotFound)
+		go p.advertiseFetched(lease, "", fmt.Errorf("project %s not found in any upstream", name))
+	default:
+		p.writeIndex(rw, req, name, idx)
+		if err != nil {
+			p.Log.Error(err, "index is not cached as some upstreams failed", "name", name)
+			go p.advertiseFetched(lease, "", err)
+			return
+		}
+		if err := p.cacheIndex(name, idx); err != nil {
+			p.Log.Error(err, "failed to cache index", "name", name)
+			go p.advertiseFetched(lease, "", nil)
+			return
+		}
+		go p.advertiseFetched(lease, name, nil)
+	}
+}
+
+func (p *PipClient) writeIndex(rw http.ResponseWriter, req *http.Request, name string, idx projectIndex) {
+	if err := writeIndex(rw, req, idx); err != nil {
+		p.Log.Error(err, "failed to write index to client", "name", name)
+	}
+}
+
+// loadIndex reads the cached index of the project. Indexes cached without freshness are considered fetched
+// when the file was last modified.
+func (p *PipClient) loadIndex(name string) (projectIndex, bool) {
+	info, err := p.store.Stat(name + ".json")
+	if err != nil {
+		return projectIndex{}, false
+	}
+	b, err := p.store.ReadFile(name + ".json")
+	if err != nil {
+		p.Log.Error(err, "failed to read cached index", "name", name)
+		return projectIndex{}, false
+	}
+	idx := projectIndex{}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		p.Log.Error(err, "failed to decode cached index", "name", name)
+		return projectIndex{}, false
+	}
+	if idx.Freshness.Fetched.IsZero() {
+		idx.Freshness.Fetched = info.ModTime
+	}
+	return idx, true
+}
+
+// storeIndex caches an index received from a peer and advertises it.
+func (p *PipClient) storeIndex(name string, idx projectIndex) {
+	if err := p.cacheIndex(name, idx); err != nil {
+		p.Log.Error(err, "failed to cache index", "name", name)
+		return
+	}
+	p.advertiseFetched(nil, name, nil)
+}
+
+// fetchIndexFromPeers fetches the cached index of the project from the peers that advertise it, and returns the
+// copy that was fetched from the upstreams most recently.
+func (p *PipClient) fetchIndexFromPeers(ctx context.Context, key, name string) (projectIndex, bool) {
+	lookupCtx, cancel := context.WithTimeout(ctx, p.ResolveTimeout)
+	defer cancel()
+	balancer, err := p.Router.Lookup(lookupCtx, key, p.ResolveRetries)
+	if err != nil {
+		p.Log.Error(err, "failed to resolve P2P peers", "key", key)
+		return projectIndex{}, false
+	}
+	peers := []netip.AddrPort{}
+	for len(peers) < p.ResolveRetries {
+		peer, err := balancer.Next()
+		if err != nil || slices.Contains(peers, peer) {
+			break
+		}
+		peers = append(peers, peer)
+	}
+
+	mx := sync.Mutex{}
+	freshest := projectIndex{}
+	found := false
+	wg := sync.WaitGroup{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			idx, err := p.fetchPeerIndex(ctx, peer, name)
+			if err != nil {
+				p.Log.Error(err, "could not fetch index from peer", "name", name, "peer", peer)
+				return
+			}
+			mx.Lock()
+			defer mx.Unlock()
+			if !found || idx.Freshness.Fetched.After(freshest.Freshness.Fetched) {
+				freshest = idx
+				found = true
+			}
+		}()
+	}
+	wg.Wait()
+	return freshest, found
+}
+
+func (p *PipClient) fetchPeerIndex(ctx context.Context, peer netip.AddrPort, name string) (projectIndex, error) {
+	u := url.URL{
+		Scheme: "http",
+		Host:   peer.String(),
+		Path:   "/simple/" + name + "/",
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return projectIndex{}, err
+	}
+	req.Header.Set("Accept", ContentTypeSimpleJSON)
+	req.Header.Set(headerMirrored, "true")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return projectIndex{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return projectIndex{}, fmt.Errorf("unexpected peer status: %s", resp.Status)
+	}
+	// The index of a peer already points to the node and keeps the origin of each file.
+	idx := projectIndex{}
+	err = json.NewDecoder(resp.Body).Decode(&idx)
+	if err != nil {
+		return projectIndex{}, fmt.Errorf("could not decode index from peer: %w", err)
+	}
+	idx.Name = name
+	idx.Meta.APIVersion = apiVersion
+	// The clock of the peer is not trusted, an index can not have been fetched after it was received.
+	if now := time.Now(); idx.Freshness.Fetched.After(now) {
+		idx.Freshness.Fetched = now
+	}
+	return idx, nil
+}
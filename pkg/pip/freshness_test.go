@@ -0,0 +1,159 @@
+package pip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clyde/pkg/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getTestIndex(t *testing.T, client *PipClient, name string, header http.Header) (int, projectIndex) {
+	t.Helper()
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/simple/"+name+"/", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", ContentTypeSimpleJSON)
+	client.PipRegistryHandler(rw, req)
+	idx := projectIndex{}
+	if rw.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &idx))
+	}
+	return rw.Code, idx
+}
+
+func TestPipRegistryHandlerIndexRevalidation(t *testing.T) {
+	t.Parallel()
+
+	mx := sync.Mutex{}
+	version := "1.0"
+	status := http.StatusOK
+	notModified := atomic.Int32{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		etag := fmt.Sprintf("%q", version)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", ContentTypeSimpleJSON)
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"meta": {"api-version": "1.1"}, "name": "fresh", "files": [{"filename": "fresh-%[1]s.tar.gz", "url": "https://files.pythonhosted.org/packages/ab/cd/fresh-%[1]s.tar.gz", "hashes": {}}]}`, version)
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	// Cached indexes are never fresh so that each request revalidates the index.
+	client := NewPipClient(router, tempDir, upstream.URL+"/simple/", WithIndexFreshness(0, time.Hour))
+
+	code, idx := getTestIndex(t, client, "fresh", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, idx.Files, 1)
+	cached, ok := client.loadIndex("fresh")
+	require.True(t, ok)
+	require.Equal(t, indexValidators{ETag: `"1.0"`}, cached.Freshness.Validators["default"])
+	fetched := cached.Freshness.Fetched
+
+	// The index is revalidated with the validators of the cached index.
+	code, idx = getTestIndex(t, client, "fresh", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "fresh-1.0.tar.gz", idx.Files[0].Filename)
+	require.Equal(t, int32(1), notModified.Load())
+	cached, ok = client.loadIndex("fresh")
+	require.True(t, ok)
+	require.True(t, cached.Freshness.Fetched.After(fetched))
+	require.Equal(t, indexValidators{ETag: `"1.0"`}, cached.Freshness.Validators["default"])
+
+	// New versions are visible once the index is revalidated.
+	mx.Lock()
+	version = "2.0"
+	mx.Unlock()
+	code, idx = getTestIndex(t, client, "fresh", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "fresh-2.0.tar.gz", idx.Files[0].Filename)
+
+	// The stale index is served when the upstream fails within the stale-if-error duration.
+	mx.Lock()
+	status = http.StatusInternalServerError
+	mx.Unlock()
+	code, idx = getTestIndex(t, client, "fresh", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "fresh-2.0.tar.gz", idx.Files[0].Filename)
+	expiredClient := NewPipClient(router, tempDir, upstream.URL+"/simple/", WithIndexFreshness(0, 0))
+	code, _ = getTestIndex(t, expiredClient, "fresh", nil)
+	require.Equal(t, http.StatusBadGateway, code)
+
+	// Peers are only served the cached index without revalidating it.
+	mirrored := http.Header{headerMirrored: []string{"true"}}
+	code, idx = getTestIndex(t, expiredClient, "fresh", mirrored)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "fresh-2.0.tar.gz", idx.Files[0].Filename)
+	code, _ = getTestIndex(t, expiredClient, "missing", mirrored)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestPipRegistryHandlerFreshestPeerIndex(t *testing.T) {
+	t.Parallel()
+
+	newPeer := func(age time.Duration, filename string) netip.AddrPort {
+		idx := projectIndex{
+			Meta:      indexMeta{APIVersion: apiVersion},
+			Name:      "shared",
+			Files:     []indexFile{{Filename: filename, URL: "/packages/ab/cd/" + filename}},
+			Freshness: indexFreshness{Fetched: time.Now().Add(-age)},
+		}
+		b, err := json.Marshal(idx)
+		require.NoError(t, err)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "true", r.Header.Get(headerMirrored))
+			w.Header().Set("Content-Type", ContentTypeSimpleJSON)
+			_, _ = w.Write(b)
+		}))
+		t.Cleanup(srv.Close)
+		return netip.MustParseAddrPort(srv.Listener.Addr().String())
+	}
+	peers := []netip.AddrPort{
+		newPeer(5*time.Minute, "shared-1.0.tar.gz"),
+		newPeer(time.Minute, "shared-2.0.tar.gz"),
+		newPeer(time.Hour, "shared-0.9.tar.gz"),
+	}
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{"pip:shared": peers}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	client := NewPipClient(router, tempDir, "http://invalid-upstream/simple/")
+
+	code, idx := getTestIndex(t, client, "shared", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, idx.Files, 1)
+	require.Equal(t, "shared-2.0.tar.gz", idx.Files[0].Filename)
+	cached, ok := client.loadIndex("shared")
+	require.True(t, ok)
+	require.Equal(t, "shared-2.0.tar.gz", cached.Files[0].Filename)
+
+	// Indexes that a peer claims to have fetched in the future are considered fetched when they are received.
+	router = routing.NewMemoryRouter(map[string][]netip.AddrPort{"pip:shared": {newPeer(-24*time.Hour, "shared-3.0.tar.gz")}}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	client = NewPipClient(router, t.TempDir(), "http://invalid-upstream/simple/")
+	code, idx = getTestIndex(t, client, "shared", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "shared-3.0.tar.gz", idx.Files[0].Filename)
+	cached, ok = client.loadIndex("shared")
+	require.True(t, ok)
+	require.False(t, cached.Freshness.Fetched.After(time.Now()))
+}
@@ -0,0 +1,355 @@
+package pip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Content types of the simple repository API.
+const (
+	ContentTypeSimpleJSON = "application/vnd.pypi.simple.v1+json"
+	ContentTypeSimpleHTML = "application/vnd.pypi.simple.v1+html"
+	ContentTypeHTML       = "text/html"
+
+	// upstreamAccept prefers the JSON format from upstream as it is parsed without ambiguity.
+	upstreamAccept = ContentTypeSimpleJSON + ", " + ContentTypeSimpleHTML + ";q=0.2, " + ContentTypeHTML + ";q=0.01"
+	filesHost      = "https://files.pythonhosted.org/packages/"
+	apiVersion     = "1.1"
+)
+
+var (
+	nameRegex   = regexp.MustCompile(`[-_.]+`)
+	anchorRegex = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a\s*>`)
+	attrRegex   = regexp.MustCompile(`(?s)([a-zA-Z][a-zA-Z0-9-]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+)
+
+// projectIndex is the list of files of a project in the simple repository API. It is stored in the JSON format
+// with URLs that point to this node and is rendered in the format negotiated by the client.
+type projectIndex struct {
+	Meta     indexMeta   `json:"meta"`
+	Name     string      `json:"name"`
+	Files    []indexFile `json:"files"`
+	Versions []string    `json:"versions,omitempty"`
+	// Freshness is kept in a private key so that peers can compare the age of their copies.
+	Freshness indexFreshness `json:"_freshness,omitzero"`
+}
+
+type indexMeta struct {
+	APIVersion string `json:"api-version"`
+}
+
+type indexFile struct {
+	Filename       string            `json:"filename"`
+	URL            string            `json:"url"`
+	Hashes         map[string]string `json:"hashes"`
+	RequiresPython string            `json:"requires-python,omitempty"`
+	CoreMetadata   coreMetadata      `json:"core-metadata"`
+	// DistInfoMetadata is the name of core metadata before PEP 714, which older clients still read.
+	DistInfoMetadata coreMetadata `json:"dist-info-metadata"`
+	Yanked           yanked       `json:"yanked"`
+	Size             *int64       `json:"size,omitempty"`
+	UploadTime       string       `json:"upload-time,omitempty"`
+	// Origin and Upstream are the URL that the file is fetched from and the name of the upstream that lists it.
+	// Keys with a leading underscore are reserved for private use by the index, so that peers receive them while
+	// clients ignore them.
+	Origin   string `json:"_origin,omitempty"`
+	Upstream string `json:"_upstream,omitempty"`
+}
+
+// coreMetadata is either a boolean or the hashes of the core metadata file of a distribution.
+type coreMetadata struct {
+	Hashes    map[string]string
+	Available bool
+}
+
+func (m coreMetadata) MarshalJSON() ([]byte, error) {
+	if m.Available && len(m.Hashes) > 0 {
+		return json.Marshal(m.Hashes)
+	}
+	return json.Marshal(m.Available)
+}
+
+func (m *coreMetadata) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*m = coreMetadata{}
+		return nil
+	}
+	if err := json.Unmarshal(b, &m.Available); err == nil {
+		return nil
+	}
+	m.Available = true
+	return json.Unmarshal(b, &m.Hashes)
+}
+
+// yanked is either a boolean or the reason that a file was yanked.
+type yanked struct {
+	Reason string
+	Yanked bool
+}
+
+func (y yanked) MarshalJSON() ([]byte, error) {
+	if y.Yanked && y.Reason != "" {
+		return json.Marshal(y.Reason)
+	}
+	return json.Marshal(y.Yanked)
+}
+
+func (y *yanked) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*y = yanked{}
+		return nil
+	}
+	if err := json.Unmarshal(b, &y.Yanked); err == nil {
+		return nil
+	}
+	y.Yanked = true
+	return json.Unmarshal(b, &y.Reason)
+}
+
+// normalizeName returns the normalized name of a project as defined by PEP 503.
+func normalizeName(name string) string {
+	return strings.ToLower(nameRegex.ReplaceAllString(name, "-"))
+}
+
+// parseIndex parses the index of a project in the JSON or HTML format. Relative URLs are resolved against the
+// URL of the index.
+func parseIndex(contentType string, b []byte, indexURL *url.URL) (projectIndex, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ContentTypeHTML
+	}
+	idx := projectIndex{}
+	switch mediaType {
+	case ContentTypeSimpleJSON:
+		err := json.Unmarshal(b, &idx)
+		if err != nil {
+			return projectIndex{}, fmt.Errorf("could not decode JSON index: %w", err)
+		}
+	case ContentTypeSimpleHTML, ContentTypeHTML:
+		idx = parseHTMLIndex(b)
+	default:
+		return projectIndex{}, fmt.Errorf("unsupported index content type %s", mediaType)
+	}
+
+	for i, f := range idx.Files {
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			return projectIndex{}, fmt.Errorf("invalid URL of file %s: %w", f.Filename, err)
+		}
+		if indexURL != nil {
+			u = indexURL.ResolveReference(u)
+		}
+		if f.Hashes == nil {
+			f.Hashes = map[string]string{}
+		}
+		// Hashes are only part of the URL in the HTML format.
+		if algorithm, value, ok := strings.Cut(u.Fragment, "="); ok {
+			f.Hashes[algorithm] = value
+		}
+		u.Fragment = ""
+		u.RawFragment = ""
+		f.URL = u.String()
+		if f.Filename == "" {
+			f.Filename = pathBase(u.Path)
+		}
+		if !f.CoreMetadata.Available {
+			f.CoreMetadata = f.DistInfoMetadata
+		}
+		f.DistInfoMetadata = f.CoreMetadata
+		idx.Files[i] = f
+	}
+	idx.Meta.APIVersion = apiVersion
+	return idx, nil
+}
+
+func parseHTMLIndex(b []byte) projectIndex {
+	idx := projectIndex{Files: []indexFile{}}
+	for _, anchor := range anchorRegex.FindAllSubmatch(b, -1) {
+		attrs := map[string]*string{}
+		for _, attr := range attrRegex.FindAllSubmatch(anchor[1], -1) {
+			// Attributes without a value, such as data-yanked, have an empty value.
+			value := html.UnescapeString(string(attr[2]) + string(attr[3]) + string(attr[4]))
+			attrs[strings.ToLower(string(attr[1]))] = &value
+		}
+		href, ok := attrs["href"]
+		if !ok {
+			continue
+		}
+		f := indexFile{
+			Filename: strings.TrimSpace(html.UnescapeString(string(anchor[2]))),
+			URL:      *href,
+		}
+		if v, ok := attrs["data-requires-python"]; ok {
+			f.RequiresPython = *v
+		}
+		if v, ok := attrs["data-yanked"]; ok {
+			f.Yanked = yanked{Yanked: true, Reason: *v}
+		}
+		for _, name := range []string{"data-core-metadata", "data-dist-info-metadata"} {
+			v, ok := attrs[name]
+			if !ok || f.CoreMetadata.Available || *v == "false" {
+				continue
+			}
+			f.CoreMetadata.Available = true
+			if algorithm, value, ok := strings.Cut(*v, "="); ok {
+				f.CoreMetadata.Hashes = map[string]string{algorithm: value}
+			}
+		}
+		idx.Files = append(idx.Files, f)
+	}
+	return idx
+}
+
+// rewriteIndex points the URLs of files listed by an upstream to this node. The URL of a file is kept as its origin.
+// Files hosted by PyPI keep their path, while other files are served under the name of the upstream.
+func rewriteIndex(idx projectIndex, name, upstream string) projectIndex {
+	idx.Name = name
+	for i, f := range idx.Files {
+		u, err := url.Parse(f.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		idx.Files[i].Origin = f.URL
+		idx.Files[i].Upstream = upstream
+		if rest, ok := strings.CutPrefix(f.URL, filesHost); ok {
+			idx.Files[i].URL = "/packages/" + rest
+			continue
+		}
+		idx.Files[i].URL = "/packages/" + url.PathEscape(upstream) + "/" + url.PathEscape(f.Filename)
+	}
+	return idx
+}
+
+// negotiateIndex returns the content type of the index that is preferred by the accept header.
+// The HTML format is returned when the client does not state a preference.
+func negotiateIndex(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return ContentTypeSimpleHTML, true
+	}
+	supported := []string{ContentTypeSimpleJSON, ContentTypeSimpleHTML, ContentTypeHTML}
+	best := ""
+	bestQ := 0.0
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		candidates := []string{mediaType}
+		switch mediaType {
+		case "*/*", "application/*":
+			candidates = []string{ContentTypeSimpleHTML}
+		case "text/*":
+			candidates = []string{ContentTypeHTML}
+		case "application/vnd.pypi.simple.latest+json":
+			candidates = []string{ContentTypeSimpleJSON}
+		case "application/vnd.pypi.simple.latest+html":
+			candidates = []string{ContentTypeSimpleHTML}
+		}
+		for _, c := range candidates {
+			if q > bestQ && slices.Contains(supported, c) {
+				best = c
+				bestQ = q
+			}
+		}
+	}
+	return best, best != ""
+}
+
+// writeIndex writes the index in the format negotiated by the request.
+func writeIndex(rw http.ResponseWriter, req *http.Request, idx projectIndex) error {
+	rw.Header().Add("Vary", "Accept")
+	contentType, ok := negotiateIndex(req.Header.Get("Accept"))
+	if !ok {
+		http.Error(rw, "index is only available as JSON or HTML", http.StatusNotAcceptable)
+		return errors.New("no acceptable index content type")
+	}
+	var b []byte
+	if contentType == ContentTypeSimpleJSON {
+		var err error
+		b, err = json.Marshal(idx)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+	} else {
+		b = renderHTMLIndex(idx)
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err := rw.Write(b)
+	return err
+}
+
+func renderHTMLIndex(idx projectIndex) []byte {
+	var sb strings.Builder
+	name := html.EscapeString(idx.Name)
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html>\n  <head>\n    <meta name=\"pypi:repository-version\" content=\"%s\">\n", apiVersion)
+	fmt.Fprintf(&sb, "    <title>Links for %s</title>\n  </head>\n  <body>\n    <h1>Links for %s</h1>\n", name, name)
+	for _, f := range idx.Files {
+		href := f.URL
+		if algorithm, value, ok := preferredHash(f.Hashes); ok {
+			href += "#" + algorithm + "=" + value
+		}
+		fmt.Fprintf(&sb, `    <a href="%s"`, html.EscapeString(href))
+		if f.RequiresPython != "" {
+			fmt.Fprintf(&sb, ` data-requires-python="%s"`, html.EscapeString(f.RequiresPython))
+		}
+		if f.CoreMetadata.Available {
+			value := "true"
+			if algorithm, hash, ok := preferredHash(f.CoreMetadata.Hashes); ok {
+				value = algorithm + "=" + hash
+			}
+			fmt.Fprintf(&sb, ` data-core-metadata="%s" data-dist-info-metadata="%s"`, html.EscapeString(value), html.EscapeString(value))
+		}
+		if f.Yanked.Yanked {
+			fmt.Fprintf(&sb, ` data-yanked="%s"`, html.EscapeString(f.Yanked.Reason))
+		}
+		fmt.Fprintf(&sb, ">%s</a><br />\n", html.EscapeString(f.Filename))
+	}
+	sb.WriteString("  </body>\n</html>\n")
+	return []byte(sb.String())
+}
+
+// preferredHash returns sha256 when it is available and otherwise the first hash by name.
+func preferredHash(hashes map[string]string) (string, string, bool) {
+	if v, ok := hashes["sha256"]; ok {
+		return "sha256", v, true
+	}
+	algorithms := make([]string, 0, len(hashes))
+	for algorithm := range hashes {
+		algorithms = append(algorithms, algorithm)
+	}
+	if len(algorithms) == 0 {
+		return "", "", false
+	}
+	slices.Sort(algorithms)
+	return algorithms[0], hashes[algorithms[0]], true
+}
+
+func pathBase(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[i+1:]
+	}
+	return p
+}
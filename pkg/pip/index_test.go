@@ -0,0 +1,244 @@
+package pip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"clyde/pkg/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testHTMLIndex = `<!DOCTYPE html>
+<html><body>
+<a href="../../packages/ab/cd/Foo_Bar-1.0-py3-none-any.whl#sha256=aaa" data-requires-python="&gt;=3.8" data-dist-info-metadata="sha256=bbb">Foo_Bar-1.0-py3-none-any.whl</a><br />
+<a href='https://files.pythonhosted.org/packages/ef/gh/foo_bar-0.9.tar.gz#sha256=ccc' data-yanked>foo_bar-0.9.tar.gz</a>
+<a href="https://mirror.example.com/foo_bar-0.8.tar.gz" data-yanked="broken &amp; bad" data-core-metadata="true">foo_bar-0.8.tar.gz</a>
+</body></html>`
+
+const testJSONIndex = `{
+  "meta": {"api-version": "1.1"},
+  "name": "foo-bar",
+  "files": [
+    {"filename": "Foo_Bar-1.0-py3-none-any.whl", "url": "https://files.pythonhosted.org/packages/ab/cd/Foo_Bar-1.0-py3-none-any.whl", "hashes": {"sha256": "aaa"}, "requires-python": ">=3.8", "core-metadata": {"sha256": "bbb"}, "yanked": false, "size": 10},
+    {"filename": "foo_bar-0.9.tar.gz", "url": "https://files.pythonhosted.org/packages/ef/gh/foo_bar-0.9.tar.gz", "hashes": {"sha256": "ccc"}, "dist-info-metadata": false, "yanked": true},
+    {"filename": "foo_bar-0.8.tar.gz", "url": "https://mirror.example.com/foo_bar-0.8.tar.gz", "hashes": {}, "core-metadata": true, "yanked": "broken & bad"}
+  ],
+  "versions": ["0.8", "0.9", "1.0"]
+}`
+
+func TestParseIndex(t *testing.T) {
+	t.Parallel()
+
+	indexURL, err := url.Parse("https://files.pythonhosted.org/simple/foo-bar/")
+	require.NoError(t, err)
+	htmlIdx, err := parseIndex("text/html; charset=utf-8", []byte(testHTMLIndex), indexURL)
+	require.NoError(t, err)
+	jsonIdx, err := parseIndex(ContentTypeSimpleJSON, []byte(testJSONIndex), indexURL)
+	require.NoError(t, err)
+
+	// Both formats result in the same index apart from the fields that are only part of the JSON format.
+	require.Equal(t, int64(10), *jsonIdx.Files[0].Size)
+	jsonIdx.Files[0].Size = nil
+	jsonIdx.Versions = nil
+	htmlIdx.Name = "foo-bar"
+	require.Equal(t, jsonIdx, htmlIdx)
+
+	idx := rewriteIndex(htmlIdx, "foo-bar", "pypi")
+	require.Equal(t, "/packages/ab/cd/Foo_Bar-1.0-py3-none-any.whl", idx.Files[0].URL)
+	require.Equal(t, "https://files.pythonhosted.org/packages/ab/cd/Foo_Bar-1.0-py3-none-any.whl", idx.Files[0].Origin)
+	require.Equal(t, "pypi", idx.Files[0].Upstream)
+	require.Equal(t, map[string]string{"sha256": "aaa"}, idx.Files[0].Hashes)
+	require.Equal(t, ">=3.8", idx.Files[0].RequiresPython)
+	require.Equal(t, coreMetadata{Available: true, Hashes: map[string]string{"sha256": "bbb"}}, idx.Files[0].CoreMetadata)
+	require.Equal(t, "/packages/ef/gh/foo_bar-0.9.tar.gz", idx.Files[1].URL)
+	require.Equal(t, yanked{Yanked: true}, idx.Files[1].Yanked)
+	require.Equal(t, "/packages/pypi/foo_bar-0.8.tar.gz", idx.Files[2].URL)
+	require.Equal(t, "https://mirror.example.com/foo_bar-0.8.tar.gz", idx.Files[2].Origin)
+	require.Equal(t, yanked{Yanked: true, Reason: "broken & bad"}, idx.Files[2].Yanked)
+	require.Equal(t, coreMetadata{Available: true}, idx.Files[2].CoreMetadata)
+
+	// The rendered formats are parsed into the same index.
+	b, err := json.Marshal(idx)
+	require.NoError(t, err)
+	fromJSON, err := parseIndex(ContentTypeSimpleJSON, b, nil)
+	require.NoError(t, err)
+	require.Equal(t, idx, fromJSON)
+	fromHTML, err := parseIndex(ContentTypeSimpleHTML, renderHTMLIndex(idx), nil)
+	require.NoError(t, err)
+	fromHTML.Name = idx.Name
+	// The origin of files is only part of the JSON format that is shared with peers.
+	for i := range idx.Files {
+		idx.Files[i].Origin = ""
+		idx.Files[i].Upstream = ""
+	}
+	require.Equal(t, idx, fromHTML)
+
+	_, err = parseIndex("text/plain", []byte("index"), nil)
+	require.EqualError(t, err, "unsupported index content type text/plain")
+}
+
+func TestNegotiateIndex(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		accept     string
+		expected   string
+		expectedOK bool
+	}{
+		{"", ContentTypeSimpleHTML, true},
+		{"*/*", ContentTypeSimpleHTML, true},
+		{"text/html", ContentTypeHTML, true},
+		{ContentTypeSimpleJSON, ContentTypeSimpleJSON, true},
+		{"application/vnd.pypi.simple.v1+json, application/vnd.pypi.simple.v1+html; q=0.1, text/html;q=0.01", ContentTypeSimpleJSON, true},
+		{"application/vnd.pypi.simple.v1+json;q=0.5, application/vnd.pypi.simple.v1+html", ContentTypeSimpleHTML, true},
+		{"application/vnd.pypi.simple.latest+json", ContentTypeSimpleJSON, true},
+		{"application/xml", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			t.Parallel()
+
+			contentType, ok := negotiateIndex(tt.accept)
+			require.Equal(t, tt.expectedOK, ok)
+			require.Equal(t, tt.expected, contentType)
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"Foo_Bar", "foo.bar", "FOO--bar", "foo-_.bar"} {
+		require.Equal(t, "foo-bar", normalizeName(name))
+	}
+}
+
+func TestPipRegistryHandlerIndexFormats(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/simple/foo-bar/", r.URL.Path)
+		require.Equal(t, upstreamAccept, r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", ContentTypeSimpleJSON)
+		_, _ = w.Write([]byte(testJSONIndex))
+	}))
+	defer upstream.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	client := NewPipClient(router, tempDir, upstream.URL+"/simple/")
+
+	get := func(path, accept string) *http.Response {
+		rw := newTestResponseWriter()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		client.PipRegistryHandler(rw, req)
+		return rw.Result()
+	}
+
+	resp := get("/simple/Foo_Bar/", ContentTypeSimpleJSON)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ContentTypeSimpleJSON, resp.Header.Get("Content-Type"))
+	require.Equal(t, "Accept", resp.Header.Get("Vary"))
+	idx := projectIndex{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&idx))
+	require.Equal(t, "foo-bar", idx.Name)
+	require.Equal(t, "/packages/ab/cd/Foo_Bar-1.0-py3-none-any.whl", idx.Files[0].URL)
+	require.FileExists(t, filepath.Join(tempDir, "foo-bar.json"))
+	require.Eventually(t, func() bool {
+		_, ok := router.Get("pip:foo-bar")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	// The cached index is rendered in the format requested by the client.
+	upstream.Close()
+	resp = get("/simple/foo.bar/", "text/html")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ContentTypeHTML, resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `<a href="/packages/ab/cd/Foo_Bar-1.0-py3-none-any.whl#sha256=aaa" data-requires-python="&gt;=3.8" data-core-metadata="sha256=bbb" data-dist-info-metadata="sha256=bbb">Foo_Bar-1.0-py3-none-any.whl</a>`)
+
+	resp = get("/simple/foo-bar/", "application/xml")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+}
+
+func TestPipRegistryHandlerPeerIndex(t *testing.T) {
+	t.Parallel()
+
+	peerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, ContentTypeSimpleJSON, r.Header.Get("Accept"))
+		require.Equal(t, "true", r.Header.Get(headerMirrored))
+		// The index of the peer is fresh so it is served without revalidating it with the upstreams.
+		peerIndex := strings.ReplaceAll(testJSONIndex, "https://files.pythonhosted.org/packages/", "/packages/")
+		peerIndex = strings.Replace(peerIndex, "{", fmt.Sprintf(`{"_freshness": {"fetched": %q},`, time.Now().Format(time.RFC3339Nano)), 1)
+		w.Header().Set("Content-Type", ContentTypeSimpleJSON)
+		_, _ = w.Write([]byte(peerIndex))
+	}))
+	defer peerSrv.Close()
+
+	peerAddr := netip.MustParseAddrPort(peerSrv.Listener.Addr().String())
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{"pip:foo-bar": {peerAddr}}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	client := NewPipClient(router, tempDir, "http://invalid-upstream/simple/")
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/simple/foo-bar/", nil)
+	client.PipRegistryHandler(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ContentTypeSimpleHTML, resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `href="/packages/ef/gh/foo_bar-0.9.tar.gz#sha256=ccc"`)
+
+	b, err := os.ReadFile(filepath.Join(tempDir, "foo-bar.json"))
+	require.NoError(t, err)
+	idx := projectIndex{}
+	require.NoError(t, json.Unmarshal(b, &idx))
+	require.Len(t, idx.Files, 3)
+}
+
+func TestPipRegistryHandlerCoreMetadata(t *testing.T) {
+	t.Parallel()
+
+	// Core metadata is fetched from PyPI, so it is served by a peer that has it cached.
+	peerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/packages/ab/cd/foo_bar-1.0-py3-none-any.whl.metadata", r.URL.Path)
+		_, _ = w.Write([]byte("Metadata-Version: 2.1\nName: foo-bar\n"))
+	}))
+	defer peerSrv.Close()
+
+	peerAddr := netip.MustParseAddrPort(peerSrv.Listener.Addr().String())
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{"pip:foo_bar-1.0-py3-none-any.whl.metadata": {peerAddr}}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	client := NewPipClient(router, tempDir, "http://invalid-upstream/simple/")
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/packages/ab/cd/foo_bar-1.0-py3-none-any.whl.metadata", nil)
+	client.PipRegistryHandler(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "Metadata-Version: 2.1\nName: foo-bar\n", rw.Body.String())
+
+	keys, err := client.WalkPipDir(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{"pip:foo_bar-1.0-py3-none-any.whl.metadata"}, keys)
+}
@@ -2,6 +2,8 @@ package pip
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,34 +11,46 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"clyde/pkg/cache"
 	"clyde/pkg/httpx"
+	"clyde/pkg/metrics"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 
 	"github.com/go-logr/logr"
 )
 
 type PipClient struct {
-	Router         routing.Router
-	PipCacheDir    string
-	FallbackIndex  string
-	ResolveTimeout time.Duration
-	ResolveRetries int
-	Log            logr.Logger
-	Client         *http.Client
+	Router            routing.Router
+	Leaser            *routing.Leaser
+	Relay             *relay.Relay
+	PipCacheDir       string
+	FallbackIndex     string
+	Upstreams         []Upstream
+	ResolveTimeout    time.Duration
+	ResolveRetries    int
+	IndexTTL          time.Duration
+	IndexStaleIfError time.Duration
+	Log               logr.Logger
+	Client            *http.Client
+	store             *cache.Store
 }
 
 func NewPipClient(router routing.Router, pipCacheDir, fallbackIndex string, opts ...PipOption) *PipClient {
 	cfg := PipConfig{
-		Router:         router,
-		PipCacheDir:    pipCacheDir,
-		FallbackIndex:  fallbackIndex,
-		ResolveTimeout: 60 * time.Second,
-		ResolveRetries: 3,
-		Log:            logr.Discard(),
-		Client:         &http.Client{},
+		Router:            router,
+		PipCacheDir:       pipCacheDir,
+		FallbackIndex:     fallbackIndex,
+		ResolveTimeout:    60 * time.Second,
+		ResolveRetries:    3,
+		IndexTTL:          10 * time.Minute,
+		IndexStaleIfError: 24 * time.Hour,
+		Log:               logr.Discard(),
+		Client:            &http.Client{},
 	}
 
 	for _, opt := range opts {
@@ -44,27 +58,47 @@ func NewPipClient(router routing.Router, pipCacheDir, fallbackIndex string, opts
 			opt(&cfg)
 		}
 	}
+	if len(cfg.Upstreams) == 0 {
+		cfg.Upstreams = []Upstream{{Name: "default", URL: cfg.FallbackIndex}}
+	}
+	store, err := cache.New(cfg.PipCacheDir, cache.WithEviction(cfg.CacheEviction))
+	if err != nil {
+		cfg.Log.Error(err, "invalid pip cache eviction, files will not be evicted")
+		store, _ = cache.New(cfg.PipCacheDir)
+	}
 
 	return &PipClient{
-		Router:         cfg.Router,
-		PipCacheDir:    cfg.PipCacheDir,
-		FallbackIndex:  cfg.FallbackIndex,
-		ResolveTimeout: cfg.ResolveTimeout,
-		ResolveRetries: cfg.ResolveRetries,
-		Log:            cfg.Log,
-		Client:         cfg.Client,
+		Router:            cfg.Router,
+		Leaser:            cfg.Leaser,
+		Relay:             cfg.Relay,
+		PipCacheDir:       cfg.PipCacheDir,
+		FallbackIndex:     cfg.FallbackIndex,
+		Upstreams:         cfg.Upstreams,
+		ResolveTimeout:    cfg.ResolveTimeout,
+		ResolveRetries:    cfg.ResolveRetries,
+		IndexTTL:          cfg.IndexTTL,
+		IndexStaleIfError: cfg.IndexStaleIfError,
+		Log:               cfg.Log,
+		Client:            cfg.Client,
+		store:             store,
 	}
 }
 
 type PipConfig struct {
-	Router         routing.Router
-	ConfigPath     string
-	PipCacheDir    string
-	FallbackIndex  string
-	ResolveTimeout time.Duration
-	ResolveRetries int
-	Log            logr.Logger
-	Client         *http.Client
+	Router            routing.Router
+	Leaser            *routing.Leaser
+	Relay             *relay.Relay
+	ConfigPath        string
+	PipCacheDir       string
+	FallbackIndex     string
+	Upstreams         []Upstream
+	CacheEviction     cache.Eviction
+	ResolveTimeout    time.Duration
+	ResolveRetries    int
+	IndexTTL          time.Duration
+	IndexStaleIfError time.Duration
+	Log               logr.Logger
+	Client            *http.Client
 }
 
 type PipOption func(cfg *PipConfig)
@@ -93,6 +127,43 @@ func WithHTTPClient(client *http.Client) PipOption {
 	}
 }
 
+// WithLeaser coordinates upstream fetches with the other nodes so that each package is fetched from upstream once.
+func WithLeaser(leaser *routing.Leaser) PipOption {
+	return func(cfg *PipConfig) {
+		cfg.Leaser = leaser
+	}
+}
+
+// WithUpstreams sets the ordered list of indexes that projects are resolved from instead of the fallback index.
+func WithUpstreams(upstreams ...Upstream) PipOption {
+	return func(cfg *PipConfig) {
+		cfg.Upstreams = upstreams
+	}
+}
+
+// WithIndexFreshness sets how long cached indexes are fresh, and how long they are served after that when the
+// upstreams fail.
+func WithIndexFreshness(ttl, staleIfError time.Duration) PipOption {
+	return func(cfg *PipConfig) {
+		cfg.IndexTTL = ttl
+		cfg.IndexStaleIfError = staleIfError
+	}
+}
+
+// WithCacheEviction evicts cached files once the cache exceeds its quota when the cache is collected.
+func WithCacheEviction(eviction cache.Eviction) PipOption {
+	return func(cfg *PipConfig) {
+		cfg.CacheEviction = eviction
+	}
+}
+
+// WithRelay lets peers stream artifacts from this node while they are downloaded from upstream.
+func WithRelay(relay *relay.Relay) PipOption {
+	return func(cfg *PipConfig) {
+		cfg.Relay = relay
+	}
+}
+
 func (p *PipClient) PipRegistryHandler(rw httpx.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	cleanPath := path.Clean(req.URL.Path)
@@ -116,9 +187,14 @@ func (p *PipClient) PipRegistryHandler(rw httpx.ResponseWriter, req *http.Reques
 	}
 	p.Log.Info("parsed package/artifact name from URL", "name", name, "isArtifact", isArtifact, "isIndex", isIndex)
 
+	// Indexes are requested by project names that are not normalized, which are normalized to share their cache.
+	if isIndex {
+		name = normalizeName(name)
+	}
+
 	trimmedPath := cleanPath
 	if isIndex {
-		trimmedPath = strings.TrimPrefix(trimmedPath, "/simple/")
+		trimmedPath = name
 	} else if isArtifact {
 		trimmedPath = strings.TrimPrefix(trimmedPath, "/packages/")
 	}
@@ -127,93 +203,211 @@ func (p *PipClient) PipRegistryHandler(rw httpx.ResponseWriter, req *http.Reques
 	key := fmt.Sprintf("pip:%s", keyName)
 	p.Log.Info("computed P2P key", "key", key, "isIndex", isIndex, "isArtifact", isArtifact)
 
-	cacheDir := filepath.Join(p.PipCacheDir)
-	cacheFile := filepath.Join(cacheDir, name)
 	if isIndex {
-		cacheFile += ".html"
+		p.serveIndex(rw, req, name, key)
+		p.Log.Info("index request completed", "duration", time.Since(start))
+		return
+	}
+
+	if isArtifact && p.serveFromRelay(rw, req, key) {
+		p.Log.Info("request completed from relayed download", "duration", time.Since(start))
+		return
+	}
+
+	expected := ""
+	if isArtifact {
+		expected = p.expectedHash(req, name)
 	}
-	if _, err := os.Stat(cacheFile); err == nil {
-		p.Log.Info("serving from local cache", "name", name, "file", cacheFile)
-		http.ServeFile(rw, req, cacheFile)
+
+	// Cached artifacts are verified before they are served to peers, so that a corrupt artifact is not shared.
+	verifyHash := ""
+	if req.Header.Get(HeaderPipSha256) != "" {
+		verifyHash = expected
+	}
+	if p.serveFromCache(rw, req, name, verifyHash) {
 		p.Log.Info("request completed from local cache", "duration", time.Since(start))
 		return
 	}
-	p.Log.Info("local cache miss", "file", cacheFile)
+	p.Log.Info("local cache miss", "name", name)
 
+	if p.serveFromPeers(rw, req, key, name, expected) {
+		p.Log.Info("request completed via P2P", "duration", time.Since(start))
+		return
+	}
+
+	// Concurrent requests for the artifact on this node share one fetch.
+	if isArtifact {
+		release, owner, err := p.store.Claim(req.Context(), name)
+		if err != nil {
+			p.Log.Error(err, "failed to wait for fetch of artifact", "name", name)
+			http.Error(rw, fmt.Sprintf("failed to wait for fetch of artifact: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if owner {
+			defer release()
+		} else if p.serveFromCache(rw, req, name, "") {
+			p.Log.Info("request completed after waiting for fetch on this node", "duration", time.Since(start))
+			return
+		}
+	}
+
+	var lease *routing.Lease
+	if p.Leaser != nil {
+		var owner bool
+		var err error
+		lease, owner, err = p.Leaser.Acquire(req.Context(), key)
+		if err != nil {
+			p.Log.Error(err, "failed to acquire upstream lease", "key", key)
+			http.Error(rw, fmt.Sprintf("failed to acquire upstream lease: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if !owner {
+			p.Log.Info("package fetched by another request", "key", key)
+			if p.serveFromCache(rw, req, name, "") || p.serveFromPeers(rw, req, key, name, expected) {
+				p.Log.Info("request completed after waiting for upstream fetch", "duration", time.Since(start))
+				return
+			}
+		}
+	}
+
+	p.Log.Info("falling back to upstream artifact", "name", name, "isArtifact", isArtifact)
+	cachedName, err := p.serveFromFallback(rw, req, name, isArtifact, trimmedPath, expected)
+	go p.advertiseFetched(lease, cachedName, err)
+	p.Log.Info("request completed via fallback", "duration", time.Since(start))
+}
+
+// serveFromRelay streams an artifact that is being downloaded from upstream by this node.
+func (p *PipClient) serveFromRelay(rw httpx.ResponseWriter, req *http.Request, key string) bool {
+	if p.Relay == nil {
+		return false
+	}
+	transfer, ok := p.Relay.Get(key)
+	if !ok {
+		return false
+	}
+	p.Log.Info("serving artifact while it is downloaded", "key", key)
+	if err := relay.ServeTransfer(rw, req, transfer); err != nil {
+		p.Log.Error(err, "failed to relay artifact", "key", key)
+	}
+	return true
+}
+
+func (p *PipClient) serveFromCache(rw http.ResponseWriter, req *http.Request, name string, verifyHash string) bool {
+	info, err := p.store.Stat(name)
+	if err != nil {
+		return false
+	}
+	if verifyHash != "" {
+		if err := p.verifyCached(name, verifyHash); err != nil {
+			p.Log.Error(err, "removing cached artifact that failed verification", "name", name)
+			p.discardArtifact(name)
+			return false
+		}
+	}
+	f, err := p.store.Open(name)
+	if err != nil {
+		p.Log.Error(err, "failed to open cached artifact", "name", name)
+		return false
+	}
+	defer f.Close()
+	p.Log.Info("serving from local cache", "name", name, "digest", info.Digest)
+	http.ServeContent(rw, req, name, info.ModTime, f)
+	return true
+}
+
+func (p *PipClient) serveFromPeers(rw httpx.ResponseWriter, req *http.Request, key, name, expected string) bool {
 	ctx, cancel := context.WithTimeout(req.Context(), p.ResolveTimeout)
 	defer cancel()
 	p.Log.Info("resolving package via P2P", "key", key)
 	balancer, err := p.Router.Lookup(ctx, key, p.ResolveRetries)
-	if err == nil {
-		for attempt := range p.ResolveRetries {
-			peer, peerErr := balancer.Next()
-			if peerErr != nil {
-				p.Log.Info("no more peers available", "key", key, "error", peerErr)
-				break
+	if err != nil {
+		p.Log.Error(err, "failed to resolve P2P peers", "key", key)
+		return false
+	}
+	for attempt := range p.ResolveRetries {
+		peer, peerErr := balancer.Next()
+		if peerErr != nil {
+			p.Log.Info("no more peers available", "key", key, "error", peerErr)
+			return false
+		}
+		p.Log.Info("got peer from P2P", "peer", peer, "key", key, "attempt", attempt+1)
+		if err := p.forwardRequest(req, rw, peer.String(), name, expected); err != nil {
+			p.Log.Error(err, "peer lookup failed", "name", name, "peer", peer, "attempt", attempt+1)
+			if errors.Is(err, ErrHashMismatch) {
+				metrics.PipHashMismatchTotal.WithLabelValues("peer").Inc()
 			}
-			p.Log.Info("got peer from P2P", "peer", peer, "key", key, "attempt", attempt+1)
-			if err := p.forwardRequest(req, rw, peer.String(), name); err == nil {
-				p.Log.Info("served pip resource from peer", "name", name, "peer", peer)
-				p.Log.Info("request completed via P2P", "duration", time.Since(start))
-				return
-			} else {
-				p.Log.Error(err, "peer lookup failed", "name", name, "peer", peer, "attempt", attempt+1)
-				balancer.Remove(peer)
+			// The response can not be retried with another peer once it has been started.
+			if rw.HeadersWritten() {
+				return true
 			}
+			balancer.Remove(peer)
+			continue
 		}
-	} else {
-		p.Log.Error(err, "failed to resolve P2P peers", "key", key)
+		p.Log.Info("served pip resource from peer", "name", name, "peer", peer)
+		return true
 	}
+	return false
+}
 
-	p.Log.Info("falling back to upstream index/artifact", "name", name, "isArtifact", isArtifact, "isIndex", isIndex)
-	p.serveFromFallback(rw, req, name, isIndex, isArtifact, trimmedPath)
-	p.Log.Info("request completed via fallback", "duration", time.Since(start))
+// advertiseFetched advertises the package cached from upstream before releasing the lease,
+// so that requests waiting for the fetch find the package through the router.
+func (p *PipClient) advertiseFetched(lease *routing.Lease, cachedName string, fetchErr error) {
+	if cachedName != "" {
+		key := fmt.Sprintf("pip:%s", strings.ToLower(cachedName))
+		if err := p.Router.Advertise(context.Background(), []string{key}); err != nil {
+			p.Log.Error(err, "failed to advertise cached package", "name", cachedName, "key", key)
+		}
+	}
+	if lease == nil {
+		return
+	}
+	if fetchErr == nil && cachedName == "" {
+		fetchErr = errors.New("package fetched from upstream was not cached")
+	}
+	lease.Release(context.Background(), fetchErr)
 }
 
 func (p *PipClient) serveFromFallback(
 	rw http.ResponseWriter,
 	req *http.Request,
 	name string,
-	isIndex bool,
 	isArtifact bool,
 	trimmedPath string,
-) {
+	expected string,
+) (string, error) {
 	start := time.Now()
-	p.Log.Info("serveFromFallback started", "originalURL", req.URL.Path, "trimmedPath", trimmedPath, "name", name, "isIndex", isIndex, "isArtifact", isArtifact)
+	p.Log.Info("serveFromFallback started", "originalURL", req.URL.Path, "trimmedPath", trimmedPath, "name", name, "isArtifact", isArtifact)
 
-	if isIndex && !strings.HasSuffix(trimmedPath, "/") {
-		trimmedPath += "/"
-	}
-
-	var upstreamURL string
-	if isIndex {
-		upstreamURL = fmt.Sprintf("%s/%s", strings.TrimSuffix(p.FallbackIndex, "/"), trimmedPath)
-	} else if isArtifact {
-		upstreamURL = fmt.Sprintf("https://files.pythonhosted.org/packages/%s", trimmedPath)
-	} else {
-		upstreamURL = fmt.Sprintf("%s/%s", strings.TrimSuffix(p.FallbackIndex, "/"), trimmedPath)
-	}
-
-	client := &http.Client{
-		Timeout: p.ResolveTimeout,
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-		},
+	upstream := p.Upstreams[0]
+	upstreamURL := fmt.Sprintf("%s/%s", strings.TrimSuffix(upstream.URL, "/"), trimmedPath)
+	if isArtifact {
+		var ok bool
+		upstreamURL, upstream, ok = p.artifactOrigin(req.Context(), name)
+		if !ok {
+			err := fmt.Errorf("artifact %s is not listed in the index of its project", name)
+			p.Log.Error(err, "artifact has no origin", "name", name)
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return "", err
+		}
+		if expected == "" {
+			expected, _ = p.indexedHash(name)
+		}
 	}
 
 	reqUpstream, err := http.NewRequestWithContext(req.Context(), req.Method, upstreamURL, nil)
 	if err != nil {
 		p.Log.Error(err, "failed to create upstream request", "url", upstreamURL)
 		http.Error(rw, fmt.Sprintf("failed to create request: %v", err), http.StatusInternalServerError)
-		return
+		return "", err
 	}
 	reqUpstream.Header.Set("User-Agent", "Clyde-PipProxy/1.0")
+	upstream.authorize(reqUpstream)
 
-	resp, err := client.Do(reqUpstream)
+	resp, err := p.upstreamClient().Do(reqUpstream)
 	if err != nil {
 		p.Log.Error(err, "failed to fetch from upstream", "url", upstreamURL)
 		http.Error(rw, fmt.Sprintf("failed to fetch from upstream: %v", err), http.StatusBadGateway)
-		return
+		return "", err
 	}
 	defer resp.Body.Close()
 
@@ -225,90 +419,87 @@ func (p *PipClient) serveFromFallback(
 			rw.Header().Add(k, v)
 		}
 	}
-	rw.WriteHeader(resp.StatusCode)
 
 	finalName := name
 	if isArtifact {
 		finalName = filepath.Base(resp.Request.URL.Path)
 	}
 
-	if isIndex {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			p.Log.Error(err, "failed to read index body")
-			http.Error(rw, "failed to read index body", http.StatusInternalServerError)
-			return
+	if isArtifact && isCacheable(finalName) && req.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		// The content length lets the client detect that an artifact which failed verification was truncated.
+		if resp.ContentLength >= 0 {
+			rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
 		}
+		rw.WriteHeader(resp.StatusCode)
 
-		rewritten := strings.ReplaceAll(string(body), "https://files.pythonhosted.org/packages/", "/packages/")
-		rewritten = strings.ReplaceAll(rewritten, "https://pypi.org/simple/", "/simple/")
-
-		if _, err := rw.Write([]byte(rewritten)); err != nil {
-			p.Log.Error(err, "failed to write rewritten index to client")
+		aw, err := newArtifactWriter(p.store, finalName, expected)
+		if err != nil {
+			p.Log.Error(err, "failed to create cache file", "name", finalName)
+			_, err = io.Copy(rw, resp.Body)
+			return "", err
 		}
 
-		cacheDir := filepath.Join(p.PipCacheDir)
-		if err := os.MkdirAll(cacheDir, 0o755); err != nil {
-			p.Log.Error(err, "failed to create cache directory", "dir", cacheDir)
-		} else {
-			cacheFile := filepath.Join(cacheDir, finalName+".html")
-			if err := os.WriteFile(cacheFile, []byte(rewritten), 0o644); err != nil {
-				p.Log.Error(err, "failed to cache rewritten index", "file", cacheFile)
+		var dst io.Writer = aw
+		var transfer *relay.Transfer
+		if p.Relay != nil {
+			key := fmt.Sprintf("pip:%s", strings.ToLower(name))
+			transfer, err = p.Relay.Start(req.Context(), key, resp.ContentLength, nil)
+			if err != nil {
+				p.Log.Info("artifact is not relayed to peers", "key", key, "error", err.Error())
 			} else {
-				go func() {
-					keyName := strings.ToLower(finalName)
-					key := fmt.Sprintf("pip:%s", keyName)
-					if err := p.Router.Advertise(context.Background(), []string{key}); err != nil {
-						p.Log.Error(err, "failed to advertise cached index", "name", finalName, "key", key)
-					}
-				}()
+				dst = io.MultiWriter(aw, transfer)
 			}
 		}
 
-		return
-	}
-
-	if isArtifact && (strings.HasSuffix(finalName, ".whl") || strings.HasSuffix(finalName, ".tar.gz")) {
-		cacheDir := filepath.Join(p.PipCacheDir)
-		if err := os.MkdirAll(cacheDir, 0o755); err != nil {
-			p.Log.Error(err, "failed to create cache directory", "dir", cacheDir)
+		hw := httpx.NewHoldbackWriter(rw)
+		n, err := io.Copy(io.MultiWriter(dst, hw), resp.Body)
+		if err == nil {
+			err = aw.Commit()
 		} else {
-			cachePath := filepath.Join(cacheDir, finalName)
-			f, err := os.Create(cachePath)
-			if err != nil {
-				p.Log.Error(err, "failed to create cache file", "file", cachePath)
-				_, _ = io.Copy(rw, resp.Body)
-				return
-			}
-			defer f.Close()
-
-			tee := io.TeeReader(resp.Body, f)
-			n, err := io.Copy(rw, tee)
-			if err != nil {
-				p.Log.Error(err, "failed to stream artifact to client/cache", "file", cachePath, "bytesCopied", n)
-				return
+			aw.Abort()
+		}
+		if transfer != nil {
+			transfer.Finish(req.Context(), err)
+		}
+		if err != nil {
+			if errors.Is(err, ErrHashMismatch) {
+				metrics.PipHashMismatchTotal.WithLabelValues("upstream").Inc()
 			}
-
-			go func() {
-				keyName := strings.ToLower(finalName)
-				key := fmt.Sprintf("pip:%s", keyName)
-				if err := p.Router.Advertise(context.Background(), []string{key}); err != nil {
-					p.Log.Error(err, "failed to advertise cached artifact", "name", finalName, "key", key)
-				}
-			}()
-
-			p.Log.Info("served and cached artifact from upstream", "file", cachePath, "bytesCopied", n, "duration", time.Since(start))
-			return
+			// The discarded artifact is fetched again by the next request as it is neither cached nor advertised.
+			p.Log.Error(err, "failed to stream artifact to client/cache", "name", finalName, "bytesCopied", n)
+			return "", err
 		}
+		if err := hw.Release(); err != nil {
+			p.Log.Error(err, "failed to stream artifact to client", "name", finalName)
+		}
+
+		p.Log.Info("served and cached artifact from upstream", "name", finalName, "bytesCopied", n, "duration", time.Since(start))
+		return finalName, nil
 	}
 
+	rw.WriteHeader(resp.StatusCode)
 	n, err := io.Copy(rw, resp.Body)
 	if err != nil {
 		p.Log.Error(err, "failed to stream response to client", "package", name, "bytesCopied", n)
 	}
+	return "", err
+}
+
+func (p *PipClient) cacheIndex(name string, idx projectIndex) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return p.store.WriteFile(name+".json", b)
+}
+
+// isCacheable returns true for the distributions and the core metadata files that are cached and shared with peers.
+func isCacheable(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".whl") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".metadata")
 }
 
-func (p *PipClient) forwardRequest(req *http.Request, rw http.ResponseWriter, peerAddr, name string) error {
+func (p *PipClient) forwardRequest(req *http.Request, rw http.ResponseWriter, peerAddr, name, expected string) error {
 	start := time.Now()
 
 	u := &url.URL{
@@ -322,6 +513,9 @@ func (p *PipClient) forwardRequest(req *http.Request, rw http.ResponseWriter, pe
 		return err
 	}
 	copyHeader(forwardReq.Header, req.Header)
+	if expected != "" {
+		forwardReq.Header.Set(HeaderPipSha256, expected)
+	}
 
 	resp, err := p.Client.Do(forwardReq)
 	if err != nil {
@@ -337,26 +531,23 @@ func (p *PipClient) forwardRequest(req *http.Request, rw http.ResponseWriter, pe
 	copyHeader(rw.Header(), resp.Header)
 	rw.WriteHeader(resp.StatusCode)
 
-	cacheDir := filepath.Join(p.PipCacheDir)
-	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
-		p.Log.Error(err, "failed to create cache directory", "dir", cacheDir)
-	}
-	cacheFile := filepath.Join(cacheDir, name)
-	if strings.HasPrefix(req.URL.Path, "/simple/") {
-		cacheFile += ".html"
-	}
-
-	var reader io.Reader = resp.Body
-	var f *os.File
-	if f, err = os.Create(cacheFile); err != nil {
-		p.Log.Error(err, "failed to create cache file, serving client only", "file", cacheFile)
-	} else {
-		defer f.Close()
-		reader = io.TeeReader(resp.Body, f)
+	aw, err := newArtifactWriter(p.store, name, expected)
+	if err != nil {
+		p.Log.Error(err, "failed to create cache file, serving client only", "name", name)
+		_, err = io.Copy(rw, resp.Body)
+		return err
 	}
 
-	n, err := io.Copy(rw, reader)
+	hw := httpx.NewHoldbackWriter(rw)
+	n, err := io.Copy(io.MultiWriter(aw, hw), resp.Body)
 	if err != nil {
+		aw.Abort()
+		return err
+	}
+	if err := aw.Commit(); err != nil {
+		return err
+	}
+	if err := hw.Release(); err != nil {
 		return err
 	}
 
@@ -364,7 +555,6 @@ func (p *PipClient) forwardRequest(req *http.Request, rw http.ResponseWriter, pe
 		"peer", peerAddr,
 		"package", name,
 		"bytesCopied", n,
-		"cacheFile", cacheFile,
 		"duration", time.Since(start),
 	)
 
@@ -416,26 +606,20 @@ func AddPipConfiguration(ctx context.Context, configDir string, indexURL string,
 	return nil
 }
 
+func (p *PipClient) CacheDir() string {
+	return p.PipCacheDir
+}
+
 func (p *PipClient) WalkPipDir(ctx context.Context) ([]string, error) {
 	var keys []string
 
-	err := filepath.Walk(p.PipCacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		lower := strings.ToLower(info.Name())
-		if strings.HasSuffix(lower, ".whl") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".html") {
-			key := fmt.Sprintf("pip:%s", strings.ToLower(info.Name()))
-			keys = append(keys, key)
-		}
-		return nil
-	})
+	infos, err := p.store.List()
 	if err != nil {
 		return nil, fmt.Errorf("failed to walk pip cache dir: %w", err)
 	}
+	for _, info := range infos {
+		keys = append(keys, cacheKeys(info.Name)...)
+	}
 
 	return keys, nil
 }
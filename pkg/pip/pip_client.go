@@ -10,4 +10,6 @@ import (
 type Pip interface {
 	PipRegistryHandler(rw httpx.ResponseWriter, req *http.Request)
 	WalkPipDir(ctx context.Context) ([]string, error)
+	// CacheDir returns the directory that files are cached in.
+	CacheDir() string
 }
@@ -9,10 +9,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"clyde/pkg/httpx"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 
 	"github.com/go-logr/logr"
@@ -164,7 +166,8 @@ func TestPipRegistryHandlerFallback(t *testing.T) {
 
 	fallbackSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/") {
-			_, _ = w.Write([]byte("fallback index content"))
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<a href="https://files.pythonhosted.org/packages/ab/cd/unknownpkg-1.0.tar.gz#sha256=abc">unknownpkg-1.0.tar.gz</a>`))
 		} else {
 			_, _ = w.Write([]byte("fallback wheel content"))
 		}
@@ -180,7 +183,7 @@ func TestPipRegistryHandlerFallback(t *testing.T) {
 		urlPath      string
 		expectedBody string
 	}{
-		{"fallback index", "/simple/unknownpkg/", "fallback index content"},
+		{"fallback index", "/simple/unknownpkg/", `<a href="/packages/ab/cd/unknownpkg-1.0.tar.gz#sha256=abc">unknownpkg-1.0.tar.gz</a>`},
 	}
 
 	for _, tt := range tests {
@@ -201,6 +204,134 @@ func TestPipRegistryHandlerFallback(t *testing.T) {
 	}
 }
 
+func TestPipRegistryHandlerUpstreamLease(t *testing.T) {
+	t.Parallel()
+
+	hits := atomic.Int32{}
+	startedCh := make(chan struct{})
+	unblockCh := make(chan struct{})
+	fallbackSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			close(startedCh)
+		}
+		<-unblockCh
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<a href="https://files.pythonhosted.org/packages/ab/cd/leasedpkg-1.0.tar.gz">leasedpkg-1.0.tar.gz</a>`))
+	}))
+	defer fallbackSrv.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	leaser, err := routing.NewLeaser(router, routing.WithLeaseTimeouts(time.Minute, time.Second))
+	require.NoError(t, err)
+	client := NewPipClient(router, t.TempDir(), fallbackSrv.URL+"/simple/", WithLeaser(leaser))
+
+	rws := []*testResponseWriter{newTestResponseWriter(), newTestResponseWriter()}
+	doneCh := make(chan struct{}, len(rws))
+	for i, rw := range rws {
+		if i > 0 {
+			<-startedCh
+		}
+		go func() {
+			client.PipRegistryHandler(rw, httptest.NewRequest(http.MethodGet, "/simple/leasedpkg/", nil))
+			doneCh <- struct{}{}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(unblockCh)
+	for range rws {
+		<-doneCh
+	}
+
+	require.Equal(t, int32(1), hits.Load())
+	for _, rw := range rws {
+		resp := rw.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), `<a href="/packages/ab/cd/leasedpkg-1.0.tar.gz">leasedpkg-1.0.tar.gz</a>`)
+	}
+}
+
+func TestPipRegistryHandlerCoalescesArtifactFetches(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("coalesced wheel")
+	hits := atomic.Int32{}
+	startedCh := make(chan struct{})
+	unblockCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/simple/coalesced/" {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<a href="/files/coalesced-1.0-py3-none-any.whl">coalesced-1.0-py3-none-any.whl</a>`))
+			return
+		}
+		if hits.Add(1) == 1 {
+			close(startedCh)
+		}
+		<-unblockCh
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	client := NewPipClient(router, t.TempDir(), srv.URL+"/simple/")
+
+	rws := []*testResponseWriter{newTestResponseWriter(), newTestResponseWriter()}
+	doneCh := make(chan struct{}, len(rws))
+	for i, rw := range rws {
+		if i > 0 {
+			<-startedCh
+		}
+		go func() {
+			client.PipRegistryHandler(rw, httptest.NewRequest(http.MethodGet, "/packages/ab/cd/coalesced-1.0-py3-none-any.whl", nil))
+			doneCh <- struct{}{}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(unblockCh)
+	for range rws {
+		<-doneCh
+	}
+
+	require.Equal(t, int32(1), hits.Load())
+	for _, rw := range rws {
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, content, rw.Body.Bytes())
+	}
+}
+
+func TestPipRegistryHandlerRelay(t *testing.T) {
+	t.Parallel()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	pipRelay, err := relay.NewRelay(router, relay.WithDir(t.TempDir()))
+	require.NoError(t, err)
+	client := NewPipClient(router, t.TempDir(), "https://pypi.org/simple/", WithRelay(pipRelay))
+
+	content := []byte("relayed wheel content")
+	transfer, err := pipRelay.Start(t.Context(), "pip:relayed-1.0-py3-none-any.whl", int64(len(content)), nil)
+	require.NoError(t, err)
+	_, err = transfer.Write(content[:7])
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		//nolint: errcheck // Ignore error.
+		transfer.Write(content[7:])
+		transfer.Finish(context.Background(), nil)
+	}()
+
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/packages/ab/cd/Relayed-1.0-py3-none-any.whl", nil)
+	client.PipRegistryHandler(rw, req)
+
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, content, body)
+}
+
 func TestAddPipConfiguration(t *testing.T) {
 	t.Parallel()
 	tempDir := t.TempDir()
@@ -224,7 +355,8 @@ func TestWalkPipDir(t *testing.T) {
 	tempDir := t.TempDir()
 	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "foo-1.0.whl"), []byte("whl"), 0644))
 	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "bar-2.0.tar.gz"), []byte("tgz"), 0644))
-	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "baz.html"), []byte("idx"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "bar-2.0-py3-none-any.whl.metadata"), []byte("meta"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "baz.json"), []byte("idx"), 0644))
 	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "README.txt"), []byte("skip"), 0644))
 
 	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
@@ -234,7 +366,7 @@ func TestWalkPipDir(t *testing.T) {
 
 	keys, err := client.WalkPipDir(context.Background())
 	require.NoError(t, err)
-	require.Len(t, keys, 3)
+	require.Len(t, keys, 4)
 
 	found := map[string]bool{}
 	for _, k := range keys {
@@ -242,6 +374,7 @@ func TestWalkPipDir(t *testing.T) {
 	}
 	require.True(t, found["pip:foo-1.0.whl"])
 	require.True(t, found["pip:bar-2.0.tar.gz"])
-	require.True(t, found["pip:baz.html"])
+	require.True(t, found["pip:bar-2.0-py3-none-any.whl.metadata"])
+	require.True(t, found["pip:baz"])
 	require.False(t, found["pip:readme.txt"])
 }
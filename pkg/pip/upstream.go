@@ -0,0 +1,351 @@
+package pip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var upstreamNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Upstream is a Python package index that projects are resolved from. Upstreams are ordered by priority, and the
+// index of a project is merged from all upstreams that it is resolved from like the extra index URLs of pip.
+type Upstream struct {
+	// Name identifies the upstream in the URLs of the files that are served from it.
+	Name string `json:"name"`
+	// URL is the base URL of the simple API of the index, such as https://pypi.org/simple/.
+	URL string `json:"url"`
+	// Username and Password are sent with basic authentication.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Token is sent as a bearer token.
+	Token string `json:"token,omitempty"`
+	// Projects are glob patterns of the normalized names of the projects resolved from the upstream.
+	// All projects are resolved from the upstream when empty.
+	Projects []string `json:"projects,omitempty"`
+	// Pinned resolves the projects that match Projects only from this upstream, so that a project with the
+	// same name that is published to another index can not be installed instead.
+	Pinned bool `json:"pinned,omitempty"`
+	// FileURLs are prefixes of the URLs of files that credentials are sent to. Credentials are always sent
+	// to files hosted on the same host as the index.
+	FileURLs []string `json:"fileURLs,omitempty"`
+}
+
+// LoadUpstreams reads an ordered list of upstreams from a JSON file.
+func LoadUpstreams(p string) ([]Upstream, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	upstreams := []Upstream{}
+	err = json.Unmarshal(b, &upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode upstreams: %w", err)
+	}
+	err = ValidateUpstreams(upstreams)
+	if err != nil {
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+// ValidateUpstreams checks that the upstreams have unique names, valid URLs and valid project patterns.
+func ValidateUpstreams(upstreams []Upstream) error {
+	if len(upstreams) == 0 {
+		return errors.New("at least one upstream is required")
+	}
+	names := map[string]struct{}{}
+	for _, upstream := range upstreams {
+		if !upstreamNameRegex.MatchString(upstream.Name) {
+			return fmt.Errorf("invalid upstream name %q", upstream.Name)
+		}
+		if _, ok := names[upstream.Name]; ok {
+			return fmt.Errorf("duplicate upstream name %s", upstream.Name)
+		}
+		names[upstream.Name] = struct{}{}
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			return fmt.Errorf("invalid URL of upstream %s: %w", upstream.Name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("URL of upstream %s is not an absolute HTTP URL", upstream.Name)
+		}
+		if upstream.Token != "" && (upstream.Username != "" || upstream.Password != "") {
+			return fmt.Errorf("upstream %s can not use both a token and basic authentication", upstream.Name)
+		}
+		for _, pattern := range upstream.Projects {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid project pattern %q of upstream %s: %w", pattern, upstream.Name, err)
+			}
+		}
+		if upstream.Pinned && len(upstream.Projects) == 0 {
+			return fmt.Errorf("pinned upstream %s requires project patterns", upstream.Name)
+		}
+	}
+	return nil
+}
+
+// matches returns true when the project is resolved from the upstream.
+func (u Upstream) matches(project string) bool {
+	if len(u.Projects) == 0 {
+		return true
+	}
+	for _, pattern := range u.Projects {
+		if ok, _ := path.Match(pattern, project); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize sets the credentials of the upstream on a request to the index or to a file of the upstream.
+func (u Upstream) authorize(req *http.Request) {
+	if !u.authorizes(req.URL) {
+		return
+	}
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+		return
+	}
+	if u.Username != "" || u.Password != "" {
+		req.SetBasicAuth(u.Username, u.Password)
+	}
+}
+
+// authorizes returns true when the credentials of the upstream may be sent to the URL.
+func (u Upstream) authorizes(target *url.URL) bool {
+	indexURL, err := url.Parse(u.URL)
+	if err != nil {
+		return false
+	}
+	if target.Scheme == indexURL.Scheme && target.Host == indexURL.Host {
+		return true
+	}
+	for _, prefix := range u.FileURLs {
+		if strings.HasPrefix(target.String(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamsFor returns the upstreams that a project is resolved from in order of priority.
+func (p *PipClient) upstreamsFor(project string) []Upstream {
+	for _, upstream := range p.Upstreams {
+		if upstream.Pinned && upstream.matches(project) {
+			return []Upstream{upstream}
+		}
+	}
+	upstreams := []Upstream{}
+	for _, upstream := range p.Upstreams {
+		if upstream.matches(project) {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams
+}
+
+func (p *PipClient) upstream(name string) (Upstream, bool) {
+	for _, upstream := range p.Upstreams {
+		if upstream.Name == name {
+			return upstream, true
+		}
+	}
+	return Upstream{}, false
+}
+
+// upstreamIndex is the result of fetching the index of a project from an upstream.
+type upstreamIndex struct {
+	idx         *projectIndex
+	validators  indexValidators
+	notModified bool
+}
+
+// fetchIndexes fetches the index of the project from each upstream it is resolved from. Upstreams that do not have
+// the project are skipped. When a base index is given its validators are sent with conditional requests, and the files
+// of upstreams that respond that the index was not modified are taken from the base index. The merged index is
+// returned with an error when any of the upstreams failed, as the index is then incomplete.
+func (p *PipClient) fetchIndexes(ctx context.Context, name string, base *projectIndex) (projectIndex, bool, error) {
+	upstreams := p.upstreamsFor(name)
+	results := make([]upstreamIndex, len(upstreams))
+	errs := make([]error, len(upstreams))
+	fetched := time.Now()
+	wg := sync.WaitGroup{}
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			validators := indexValidators{}
+			if base != nil {
+				validators = base.Freshness.Validators[upstream.Name]
+			}
+			results[i], errs[i] = p.fetchIndex(ctx, upstream, name, validators)
+		}()
+	}
+	wg.Wait()
+
+	found := []projectIndex{}
+	freshness := indexFreshness{Fetched: fetched, Validators: map[string]indexValidators{}}
+	for i, result := range results {
+		if result.notModified {
+			found = append(found, base.fromUpstream(upstreams[i].Name))
+		} else if result.idx != nil {
+			found = append(found, *result.idx)
+		} else {
+			continue
+		}
+		if result.validators != (indexValidators{}) {
+			freshness.Validators[upstreams[i].Name] = result.validators
+		}
+	}
+	if len(found) == 0 {
+		return projectIndex{}, false, errors.Join(errs...)
+	}
+	idx := mergeIndexes(name, found)
+	idx.Freshness = freshness
+	return idx, true, errors.Join(errs...)
+}
+
+// fetchIndex fetches the index of the project from the upstream, conditionally when validators are given. The result
+// has no index when the upstream does not have the project.
+func (p *PipClient) fetchIndex(ctx context.Context, upstream Upstream, name string, validators indexValidators) (upstreamIndex, error) {
+	indexURL := strings.TrimSuffix(upstream.URL, "/") + "/" + name + "/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, indexURL, nil)
+	if err != nil {
+		return upstreamIndex{}, err
+	}
+	req.Header.Set("User-Agent", "Clyde-PipProxy/1.0")
+	req.Header.Set("Accept", upstreamAccept)
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	upstream.authorize(req)
+	resp, err := p.upstreamClient().Do(req)
+	if err != nil {
+		return upstreamIndex{}, fmt.Errorf("could not fetch index from upstream %s: %w", upstream.Name, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return upstreamIndex{validators: validators, notModified: true}, nil
+	case http.StatusNotFound:
+		return upstreamIndex{}, nil
+	default:
+		return upstreamIndex{}, fmt.Errorf("upstream %s returned %s", upstream.Name, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return upstreamIndex{}, fmt.Errorf("could not read index from upstream %s: %w", upstream.Name, err)
+	}
+	idx, err := parseIndex(resp.Header.Get("Content-Type"), body, resp.Request.URL)
+	if err != nil {
+		return upstreamIndex{}, fmt.Errorf("could not parse index from upstream %s: %w", upstream.Name, err)
+	}
+	idx = rewriteIndex(idx, name, upstream.Name)
+	result := upstreamIndex{
+		idx: &idx,
+		validators: indexValidators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		},
+	}
+	return result, nil
+}
+
+// mergeIndexes merges the indexes of a project from multiple upstreams. Files are identified by their filename, and
+// the files of upstreams with a higher priority take precedence.
+func mergeIndexes(name string, indexes []projectIndex) projectIndex {
+	merged := projectIndex{
+		Meta:  indexMeta{APIVersion: apiVersion},
+		Name:  name,
+		Files: []indexFile{},
+	}
+	filenames := map[string]struct{}{}
+	for _, idx := range indexes {
+		for _, f := range idx.Files {
+			filename := strings.ToLower(f.Filename)
+			if _, ok := filenames[filename]; ok {
+				continue
+			}
+			filenames[filename] = struct{}{}
+			merged.Files = append(merged.Files, f)
+		}
+		for _, version := range idx.Versions {
+			if !slices.Contains(merged.Versions, version) {
+				merged.Versions = append(merged.Versions, version)
+			}
+		}
+	}
+	return merged
+}
+
+// artifactOrigin returns the URL that an artifact is fetched from and the upstream that lists it. The origin is taken
+// from the links in the index of the project, which is fetched from peers or the upstreams when it is not cached or
+// does not list the artifact. Artifacts that are not listed in the index of their project have no origin.
+func (p *PipClient) artifactOrigin(ctx context.Context, name string) (string, Upstream, bool) {
+	f, ok := p.indexedFile(name)
+	if !ok {
+		f, ok = p.fetchArtifactIndex(ctx, name)
+	}
+	if !ok || f.Origin == "" {
+		return "", Upstream{}, false
+	}
+	origin := f.Origin
+	if strings.HasSuffix(name, ".metadata") {
+		origin += ".metadata"
+	}
+	upstream, ok := p.upstream(f.Upstream)
+	return origin, upstream, ok
+}
+
+// fetchArtifactIndex fetches the index of the project that the artifact belongs to, first from peers and then from the
+// upstreams, and returns the file of the artifact once an index lists it. Indexes that were fetched completely are
+// cached and advertised.
+func (p *PipClient) fetchArtifactIndex(ctx context.Context, name string) (indexFile, bool) {
+	distribution := strings.TrimSuffix(name, ".metadata")
+	for _, project := range projectCandidates(distribution) {
+		if idx, ok := p.fetchIndexFromPeers(ctx, "pip:"+project, project); ok {
+			if f, ok := idx.file(distribution); ok {
+				p.storeIndex(project, idx)
+				return f, true
+			}
+		}
+		idx, found, err := p.fetchIndexes(ctx, project, nil)
+		if !found {
+			continue
+		}
+		if err != nil {
+			p.Log.Error(err, "index is not cached as some upstreams failed", "name", project)
+		} else {
+			p.storeIndex(project, idx)
+		}
+		if f, ok := idx.file(distribution); ok {
+			return f, true
+		}
+	}
+	return indexFile{}, false
+}
+
+func (p *PipClient) upstreamClient() *http.Client {
+	return &http.Client{
+		Timeout: p.ResolveTimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+}
@@ -0,0 +1,250 @@
+package pip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"clyde/pkg/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadUpstreams(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name          string
+		upstreams     string
+		expectedError string
+	}{
+		{
+			name:      "valid",
+			upstreams: `[{"name": "internal", "url": "https://pypi.example.com/simple/", "token": "secret", "projects": ["corp-*"], "pinned": true}, {"name": "pypi", "url": "https://pypi.org/simple/"}]`,
+		},
+		{
+			name:          "no upstreams",
+			upstreams:     `[]`,
+			expectedError: "at least one upstream is required",
+		},
+		{
+			name:          "invalid name",
+			upstreams:     `[{"name": "Internal Index", "url": "https://pypi.example.com/simple/"}]`,
+			expectedError: `invalid upstream name "Internal Index"`,
+		},
+		{
+			name:          "duplicate name",
+			upstreams:     `[{"name": "pypi", "url": "https://pypi.org/simple/"}, {"name": "pypi", "url": "https://pypi.org/simple/"}]`,
+			expectedError: "duplicate upstream name pypi",
+		},
+		{
+			name:          "relative URL",
+			upstreams:     `[{"name": "pypi", "url": "/simple/"}]`,
+			expectedError: "URL of upstream pypi is not an absolute HTTP URL",
+		},
+		{
+			name:          "token and basic authentication",
+			upstreams:     `[{"name": "pypi", "url": "https://pypi.org/simple/", "token": "secret", "username": "user"}]`,
+			expectedError: "upstream pypi can not use both a token and basic authentication",
+		},
+		{
+			name:          "invalid project pattern",
+			upstreams:     `[{"name": "pypi", "url": "https://pypi.org/simple/", "projects": ["[corp"]}]`,
+			expectedError: `invalid project pattern "[corp" of upstream pypi: syntax error in pattern`,
+		},
+		{
+			name:          "pinned without projects",
+			upstreams:     `[{"name": "pypi", "url": "https://pypi.org/simple/", "pinned": true}]`,
+			expectedError: "pinned upstream pypi requires project patterns",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := filepath.Join(t.TempDir(), "upstreams.json")
+			err := os.WriteFile(p, []byte(tt.upstreams), 0o644)
+			require.NoError(t, err)
+			upstreams, err := LoadUpstreams(p)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, upstreams, 2)
+			require.Equal(t, "secret", upstreams[0].Token)
+			require.True(t, upstreams[0].Pinned)
+		})
+	}
+}
+
+func TestUpstreamsFor(t *testing.T) {
+	t.Parallel()
+
+	upstreams := []Upstream{
+		{Name: "pytorch", URL: "https://download.pytorch.org/whl/cu121/", Projects: []string{"torch", "torchvision"}},
+		{Name: "internal", URL: "https://pypi.example.com/simple/", Projects: []string{"corp-*"}, Pinned: true},
+		{Name: "pypi", URL: "https://pypi.org/simple/"},
+	}
+	client := NewPipClient(routing.NewMemoryRouter(nil, netip.AddrPort{}), t.TempDir(), "", WithUpstreams(upstreams...))
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		project  string
+		expected []string
+	}{
+		{"torch", []string{"pytorch", "pypi"}},
+		{"corp-lib", []string{"internal"}},
+		{"requests", []string{"pypi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.project, func(t *testing.T) {
+			t.Parallel()
+
+			names := []string{}
+			for _, upstream := range client.upstreamsFor(tt.project) {
+				names = append(names, upstream.Name)
+			}
+			require.Equal(t, tt.expected, names)
+		})
+	}
+
+	// The fallback index is the only upstream when no upstreams are configured.
+	fallbackClient := NewPipClient(routing.NewMemoryRouter(nil, netip.AddrPort{}), t.TempDir(), "https://pypi.org/simple/")
+	require.Equal(t, []Upstream{{Name: "default", URL: "https://pypi.org/simple/"}}, fallbackClient.Upstreams)
+}
+
+func TestPipRegistryHandlerUpstreams(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("internal wheel content")
+	internalSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/simple/corp-lib/":
+			w.Header().Set("Content-Type", ContentTypeSimpleJSON)
+			fmt.Fprintf(w, `{"meta": {"api-version": "1.1"}, "name": "corp-lib", "files": [{"filename": "corp_lib-1.0-py3-none-any.whl", "url": "../../files/corp_lib-1.0-py3-none-any.whl", "hashes": {"sha256": "%s"}}]}`, sha256Hex(content))
+		case "/simple/shared/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<a href="/files/shared-1.0-py3-none-any.whl">shared-1.0-py3-none-any.whl</a>`))
+		case "/files/corp_lib-1.0-py3-none-any.whl":
+			_, _ = w.Write(content)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer internalSrv.Close()
+	publicHits := atomic.Int32{}
+	publicSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.Header.Get("Authorization"))
+		if r.URL.Path != "/simple/shared/" {
+			publicHits.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<a href="https://files.pythonhosted.org/packages/ab/cd/shared-1.0-py3-none-any.whl">shared-1.0-py3-none-any.whl</a>
+<a href="https://files.pythonhosted.org/packages/ef/gh/shared-0.9-py3-none-any.whl">shared-0.9-py3-none-any.whl</a>`))
+	}))
+	defer publicSrv.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	client := NewPipClient(router, tempDir, "", WithUpstreams(
+		Upstream{Name: "internal", URL: internalSrv.URL + "/simple/", Username: "user", Password: "pass", Projects: []string{"corp-*", "shared"}},
+		Upstream{Name: "public", URL: publicSrv.URL + "/simple/"},
+		Upstream{Name: "corp", URL: internalSrv.URL + "/simple/", Username: "user", Password: "pass", Projects: []string{"corp-*"}, Pinned: true},
+	))
+
+	getIndex := func(name string) (int, projectIndex) {
+		rw := newTestResponseWriter()
+		req := httptest.NewRequest(http.MethodGet, "/simple/"+name+"/", nil)
+		req.Header.Set("Accept", ContentTypeSimpleJSON)
+		client.PipRegistryHandler(rw, req)
+		idx := projectIndex{}
+		if rw.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &idx))
+		}
+		return rw.Code, idx
+	}
+
+	// Pinned projects are only resolved from the pinned upstream.
+	status, idx := getIndex("corp-lib")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, idx.Files, 1)
+	require.Equal(t, "/packages/corp/corp_lib-1.0-py3-none-any.whl", idx.Files[0].URL)
+	require.Equal(t, internalSrv.URL+"/files/corp_lib-1.0-py3-none-any.whl", idx.Files[0].Origin)
+	require.Equal(t, int32(0), publicHits.Load())
+
+	// Indexes are merged with files of upstreams with a higher priority taking precedence.
+	status, idx = getIndex("shared")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, idx.Files, 2)
+	require.Equal(t, "/packages/internal/shared-1.0-py3-none-any.whl", idx.Files[0].URL)
+	require.Equal(t, "/packages/ef/gh/shared-0.9-py3-none-any.whl", idx.Files[1].URL)
+	require.Equal(t, "public", idx.Files[1].Upstream)
+
+	status, _ = getIndex("missing")
+	require.Equal(t, http.StatusNotFound, status)
+	require.NoFileExists(t, filepath.Join(tempDir, "missing.json"))
+
+	// Artifacts are fetched from the origin listed in the index with the credentials of the upstream.
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/packages/corp/corp_lib-1.0-py3-none-any.whl", nil)
+	client.PipRegistryHandler(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, content, rw.Body.Bytes())
+	b, err := os.ReadFile(filepath.Join(tempDir, "corp_lib-1.0-py3-none-any.whl"))
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+}
+
+func TestPipArtifactOrigin(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("origin wheel")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/simple/origin/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<a href="/files/origin-1.0-py3-none-any.whl">origin-1.0-py3-none-any.whl</a>`))
+		case "/files/origin-1.0-py3-none-any.whl":
+			_, _ = w.Write(content)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	tempDir := t.TempDir()
+	client := NewPipClient(router, tempDir, "", WithUpstreams(Upstream{Name: "internal", URL: srv.URL + "/simple/"}))
+
+	// Artifacts of projects without a cached index are fetched from the origin listed in the fetched index.
+	rw := newTestResponseWriter()
+	req := httptest.NewRequest(http.MethodGet, "/packages/internal/origin-1.0-py3-none-any.whl", nil)
+	client.PipRegistryHandler(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, content, rw.Body.Bytes())
+	require.FileExists(t, filepath.Join(tempDir, "origin.json"))
+
+	// Artifacts that are not listed in the index of their project are not fetched.
+	for _, name := range []string{"origin-2.0-py3-none-any.whl", "missing-1.0-py3-none-any.whl"} {
+		rw = newTestResponseWriter()
+		req = httptest.NewRequest(http.MethodGet, "/packages/ab/cd/"+name, nil)
+		client.PipRegistryHandler(rw, req)
+		require.Equal(t, http.StatusNotFound, rw.Code)
+		require.NoFileExists(t, filepath.Join(tempDir, name))
+	}
+}
@@ -0,0 +1,171 @@
+package pip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"clyde/pkg/cache"
+	"clyde/pkg/metrics"
+)
+
+// HeaderPipSha256 is set on requests to peers with the expected sha256 hash of the requested artifact, so that
+// peers that have not cached the index of the project can verify the artifact too.
+const HeaderPipSha256 = "X-Clyde-Pip-Sha256"
+
+var (
+	ErrHashMismatch = errors.New("artifact content does not match hash from index")
+	sha256Regex     = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// expectedHash returns the sha256 hash that an artifact is verified with. The hash from the cached index is preferred
+// over the hash sent by the peer that requested the artifact.
+func (p *PipClient) expectedHash(req *http.Request, name string) string {
+	if value, ok := p.indexedHash(name); ok {
+		return value
+	}
+	value := strings.ToLower(req.Header.Get(HeaderPipSha256))
+	if sha256Regex.MatchString(value) {
+		return value
+	}
+	return ""
+}
+
+// indexedHash returns the sha256 hash of an artifact from the cached index of its project. Core metadata files are
+// verified with the core metadata hash of their distribution.
+func (p *PipClient) indexedHash(filename string) (string, bool) {
+	f, ok := p.indexedFile(filename)
+	if !ok {
+		return "", false
+	}
+	hashes := f.Hashes
+	if strings.HasSuffix(filename, ".metadata") {
+		hashes = f.CoreMetadata.Hashes
+	}
+	value := strings.ToLower(hashes["sha256"])
+	return value, sha256Regex.MatchString(value)
+}
+
+// indexedFile returns the file of a distribution from the cached index of its project. The distribution of a core
+// metadata file is returned for the core metadata file.
+func (p *PipClient) indexedFile(filename string) (indexFile, bool) {
+	distribution := strings.TrimSuffix(filename, ".metadata")
+	for _, project := range projectCandidates(distribution) {
+		b, err := p.store.ReadFile(project + ".json")
+		if err != nil {
+			continue
+		}
+		idx := projectIndex{}
+		if err := json.Unmarshal(b, &idx); err != nil {
+			continue
+		}
+		if f, ok := idx.file(distribution); ok {
+			return f, true
+		}
+	}
+	return indexFile{}, false
+}
+
+// file returns the file of the distribution that the index lists.
+func (idx *projectIndex) file(distribution string) (indexFile, bool) {
+	for _, f := range idx.Files {
+		if strings.EqualFold(f.Filename, distribution) {
+			return f, true
+		}
+	}
+	return indexFile{}, false
+}
+
+// projectCandidates returns the normalized names of the projects that a distribution may belong to. Wheels escape
+// dashes in the project name, while the name of older source distributions may contain dashes.
+func projectCandidates(filename string) []string {
+	parts := strings.Split(filename, "-")
+	if strings.HasSuffix(strings.ToLower(filename), ".whl") {
+		return []string{normalizeName(parts[0])}
+	}
+	candidates := []string{}
+	for i := len(parts) - 1; i > 0; i-- {
+		candidates = append(candidates, normalizeName(strings.Join(parts[:i], "-")))
+	}
+	return candidates
+}
+
+// discardArtifact removes a cached artifact that failed verification and stops advertising it.
+func (p *PipClient) discardArtifact(name string) {
+	metrics.PipHashMismatchTotal.WithLabelValues("cache").Inc()
+	if err := p.store.Delete(name); err != nil {
+		p.Log.Error(err, "failed to remove cached artifact", "name", name)
+	}
+	key := fmt.Sprintf("pip:%s", strings.ToLower(name))
+	if err := p.Router.Withdraw(context.Background(), []string{key}); err != nil {
+		p.Log.Error(err, "failed to withdraw cached artifact", "key", key)
+	}
+}
+
+// verifyCached checks the sha256 hash of a cached artifact.
+func (p *PipClient) verifyCached(name, expected string) error {
+	f, err := p.store.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return checkHash(hex.EncodeToString(h.Sum(nil)), expected)
+}
+
+func checkHash(computed, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	if computed != expected {
+		return errors.Join(ErrHashMismatch, fmt.Errorf("expected sha256 %s but computed %s", expected, computed))
+	}
+	return nil
+}
+
+// artifactWriter writes an artifact to the cache while it is hashed. The artifact is only linked into the cache
+// once it has been verified, so that a truncated or corrupt artifact is never served from the cache or advertised
+// to peers.
+type artifactWriter struct {
+	w        *cache.Writer
+	expected string
+}
+
+// newArtifactWriter creates a writer for the artifact with the name. The artifact is stored by the expected hash,
+// and is only verified when the expected hash is not empty.
+func newArtifactWriter(store *cache.Store, name, expected string) (*artifactWriter, error) {
+	w, err := store.Create(name, expected)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactWriter{w: w, expected: expected}, nil
+}
+
+func (w *artifactWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Commit verifies the artifact and links it into the cache. The written content is removed when it fails.
+func (w *artifactWriter) Commit() error {
+	err := checkHash(w.w.Sum(), w.expected)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.w.Commit()
+}
+
+// Abort removes the written content.
+func (w *artifactWriter) Abort() {
+	w.w.Abort()
+}
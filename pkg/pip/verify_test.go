@@ -0,0 +1,189 @@
+package pip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"clyde/pkg/cache"
+	"clyde/pkg/httpx"
+	"clyde/pkg/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIndexedHash(t *testing.T) {
+	t.Parallel()
+
+	wheelHash := sha256Hex([]byte("wheel"))
+	metadataHash := sha256Hex([]byte("metadata"))
+	sdistHash := sha256Hex([]byte("sdist"))
+	tempDir := t.TempDir()
+	client := NewPipClient(routing.NewMemoryRouter(nil, netip.AddrPort{}), tempDir, "https://pypi.org/simple/")
+	err := client.cacheIndex("foo-bar", projectIndex{
+		Name: "foo-bar",
+		Files: []indexFile{
+			{Filename: "foo_bar-1.0-py3-none-any.whl", Hashes: map[string]string{"sha256": wheelHash}, CoreMetadata: coreMetadata{Available: true, Hashes: map[string]string{"sha256": metadataHash}}},
+			{Filename: "foo-bar-0.9.tar.gz", Hashes: map[string]string{"sha256": sdistHash}},
+			{Filename: "foo_bar-0.8.tar.gz", Hashes: map[string]string{"md5": "abc"}},
+		},
+	})
+	require.NoError(t, err)
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		filename   string
+		expected   string
+		expectedOK bool
+	}{
+		{"foo_bar-1.0-py3-none-any.whl", wheelHash, true},
+		{"Foo_Bar-1.0-py3-none-any.whl", wheelHash, true},
+		{"foo_bar-1.0-py3-none-any.whl.metadata", metadataHash, true},
+		{"foo-bar-0.9.tar.gz", sdistHash, true},
+		{"foo_bar-0.8.tar.gz", "", false},
+		{"foo_bar-2.0-py3-none-any.whl", "", false},
+		{"baz-1.0.tar.gz", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			t.Parallel()
+
+			value, ok := client.indexedHash(tt.filename)
+			require.Equal(t, tt.expectedOK, ok)
+			require.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestArtifactWriter(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("wheel content")
+	for _, expected := range []string{sha256Hex(content), "", sha256Hex([]byte("other content"))} {
+		t.Run(expected, func(t *testing.T) {
+			t.Parallel()
+
+			tempDir := t.TempDir()
+			store, err := cache.New(tempDir)
+			require.NoError(t, err)
+			p := filepath.Join(tempDir, "foo-1.0-py3-none-any.whl")
+			aw, err := newArtifactWriter(store, "foo-1.0-py3-none-any.whl", expected)
+			require.NoError(t, err)
+			buf := &bytes.Buffer{}
+			hw := httpx.NewHoldbackWriter(buf)
+			for _, b := range [][]byte{content[:4], content[4:]} {
+				_, err := aw.Write(b)
+				require.NoError(t, err)
+				_, err = hw.Write(b)
+				require.NoError(t, err)
+			}
+			require.Equal(t, content[:len(content)-1], buf.Bytes())
+			require.NoFileExists(t, p)
+
+			err = aw.Commit()
+			if expected == sha256Hex([]byte("other content")) {
+				require.ErrorIs(t, err, ErrHashMismatch)
+				infos, err := store.List()
+				require.NoError(t, err)
+				require.Empty(t, infos)
+				entries, err := os.ReadDir(filepath.Join(tempDir, "blobs"))
+				require.NoError(t, err)
+				require.Empty(t, entries)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, hw.Release())
+			require.Equal(t, content, buf.Bytes())
+			b, err := os.ReadFile(p)
+			require.NoError(t, err)
+			require.Equal(t, content, b)
+		})
+	}
+}
+
+func TestPipRegistryHandlerPeerVerification(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("peer wheel content")
+	expected := sha256Hex(content)
+	filename := "verified-1.0-py3-none-any.whl"
+	key := "pip:" + filename
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		peerContent    []byte
+		cachedContent  []byte
+		expectedCached bool
+	}{
+		{"matching content", content, nil, true},
+		{"corrupt content", []byte("peer wheel CONTENT"), nil, false},
+		{"truncated content", content[:5], nil, false},
+		{"corrupt cached content replaced", content, []byte("corrupt"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			peerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, expected, r.Header.Get(HeaderPipSha256))
+				w.Header().Set("Content-Length", fmt.Sprint(len(tt.peerContent)))
+				_, _ = w.Write(tt.peerContent)
+			}))
+			defer peerSrv.Close()
+
+			peerAddr := netip.MustParseAddrPort(peerSrv.Listener.Addr().String())
+			self := netip.MustParseAddrPort("10.0.0.1:5000")
+			router := routing.NewMemoryRouter(map[string][]netip.AddrPort{key: {peerAddr}}, self)
+			tempDir := t.TempDir()
+			client := NewPipClient(router, tempDir, "http://invalid-upstream/simple/", WithResolveRetries(1))
+			err := client.cacheIndex("verified", projectIndex{
+				Name:  "verified",
+				Files: []indexFile{{Filename: filename, Hashes: map[string]string{"sha256": expected}}},
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/packages/ab/cd/"+filename, nil)
+			if tt.cachedContent != nil {
+				// Requests from peers carry the hash that the cached artifact is verified with.
+				err := os.WriteFile(filepath.Join(tempDir, filename), tt.cachedContent, 0o644)
+				require.NoError(t, err)
+				req.Header.Set(HeaderPipSha256, expected)
+			}
+			rw := newTestResponseWriter()
+			client.PipRegistryHandler(rw, req)
+
+			require.Equal(t, http.StatusOK, rw.Code)
+			peers, _ := router.Get(key)
+			advertised := slices.Contains(peers, self)
+			if !tt.expectedCached {
+				// The last byte is held back so that the client detects the discarded artifact as truncated.
+				require.Equal(t, tt.peerContent[:len(tt.peerContent)-1], rw.Body.Bytes())
+				require.NoFileExists(t, filepath.Join(tempDir, filename))
+				require.False(t, advertised)
+				infos, err := client.store.List()
+				require.NoError(t, err)
+				require.Len(t, infos, 1)
+				return
+			}
+			require.Equal(t, content, rw.Body.Bytes())
+			b, err := os.ReadFile(filepath.Join(tempDir, filename))
+			require.NoError(t, err)
+			require.Equal(t, content, b)
+			require.True(t, advertised)
+		})
+	}
+}
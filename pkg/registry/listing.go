@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/oci"
+)
+
+const (
+	// clusterListingMaxPeers is the maximum amount of peers asked when merging listings across the cluster.
+	clusterListingMaxPeers = 100
+	// clusterListingTimeout bounds the time spent waiting for a single peer to respond with its listing.
+	clusterListingTimeout = 2 * time.Second
+)
+
+// listFunc lists the entries of a single peer.
+type listFunc[T any] func(ctx context.Context, opts ...oci.FetchOption) ([]T, error)
+
+// tagsListHandler lists the tags of a repository from the images in the store.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-tags
+func (r *Registry) tagsListHandler(rw httpx.ResponseWriter, req *http.Request) {
+	rw.SetAttrs(HandlerAttrKey, "tags")
+
+	ref, err := oci.ParseTagsListPath(req.URL)
+	if err != nil {
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("could not parse path according to OCI distribution spec: %w", err))
+		return
+	}
+	if ref.Registry != "" {
+		rw.SetAttrs(RegistryAttrKey, ref.Registry)
+	}
+	last, n, err := parsePagination(req.URL.Query())
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	imgs, err := r.ociStore.ListImages(req.Context())
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	tags, found := oci.ListTags(imgs, ref.Registry, ref.Repository, r.filters)
+	if r.clusterListing && req.Header.Get(HeaderClydeMirrored) != "true" {
+		peerTags, peerFound := listFromPeers(r, req, oci.CatalogKey, func(ctx context.Context, opts ...oci.FetchOption) ([]string, error) {
+			return r.ociClient.ListTags(ctx, ref.Registry, ref.Repository, opts...)
+		})
+		for _, tag := range peerTags {
+			if ref.Registry != "" && oci.MatchesFilter(oci.Reference{Registry: ref.Registry, Repository: ref.Repository, Tag: tag}, r.filters) {
+				continue
+			}
+			tags = append(tags, tag)
+		}
+		found = found || peerFound
+		slices.Sort(tags)
+		tags = slices.Compact(tags)
+	}
+	if !found {
+		respErr := oci.NewDistributionError(oci.ErrCodeNameUnknown, fmt.Sprintf("repository %s not found", ref.Repository), nil)
+		rw.WriteError(http.StatusNotFound, respErr)
+		return
+	}
+
+	tags, more := oci.Paginate(tags, last, n)
+	if more && len(tags) > 0 {
+		setNextLink(rw, req, tags[len(tags)-1], n)
+	}
+	writeListing(rw, req, oci.TagList{Name: ref.Repository, Tags: tags})
+}
+
+// catalogHandler lists the repositories of the images in the store.
+// The listing is limited to a single registry when the registry parameter is set.
+func (r *Registry) catalogHandler(rw httpx.ResponseWriter, req *http.Request) {
+	rw.SetAttrs(HandlerAttrKey, "catalog")
+
+	registry := req.URL.Query().Get("ns")
+	if registry != "" {
+		rw.SetAttrs(RegistryAttrKey, registry)
+	}
+	last, n, err := parsePagination(req.URL.Query())
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	imgs, err := r.ociStore.ListImages(req.Context())
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	repos := oci.ListRepositories(imgs, registry, r.filters)
+	if r.clusterListing && req.Header.Get(HeaderClydeMirrored) != "true" {
+		peerRepos, _ := listFromPeers(r, req, oci.CatalogKey, func(ctx context.Context, opts ...oci.FetchOption) ([]string, error) {
+			return r.ociClient.ListRepositories(ctx, registry, opts...)
+		})
+		for _, repo := range peerRepos {
+			if registry != "" && oci.MatchesFilter(oci.Reference{Registry: registry, Repository: repo}, r.filters) {
+				continue
+			}
+			repos = append(repos, repo)
+		}
+		slices.Sort(repos)
+		repos = slices.Compact(repos)
+	}
+
+	repos, more := oci.Paginate(repos, last, n)
+	if more && len(repos) > 0 {
+		setNextLink(rw, req, repos[len(repos)-1], n)
+	}
+	writeListing(rw, req, oci.Catalog{Repositories: repos})
+}
+
+// listFromPeers merges the listings of the peers that advertise the key.
+// Peers that fail to respond are skipped as the listing is best effort, the returned
+// boolean is true when at least one peer responded.
+func listFromPeers[T any](r *Registry, req *http.Request, key string, list listFunc[T]) ([]T, bool) {
+	log := logr.FromContextOrDiscard(req.Context())
+
+	lookupCtx, lookupCancel := context.WithTimeout(req.Context(), r.resolveTimeout)
+	defer lookupCancel()
+	balancer, err := r.router.Lookup(lookupCtx, key, clusterListingMaxPeers)
+	if err != nil {
+		log.Error(err, "could not lookup peers for listing")
+		return nil, false
+	}
+	peers := []netip.AddrPort{}
+	for len(peers) < clusterListingMaxPeers {
+		peer, err := balancer.Next()
+		if err != nil || slices.Contains(peers, peer) {
+			break
+		}
+		peers = append(peers, peer)
+	}
+
+	mx := sync.Mutex{}
+	entries := []T{}
+	found := false
+	wg := sync.WaitGroup{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mirror := &url.URL{
+				Scheme: "http",
+				Host:   peer.String(),
+			}
+			if req.TLS != nil {
+				mirror.Scheme = "https"
+			}
+			ctx, cancel := context.WithTimeout(req.Context(), clusterListingTimeout)
+			defer cancel()
+			peerEntries, err := list(
+				ctx,
+				oci.WithFetchHeader(HeaderClydeMirrored, "true"),
+				oci.WithFetchMirror(mirror),
+				oci.WithFetchBasicAuth(r.username, r.password),
+			)
+			if err != nil {
+				log.Error(err, "could not list from peer", "peer", peer.String())
+				return
+			}
+			mx.Lock()
+			defer mx.Unlock()
+			entries = append(entries, peerEntries...)
+			found = true
+		}()
+	}
+	wg.Wait()
+	return entries, found
+}
+
+// parsePagination returns the last entry and page size parameters, the page size is negative when not set.
+func parsePagination(query url.Values) (string, int, error) {
+	n := -1
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", 0, fmt.Errorf("invalid page size %s", v)
+		}
+	}
+	return query.Get("last"), n, nil
+}
+
+// setNextLink sets the link to the next page of the listing.
+func setNextLink(rw httpx.ResponseWriter, req *http.Request, last string, n int) {
+	query := req.URL.Query()
+	query.Set("last", last)
+	query.Set("n", strconv.Itoa(n))
+	next := &url.URL{Path: req.URL.Path, RawQuery: query.Encode()}
+	rw.Header().Set(httpx.HeaderLink, fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+}
+
+func writeListing(rw httpx.ResponseWriter, req *http.Request, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeJSON)
+	rw.Header().Set(httpx.HeaderContentLength, strconv.Itoa(len(b)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, err = rw.Write(b)
+	if err != nil {
+		logr.FromContextOrDiscard(req.Context()).Error(err, "error occurred when writing listing")
+		return
+	}
+}
@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+func TestListing(t *testing.T) {
+	t.Parallel()
+
+	peerStore := oci.NewMemory()
+	peerStore.AddImage(oci.Image{Reference: oci.Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.27", Digest: digest.FromString("1")}})
+	peerStore.AddImage(oci.Image{Reference: oci.Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Tag: "v1", Digest: digest.FromString("2")}})
+	peerStore.AddImage(oci.Image{Reference: oci.Reference{Registry: "docker.io", Repository: "library/private", Tag: "v1", Digest: digest.FromString("3")}})
+	peerReg, err := NewRegistry(peerStore, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	require.NoError(t, err)
+	peerSrv := httptest.NewServer(peerReg.Handler(logr.Discard()))
+	t.Cleanup(func() {
+		peerSrv.Close()
+	})
+	peer := netip.MustParseAddrPort(peerSrv.Listener.Addr().String())
+
+	store := oci.NewMemory()
+	store.AddImage(oci.Image{Reference: oci.Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest", Digest: digest.FromString("4")}})
+	store.AddImage(oci.Image{Reference: oci.Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.26", Digest: digest.FromString("5")}})
+	store.AddImage(oci.Image{Reference: oci.Reference{Registry: "docker.io", Repository: "library/busybox", Digest: digest.FromString("6")}})
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{oci.CatalogKey: {peer}}, netip.AddrPort{})
+	filters := []oci.Filter{oci.RegexFilter{Regex: regexp.MustCompile(`private`)}}
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		clusterListing bool
+		mirrored       bool
+		target         string
+		expectedStatus int
+		expectedBody   string
+		expectedLink   string
+	}{
+		{
+			name:           "local tags",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/nginx","tags":["1.26","latest"]}`,
+		},
+		{
+			name:           "repository without tags",
+			target:         "/v2/library/busybox/tags/list?ns=docker.io",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/busybox","tags":[]}`,
+		},
+		{
+			name:           "unknown repository",
+			target:         "/v2/spegel-org/spegel/tags/list?ns=ghcr.io",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "cluster tags",
+			clusterListing: true,
+			target:         "/v2/library/nginx/tags/list?ns=docker.io",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/nginx","tags":["1.26","1.27","latest"]}`,
+		},
+		{
+			name:           "cluster tags only on peer",
+			clusterListing: true,
+			target:         "/v2/spegel-org/spegel/tags/list",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"spegel-org/spegel","tags":["v1"]}`,
+		},
+		{
+			name:           "cluster tags filtered",
+			clusterListing: true,
+			target:         "/v2/library/private/tags/list?ns=docker.io",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/private","tags":[]}`,
+		},
+		{
+			name:           "mirrored request is not merged",
+			clusterListing: true,
+			mirrored:       true,
+			target:         "/v2/spegel-org/spegel/tags/list",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "paginated tags",
+			clusterListing: true,
+			target:         "/v2/library/nginx/tags/list?ns=docker.io&n=2",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/nginx","tags":["1.26","1.27"]}`,
+			expectedLink:   `</v2/library/nginx/tags/list?last=1.27&n=2&ns=docker.io>; rel="next"`,
+		},
+		{
+			name:           "invalid page size",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io&n=foo",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "local catalog",
+			target:         "/v2/_catalog",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"repositories":["library/busybox","library/nginx"]}`,
+		},
+		{
+			name:           "cluster catalog",
+			clusterListing: true,
+			target:         "/v2/_catalog",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"repositories":["library/busybox","library/nginx","library/private","spegel-org/spegel"]}`,
+		},
+		{
+			name:           "cluster catalog for registry",
+			clusterListing: true,
+			target:         "/v2/_catalog?ns=docker.io&last=library/busybox",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"repositories":["library/nginx"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg, err := NewRegistry(store, router, WithRegistryFilters(filters), WithClusterListing(tt.clusterListing))
+			require.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.target, nil)
+			if tt.mirrored {
+				req.Header.Set(HeaderClydeMirrored, "true")
+			}
+			reg.Handler(logr.Discard()).ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer httpx.DrainAndClose(resp.Body)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.expectedBody, string(b))
+			require.Equal(t, httpx.ContentTypeJSON, resp.Header.Get(httpx.HeaderContentType))
+			require.Equal(t, tt.expectedLink, resp.Header.Get(httpx.HeaderLink))
+		})
+	}
+}
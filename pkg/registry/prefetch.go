@@ -0,0 +1,188 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/platforms"
+	"github.com/go-logr/logr"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/oci"
+)
+
+// PrefetchRequest is the body of a request to prefetch an image onto the node.
+type PrefetchRequest struct {
+	Image string `json:"image"`
+	// Platform defaults to the platform of the node when empty.
+	Platform string `json:"platform,omitempty"`
+}
+
+// PrefetchProgress is written as a JSON line for each piece of content pulled.
+// The last line either reports that the prefetch is done or the error that caused it to fail.
+type PrefetchProgress struct {
+	Digest    string `json:"digest,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	// Duration is the time in milliseconds it took to pull the content.
+	Duration int64 `json:"duration,omitempty"`
+	Done     bool  `json:"done,omitempty"`
+}
+
+// prefetchHandler pulls an image through the local mirror into the node's store.
+// Content written to the store is advertised by the state tracker through store events.
+func (r *Registry) prefetchHandler(rw httpx.ResponseWriter, req *http.Request) {
+	rw.SetAttrs(HandlerAttrKey, "prefetch")
+
+	// Prefetching makes the node pull any image, so it is disabled unless requests are authenticated.
+	if !r.basicAuthConfigured() {
+		rw.WriteError(http.StatusForbidden, errors.New("prefetch is disabled as basic auth is not configured"))
+		return
+	}
+	if !r.validBasicAuth(req) {
+		rw.WriteError(http.StatusUnauthorized, errors.New("invalid credentials"))
+		return
+	}
+	store, ok := r.ociStore.(oci.WritableStore)
+	if !ok {
+		rw.WriteError(http.StatusNotImplemented, fmt.Errorf("store %s does not support writing content", r.ociStore.Name()))
+		return
+	}
+
+	prefetchReq := PrefetchRequest{}
+	err := json.NewDecoder(io.LimitReader(req.Body, 1024*1024)).Decode(&prefetchReq)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("could not decode prefetch request: %w", err))
+		return
+	}
+	img, err := oci.ParseImage(prefetchReq.Image, oci.AllowTagOnly())
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	if oci.MatchesFilter(img.Reference, r.filters) {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("image %s is filtered out by registry filters", img.String()))
+		return
+	}
+	platform := platforms.DefaultSpec()
+	if prefetchReq.Platform != "" {
+		platform, err = platforms.Parse(prefetchReq.Platform)
+		if err != nil {
+			rw.WriteError(http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	// Content is pulled through this registry so that it is fetched from peers.
+	localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		rw.WriteError(http.StatusInternalServerError, errors.New("could not determine local address"))
+		return
+	}
+	mirror := &url.URL{
+		Scheme: "http",
+		Host:   localAddr.String(),
+	}
+	if req.TLS != nil {
+		mirror.Scheme = "https"
+	}
+
+	log := logr.FromContextOrDiscard(req.Context()).WithValues("image", img.String(), "platform", platforms.Format(platform))
+	log.Info("prefetching image")
+
+	rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeNDJSON)
+	rw.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(rw)
+	writeProgress := func(progress PrefetchProgress) {
+		err := enc.Encode(progress)
+		if err != nil {
+			log.Error(err, "could not write prefetch progress")
+			return
+		}
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	pullOpts := []oci.PullOption{
+		oci.WithPullPlatform(platform),
+		oci.WithPullStore(store),
+		oci.WithPullProgress(func(metric oci.PullMetric) {
+			writeProgress(PrefetchProgress{
+				Digest:    metric.Digest.String(),
+				MediaType: metric.ContentType,
+				Size:      metric.ContentLength,
+				Duration:  metric.Duration.Milliseconds(),
+			})
+		}),
+	}
+	mirrorPullOpts := append([]oci.PullOption{
+		oci.WithPullMirror(mirror),
+		oci.WithPullBasicAuth(r.username, r.password),
+	}, pullOpts...)
+	_, err = r.ociClient.Pull(req.Context(), img, mirrorPullOpts...)
+	if err != nil && r.leaser != nil {
+		log.Info("image could not be pulled from peers, pulling from upstream", "error", err.Error())
+		err = r.prefetchFromUpstream(req.Context(), img, mirrorPullOpts, pullOpts)
+	}
+	if err != nil {
+		log.Error(err, "prefetch failed")
+		writeProgress(PrefetchProgress{Error: err.Error()})
+		return
+	}
+	log.Info("prefetch successful")
+	writeProgress(PrefetchProgress{Done: true})
+}
+
+// hfPrefetchHandler downloads the files of a Hugging Face repository into the node's cache.
+func (r *Registry) hfPrefetchHandler(rw httpx.ResponseWriter, req *http.Request) {
+	rw.SetAttrs(HandlerAttrKey, "hf-prefetch")
+
+	// Prefetching makes the node download any repository, so it is disabled unless requests are authenticated.
+	if !r.basicAuthConfigured() {
+		rw.WriteError(http.StatusForbidden, errors.New("prefetch is disabled as basic auth is not configured"))
+		return
+	}
+	if !r.validBasicAuth(req) {
+		rw.WriteError(http.StatusUnauthorized, errors.New("invalid credentials"))
+		return
+	}
+	r.hfClient.PrefetchHandler(rw, req)
+}
+
+// prefetchFromUpstream pulls the image from its registry when it is not available from peers.
+// The upstream pull is leased so that a single node pulls the image while the other nodes wait and pull it from that node.
+func (r *Registry) prefetchFromUpstream(ctx context.Context, img oci.Image, mirrorPullOpts, pullOpts []oci.PullOption) error {
+	key := img.Identifier()
+	lease, owner, err := r.leaser.Acquire(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !owner {
+		_, err := r.ociClient.Pull(ctx, img, mirrorPullOpts...)
+		if err == nil {
+			return nil
+		}
+		logr.FromContextOrDiscard(ctx).Error(err, "image pulled by another node could not be pulled from peers, pulling from upstream")
+	}
+	_, err = r.ociClient.Pull(ctx, img, pullOpts...)
+	if lease == nil {
+		return err
+	}
+	// The image is advertised before the lease is released so that waiting nodes find it, the state tracker advertises the remaining content from store events.
+	if err == nil {
+		advertiseErr := r.router.Advertise(ctx, []string{key})
+		if advertiseErr != nil {
+			logr.FromContextOrDiscard(ctx).Error(advertiseErr, "could not advertise prefetched image")
+		}
+	}
+	lease.Release(ctx, err)
+	return err
+}
@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/hf"
+	"clyde/pkg/httpx"
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+func TestPrefetchHandler(t *testing.T) {
+	t.Parallel()
+
+	// Create an image on a peer.
+	peerStore := oci.NewMemory()
+	write := func(mediaType string, b []byte) ocispec.Descriptor {
+		t.Helper()
+
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		err := peerStore.Write(desc, b)
+		require.NoError(t, err)
+		return desc
+	}
+	marshal := func(v any) []byte {
+		t.Helper()
+
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return b
+	}
+	configDesc := write(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{}}`))
+	layerDesc := write(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{layerDesc}}
+	manifest.SchemaVersion = 2
+	manifestDesc := write(ocispec.MediaTypeImageManifest, marshal(manifest))
+	manifestDesc.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{manifestDesc}}
+	index.SchemaVersion = 2
+	indexDesc := write(ocispec.MediaTypeImageIndex, marshal(index))
+	img, err := oci.ParseImage("example.com/foo/bar:latest", oci.WithDigest(indexDesc.Digest))
+	require.NoError(t, err)
+	peerStore.AddImage(img)
+	peerReg, err := NewRegistry(peerStore, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	require.NoError(t, err)
+	peerSrv := httptest.NewServer(peerReg.Handler(logr.Discard()))
+	t.Cleanup(func() {
+		peerSrv.Close()
+	})
+	peer := netip.MustParseAddrPort(peerSrv.Listener.Addr().String())
+	resolver := map[string][]netip.AddrPort{
+		"example.com/foo/bar:latest": {peer},
+	}
+	for _, desc := range []ocispec.Descriptor{configDesc, layerDesc, manifestDesc, indexDesc} {
+		resolver[desc.Digest.String()] = []netip.AddrPort{peer}
+	}
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		store          oci.Store
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "basic auth not configured",
+			store:          oci.NewMemory(),
+			body:           `{"image":"example.com/foo/bar:latest"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "invalid credentials",
+			store:          oci.NewMemory(),
+			body:           `{"image":"example.com/foo/bar:latest"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "store is not writable",
+			store:          struct{ oci.Store }{oci.NewMemory()},
+			body:           `{"image":"example.com/foo/bar:latest"}`,
+			expectedStatus: http.StatusNotImplemented,
+		},
+		{
+			name:           "invalid image",
+			store:          oci.NewMemory(),
+			body:           `{"image":"bar"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "filtered image",
+			store:          oci.NewMemory(),
+			body:           `{"image":"docker.io/library/alpine:latest"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid platform",
+			store:          oci.NewMemory(),
+			body:           `{"image":"example.com/foo/bar:latest","platform":"linux/amd64/v1/foo"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "prefetch image",
+			store:          oci.NewMemory(),
+			body:           `{"image":"example.com/foo/bar:latest","platform":"linux/amd64"}`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			router := routing.NewMemoryRouter(resolver, netip.AddrPort{})
+			filters := []oci.Filter{oci.RegexFilter{Regex: regexp.MustCompile(`^docker.io/`)}}
+			opts := []RegistryOption{WithRegistryFilters(filters)}
+			if tt.expectedStatus != http.StatusForbidden {
+				opts = append(opts, WithBasicAuth("foo", "bar"))
+			}
+			reg, err := NewRegistry(tt.store, router, opts...)
+			require.NoError(t, err)
+			srv := httptest.NewServer(reg.Handler(logr.Discard()))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, srv.URL+"/v2/_prefetch", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.expectedStatus != http.StatusUnauthorized {
+				req.SetBasicAuth("foo", "bar")
+			}
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer httpx.DrainAndClose(resp.Body)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, httpx.ContentTypeNDJSON, resp.Header.Get(httpx.HeaderContentType))
+
+			progress := []PrefetchProgress{}
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				p := PrefetchProgress{}
+				err := json.Unmarshal(scanner.Bytes(), &p)
+				require.NoError(t, err)
+				progress = append(progress, p)
+			}
+			require.NoError(t, scanner.Err())
+			require.Len(t, progress, 5)
+			for i, desc := range []ocispec.Descriptor{indexDesc, manifestDesc, configDesc, layerDesc} {
+				require.Empty(t, progress[i].Error)
+				require.Equal(t, desc.Digest.String(), progress[i].Digest)
+				require.Equal(t, desc.Size, progress[i].Size)
+			}
+			require.Equal(t, PrefetchProgress{Done: true}, progress[4])
+
+			imgs, err := tt.store.ListImages(t.Context())
+			require.NoError(t, err)
+			require.Equal(t, []oci.Image{img}, imgs)
+			for _, desc := range []ocispec.Descriptor{configDesc, layerDesc, manifestDesc, indexDesc} {
+				_, err := tt.store.Descriptor(t.Context(), desc.Digest)
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// prefetchRecordingHf records the prefetch requests that are passed on to it.
+type prefetchRecordingHf struct {
+	hf.Hf
+	prefetched bool
+}
+
+func (h *prefetchRecordingHf) PrefetchHandler(rw httpx.ResponseWriter, req *http.Request) {
+	h.prefetched = true
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestHFPrefetchHandler(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		opts           []RegistryOption
+		username       string
+		password       string
+		expectedStatus int
+	}{
+		{
+			name:           "basic auth not configured",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "invalid credentials",
+			opts:           []RegistryOption{WithBasicAuth("foo", "bar")},
+			username:       "foo",
+			password:       "baz",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "prefetch repository",
+			opts:           []RegistryOption{WithBasicAuth("foo", "bar")},
+			username:       "foo",
+			password:       "bar",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			hfClient := &prefetchRecordingHf{}
+			opts := append([]RegistryOption{WithHfClient(hfClient)}, tt.opts...)
+			reg, err := NewRegistry(oci.NewMemory(), routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), opts...)
+			require.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/huggingface/_prefetch", strings.NewReader(`{"repo":"org/model"}`))
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			reg.Handler(logr.Discard()).ServeHTTP(rw, req)
+			require.Equal(t, tt.expectedStatus, rw.Code)
+			require.Equal(t, tt.expectedStatus == http.StatusOK, hfClient.prefetched)
+		})
+	}
+}
@@ -0,0 +1,553 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/oci"
+)
+
+const (
+	HeaderUploadUUID = "Docker-Upload-UUID"
+	HeaderSubject    = "OCI-Subject"
+
+	// uploadExpiration is the duration after which an upload session that has not been completed is removed.
+	uploadExpiration = 1 * time.Hour
+)
+
+var errUploadTooLarge = errors.New("upload is larger than the max upload size")
+
+// upload is a blob upload session which buffers the content in a temporary file until the digest is known.
+type upload struct {
+	file    *os.File
+	path    oci.UploadPath
+	updated time.Time
+	size    int64
+	mx      sync.Mutex
+}
+
+// pushHandler implements the push flow of the OCI distribution spec so that content built in the cluster can be pulled by any node.
+// Pushed content is written to the store and advertised once it has been verified.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#push
+func (r *Registry) pushHandler(rw httpx.ResponseWriter, req *http.Request) {
+	rw.SetAttrs(HandlerAttrKey, "push")
+
+	if r.pushNamespace == "" {
+		respErr := oci.NewDistributionError(oci.ErrCodeUnsupported, "push is not enabled", nil)
+		rw.WriteError(http.StatusMethodNotAllowed, respErr)
+		return
+	}
+	if !r.validBasicAuth(req) {
+		respErr := oci.NewDistributionError(oci.ErrCodeUnauthorized, "invalid credentials", nil)
+		rw.WriteError(http.StatusUnauthorized, respErr)
+		return
+	}
+	store, ok := r.ociStore.(oci.WritableStore)
+	if !ok {
+		respErr := oci.NewDistributionError(oci.ErrCodeUnsupported, fmt.Sprintf("store %s does not support writing content", r.ociStore.Name()), nil)
+		rw.WriteError(http.StatusMethodNotAllowed, respErr)
+		return
+	}
+
+	// Pushed content is always named after the push namespace, so that neither the host nor the registry parameter
+	// can be used to replace content mirrored from an upstream registry.
+	u := *req.URL
+	q := u.Query()
+	if ns := q.Get("ns"); ns != "" && ns != r.pushNamespace {
+		respErr := oci.NewDistributionError(oci.ErrCodeDenied, fmt.Sprintf("content can only be pushed to %s", r.pushNamespace), nil)
+		rw.WriteError(http.StatusForbidden, respErr)
+		return
+	}
+	q.Set("ns", r.pushNamespace)
+	u.RawQuery = q.Encode()
+	rw.SetAttrs(RegistryAttrKey, r.pushNamespace)
+
+	if strings.Contains(u.Path, "/blobs/uploads/") {
+		uploadPath, err := oci.ParseUploadPath(&u)
+		if err != nil {
+			rw.WriteError(http.StatusNotFound, fmt.Errorf("could not parse path according to OCI distribution spec: %w", err))
+			return
+		}
+		switch {
+		case req.Method == http.MethodPost && uploadPath.ID == "":
+			r.startUpload(rw, req, store, uploadPath)
+		case req.Method == http.MethodPatch && uploadPath.ID != "":
+			r.patchUpload(rw, req, uploadPath)
+		case req.Method == http.MethodPut && uploadPath.ID != "":
+			r.completeUpload(rw, req, store, uploadPath)
+		default:
+			rw.WriteError(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %s", req.Method, u.Path))
+		}
+		return
+	}
+
+	dist, err := oci.ParseDistributionPath(&u)
+	if err != nil {
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("could not parse path according to OCI distribution spec: %w", err))
+		return
+	}
+	if dist.Kind != oci.DistributionKindManifest || req.Method != http.MethodPut {
+		rw.WriteError(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %s", req.Method, u.Path))
+		return
+	}
+	r.putManifest(rw, req, store, dist)
+}
+
+func (r *Registry) startUpload(rw httpx.ResponseWriter, req *http.Request, store oci.WritableStore, uploadPath oci.UploadPath) {
+	rw.SetAttrs(HandlerAttrKey, "upload")
+
+	r.expireUploads(logr.FromContextOrDiscard(req.Context()))
+
+	// Blobs that already exist in the store are mounted instead of uploaded again.
+	if mount := req.URL.Query().Get("mount"); mount != "" {
+		dgst, err := digest.Parse(mount)
+		if err != nil {
+			respErr := oci.NewDistributionError(oci.ErrCodeDigestInvalid, fmt.Sprintf("invalid mount digest %s", mount), nil)
+			rw.WriteError(http.StatusBadRequest, errors.Join(respErr, err))
+			return
+		}
+		desc, err := store.Descriptor(req.Context(), dgst)
+		if err == nil {
+			err := r.commitBlob(req, store, uploadPath, desc, nil)
+			if err != nil {
+				rw.WriteError(http.StatusInternalServerError, err)
+				return
+			}
+			writeBlobCreated(rw, uploadPath, dgst)
+			return
+		}
+		if !errors.Is(err, oci.ErrNotFound) {
+			rw.WriteError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	uploadPath.ID = rand.Text()
+	u, err := r.createUpload(uploadPath)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// The whole blob is uploaded in a single request when the digest is set.
+	if req.URL.Query().Get("digest") != "" {
+		r.completeUpload(rw, req, store, uploadPath)
+		return
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	writeUploadAccepted(rw, u)
+}
+
+func (r *Registry) patchUpload(rw httpx.ResponseWriter, req *http.Request, uploadPath oci.UploadPath) {
+	rw.SetAttrs(HandlerAttrKey, "upload")
+
+	u, ok := r.getUpload(uploadPath)
+	if !ok {
+		respErr := oci.NewDistributionError(oci.ErrCodeBlobUploadUnknown, fmt.Sprintf("upload %s not found", uploadPath.ID), nil)
+		rw.WriteError(http.StatusNotFound, respErr)
+		return
+	}
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	// Chunks have to be uploaded in order.
+	if contentRange := req.Header.Get(httpx.HeaderContentRange); contentRange != "" {
+		start, _, _ := strings.Cut(contentRange, "-")
+		offset, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || offset != u.size {
+			rw.Header().Set(httpx.HeaderRange, uploadRange(u.size))
+			respErr := oci.NewDistributionError(oci.ErrCodeBlobUploadInvalid, fmt.Sprintf("chunk range %s does not start at offset %d", contentRange, u.size), nil)
+			rw.WriteError(http.StatusRequestedRangeNotSatisfiable, respErr)
+			return
+		}
+	}
+	err := u.write(req.Body, r.pushMaxUploadSize)
+	if err != nil {
+		// Uploads that exceed the max size cannot be completed.
+		if errors.Is(err, errUploadTooLarge) {
+			r.removeUpload(u)
+		}
+		writeUploadError(rw, err)
+		return
+	}
+	writeUploadAccepted(rw, u)
+}
+
+func (r *Registry) completeUpload(rw httpx.ResponseWriter, req *http.Request, store oci.WritableStore, uploadPath oci.UploadPath) {
+	rw.SetAttrs(HandlerAttrKey, "upload")
+
+	u, ok := r.getUpload(uploadPath)
+	if !ok {
+		respErr := oci.NewDistributionError(oci.ErrCodeBlobUploadUnknown, fmt.Sprintf("upload %s not found", uploadPath.ID), nil)
+		rw.WriteError(http.StatusNotFound, respErr)
+		return
+	}
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	// The upload can not be resumed once it is completed, even if verification fails.
+	defer r.removeUpload(u)
+
+	dgst, err := digest.Parse(req.URL.Query().Get("digest"))
+	if err != nil {
+		respErr := oci.NewDistributionError(oci.ErrCodeDigestInvalid, "digest parameter is required to complete upload", nil)
+		rw.WriteError(http.StatusBadRequest, errors.Join(respErr, err))
+		return
+	}
+	err = u.write(req.Body, r.pushMaxUploadSize)
+	if err != nil {
+		writeUploadError(rw, err)
+		return
+	}
+
+	// Verify the uploaded content before it is written to the store.
+	_, err = u.file.Seek(0, io.SeekStart)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	verifier := dgst.Verifier()
+	_, err = io.Copy(verifier, u.file)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	if !verifier.Verified() {
+		respErr := oci.NewDistributionError(oci.ErrCodeDigestInvalid, fmt.Sprintf("uploaded content does not match digest %s", dgst), nil)
+		rw.WriteError(http.StatusBadRequest, respErr)
+		return
+	}
+
+	mediaType := httpx.ContentTypeBinary
+	if u.size <= oci.ManifestMaxSize {
+		_, err = u.file.Seek(0, io.SeekStart)
+		if err != nil {
+			rw.WriteError(http.StatusInternalServerError, err)
+			return
+		}
+		// Content such as an empty blob that cannot be detected is stored as binary.
+		if mt, err := oci.DetectMediaType(u.file); err == nil {
+			mediaType = mt
+		}
+	}
+	_, err = u.file.Seek(0, io.SeekStart)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      u.size,
+	}
+	err = r.commitBlob(req, store, uploadPath, desc, u.file)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	writeBlobCreated(rw, uploadPath, dgst)
+}
+
+func (r *Registry) putManifest(rw httpx.ResponseWriter, req *http.Request, store oci.WritableStore, dist oci.DistributionPath) {
+	rw.SetAttrs(HandlerAttrKey, "manifest")
+
+	b, err := io.ReadAll(io.LimitReader(req.Body, oci.ManifestMaxSize+1))
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	if len(b) > oci.ManifestMaxSize {
+		respErr := oci.NewDistributionError(oci.ErrCodeSizeInvalid, fmt.Sprintf("manifest is larger than %d bytes", oci.ManifestMaxSize), nil)
+		rw.WriteError(http.StatusRequestEntityTooLarge, respErr)
+		return
+	}
+	mediaType := req.Header.Get(httpx.HeaderContentType)
+	if !oci.IsManifestsMediatype(mediaType) {
+		mediaType, err = oci.FingerprintMediaType(bytes.NewReader(b))
+		if err != nil || !oci.IsManifestsMediatype(mediaType) {
+			respErr := oci.NewDistributionError(oci.ErrCodeManifestInvalid, "content is not a manifest", nil)
+			rw.WriteError(http.StatusBadRequest, errors.Join(respErr, err))
+			return
+		}
+	}
+	dgst := digest.FromBytes(b)
+	if dist.Digest != "" {
+		dgst = dist.Digest.Algorithm().FromBytes(b)
+		if dgst != dist.Digest {
+			respErr := oci.NewDistributionError(oci.ErrCodeDigestInvalid, fmt.Sprintf("manifest digest %s does not match %s", dgst, dist.Digest), nil)
+			rw.WriteError(http.StatusBadRequest, respErr)
+			return
+		}
+	}
+
+	// All content referenced by the manifest has to be pushed before the manifest.
+	children, err := oci.ManifestChildren(b)
+	if err != nil {
+		respErr := oci.NewDistributionError(oci.ErrCodeManifestInvalid, "manifest could not be decoded", nil)
+		rw.WriteError(http.StatusBadRequest, errors.Join(respErr, err))
+		return
+	}
+	for _, child := range children {
+		_, err := store.Descriptor(req.Context(), child.Digest)
+		if errors.Is(err, oci.ErrNotFound) {
+			respErr := oci.NewDistributionError(oci.ErrCodeManifestBlobUnknown, fmt.Sprintf("referenced content %s not found", child.Digest), child.Digest)
+			rw.WriteError(http.StatusBadRequest, errors.Join(respErr, err))
+			return
+		}
+		if err != nil {
+			rw.WriteError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	img, err := oci.NewImage(dist.Registry, dist.Repository, dist.Tag, dgst)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	// Tags that exist in the store but were not pushed to this node have been mirrored from peers or upstream,
+	// overwriting them would make the tag resolve to different content depending on the node.
+	tagName, tagged := img.TagName()
+	if tagged {
+		existing, err := store.Resolve(req.Context(), tagName)
+		if err != nil && !errors.Is(err, oci.ErrNotFound) {
+			rw.WriteError(http.StatusInternalServerError, err)
+			return
+		}
+		if err == nil && existing != dgst && !r.pushedTag(tagName) {
+			respErr := oci.NewDistributionError(oci.ErrCodeDenied, fmt.Sprintf("tag %s was not pushed to this node and cannot be overwritten", dist.Tag), nil)
+			rw.WriteError(http.StatusConflict, respErr)
+			return
+		}
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(b)),
+	}
+	// The manifest is leased until the image that references it has been created.
+	leaseCtx, release, err := store.Lease(req.Context(), uploadExpiration)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	defer func() {
+		err := release(context.WithoutCancel(req.Context()))
+		if err != nil {
+			logr.FromContextOrDiscard(req.Context()).Error(err, "could not release push lease", "image", img.String())
+		}
+	}()
+	err = store.Ingest(leaseCtx, desc, bytes.NewReader(b))
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	err = store.Label(leaseCtx, img, desc)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	keys := []string{dgst.String()}
+	if tagged {
+		r.pushedTagsMx.Lock()
+		r.pushedTags[tagName] = struct{}{}
+		r.pushedTagsMx.Unlock()
+		keys = append(keys, tagName)
+	}
+	_, subject, err := oci.ReadReferrer(req.Context(), store, dgst)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	if subject != "" {
+		rw.Header().Set(HeaderSubject, subject.String())
+		keys = append(keys, oci.ReferrersKey(subject))
+	}
+	r.advertisePushed(req, img.Reference, keys)
+
+	logr.FromContextOrDiscard(req.Context()).Info("pushed manifest", "image", img.String())
+	rw.Header().Set(httpx.HeaderLocation, fmt.Sprintf("/v2/%s/manifests/%s", dist.Repository, dgst))
+	rw.Header().Set(oci.HeaderDockerDigest, dgst.String())
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// commitBlob writes the verified blob to the store and advertises it.
+// The content is only labeled with the repository when the reader is nil.
+// The blob is not referenced by an image until the manifest is pushed, so the lease is not released and
+// protects the blob from garbage collection until the upload expiration has passed.
+func (r *Registry) commitBlob(req *http.Request, store oci.WritableStore, uploadPath oci.UploadPath, desc ocispec.Descriptor, rd io.Reader) error {
+	ctx, _, err := store.Lease(req.Context(), uploadExpiration)
+	if err != nil {
+		return err
+	}
+	if rd != nil {
+		err := store.Ingest(ctx, desc, rd)
+		if err != nil {
+			return err
+		}
+	}
+	img := oci.Image{
+		Reference: oci.Reference{
+			Registry:   uploadPath.Registry,
+			Repository: uploadPath.Repository,
+		},
+	}
+	err = store.Label(ctx, img, desc)
+	if err != nil {
+		return err
+	}
+	ref := img.Reference
+	ref.Digest = desc.Digest
+	r.advertisePushed(req, ref, []string{desc.Digest.String()})
+	return nil
+}
+
+// advertisePushed advertises pushed content right away instead of waiting for the store events.
+func (r *Registry) advertisePushed(req *http.Request, ref oci.Reference, keys []string) {
+	if oci.MatchesFilter(ref, r.filters) {
+		return
+	}
+	err := r.router.Advertise(req.Context(), keys)
+	if err != nil {
+		logr.FromContextOrDiscard(req.Context()).Error(err, "could not advertise pushed content", "ref", ref.String())
+	}
+}
+
+// pushedTag returns true when the tag was pushed to this node.
+func (r *Registry) pushedTag(tagName string) bool {
+	r.pushedTagsMx.Lock()
+	defer r.pushedTagsMx.Unlock()
+
+	_, ok := r.pushedTags[tagName]
+	return ok
+}
+
+func (r *Registry) createUpload(uploadPath oci.UploadPath) (*upload, error) {
+	if r.uploadDir != "" {
+		err := os.MkdirAll(r.uploadDir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.CreateTemp(r.uploadDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{
+		file:    file,
+		path:    uploadPath,
+		updated: time.Now(),
+	}
+	r.uploadsMx.Lock()
+	defer r.uploadsMx.Unlock()
+	r.uploads[uploadPath.ID] = u
+	return u, nil
+}
+
+func (r *Registry) getUpload(uploadPath oci.UploadPath) (*upload, bool) {
+	r.uploadsMx.Lock()
+	defer r.uploadsMx.Unlock()
+
+	u, ok := r.uploads[uploadPath.ID]
+	if !ok || u.path != uploadPath {
+		return nil, false
+	}
+	return u, true
+}
+
+func (r *Registry) removeUpload(u *upload) {
+	r.uploadsMx.Lock()
+	delete(r.uploads, u.path.ID)
+	r.uploadsMx.Unlock()
+
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// expireUploads removes upload sessions that have been abandoned by clients.
+func (r *Registry) expireUploads(log logr.Logger) {
+	r.uploadsMx.Lock()
+	expired := []*upload{}
+	for _, u := range r.uploads {
+		if time.Since(u.updated) > uploadExpiration {
+			expired = append(expired, u)
+		}
+	}
+	r.uploadsMx.Unlock()
+
+	for _, u := range expired {
+		u.mx.Lock()
+		log.Info("removing expired upload", "id", u.path.ID, "repository", u.path.Repository)
+		r.removeUpload(u)
+		u.mx.Unlock()
+	}
+}
+
+// write appends the content to the upload, failing with errUploadTooLarge when the upload would exceed the max size.
+func (u *upload) write(rd io.Reader, maxSize int64) error {
+	_, err := u.file.Seek(u.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(u.file, io.LimitReader(rd, maxSize-u.size+1))
+	u.size += n
+	u.updated = time.Now()
+	if err != nil {
+		return err
+	}
+	if u.size > maxSize {
+		return errUploadTooLarge
+	}
+	return nil
+}
+
+func writeUploadError(rw httpx.ResponseWriter, err error) {
+	if errors.Is(err, errUploadTooLarge) {
+		respErr := oci.NewDistributionError(oci.ErrCodeSizeInvalid, "upload is larger than the max upload size", nil)
+		rw.WriteError(http.StatusRequestEntityTooLarge, respErr)
+		return
+	}
+	respErr := oci.NewDistributionError(oci.ErrCodeBlobUploadInvalid, "could not write upload chunk", nil)
+	rw.WriteError(http.StatusInternalServerError, errors.Join(respErr, err))
+}
+
+func writeUploadAccepted(rw httpx.ResponseWriter, u *upload) {
+	rw.Header().Set(httpx.HeaderLocation, u.path.URL().String())
+	rw.Header().Set(httpx.HeaderRange, uploadRange(u.size))
+	rw.Header().Set(HeaderUploadUUID, u.path.ID)
+	rw.Header().Set(httpx.HeaderContentLength, "0")
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func writeBlobCreated(rw httpx.ResponseWriter, uploadPath oci.UploadPath, dgst digest.Digest) {
+	location := &url.URL{Path: fmt.Sprintf("/v2/%s/blobs/%s", uploadPath.Repository, dgst)}
+	rw.Header().Set(httpx.HeaderLocation, location.String())
+	rw.Header().Set(oci.HeaderDockerDigest, dgst.String())
+	rw.Header().Set(httpx.HeaderContentLength, "0")
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// uploadRange returns the range of the content received so far, which is inclusive and without a unit.
+func uploadRange(size int64) string {
+	if size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", size-1)
+}
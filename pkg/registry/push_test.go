@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+func TestPush(t *testing.T) {
+	t.Parallel()
+
+	store := oci.NewMemory()
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	reg, err := NewRegistry(store, router, WithBasicAuth("foo", "bar"), WithUploadDir(t.TempDir()), WithPush("clyde.local", 1024))
+	require.NoError(t, err)
+	srv := httptest.NewServer(reg.Handler(logr.Discard()))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	do := func(method, target, contentType string, header http.Header, body []byte) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(t.Context(), method, srv.URL+target, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Host = "registry.local:5000"
+		req.SetBasicAuth("foo", "bar")
+		if contentType != "" {
+			req.Header.Set(httpx.HeaderContentType, contentType)
+		}
+		httpx.CopyHeader(req.Header, header)
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			httpx.DrainAndClose(resp.Body)
+		})
+		return resp
+	}
+
+	// Upload the layer in chunks.
+	layer := []byte("hello world")
+	layerDgst := digest.FromBytes(layer)
+	resp := do(http.MethodPost, "/v2/team/app/blobs/uploads/", "", nil, nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get(httpx.HeaderLocation)
+	require.Regexp(t, `^/v2/team/app/blobs/uploads/[A-Z2-7]+$`, location)
+	resp = do(http.MethodPatch, location, httpx.ContentTypeBinary, http.Header{httpx.HeaderContentRange: {"0-4"}}, layer[:5])
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Equal(t, "0-4", resp.Header.Get(httpx.HeaderRange))
+	resp = do(http.MethodPatch, location, httpx.ContentTypeBinary, http.Header{httpx.HeaderContentRange: {"0-4"}}, layer[:5])
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	require.Equal(t, "0-4", resp.Header.Get(httpx.HeaderRange))
+	resp = do(http.MethodPut, location+"?digest="+layerDgst.String(), httpx.ContentTypeBinary, nil, layer[5:])
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/v2/team/app/blobs/"+layerDgst.String(), resp.Header.Get(httpx.HeaderLocation))
+	require.Equal(t, layerDgst.String(), resp.Header.Get(oci.HeaderDockerDigest))
+	resp = do(http.MethodPatch, location, httpx.ContentTypeBinary, nil, layer)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Uploads larger than the max upload size are rejected and removed.
+	resp = do(http.MethodPost, "/v2/team/app/blobs/uploads/", "", nil, nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	location = resp.Header.Get(httpx.HeaderLocation)
+	resp = do(http.MethodPatch, location, httpx.ContentTypeBinary, nil, bytes.Repeat([]byte("a"), 1025))
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp = do(http.MethodPatch, location, httpx.ContentTypeBinary, nil, layer)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Content can only be pushed to the push namespace.
+	resp = do(http.MethodPost, "/v2/team/app/blobs/uploads/?ns=docker.io", "", nil, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Upload the config in a single request.
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{}}`)
+	configDgst := digest.FromBytes(config)
+	resp = do(http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+configDgst.String(), httpx.ContentTypeBinary, nil, config)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Uploads with content that does not match the digest are rejected.
+	resp = do(http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+configDgst.String(), httpx.ContentTypeBinary, nil, []byte("corrupt"))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Existing blobs are mounted from other repositories.
+	resp = do(http.MethodPost, "/v2/team/other/blobs/uploads/?mount="+layerDgst.String()+"&from=team/app", "", nil, nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/v2/team/other/blobs/"+layerDgst.String(), resp.Header.Get(httpx.HeaderLocation))
+
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDgst, Size: int64(len(config))},
+		Layers:    []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: layerDgst, Size: int64(len(layer))}},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDgst := digest.FromBytes(b)
+
+	// Manifests are rejected when referenced content is missing or the digest does not match.
+	missing := manifest
+	missing.Layers = []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("missing"), Size: 7}}
+	missingB, err := json.Marshal(missing)
+	require.NoError(t, err)
+	resp = do(http.MethodPut, "/v2/team/app/manifests/latest", ocispec.MediaTypeImageManifest, nil, missingB)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/team/app/manifests/"+digest.FromString("foo").String(), ocispec.MediaTypeImageManifest, nil, b)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPut, "/v2/team/app/manifests/latest", ocispec.MediaTypeImageManifest, nil, b)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, manifestDgst.String(), resp.Header.Get(oci.HeaderDockerDigest))
+	require.Equal(t, "/v2/team/app/manifests/"+manifestDgst.String(), resp.Header.Get(httpx.HeaderLocation))
+
+	// Pushed content is stored and advertised.
+	imgs, err := store.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	require.Equal(t, "clyde.local/team/app:latest@"+manifestDgst.String(), imgs[0].String())
+	for _, key := range []string{"clyde.local/team/app:latest", manifestDgst.String(), configDgst.String(), layerDgst.String()} {
+		_, ok := router.Get(key)
+		require.True(t, ok, key)
+	}
+	resp = do(http.MethodGet, fmt.Sprintf("/v2/team/app/blobs/%s?ns=clyde.local", layerDgst), "", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, layer, got)
+	resp = do(http.MethodGet, "/v2/team/app/manifests/latest?ns=clyde.local", "", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ocispec.MediaTypeImageManifest, resp.Header.Get(httpx.HeaderContentType))
+
+	// Tags pushed to this node can be overwritten, while tags that were not pushed to this node cannot.
+	other := manifest
+	other.Annotations = map[string]string{"foo": "bar"}
+	otherB, err := json.Marshal(other)
+	require.NoError(t, err)
+	resp = do(http.MethodPut, "/v2/team/app/manifests/latest", ocispec.MediaTypeImageManifest, nil, otherB)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	mirroredImg, err := oci.NewImage("clyde.local", "team/mirrored", "latest", manifestDgst)
+	require.NoError(t, err)
+	store.AddImage(mirroredImg)
+	resp = do(http.MethodPut, "/v2/team/mirrored/manifests/latest", ocispec.MediaTypeImageManifest, nil, otherB)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/team/mirrored/manifests/latest", ocispec.MediaTypeImageManifest, nil, b)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestPushErrors(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		store          oci.Store
+		method         string
+		target         string
+		auth           bool
+		pushDisabled   bool
+		expectedStatus int
+	}{
+		{
+			name:           "push is not enabled",
+			store:          oci.NewMemory(),
+			method:         http.MethodPost,
+			target:         "/v2/team/app/blobs/uploads/",
+			auth:           true,
+			pushDisabled:   true,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "invalid credentials",
+			store:          oci.NewMemory(),
+			method:         http.MethodPost,
+			target:         "/v2/team/app/blobs/uploads/",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "store is not writable",
+			store:          struct{ oci.Store }{oci.NewMemory()},
+			method:         http.MethodPost,
+			target:         "/v2/team/app/blobs/uploads/",
+			auth:           true,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "unknown upload",
+			store:          oci.NewMemory(),
+			method:         http.MethodPut,
+			target:         "/v2/team/app/blobs/uploads/UNKNOWN?digest=" + digest.FromString("foo").String(),
+			auth:           true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "put blob",
+			store:          oci.NewMemory(),
+			method:         http.MethodPut,
+			target:         "/v2/team/app/blobs/" + digest.FromString("foo").String(),
+			auth:           true,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+			opts := []RegistryOption{WithBasicAuth("foo", "bar")}
+			if !tt.pushDisabled {
+				opts = append(opts, WithPush("clyde.local", 1024))
+			}
+			reg, err := NewRegistry(tt.store, router, opts...)
+			require.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "http://registry.local"+tt.target, nil)
+			if tt.auth {
+				req.SetBasicAuth("foo", "bar")
+			}
+			reg.Handler(logr.Discard()).ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer httpx.DrainAndClose(resp.Body)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestPushRequiresBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	_, err := NewRegistry(oci.NewMemory(), router, WithPush("clyde.local", 1024))
+	require.EqualError(t, err, "basic auth has to be configured when push is enabled")
+	_, err = NewRegistry(oci.NewMemory(), router, WithBasicAuth("foo", "bar"), WithPush("clyde.local", 0))
+	require.EqualError(t, err, "push max upload size has to be larger than zero")
+}
@@ -2,18 +2,24 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"clyde/internal/option"
 	"clyde/pkg/hf"
@@ -21,6 +27,7 @@ import (
 	"clyde/pkg/metrics"
 	"clyde/pkg/oci"
 	"clyde/pkg/pip"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 )
 
@@ -39,6 +46,24 @@ type RegistryConfig struct {
 	Filters        []oci.Filter
 	ResolveTimeout time.Duration
 	ResolveRetries int
+	// SwarmConcurrency is the amount of blob ranges fetched in parallel from peers, swarming is disabled when less than two.
+	SwarmConcurrency  int
+	SwarmChunkSize    int64
+	SwarmStallTimeout time.Duration
+	// Leaser coordinates upstream pulls of prefetched images across the cluster, prefetching only pulls from peers when nil.
+	Leaser *routing.Leaser
+	// Relay streams blobs to peers while they are mirrored, blobs are only served once stored when nil.
+	Relay *relay.Relay
+	// ReferrersIndex lists the referrers in the store, it is expected to be kept up to date by the state tracker.
+	ReferrersIndex *oci.ReferrersIndex
+	// ClusterListing merges the tag and repository listings of all peers with the local listing.
+	ClusterListing bool
+	// UploadDir is where pushed blobs are buffered until they are verified, the default temporary directory is used when empty.
+	UploadDir string
+	// PushNamespace is the registry name that pushed content is stored under, pushing is disabled when empty.
+	PushNamespace string
+	// PushMaxUploadSize is the maximum size in bytes of a single blob upload.
+	PushMaxUploadSize int64
 }
 
 type RegistryOption = option.Option[RegistryConfig]
@@ -64,6 +89,72 @@ func WithResolveTimeout(resolveTimeout time.Duration) RegistryOption {
 	}
 }
 
+// WithSwarm enables fetching ranges of a blob from multiple peers in parallel.
+// Ranges that are not received within the stall timeout are reassigned to another peer.
+func WithSwarm(concurrency int, chunkSize int64, stallTimeout time.Duration) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		if concurrency > 1 && chunkSize <= 0 {
+			return fmt.Errorf("swarm chunk size %d has to be larger than zero", chunkSize)
+		}
+		if concurrency > 1 && stallTimeout <= 0 {
+			return fmt.Errorf("swarm stall timeout %s has to be larger than zero", stallTimeout)
+		}
+		cfg.SwarmConcurrency = concurrency
+		cfg.SwarmChunkSize = chunkSize
+		cfg.SwarmStallTimeout = stallTimeout
+		return nil
+	}
+}
+
+// WithUploadDir sets the directory where pushed blobs are buffered until the upload is completed.
+func WithUploadDir(dir string) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.UploadDir = dir
+		return nil
+	}
+}
+
+// WithPush enables pushing content into the namespace, which requires basic auth to be configured.
+func WithPush(namespace string, maxUploadSize int64) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.PushNamespace = namespace
+		cfg.PushMaxUploadSize = maxUploadSize
+		return nil
+	}
+}
+
+// WithClusterListing enables merging tag and repository listings from all peers in the cluster.
+func WithClusterListing(enabled bool) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.ClusterListing = enabled
+		return nil
+	}
+}
+
+// WithLeaser allows prefetching images from upstream, with a single node pulling each image from upstream.
+func WithLeaser(leaser *routing.Leaser) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.Leaser = leaser
+		return nil
+	}
+}
+
+// WithRelay allows peers to stream blobs from this node while they are still being mirrored.
+func WithRelay(relay *relay.Relay) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.Relay = relay
+		return nil
+	}
+}
+
+// WithReferrersIndex shares the referrers index that is kept up to date from the store events.
+func WithReferrersIndex(referrersIdx *oci.ReferrersIndex) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.ReferrersIndex = referrersIdx
+		return nil
+	}
+}
+
 func WithOCIClient(ociClient *oci.Client) RegistryOption {
 	return func(cfg *RegistryConfig) error {
 		cfg.OCIClient = ociClient
@@ -101,6 +192,7 @@ type Registry struct {
 	bufferPool     *sync.Pool
 	ociStore       oci.Store
 	ociClient      *oci.Client
+	referrersIdx   *oci.ReferrersIndex
 	pipClient      pip.Pip
 	hfClient       hf.Hf
 	router         routing.Router
@@ -110,6 +202,22 @@ type Registry struct {
 	resolveTimeout time.Duration
 	resolveRetries int
 	stats          Statistics
+
+	swarmConcurrency  int
+	swarmChunkSize    int64
+	swarmStallTimeout time.Duration
+
+	uploads           map[string]*upload
+	uploadDir         string
+	uploadsMx         sync.Mutex
+	pushNamespace     string
+	pushMaxUploadSize int64
+	pushedTags        map[string]struct{}
+	pushedTagsMx      sync.Mutex
+
+	clusterListing bool
+	leaser         *routing.Leaser
+	relay          *relay.Relay
 }
 
 func NewRegistry(ociStore oci.Store, router routing.Router, opts ...RegistryOption) (*Registry, error) {
@@ -129,6 +237,18 @@ func NewRegistry(ociStore oci.Store, router routing.Router, opts ...RegistryOpti
 		cfg.OCIClient = ociClient
 	}
 
+	if cfg.ReferrersIndex == nil {
+		cfg.ReferrersIndex = oci.NewReferrersIndex()
+	}
+	if cfg.PushNamespace != "" {
+		if cfg.Username == "" && cfg.Password == "" {
+			return nil, errors.New("basic auth has to be configured when push is enabled")
+		}
+		if cfg.PushMaxUploadSize <= 0 {
+			return nil, errors.New("push max upload size has to be larger than zero")
+		}
+	}
+
 	bufferPool := &sync.Pool{
 		New: func() any {
 			buf := make([]byte, 32*1024)
@@ -140,6 +260,7 @@ func NewRegistry(ociStore oci.Store, router routing.Router, opts ...RegistryOpti
 		ociStore:       ociStore,
 		router:         router,
 		ociClient:      cfg.OCIClient,
+		referrersIdx:   cfg.ReferrersIndex,
 		pipClient:      cfg.PipClient,
 		hfClient:       cfg.HfClient,
 		resolveRetries: cfg.ResolveRetries,
@@ -149,6 +270,20 @@ func NewRegistry(ociStore oci.Store, router routing.Router, opts ...RegistryOpti
 		password:       cfg.Password,
 		bufferPool:     bufferPool,
 		stats:          Statistics{},
+
+		swarmConcurrency:  cfg.SwarmConcurrency,
+		swarmChunkSize:    cfg.SwarmChunkSize,
+		swarmStallTimeout: cfg.SwarmStallTimeout,
+
+		uploads:           map[string]*upload{},
+		uploadDir:         cfg.UploadDir,
+		pushNamespace:     cfg.PushNamespace,
+		pushMaxUploadSize: cfg.PushMaxUploadSize,
+		pushedTags:        map[string]struct{}{},
+
+		clusterListing: cfg.ClusterListing,
+		leaser:         cfg.Leaser,
+		relay:          cfg.Relay,
 	}
 	return r, nil
 }
@@ -160,6 +295,10 @@ func (r *Registry) Handler(log logr.Logger) *httpx.ServeMux {
 	m.Handle("GET /livez", r.livenessHandler)
 	m.Handle("GET /v2/", r.registryHandler)
 	m.Handle("HEAD /v2/", r.registryHandler)
+	m.Handle("POST /v2/_prefetch", r.prefetchHandler)
+	m.Handle("POST /v2/", r.pushHandler)
+	m.Handle("PATCH /v2/", r.pushHandler)
+	m.Handle("PUT /v2/", r.pushHandler)
 
 	if r.pipClient != nil {
 		m.Handle("GET /simple/", r.pipClient.PipRegistryHandler)
@@ -171,6 +310,7 @@ func (r *Registry) Handler(log logr.Logger) *httpx.ServeMux {
 	if r.hfClient != nil {
 		m.Handle("GET /huggingface/", r.hfClient.HuggingFaceRegistryHandler)
 		m.Handle("HEAD /huggingface/", r.hfClient.HuggingFaceRegistryHandler)
+		m.Handle("POST /huggingface/_prefetch", r.hfPrefetchHandler)
 	}
 
 	return m
@@ -203,13 +343,10 @@ func (r *Registry) livenessHandler(rw httpx.ResponseWriter, req *http.Request) {
 func (r *Registry) registryHandler(rw httpx.ResponseWriter, req *http.Request) {
 	rw.SetAttrs(HandlerAttrKey, "registry")
 
-	if r.username != "" || r.password != "" {
-		username, password, _ := req.BasicAuth()
-		if r.username != username || r.password != password {
-			respErr := oci.NewDistributionError(oci.ErrCodeUnauthorized, "invalid credentials", nil)
-			rw.WriteError(http.StatusUnauthorized, respErr)
-			return
-		}
+	if !r.validBasicAuth(req) {
+		respErr := oci.NewDistributionError(oci.ErrCodeUnauthorized, "invalid credentials", nil)
+		rw.WriteError(http.StatusUnauthorized, respErr)
+		return
 	}
 
 	if path.Clean(req.URL.Path) == "/v2" {
@@ -218,6 +355,15 @@ func (r *Registry) registryHandler(rw httpx.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if path.Clean(req.URL.Path) == "/v2/_catalog" {
+		r.catalogHandler(rw, req)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/tags/list") {
+		r.tagsListHandler(rw, req)
+		return
+	}
+
 	dist, err := oci.ParseDistributionPath(req.URL)
 	if err != nil {
 		rw.WriteError(http.StatusNotFound, fmt.Errorf("could not parse path according to OCI distribution spec: %w", err))
@@ -232,12 +378,17 @@ func (r *Registry) registryHandler(rw httpx.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if req.Header.Get(HeaderClydeMirrored) != "true" {
+	// Referrers are merged with the referrers of peers by the referrers handler.
+	if req.Header.Get(HeaderClydeMirrored) != "true" && dist.Kind != oci.DistributionKindReferrers {
 		var ociErr error
-		if dist.Digest == "" {
+		switch {
+		case dist.Digest == "":
 			_, ociErr = r.ociStore.Resolve(req.Context(), dist.Identifier())
-		} else {
+		default:
 			_, ociErr = r.ociStore.Descriptor(req.Context(), dist.Digest)
+			if ociErr != nil && dist.Kind == oci.DistributionKindBlob && r.relayed(dist.Digest) != nil {
+				ociErr = nil
+			}
 		}
 		if ociErr != nil {
 			r.mirrorHandler(rw, req, dist)
@@ -252,12 +403,29 @@ func (r *Registry) registryHandler(rw httpx.ResponseWriter, req *http.Request) {
 	case oci.DistributionKindBlob:
 		r.blobHandler(rw, req, dist)
 		return
+	case oci.DistributionKindReferrers:
+		r.referrersHandler(rw, req, dist)
+		return
 	default:
 		rw.WriteError(http.StatusNotFound, fmt.Errorf("unknown distribution path kind %s", dist.Kind))
 		return
 	}
 }
 
+// basicAuthConfigured returns true if credentials are required for requests.
+func (r *Registry) basicAuthConfigured() bool {
+	return r.username != "" || r.password != ""
+}
+
+// validBasicAuth returns true if basic auth is not configured or the request credentials match.
+func (r *Registry) validBasicAuth(req *http.Request) bool {
+	if !r.basicAuthConfigured() {
+		return true
+	}
+	username, password, _ := req.BasicAuth()
+	return r.username == username && r.password == password
+}
+
 type MirrorErrorDetails struct {
 	Attempts int `json:"attempts"`
 }
@@ -285,20 +453,31 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 		oci.DistributionKindManifest: oci.ErrCodeManifestUnknown,
 	}[dist.Kind]
 
-	var resumeRng *httpx.Range
+	key := dist.Identifier()
+
+	// Blob content is verified against its digest as it is streamed from peers.
+	// The verifier is created when the first peer responds and keeps track of
+	// the offset to resume from when a peer fails.
+	var verifier *blobVerifier
+	defer func() {
+		if verifier != nil {
+			verifier.Abandon(req.Context())
+		}
+	}()
+	contributors := []netip.AddrPort{}
 
 	lookupCtx, lookupCancel := context.WithTimeout(req.Context(), r.resolveTimeout)
 	defer lookupCancel()
-	balancer, err := r.router.Lookup(lookupCtx, dist.Identifier(), r.resolveRetries)
+	balancer, err := r.router.Lookup(lookupCtx, key, r.resolveRetries)
 	if err != nil {
-		respErr := oci.NewDistributionError(errCode, fmt.Sprintf("lookup failed for %s", dist.Identifier()), mirrorDetails)
+		respErr := oci.NewDistributionError(errCode, fmt.Sprintf("lookup failed for %s", key), mirrorDetails)
 		rw.WriteError(http.StatusNotFound, errors.Join(respErr, err))
 		return
 	}
 	for range r.resolveRetries {
 		peer, err := balancer.Next()
 		if err != nil {
-			respErr := oci.NewDistributionError(errCode, fmt.Sprintf("could not find peer for %s", dist.Identifier()), mirrorDetails)
+			respErr := oci.NewDistributionError(errCode, fmt.Sprintf("could not find peer for %s", key), mirrorDetails)
 			rw.WriteError(http.StatusNotFound, errors.Join(respErr, lookupCtx.Err()))
 			return
 		}
@@ -318,10 +497,23 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 			oci.WithFetchMirror(mirror),
 			oci.WithFetchBasicAuth(r.username, r.password),
 		}
-		if resumeRng != nil {
-			fetchOpts = append(fetchOpts, oci.WithFetchRange(*resumeRng))
-		} else if h := req.Header.Get(httpx.HeaderRange); h != "" {
-			fetchOpts = append(fetchOpts, oci.WithFetchHeader(httpx.HeaderRange, h))
+		// When swarming only the first chunk is fetched from the peer, the
+		// remaining chunks are fetched in parallel from multiple peers.
+		var fetchRng *httpx.Range
+		if req.Method == http.MethodGet && dist.Kind == oci.DistributionKindBlob {
+			offset := int64(0)
+			if verifier != nil {
+				offset = verifier.Offset()
+			}
+			switch {
+			case r.swarmConcurrency > 1:
+				fetchRng = &httpx.Range{Start: offset, End: offset + r.swarmChunkSize - 1}
+			case offset > 0:
+				fetchRng = &httpx.Range{Start: offset, End: verifier.Size() - 1}
+			}
+		}
+		if fetchRng != nil {
+			fetchOpts = append(fetchOpts, oci.WithFetchRange(*fetchRng))
 		}
 
 		done := func() bool {
@@ -332,7 +524,7 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 				var reqCancel context.CancelFunc
 				fetchCtx, reqCancel = context.WithTimeout(req.Context(), 1*time.Second)
 				defer reqCancel()
-			} else if req.Method == http.MethodGet && dist.Kind == oci.DistributionKindManifest {
+			} else if req.Method == http.MethodGet && dist.Kind != oci.DistributionKindBlob {
 				var reqCancel context.CancelFunc
 				fetchCtx, reqCancel = context.WithTimeout(req.Context(), 2*time.Second)
 				defer reqCancel()
@@ -346,6 +538,12 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 			}
 			defer httpx.DrainAndClose(rc)
 
+			if dist.Kind == oci.DistributionKindBlob && desc.Digest != dist.Digest {
+				log.Error(errors.New("mirror responded with unexpected digest"), "retrying with next", "digest", desc.Digest.String())
+				balancer.Remove(peer)
+				return false
+			}
+
 			if !rw.HeadersWritten() {
 				oci.WriteDescriptorToHeader(desc, rw.Header())
 
@@ -358,7 +556,27 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 						rw.WriteError(http.StatusBadRequest, err)
 						return true
 					}
-					resumeRng = rng
+					window := httpx.Range{Start: 0, End: desc.Size - 1}
+					if rng != nil {
+						window = *rng
+					}
+					// Ranged reads are also verified as the full blob is hashed, only the window is written to the client.
+					if req.Method == http.MethodGet {
+						verifier, err = newBlobVerifier(rw, dist.Digest, desc.Size, window)
+						if err != nil {
+							rw.WriteError(http.StatusInternalServerError, err)
+							return true
+						}
+						if r.relay != nil {
+							transfer, err := r.relay.Start(req.Context(), dist.Digest.String(), desc.Size, nil)
+							if err != nil && !errors.Is(err, relay.ErrTransferExists) {
+								log.Error(err, "could not relay blob to peers")
+							}
+							if err == nil {
+								verifier.Relay(transfer)
+							}
+						}
+					}
 
 					rw.Header().Set(httpx.HeaderAcceptRanges, httpx.RangeUnit)
 					if rng == nil {
@@ -378,23 +596,61 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 
 			buf := r.bufferPool.Get().(*[]byte)
 			defer r.bufferPool.Put(buf)
-			n, err := io.CopyBuffer(rw, rc, *buf)
-			if err != nil {
-				switch dist.Kind {
-				case oci.DistributionKindManifest:
+
+			if dist.Kind != oci.DistributionKindBlob {
+				n, err := io.CopyBuffer(rw, rc, *buf)
+				if err != nil {
 					log.Error(err, "copying of manifest data failed")
 					return true
-				case oci.DistributionKindBlob:
-					if resumeRng == nil {
-						resumeRng = &httpx.Range{
-							End: desc.Size - 1,
+				}
+				log.Info("mirror request successful", "attempt", mirrorDetails.Attempts, "mirror", peer.String(), "bytes", n, "kind", dist.Kind)
+				return true
+			}
+
+			if !slices.Contains(contributors, peer) {
+				contributors = append(contributors, peer)
+			}
+			var sw *swarm
+			if r.swarmConcurrency > 1 && fetchRng != nil && fetchRng.End < verifier.Size()-1 {
+				sw = r.newSwarm(req.Context(), dist, balancer, mirror.Scheme, httpx.Range{Start: fetchRng.End + 1, End: verifier.Size() - 1})
+				sw.Start()
+				defer sw.Close()
+			}
+			n, err := io.CopyBuffer(verifier, rc, *buf)
+			if err == nil && sw != nil {
+				if verifier.Offset() != fetchRng.End+1 {
+					err = io.ErrUnexpectedEOF
+				} else {
+					var peers []netip.AddrPort
+					peers, err = sw.WriteChunks(verifier)
+					for _, p := range peers {
+						if !slices.Contains(contributors, p) {
+							contributors = append(contributors, p)
 						}
 					}
-					resumeRng.Start += n
-					log.Error(err, "copying of blob data failed, retrying with offset")
-					return false
+					n = verifier.Offset() - fetchRng.Start
 				}
 			}
+			if errors.Is(err, ErrDeliveredContentMismatch) {
+				// Content already sent to the client can not be taken back so the response is aborted.
+				r.markDigestMismatch(log, balancer, dist, contributors)
+				log.Error(err, "aborting mirror request")
+				return true
+			}
+			if err == nil {
+				err = verifier.Verify()
+			}
+			if errors.Is(err, ErrDigestMismatch) {
+				r.markDigestMismatch(log, balancer, dist, contributors)
+				log.Error(err, "verification of blob data failed, retrying with next")
+				contributors = []netip.AddrPort{}
+				verifier.Reset()
+				return false
+			}
+			if err != nil {
+				log.Error(err, "copying of blob data failed, retrying with offset", "offset", verifier.Offset())
+				return false
+			}
 			log.Info("mirror request successful", "attempt", mirrorDetails.Attempts, "mirror", peer.String(), "bytes", n, "kind", dist.Kind)
 			return true
 		}()
@@ -407,6 +663,16 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 	rw.WriteError(http.StatusNotFound, errors.Join(respErr, err))
 }
 
+// markDigestMismatch removes the peers that served content which did not match the expected digest.
+// It is not possible to know which peer served the corrupt bytes when a blob was resumed from multiple peers.
+func (r *Registry) markDigestMismatch(log logr.Logger, balancer routing.Balancer, dist oci.DistributionPath, peers []netip.AddrPort) {
+	metrics.MirrorDigestMismatchTotal.WithLabelValues(dist.Registry).Inc()
+	for _, peer := range peers {
+		log.Info("removing mirror that served content not matching digest", "mirror", peer.String())
+		balancer.Remove(peer)
+	}
+}
+
 func (r *Registry) manifestHandler(rw httpx.ResponseWriter, req *http.Request, dist oci.DistributionPath) {
 	rw.SetAttrs(HandlerAttrKey, "manifest")
 
@@ -455,11 +721,89 @@ func (r *Registry) manifestHandler(rw httpx.ResponseWriter, req *http.Request, d
 	}
 }
 
+// referrersHandler writes an index of the manifests which have the digest as subject. Referrers in the store are
+// merged with the referrers of peers that advertise the subject, unless the request is mirrored from a peer.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func (r *Registry) referrersHandler(rw httpx.ResponseWriter, req *http.Request, dist oci.DistributionPath) {
+	rw.SetAttrs(HandlerAttrKey, "referrers")
+
+	referrers := r.referrersIdx.Referrers(dist.Digest, dist.ArtifactType)
+	if req.Header.Get(HeaderClydeMirrored) != "true" {
+		peerReferrers, found := listFromPeers(r, req, oci.ReferrersKey(dist.Digest), func(ctx context.Context, opts ...oci.FetchOption) ([]ocispec.Descriptor, error) {
+			return r.ociClient.ListReferrers(ctx, dist.Registry, dist.Repository, dist.Digest, opts...)
+		})
+		if !found && len(referrers) == 0 && !r.referrersIdx.HasReferrers(dist.Digest) {
+			respErr := oci.NewDistributionError(oci.ErrCodeManifestUnknown, fmt.Sprintf("could not find referrers for %s", dist.Digest), nil)
+			rw.WriteError(http.StatusNotFound, respErr)
+			return
+		}
+		for _, desc := range peerReferrers {
+			if dist.ArtifactType != "" && desc.ArtifactType != dist.ArtifactType {
+				continue
+			}
+			if slices.ContainsFunc(referrers, func(d ocispec.Descriptor) bool { return d.Digest == desc.Digest }) {
+				continue
+			}
+			referrers = append(referrers, desc)
+		}
+		oci.SortReferrers(referrers)
+	}
+	idx := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: referrers,
+	}
+	idx.SchemaVersion = 2
+	b, err := json.Marshal(idx)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.Header().Set(httpx.HeaderContentType, ocispec.MediaTypeImageIndex)
+	rw.Header().Set(httpx.HeaderContentLength, strconv.Itoa(len(b)))
+	rw.Header().Set(oci.HeaderDockerDigest, digest.FromBytes(b).String())
+	rw.Header().Set(oci.HeaderNamespace, dist.Registry)
+	if dist.ArtifactType != "" {
+		rw.Header().Set(oci.HeaderFiltersApplied, "artifactType")
+	}
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, err = rw.Write(b)
+	if err != nil {
+		logr.FromContextOrDiscard(req.Context()).Error(err, "error occurred when writing referrers")
+		return
+	}
+}
+
+// relayed returns the transfer of a blob that is being mirrored by this node, or nil when there is none.
+func (r *Registry) relayed(dgst digest.Digest) *relay.Transfer {
+	if r.relay == nil {
+		return nil
+	}
+	transfer, ok := r.relay.Get(dgst.String())
+	if !ok {
+		return nil
+	}
+	return transfer
+}
+
 func (r *Registry) blobHandler(rw httpx.ResponseWriter, req *http.Request, dist oci.DistributionPath) {
 	rw.SetAttrs(HandlerAttrKey, "blob")
 
 	desc, err := r.ociStore.Descriptor(req.Context(), dist.Digest)
 	if err != nil {
+		if transfer := r.relayed(dist.Digest); transfer != nil {
+			rw.SetAttrs(HandlerAttrKey, "relay")
+			rw.Header().Set(oci.HeaderDockerDigest, dist.Digest.String())
+			rw.Header().Set(oci.HeaderNamespace, dist.Registry)
+			err := relay.ServeTransfer(rw, req, transfer)
+			if err != nil {
+				logr.FromContextOrDiscard(req.Context()).Error(err, "failed to relay blob")
+			}
+			return
+		}
 		respErr := oci.NewDistributionError(oci.ErrCodeBlobUnknown, fmt.Sprintf("could not get blob %s", dist.Digest), nil)
 		rw.WriteError(http.StatusNotFound, errors.Join(respErr, err))
 		return
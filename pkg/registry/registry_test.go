@@ -1,12 +1,16 @@
 package registry
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 
@@ -18,6 +22,7 @@ import (
 	"clyde/internal/option"
 	"clyde/pkg/httpx"
 	"clyde/pkg/oci"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 )
 
@@ -37,6 +42,9 @@ func TestRegistryOptions(t *testing.T) {
 		WithResolveTimeout(10 * time.Minute),
 		WithBasicAuth("foo", "bar"),
 		WithOCIClient(ociClient),
+		WithSwarm(4, 1024, time.Second),
+		WithUploadDir("/var/lib/clyde/uploads"),
+		WithClusterListing(true),
 	}
 	cfg := RegistryConfig{}
 	err = option.Apply(&cfg, opts...)
@@ -47,6 +55,14 @@ func TestRegistryOptions(t *testing.T) {
 	require.Equal(t, ociClient, cfg.OCIClient)
 	require.Equal(t, "foo", cfg.Username)
 	require.Equal(t, "bar", cfg.Password)
+	require.Equal(t, 4, cfg.SwarmConcurrency)
+	require.Equal(t, int64(1024), cfg.SwarmChunkSize)
+	require.Equal(t, time.Second, cfg.SwarmStallTimeout)
+	require.Equal(t, "/var/lib/clyde/uploads", cfg.UploadDir)
+	require.True(t, cfg.ClusterListing)
+
+	err = option.Apply(&cfg, WithSwarm(4, 0, time.Second))
+	require.EqualError(t, err, "swarm chunk size 0 has to be larger than zero")
 }
 
 func TestProbeHandlers(t *testing.T) {
@@ -385,3 +401,442 @@ func TestRegistryHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestMirrorDigestVerification(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("verified content")
+	dgst := digest.FromBytes(content)
+
+	newPeer := func(b []byte) netip.AddrPort {
+		t.Helper()
+
+		memStore := oci.NewMemory()
+		err := memStore.Write(ocispec.Descriptor{Digest: dgst, MediaType: "dummy"}, b)
+		require.NoError(t, err)
+		reg, err := NewRegistry(memStore, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+		require.NoError(t, err)
+		svr := httptest.NewServer(reg.Handler(logr.Discard()))
+		t.Cleanup(func() {
+			svr.Close()
+		})
+		return netip.MustParseAddrPort(svr.Listener.Addr().String())
+	}
+	goodAddrPort := newPeer(content)
+	lastByteCorruptAddrPort := newPeer([]byte("verified contenT"))
+	firstByteCorruptAddrPort := newPeer([]byte("Verified content"))
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		peers          []netip.AddrPort
+		rng            *httpx.Range
+		expectedStatus int
+		expectedBody   []byte
+	}{
+		{
+			name:           "good peer",
+			peers:          []netip.AddrPort{goodAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   content,
+		},
+		{
+			name:           "fail over to next peer on mismatch",
+			peers:          []netip.AddrPort{lastByteCorruptAddrPort, goodAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   content,
+		},
+		{
+			name:           "range from good peer",
+			peers:          []netip.AddrPort{goodAddrPort},
+			rng:            &httpx.Range{Start: 9, End: 15},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   []byte("content"),
+		},
+		{
+			name:           "fail over to next peer on mismatch outside of range",
+			peers:          []netip.AddrPort{firstByteCorruptAddrPort, goodAddrPort},
+			rng:            &httpx.Range{Start: 9, End: 15},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   []byte("content"),
+		},
+		{
+			name:           "fail over to next peer on mismatch in range",
+			peers:          []netip.AddrPort{lastByteCorruptAddrPort, goodAddrPort},
+			rng:            &httpx.Range{Start: 9, End: 15},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   []byte("content"),
+		},
+		{
+			name:           "range of whole blob is verified",
+			peers:          []netip.AddrPort{lastByteCorruptAddrPort, goodAddrPort},
+			rng:            &httpx.Range{Start: 0, End: 15},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   content,
+		},
+		{
+			name:           "abort when delivered content is corrupt",
+			peers:          []netip.AddrPort{firstByteCorruptAddrPort, goodAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []byte("Verified conten"),
+		},
+		{
+			name:           "all peers corrupt",
+			peers:          []netip.AddrPort{lastByteCorruptAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []byte("verified conten"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			router := routing.NewMemoryRouter(map[string][]netip.AddrPort{dgst.String(): tt.peers}, netip.AddrPort{})
+			reg, err := NewRegistry(oci.NewMemory(), router)
+			require.NoError(t, err)
+
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s?ns=docker.io", dgst.String())
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.rng != nil {
+				req.Header.Set(httpx.HeaderRange, tt.rng.String())
+			}
+			reg.Handler(logr.Discard()).ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer httpx.DrainAndClose(resp.Body)
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedBody, b)
+		})
+	}
+}
+
+func TestMirrorSwarm(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("swarmed content fetched from multiple peers")
+	dgst := digest.FromBytes(content)
+
+	newPeer := func(delay time.Duration, b []byte) netip.AddrPort {
+		t.Helper()
+
+		memStore := oci.NewMemory()
+		if b != nil {
+			err := memStore.Write(ocispec.Descriptor{Digest: dgst, MediaType: "dummy"}, b)
+			require.NoError(t, err)
+		}
+		reg, err := NewRegistry(memStore, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+		require.NoError(t, err)
+		handler := reg.Handler(logr.Discard())
+		svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+			handler.ServeHTTP(rw, req)
+		}))
+		t.Cleanup(func() {
+			svr.Close()
+		})
+		return netip.MustParseAddrPort(svr.Listener.Addr().String())
+	}
+	goodAddrPort := newPeer(0, content)
+	otherGoodAddrPort := newPeer(0, content)
+	slowAddrPort := newPeer(time.Minute, content)
+	missingAddrPort := newPeer(0, nil)
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		peers          []netip.AddrPort
+		rng            *httpx.Range
+		expectedStatus int
+		expectedBody   []byte
+	}{
+		{
+			name:           "single peer",
+			peers:          []netip.AddrPort{goodAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   content,
+		},
+		{
+			name:           "multiple peers",
+			peers:          []netip.AddrPort{goodAddrPort, otherGoodAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   content,
+		},
+		{
+			name:           "multiple peers with range",
+			peers:          []netip.AddrPort{goodAddrPort, otherGoodAddrPort},
+			rng:            &httpx.Range{Start: 8, End: 14},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   []byte("content"),
+		},
+		{
+			name:           "peer missing content",
+			peers:          []netip.AddrPort{goodAddrPort, missingAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   content,
+		},
+		{
+			name:           "slow peer is reassigned",
+			peers:          []netip.AddrPort{goodAddrPort, slowAddrPort},
+			expectedStatus: http.StatusOK,
+			expectedBody:   content,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			router := routing.NewMemoryRouter(map[string][]netip.AddrPort{dgst.String(): tt.peers}, netip.AddrPort{})
+			reg, err := NewRegistry(oci.NewMemory(), router, WithSwarm(3, 4, 50*time.Millisecond))
+			require.NoError(t, err)
+
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s?ns=docker.io", dgst.String())
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.rng != nil {
+				req.Header.Set(httpx.HeaderRange, tt.rng.String())
+			}
+			reg.Handler(logr.Discard()).ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer httpx.DrainAndClose(resp.Body)
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedBody, b)
+		})
+	}
+}
+
+func TestMirrorRelay(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("content relayed while mirrored")
+	dgst := digest.FromBytes(content)
+
+	// The seed stalls after the first half of the blob until it is unblocked.
+	unblockCh := make(chan struct{})
+	seedSrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeBinary)
+		rw.Header().Set(httpx.HeaderContentLength, strconv.Itoa(len(content)))
+		rw.Header().Set(oci.HeaderDockerDigest, dgst.String())
+		rw.WriteHeader(http.StatusOK)
+		//nolint: errcheck // Ignore error.
+		rw.Write(content[:len(content)/2])
+		rw.(http.Flusher).Flush()
+		<-unblockCh
+		//nolint: errcheck // Ignore error.
+		rw.Write(content[len(content)/2:])
+	}))
+	t.Cleanup(func() {
+		seedSrv.Close()
+	})
+	seed := netip.MustParseAddrPort(seedSrv.Listener.Addr().String())
+
+	relayRouter := routing.NewMemoryRouter(map[string][]netip.AddrPort{dgst.String(): {seed}}, netip.AddrPort{})
+	blobRelay, err := relay.NewRelay(relayRouter, relay.WithDir(t.TempDir()))
+	require.NoError(t, err)
+	relayReg, err := NewRegistry(oci.NewMemory(), relayRouter, WithRelay(blobRelay))
+	require.NoError(t, err)
+	relaySrv := httptest.NewServer(relayReg.Handler(logr.Discard()))
+	t.Cleanup(func() {
+		relaySrv.Close()
+	})
+	relayAddrPort := netip.MustParseAddrPort(relaySrv.Listener.Addr().String())
+	reg, err := NewRegistry(oci.NewMemory(), routing.NewMemoryRouter(map[string][]netip.AddrPort{dgst.String(): {relayAddrPort}}, netip.AddrPort{}))
+	require.NoError(t, err)
+
+	get := func(handler http.Handler) ([]byte, error) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s?ns=docker.io", dgst.String()), nil)
+		handler.ServeHTTP(rw, req)
+		resp := rw.Result()
+		defer httpx.DrainAndClose(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	type result struct {
+		err error
+		b   []byte
+	}
+	relayCh := make(chan result)
+	go func() {
+		b, err := get(relayReg.Handler(logr.Discard()))
+		relayCh <- result{b: b, err: err}
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := blobRelay.Get(dgst.String())
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	peers, ok := relayRouter.Get(dgst.String())
+	require.True(t, ok)
+	require.Contains(t, peers, netip.AddrPort{})
+
+	// The blob is streamed from the relaying node before it has received the full blob from the seed.
+	peerCh := make(chan result)
+	go func() {
+		b, err := get(reg.Handler(logr.Discard()))
+		peerCh <- result{b: b, err: err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(unblockCh)
+	res := <-relayCh
+	require.NoError(t, res.err)
+	require.Equal(t, content, res.b)
+	res = <-peerCh
+	require.NoError(t, res.err)
+	require.Equal(t, content, res.b)
+}
+
+func TestReferrers(t *testing.T) {
+	t.Parallel()
+
+	write := func(store *oci.Memory, referrersIdx *oci.ReferrersIndex, b []byte) ocispec.Descriptor {
+		t.Helper()
+
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		err := store.Write(desc, b)
+		require.NoError(t, err)
+		referrer, subject, err := oci.ReadReferrer(t.Context(), store, desc.Digest)
+		require.NoError(t, err)
+		if subject != "" {
+			referrersIdx.Add(referrer, subject)
+		}
+		return desc
+	}
+	referrerB := func(artifactType string, subjectDesc ocispec.Descriptor) []byte {
+		return fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"%s","config":{},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"%s","size":%d}}`, artifactType, subjectDesc.Digest, subjectDesc.Size)
+	}
+
+	peerStore := oci.NewMemory()
+	peerReferrersIdx := oci.NewReferrersIndex()
+	subjectDesc := write(peerStore, peerReferrersIdx, []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{},"layers":[]}`))
+	sigDesc := write(peerStore, peerReferrersIdx, referrerB("application/vnd.dev.cosign.artifact.sig.v1+json", subjectDesc))
+	peerReg, err := NewRegistry(peerStore, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithReferrersIndex(peerReferrersIdx))
+	require.NoError(t, err)
+	peerSrv := httptest.NewServer(peerReg.Handler(logr.Discard()))
+	t.Cleanup(func() {
+		peerSrv.Close()
+	})
+	peer := netip.MustParseAddrPort(peerSrv.Listener.Addr().String())
+
+	localStore := oci.NewMemory()
+	localReferrersIdx := oci.NewReferrersIndex()
+	sbomDesc := write(localStore, localReferrersIdx, referrerB("application/spdx+json", subjectDesc))
+	mergedReferrers := []digest.Digest{sigDesc.Digest, sbomDesc.Digest}
+	slices.Sort(mergedReferrers)
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name              string
+		store             oci.Store
+		referrersIdx      *oci.ReferrersIndex
+		peers             []netip.AddrPort
+		artifactType      string
+		expectedStatus    int
+		expectedReferrers []digest.Digest
+	}{
+		{
+			name:              "local referrers",
+			store:             peerStore,
+			referrersIdx:      peerReferrersIdx,
+			expectedStatus:    http.StatusOK,
+			expectedReferrers: []digest.Digest{sigDesc.Digest},
+		},
+		{
+			name:              "local referrers filtered by artifact type",
+			store:             peerStore,
+			referrersIdx:      peerReferrersIdx,
+			artifactType:      "application/spdx+json",
+			expectedStatus:    http.StatusOK,
+			expectedReferrers: []digest.Digest{},
+		},
+		{
+			name:              "local referrers merged with peers",
+			store:             localStore,
+			referrersIdx:      localReferrersIdx,
+			peers:             []netip.AddrPort{peer},
+			expectedStatus:    http.StatusOK,
+			expectedReferrers: mergedReferrers,
+		},
+		{
+			name:              "local referrers filtered by artifact type merged with peers",
+			store:             localStore,
+			referrersIdx:      localReferrersIdx,
+			peers:             []netip.AddrPort{peer},
+			artifactType:      "application/spdx+json",
+			expectedStatus:    http.StatusOK,
+			expectedReferrers: []digest.Digest{sbomDesc.Digest},
+		},
+		{
+			name:              "mirrored referrers",
+			store:             oci.NewMemory(),
+			peers:             []netip.AddrPort{peer},
+			artifactType:      "application/vnd.dev.cosign.artifact.sig.v1+json",
+			expectedStatus:    http.StatusOK,
+			expectedReferrers: []digest.Digest{sigDesc.Digest},
+		},
+		{
+			name:           "no peers with referrers",
+			store:          oci.NewMemory(),
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resolver := map[string][]netip.AddrPort{}
+			if len(tt.peers) > 0 {
+				resolver[oci.ReferrersKey(subjectDesc.Digest)] = tt.peers
+			}
+			opts := []RegistryOption{}
+			if tt.referrersIdx != nil {
+				opts = append(opts, WithReferrersIndex(tt.referrersIdx))
+			}
+			reg, err := NewRegistry(tt.store, routing.NewMemoryRouter(resolver, netip.AddrPort{}), opts...)
+			require.NoError(t, err)
+
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/referrers/%s?ns=docker.io", subjectDesc.Digest)
+			if tt.artifactType != "" {
+				target += "&artifactType=" + url.QueryEscape(tt.artifactType)
+			}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			reg.Handler(logr.Discard()).ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer httpx.DrainAndClose(resp.Body)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, ocispec.MediaTypeImageIndex, resp.Header.Get(httpx.HeaderContentType))
+			if tt.artifactType != "" {
+				require.Equal(t, "artifactType", resp.Header.Get(oci.HeaderFiltersApplied))
+			}
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, digest.FromBytes(b).String(), resp.Header.Get(oci.HeaderDockerDigest))
+			idx := ocispec.Index{}
+			err = json.Unmarshal(b, &idx)
+			require.NoError(t, err)
+			referrers := []digest.Digest{}
+			for _, desc := range idx.Manifests {
+				if tt.artifactType != "" {
+					require.Equal(t, tt.artifactType, desc.ArtifactType)
+				}
+				referrers = append(referrers, desc.Digest)
+			}
+			require.Equal(t, tt.expectedReferrers, referrers)
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/metrics"
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+// swarmChunk is a range of a blob that is fetched from one or more peers.
+// The first attempt to complete wins and cancels any other attempts.
+type swarmChunk struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan any
+	err      error
+	b        []byte
+	peer     netip.AddrPort
+	rng      httpx.Range
+	attempts []netip.AddrPort
+	inflight int
+	mx       sync.Mutex
+}
+
+func (c *swarmChunk) complete(b []byte, peer netip.AddrPort) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.inflight--
+	if c.ctx.Err() != nil {
+		return false
+	}
+	c.b = b
+	c.peer = peer
+	c.cancel()
+	close(c.done)
+	return true
+}
+
+func (c *swarmChunk) fail(err error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.inflight--
+	if c.inflight > 0 || c.ctx.Err() != nil {
+		return
+	}
+	c.err = err
+	c.cancel()
+	close(c.done)
+}
+
+// swarm fetches ranges of a blob from multiple peers in parallel and writes them in order.
+// Ranges that are not completed within the stall timeout are reassigned to another peer.
+type swarm struct {
+	ctx          context.Context
+	log          logr.Logger
+	balancer     routing.Balancer
+	r            *Registry
+	scheme       string
+	dist         oci.DistributionPath
+	chunks       []*swarmChunk
+	stallTimeout time.Duration
+	lookahead    int
+	next         int
+}
+
+func (r *Registry) newSwarm(ctx context.Context, dist oci.DistributionPath, balancer routing.Balancer, scheme string, rng httpx.Range) *swarm {
+	chunks := []*swarmChunk{}
+	for start := rng.Start; start <= rng.End; start += r.swarmChunkSize {
+		chunkCtx, chunkCancel := context.WithCancel(ctx)
+		chunks = append(chunks, &swarmChunk{
+			ctx:    chunkCtx,
+			cancel: chunkCancel,
+			done:   make(chan any),
+			rng: httpx.Range{
+				Start: start,
+				End:   min(start+r.swarmChunkSize-1, rng.End),
+			},
+		})
+	}
+	return &swarm{
+		ctx:          ctx,
+		log:          logr.FromContextOrDiscard(ctx).WithValues("ref", dist.Identifier()),
+		r:            r,
+		dist:         dist,
+		balancer:     balancer,
+		scheme:       scheme,
+		chunks:       chunks,
+		stallTimeout: r.swarmStallTimeout,
+		lookahead:    r.swarmConcurrency,
+	}
+}
+
+// Start begins fetching the first chunks so that they can be fetched while other content is written.
+func (s *swarm) Start() {
+	for s.next < len(s.chunks) && s.next < s.lookahead {
+		s.launch(s.chunks[s.next])
+		s.next++
+	}
+}
+
+// Close cancels all chunks that are still being fetched.
+func (s *swarm) Close() {
+	for _, c := range s.chunks {
+		c.cancel()
+	}
+}
+
+// WriteChunks writes the chunks in order as they are completed and returns the peers that served content.
+func (s *swarm) WriteChunks(w io.Writer) ([]netip.AddrPort, error) {
+	peers := []netip.AddrPort{}
+	for i, c := range s.chunks {
+		for s.next < len(s.chunks) && s.next < i+s.lookahead {
+			s.launch(s.chunks[s.next])
+			s.next++
+		}
+
+		err := func() error {
+			timer := time.NewTimer(s.stallTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-s.ctx.Done():
+					return s.ctx.Err()
+				case <-c.done:
+					return c.err
+				case <-timer.C:
+					c.mx.Lock()
+					inflight := c.inflight
+					c.mx.Unlock()
+					if inflight < s.balancer.Size() {
+						s.log.Info("reassigning stalled swarm range", "range", c.rng.String())
+						s.launch(c)
+					}
+					timer.Reset(s.stallTimeout)
+				}
+			}
+		}()
+		if err != nil {
+			return peers, err
+		}
+		_, err = w.Write(c.b)
+		if err != nil {
+			return peers, err
+		}
+		c.b = nil
+		peers = append(peers, c.peer)
+	}
+	return peers, nil
+}
+
+func (s *swarm) launch(c *swarmChunk) {
+	c.mx.Lock()
+	c.inflight++
+	c.mx.Unlock()
+
+	go func() {
+		var errs []error
+		for range s.r.resolveRetries {
+			peer, err := s.nextPeer(c)
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			b, err := s.fetch(c.ctx, peer, c.rng)
+			c.mx.Lock()
+			c.attempts = slices.DeleteFunc(c.attempts, func(p netip.AddrPort) bool { return p == peer })
+			c.mx.Unlock()
+			if c.ctx.Err() != nil {
+				c.fail(c.ctx.Err())
+				return
+			}
+			if err != nil {
+				s.log.Error(err, "swarm range request failed, retrying with next", "mirror", peer.String(), "range", c.rng.String())
+				s.balancer.Remove(peer)
+				errs = append(errs, err)
+				continue
+			}
+			c.complete(b, peer)
+			return
+		}
+		c.fail(errors.Join(append([]error{fmt.Errorf("could not fetch range %s", c.rng.String())}, errs...)...))
+	}()
+}
+
+// nextPeer returns the next peer that is not already fetching the chunk, so that a reassigned chunk is fetched from another peer.
+func (s *swarm) nextPeer(c *swarmChunk) (netip.AddrPort, error) {
+	for range max(s.balancer.Size(), 1) {
+		peer, err := s.balancer.Next()
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		c.mx.Lock()
+		busy := slices.Contains(c.attempts, peer)
+		if !busy {
+			c.attempts = append(c.attempts, peer)
+		}
+		c.mx.Unlock()
+		if !busy {
+			return peer, nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("no other peer available to fetch range %s", c.rng.String())
+}
+
+func (s *swarm) fetch(ctx context.Context, peer netip.AddrPort, rng httpx.Range) ([]byte, error) {
+	start := time.Now()
+	mirror := &url.URL{
+		Scheme: s.scheme,
+		Host:   peer.String(),
+	}
+	fetchOpts := []oci.FetchOption{
+		oci.WithFetchHeader(HeaderClydeMirrored, "true"),
+		oci.WithFetchMirror(mirror),
+		oci.WithFetchBasicAuth(s.r.username, s.r.password),
+		oci.WithFetchRange(rng),
+	}
+	rc, desc, err := s.r.ociClient.Fetch(ctx, http.MethodGet, s.dist, fetchOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if desc.Digest != s.dist.Digest {
+		return nil, fmt.Errorf("mirror responded with unexpected digest %s", desc.Digest)
+	}
+	b := make([]byte, rng.Size())
+	_, err = io.ReadFull(rc, b)
+	if err != nil {
+		return nil, err
+	}
+
+	peerLabel := peer.Addr().String()
+	metrics.MirrorSwarmPeerBytesTotal.WithLabelValues(peerLabel).Add(float64(len(b)))
+	if d := time.Since(start).Seconds(); d > 0 {
+		metrics.MirrorSwarmPeerThroughput.WithLabelValues(peerLabel).Set(float64(len(b)) / d)
+	}
+	return b, nil
+}
@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/relay"
+)
+
+var (
+	ErrDigestMismatch           = errors.New("blob content does not match digest")
+	ErrDeliveredContentMismatch = errors.New("content already delivered to client does not match content from peer")
+)
+
+// blobVerifier hashes a blob while it is streamed from one or more peers and
+// writes the bytes that fall within the requested window to the client.
+// The full blob is always hashed, including the bytes outside of the window,
+// so that ranged requests can be verified. The last byte of the window is held
+// back until the digest has been verified so that a client never receives a
+// complete response with corrupt content.
+type blobVerifier struct {
+	dst      *httpx.HoldbackWriter
+	digester digest.Digester
+	// sentDigester hashes the bytes written to the client so that they can be
+	// compared with the content from another peer after a mismatch.
+	sentDigester digest.Digester
+	// resendDigester hashes the bytes already written to the client when the blob is streamed again.
+	resendDigester digest.Digester
+	expected       digest.Digest
+	window         httpx.Range
+	size           int64
+	offset         int64
+	// transfer receives the full blob in order so that peers can stream it before it is verified.
+	transfer *relay.Transfer
+}
+
+func newBlobVerifier(dst io.Writer, expected digest.Digest, size int64, window httpx.Range) (*blobVerifier, error) {
+	if !expected.Algorithm().Available() {
+		return nil, fmt.Errorf("digest algorithm %s is not available", expected.Algorithm())
+	}
+	if window.Start < 0 || window.End >= size || window.Start > window.End+1 {
+		return nil, fmt.Errorf("window %s is not within size %d", window.String(), size)
+	}
+	sentDigester := expected.Algorithm().Digester()
+	v := &blobVerifier{
+		dst:          httpx.NewHoldbackWriter(io.MultiWriter(dst, sentDigester.Hash())),
+		expected:     expected,
+		size:         size,
+		window:       window,
+		digester:     expected.Algorithm().Digester(),
+		sentDigester: sentDigester,
+	}
+	return v, nil
+}
+
+// Offset returns the amount of bytes hashed, which is where the next peer request should start.
+func (v *blobVerifier) Offset() int64 {
+	return v.offset
+}
+
+// Size returns the full size of the blob.
+func (v *blobVerifier) Size() int64 {
+	return v.size
+}
+
+// Relay writes the blob to the transfer while it is hashed. Peers verify the digest themselves so the
+// transfer is not held back until the blob is verified, it is failed when the blob is streamed again.
+func (v *blobVerifier) Relay(transfer *relay.Transfer) {
+	v.transfer = transfer
+}
+
+// Abandon fails the relayed transfer when the blob was not verified.
+func (v *blobVerifier) Abandon(ctx context.Context) {
+	if v.transfer == nil {
+		return
+	}
+	v.transfer.Finish(ctx, errors.New("blob was not received from peers"))
+	v.transfer = nil
+}
+
+// Reset discards the hashed content so that the blob can be streamed again from the start.
+// Bytes already written to the client are compared against the new stream.
+func (v *blobVerifier) Reset() {
+	if v.transfer != nil {
+		v.transfer.Finish(context.Background(), ErrDigestMismatch)
+		v.transfer = nil
+	}
+	v.digester = v.expected.Algorithm().Digester()
+	v.resendDigester = v.expected.Algorithm().Digester()
+	v.offset = 0
+	v.dst.Discard()
+}
+
+// sent returns the offset up to which the blob has been written to the client.
+func (v *blobVerifier) sent() int64 {
+	return v.window.Start + v.dst.Written()
+}
+
+func (v *blobVerifier) Write(p []byte) (int, error) {
+	if v.offset+int64(len(p)) > v.size {
+		return 0, fmt.Errorf("received more than the expected %d bytes", v.size)
+	}
+
+	n := 0
+	for n < len(p) {
+		var m int
+		sent := v.sent()
+		switch {
+		// Content already written to client is only hashed and compared once complete.
+		case v.offset >= v.window.Start && v.offset < sent:
+			m = int(min(int64(len(p)-n), sent-v.offset))
+			v.digester.Hash().Write(p[n : n+m])
+			v.resendDigester.Hash().Write(p[n : n+m])
+			if v.offset+int64(m) == sent && v.resendDigester.Digest() != v.sentDigester.Digest() {
+				return n, ErrDeliveredContentMismatch
+			}
+		// Content outside of the window is only hashed.
+		case v.offset < v.window.Start || v.offset > v.window.End:
+			m = len(p) - n
+			if v.offset < v.window.Start {
+				m = int(min(int64(m), v.window.Start-v.offset))
+			}
+			v.digester.Hash().Write(p[n : n+m])
+		// Content within the window is written to the client, except for the held back last byte.
+		default:
+			m = int(min(int64(len(p)-n), v.window.End+1-v.offset))
+			v.digester.Hash().Write(p[n : n+m])
+			_, err := v.dst.Write(p[n : n+m])
+			if err != nil {
+				return n, err
+			}
+		}
+		if v.transfer != nil {
+			_, err := v.transfer.Write(p[n : n+m])
+			if err != nil {
+				v.transfer.Finish(context.Background(), err)
+				v.transfer = nil
+			}
+		}
+		v.offset += int64(m)
+		n += m
+	}
+	return n, nil
+}
+
+// Verify checks the digest of the full blob and writes the held back byte to the client on success.
+func (v *blobVerifier) Verify() error {
+	if v.offset != v.size {
+		return fmt.Errorf("received %d bytes but expected %d", v.offset, v.size)
+	}
+	dgst := v.digester.Digest()
+	if dgst != v.expected {
+		return errors.Join(ErrDigestMismatch, fmt.Errorf("expected %s but computed %s", v.expected, dgst))
+	}
+	if v.transfer != nil {
+		v.transfer.Finish(context.Background(), nil)
+		v.transfer = nil
+	}
+	return v.dst.Release()
+}
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/relay"
+	"clyde/pkg/routing"
+)
+
+func TestBlobVerifier(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("hello world, this is a blob")
+	dgst := digest.FromBytes(content)
+	size := int64(len(content))
+
+	tests := []struct {
+		name   string
+		window httpx.Range
+		splits []int
+	}{
+		{
+			name:   "full blob",
+			window: httpx.Range{Start: 0, End: size - 1},
+			splits: []int{len(content)},
+		},
+		{
+			name:   "full blob multiple writes",
+			window: httpx.Range{Start: 0, End: size - 1},
+			splits: []int{1, 5, 10, len(content)},
+		},
+		{
+			name:   "range in middle",
+			window: httpx.Range{Start: 6, End: 10},
+			splits: []int{3, 8, len(content)},
+		},
+		{
+			name:   "single byte range",
+			window: httpx.Range{Start: 0, End: 0},
+			splits: []int{len(content)},
+		},
+		{
+			name:   "range at end",
+			window: httpx.Range{Start: 22, End: size - 1},
+			splits: []int{22, 24, len(content)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := bytes.NewBuffer(nil)
+			v, err := newBlobVerifier(buf, dgst, size, tt.window)
+			require.NoError(t, err)
+			prev := 0
+			for _, split := range tt.splits {
+				n, err := v.Write(content[prev:split])
+				require.NoError(t, err)
+				require.Equal(t, split-prev, n)
+				prev = split
+			}
+			require.Equal(t, size, v.Offset())
+			require.Equal(t, string(content[tt.window.Start:tt.window.End]), buf.String())
+			err = v.Verify()
+			require.NoError(t, err)
+			require.Equal(t, string(content[tt.window.Start:tt.window.End+1]), buf.String())
+		})
+	}
+}
+
+func TestBlobVerifierMismatch(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("hello world")
+	dgst := digest.FromBytes(content)
+	size := int64(len(content))
+
+	// Corruption in the held back byte can be recovered from.
+	buf := bytes.NewBuffer(nil)
+	v, err := newBlobVerifier(buf, dgst, size, httpx.Range{Start: 0, End: size - 1})
+	require.NoError(t, err)
+	_, err = v.Write([]byte("hello worlD"))
+	require.NoError(t, err)
+	err = v.Verify()
+	require.ErrorIs(t, err, ErrDigestMismatch)
+	require.Equal(t, "hello worl", buf.String())
+	v.Reset()
+	require.Equal(t, int64(0), v.Offset())
+	_, err = v.Write(content)
+	require.NoError(t, err)
+	err = v.Verify()
+	require.NoError(t, err)
+	require.Equal(t, "hello world", buf.String())
+
+	// Corruption in delivered content can not be recovered from.
+	buf = bytes.NewBuffer(nil)
+	v, err = newBlobVerifier(buf, dgst, size, httpx.Range{Start: 2, End: 6})
+	require.NoError(t, err)
+	_, err = v.Write([]byte("heLlo world"))
+	require.NoError(t, err)
+	err = v.Verify()
+	require.ErrorIs(t, err, ErrDigestMismatch)
+	v.Reset()
+	_, err = v.Write(content)
+	require.ErrorIs(t, err, ErrDeliveredContentMismatch)
+	require.Equal(t, "Llo ", buf.String())
+
+	// Content outside of the window is hashed.
+	buf = bytes.NewBuffer(nil)
+	v, err = newBlobVerifier(buf, dgst, size, httpx.Range{Start: 0, End: 1})
+	require.NoError(t, err)
+	_, err = v.Write([]byte("hello worlD"))
+	require.NoError(t, err)
+	err = v.Verify()
+	require.ErrorIs(t, err, ErrDigestMismatch)
+	require.Equal(t, "h", buf.String())
+
+	// Writing more than the size fails.
+	v, err = newBlobVerifier(bytes.NewBuffer(nil), dgst, size, httpx.Range{Start: 0, End: size - 1})
+	require.NoError(t, err)
+	_, err = v.Write([]byte("hello world!"))
+	require.EqualError(t, err, "received more than the expected 11 bytes")
+
+	// Verifying before all content has been received fails.
+	v, err = newBlobVerifier(bytes.NewBuffer(nil), dgst, size, httpx.Range{Start: 0, End: size - 1})
+	require.NoError(t, err)
+	_, err = v.Write([]byte("hello"))
+	require.NoError(t, err)
+	err = v.Verify()
+	require.EqualError(t, err, "received 5 bytes but expected 11")
+
+	_, err = newBlobVerifier(bytes.NewBuffer(nil), dgst, size, httpx.Range{Start: 0, End: size})
+	require.EqualError(t, err, "window bytes=0-11 is not within size 11")
+}
+
+func TestBlobVerifierRelay(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("hello world")
+	dgst := digest.FromBytes(content)
+	size := int64(len(content))
+	blobRelay, err := relay.NewRelay(routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), relay.WithDir(t.TempDir()))
+	require.NoError(t, err)
+
+	// The full blob is relayed even when only a range is written to the client.
+	transfer, err := blobRelay.Start(t.Context(), dgst.String(), size, nil)
+	require.NoError(t, err)
+	v, err := newBlobVerifier(bytes.NewBuffer(nil), dgst, size, httpx.Range{Start: 6, End: 10})
+	require.NoError(t, err)
+	v.Relay(transfer)
+	_, err = v.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, v.Verify())
+	rc, err := transfer.NewReader(t.Context(), 0)
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, content, b)
+
+	// Readers of the relayed blob receive an error when the blob is streamed again.
+	transfer, err = blobRelay.Start(t.Context(), "corrupt", size, nil)
+	require.NoError(t, err)
+	rc, err = transfer.NewReader(t.Context(), 0)
+	require.NoError(t, err)
+	defer rc.Close()
+	v, err = newBlobVerifier(bytes.NewBuffer(nil), dgst, size, httpx.Range{Start: 0, End: size - 1})
+	require.NoError(t, err)
+	v.Relay(transfer)
+	_, err = v.Write([]byte("hello worlD"))
+	require.NoError(t, err)
+	require.ErrorIs(t, v.Verify(), ErrDigestMismatch)
+	v.Reset()
+	_, err = io.ReadAll(rc)
+	require.ErrorIs(t, err, ErrDigestMismatch)
+
+	// Abandoning the verifier fails the relayed blob.
+	transfer, err = blobRelay.Start(t.Context(), "abandoned", size, nil)
+	require.NoError(t, err)
+	v, err = newBlobVerifier(bytes.NewBuffer(nil), dgst, size, httpx.Range{Start: 0, End: size - 1})
+	require.NoError(t, err)
+	v.Relay(transfer)
+	_, err = v.Write([]byte("hello"))
+	require.NoError(t, err)
+	v.Abandon(t.Context())
+	_, ok := blobRelay.Get("abandoned")
+	require.False(t, ok)
+}
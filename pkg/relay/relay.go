@@ -0,0 +1,329 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"clyde/internal/option"
+	"clyde/pkg/httpx"
+	"clyde/pkg/metrics"
+	"clyde/pkg/routing"
+)
+
+var ErrTransferExists = errors.New("transfer of key is already in progress")
+
+type RelayConfig struct {
+	// Dir is where content is buffered while it is transferred, the default temporary directory is used when empty.
+	Dir string
+	// Linger is how long completed content can still be streamed, which covers the time until the content is stored.
+	Linger time.Duration
+}
+
+type RelayOption = option.Option[RelayConfig]
+
+// WithDir sets the directory where transferred content is buffered, content left behind by a previous process is removed.
+func WithDir(dir string) RelayOption {
+	return func(cfg *RelayConfig) error {
+		cfg.Dir = dir
+		return nil
+	}
+}
+
+func WithLinger(linger time.Duration) RelayOption {
+	return func(cfg *RelayConfig) error {
+		if linger < 0 {
+			return fmt.Errorf("relay linger %s cannot be negative", linger)
+		}
+		cfg.Linger = linger
+		return nil
+	}
+}
+
+// Relay keeps track of content that is being downloaded so that peers can stream it before the download completes.
+// The key of the content is advertised when the transfer starts, requests for the key are then served with the bytes
+// received so far and wait for the rest to arrive. Each node that streams content from a transfer can relay it
+// again, which chains the replication of content through the cluster instead of waiting for a full copy on each hop.
+type Relay struct {
+	router    routing.Router
+	transfers map[string]*Transfer
+	dir       string
+	linger    time.Duration
+	mx        sync.Mutex
+}
+
+func NewRelay(router routing.Router, opts ...RelayOption) (*Relay, error) {
+	cfg := RelayConfig{
+		Linger: 30 * time.Second,
+	}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Dir != "" {
+		err := os.RemoveAll(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(cfg.Dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Relay{
+		router:    router,
+		transfers: map[string]*Transfer{},
+		dir:       cfg.Dir,
+		linger:    cfg.Linger,
+	}, nil
+}
+
+// Start begins the transfer of the content of the key and advertises the key.
+// The size has to be known so that readers can tell a completed transfer from a truncated one.
+// The header describes the content and is written to responses that serve the transfer, it may be nil.
+// ErrTransferExists is returned when the key is already being transferred by another request.
+func (r *Relay) Start(ctx context.Context, key string, size int64, header http.Header) (*Transfer, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("size of %s has to be known to relay it", key)
+	}
+
+	r.mx.Lock()
+	if _, ok := r.transfers[key]; ok {
+		r.mx.Unlock()
+		return nil, ErrTransferExists
+	}
+	f, err := os.CreateTemp(r.dir, "relay-*")
+	if err != nil {
+		r.mx.Unlock()
+		return nil, err
+	}
+	t := &Transfer{
+		relay:  r,
+		key:    key,
+		file:   f,
+		header: header.Clone(),
+		size:   size,
+		notify: make(chan struct{}),
+	}
+	r.transfers[key] = t
+	r.mx.Unlock()
+
+	err = r.router.Advertise(ctx, []string{key})
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "could not advertise relayed key", "key", key)
+	}
+	return t, nil
+}
+
+// Get returns the transfer of the key when it is in progress or has recently completed.
+func (r *Relay) Get(key string) (*Transfer, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	t, ok := r.transfers[key]
+	return t, ok
+}
+
+// remove stops serving the transfer and withdraws the key when the transfer failed.
+func (r *Relay) remove(ctx context.Context, t *Transfer, withdraw bool) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("key", t.key)
+
+	r.mx.Lock()
+	if r.transfers[t.key] == t {
+		delete(r.transfers, t.key)
+	}
+	r.mx.Unlock()
+
+	// Open readers keep reading from their own handle of the removed file.
+	err := os.Remove(t.file.Name())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error(err, "could not remove relay file")
+	}
+	if !withdraw {
+		return
+	}
+	err = r.router.Withdraw(ctx, []string{t.key})
+	if err != nil {
+		log.Error(err, "could not withdraw relayed key")
+	}
+}
+
+// Transfer buffers the content of a single key while it is downloaded.
+type Transfer struct {
+	relay  *Relay
+	file   *os.File
+	header http.Header
+	err    error
+	// notify is closed and replaced each time content is written to wake up waiting readers.
+	notify  chan struct{}
+	key     string
+	size    int64
+	written int64
+	done    bool
+	mx      sync.Mutex
+}
+
+// Size returns the full size of the transferred content.
+func (t *Transfer) Size() int64 {
+	return t.size
+}
+
+// Write appends content to the transfer and wakes up readers waiting for it.
+func (t *Transfer) Write(p []byte) (int, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.done {
+		return 0, errors.New("transfer has already finished")
+	}
+	if t.written+int64(len(p)) > t.size {
+		return 0, fmt.Errorf("transfer received more than the expected %d bytes", t.size)
+	}
+	n, err := t.file.Write(p)
+	t.written += int64(n)
+	close(t.notify)
+	t.notify = make(chan struct{})
+	return n, err
+}
+
+// Finish completes the transfer, or fails it when err is not nil. Readers of a failed transfer receive the error
+// and the key is withdrawn. Content of a completed transfer can still be streamed for the linger duration, after
+// which the content is expected to be served from where the writer stored it. Only the first call has an effect.
+func (t *Transfer) Finish(ctx context.Context, err error) {
+	// The transfer is cleaned up even when the request that wrote it has been cancelled.
+	ctx = context.WithoutCancel(ctx)
+	t.mx.Lock()
+	if t.done {
+		t.mx.Unlock()
+		return
+	}
+	if err == nil && t.written != t.size {
+		err = fmt.Errorf("transfer finished after %d of %d bytes", t.written, t.size)
+	}
+	t.done = true
+	t.err = err
+	close(t.notify)
+	t.mx.Unlock()
+
+	closeErr := t.file.Close()
+	if err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		metrics.RelayTransfersTotal.WithLabelValues("failed").Inc()
+		t.relay.remove(ctx, t, true)
+		return
+	}
+	metrics.RelayTransfersTotal.WithLabelValues("completed").Inc()
+	time.AfterFunc(t.relay.linger, func() {
+		t.relay.remove(ctx, t, false)
+	})
+}
+
+// NewReader returns a reader of the content from the offset. Reads wait for the writer to make progress
+// and return the error of the writer when the transfer fails.
+func (t *Transfer) NewReader(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > t.size {
+		return nil, fmt.Errorf("offset %d is not within size %d", offset, t.size)
+	}
+	f, err := os.Open(t.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &transferReader{
+		ctx:      ctx,
+		transfer: t,
+		file:     f,
+		offset:   offset,
+	}, nil
+}
+
+type transferReader struct {
+	ctx      context.Context
+	transfer *Transfer
+	file     *os.File
+	offset   int64
+}
+
+func (tr *transferReader) Read(p []byte) (int, error) {
+	for {
+		tr.transfer.mx.Lock()
+		written := tr.transfer.written
+		done := tr.transfer.done
+		transferErr := tr.transfer.err
+		notify := tr.transfer.notify
+		tr.transfer.mx.Unlock()
+
+		if tr.offset < written {
+			n, err := tr.file.ReadAt(p[:min(int64(len(p)), written-tr.offset)], tr.offset)
+			tr.offset += int64(n)
+			if errors.Is(err, io.EOF) && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		if done {
+			if transferErr != nil {
+				return 0, transferErr
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-tr.ctx.Done():
+			return 0, tr.ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+func (tr *transferReader) Close() error {
+	return tr.file.Close()
+}
+
+// ServeTransfer writes the content of the transfer to the response while it is received.
+// The content length is always set so that clients detect a response that ends early because the transfer failed.
+func ServeTransfer(rw httpx.ResponseWriter, req *http.Request, t *Transfer) error {
+	rng, err := httpx.ParseRangeHeader(req.Header, t.Size())
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return err
+	}
+	window := httpx.Range{Start: 0, End: t.Size() - 1}
+	status := http.StatusOK
+	for k, v := range t.header {
+		rw.Header()[k] = v
+	}
+	rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeBinary)
+	rw.Header().Set(httpx.HeaderAcceptRanges, httpx.RangeUnit)
+	if rng != nil {
+		window = *rng
+		status = http.StatusPartialContent
+		rw.Header().Set(httpx.HeaderContentRange, httpx.ContentRangeFromRange(*rng, t.Size()).String())
+	}
+	rw.Header().Set(httpx.HeaderContentLength, strconv.FormatInt(window.Size(), 10))
+	if req.Method == http.MethodHead {
+		rw.WriteHeader(status)
+		return nil
+	}
+
+	rc, err := t.NewReader(req.Context(), window.Start)
+	if err != nil {
+		rw.WriteError(http.StatusNotFound, err)
+		return err
+	}
+	defer rc.Close()
+	rw.WriteHeader(status)
+	_, err = io.Copy(rw, io.LimitReader(rc, window.Size()))
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/httpx"
+	"clyde/pkg/routing"
+)
+
+func TestRelayOptions(t *testing.T) {
+	t.Parallel()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	_, err := NewRelay(router, WithLinger(-1*time.Second))
+	require.EqualError(t, err, "relay linger -1s cannot be negative")
+	r, err := NewRelay(router, WithDir(t.TempDir()), WithLinger(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, r.linger)
+}
+
+func TestTransfer(t *testing.T) {
+	t.Parallel()
+
+	self := netip.MustParseAddrPort("10.0.0.1:5000")
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, self)
+	r, err := NewRelay(router, WithDir(t.TempDir()), WithLinger(0))
+	require.NoError(t, err)
+
+	_, err = r.Start(t.Context(), "foo", -1, nil)
+	require.EqualError(t, err, "size of foo has to be known to relay it")
+	transfer, err := r.Start(t.Context(), "foo", 11, nil)
+	require.NoError(t, err)
+	_, err = r.Start(t.Context(), "foo", 11, nil)
+	require.ErrorIs(t, err, ErrTransferExists)
+	peers, ok := router.Get("foo")
+	require.True(t, ok)
+	require.Equal(t, []netip.AddrPort{self}, peers)
+
+	_, err = transfer.Write([]byte("hello"))
+	require.NoError(t, err)
+	rc, err := transfer.NewReader(t.Context(), 0)
+	require.NoError(t, err)
+	offsetRc, err := transfer.NewReader(t.Context(), 6)
+	require.NoError(t, err)
+
+	// Readers wait for the content that has not been written yet.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		//nolint: errcheck // Ignore error.
+		transfer.Write([]byte(" world"))
+		transfer.Finish(t.Context(), nil)
+	}()
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+	require.NoError(t, rc.Close())
+	b, err = io.ReadAll(offsetRc)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(b))
+	require.NoError(t, offsetRc.Close())
+
+	_, err = transfer.Write([]byte("!"))
+	require.EqualError(t, err, "transfer has already finished")
+	require.Eventually(t, func() bool {
+		_, ok := r.Get("foo")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	peers, _ = router.Get("foo")
+	require.Equal(t, []netip.AddrPort{self}, peers)
+}
+
+func TestTransferFailure(t *testing.T) {
+	t.Parallel()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	r, err := NewRelay(router, WithDir(t.TempDir()))
+	require.NoError(t, err)
+
+	transfer, err := r.Start(t.Context(), "foo", 10, nil)
+	require.NoError(t, err)
+	_, err = transfer.Write([]byte("hello world"))
+	require.EqualError(t, err, "transfer received more than the expected 10 bytes")
+	_, err = transfer.Write([]byte("hello"))
+	require.NoError(t, err)
+	rc, err := transfer.NewReader(t.Context(), 0)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		transfer.Finish(t.Context(), errors.New("upstream failed"))
+	}()
+	b, err := io.ReadAll(rc)
+	require.EqualError(t, err, "upstream failed")
+	require.Equal(t, "hello", string(b))
+
+	_, ok := r.Get("foo")
+	require.False(t, ok)
+	peers, _ := router.Get("foo")
+	require.Empty(t, peers)
+
+	// A transfer that ends before all content is received is failed.
+	transfer, err = r.Start(t.Context(), "bar", 10, nil)
+	require.NoError(t, err)
+	transfer.Finish(t.Context(), nil)
+	_, err = transfer.NewReader(t.Context(), 0)
+	require.Error(t, err)
+	_, ok = r.Get("bar")
+	require.False(t, ok)
+}
+
+func TestServeTransfer(t *testing.T) {
+	t.Parallel()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	r, err := NewRelay(router, WithDir(t.TempDir()))
+	require.NoError(t, err)
+	transfer, err := r.Start(t.Context(), "foo", 11, nil)
+	require.NoError(t, err)
+	_, err = transfer.Write([]byte("hello world"))
+	require.NoError(t, err)
+	transfer.Finish(t.Context(), nil)
+	mux := httpx.NewServeMux(logr.Discard())
+	mux.Handle("/foo", func(rw httpx.ResponseWriter, req *http.Request) {
+		//nolint: errcheck // Ignore error.
+		ServeTransfer(rw, req, transfer)
+	})
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name                 string
+		method               string
+		rng                  string
+		expectedStatus       int
+		expectedBody         string
+		expectedContentRange string
+	}{
+		{
+			name:           "full content",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello world",
+		},
+		{
+			name:                 "range",
+			method:               http.MethodGet,
+			rng:                  "bytes=6-",
+			expectedStatus:       http.StatusPartialContent,
+			expectedBody:         "world",
+			expectedContentRange: "bytes 6-10/11",
+		},
+		{
+			name:           "head",
+			method:         http.MethodHead,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid range",
+			method:         http.MethodGet,
+			rng:            "foo",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "http://localhost/foo", nil)
+			if tt.rng != "" {
+				req.Header.Set(httpx.HeaderRange, tt.rng)
+			}
+			mux.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus >= http.StatusBadRequest {
+				return
+			}
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedBody, string(b))
+			require.Equal(t, tt.expectedContentRange, resp.Header.Get(httpx.HeaderContentRange))
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"clyde/internal/option"
+	"clyde/pkg/metrics"
+)
+
+// LeaseKey returns the key advertised by the node that is fetching the key from upstream.
+func LeaseKey(key string) string {
+	return "lease/" + key
+}
+
+// IsLeaseKey returns true when the key is advertised for a lease.
+func IsLeaseKey(key string) bool {
+	return strings.HasPrefix(key, LeaseKey(""))
+}
+
+type LeaserConfig struct {
+	// WaitTimeout bounds the time spent waiting for another fetch of the key before fetching it from upstream.
+	WaitTimeout time.Duration
+	// LookupTimeout bounds each lookup of the lease and content keys.
+	LookupTimeout time.Duration
+	// PollInterval is the interval at which the router is checked while waiting for a peer to fetch the key.
+	PollInterval time.Duration
+	// Self is the address of this node as returned by lookups, concurrent claims of the same key on different
+	// nodes are only settled when it is set.
+	Self netip.AddrPort
+}
+
+type LeaserOption = option.Option[LeaserConfig]
+
+// WithLeaseTimeouts sets how long to wait for another fetch and how long each lookup may take.
+func WithLeaseTimeouts(waitTimeout, lookupTimeout time.Duration) LeaserOption {
+	return func(cfg *LeaserConfig) error {
+		if waitTimeout <= 0 {
+			return errors.New("lease wait timeout has to be larger than zero")
+		}
+		if lookupTimeout <= 0 {
+			return errors.New("lease lookup timeout has to be larger than zero")
+		}
+		cfg.WaitTimeout = waitTimeout
+		cfg.LookupTimeout = lookupTimeout
+		return nil
+	}
+}
+
+func WithLeasePollInterval(pollInterval time.Duration) LeaserOption {
+	return func(cfg *LeaserConfig) error {
+		if pollInterval <= 0 {
+			return errors.New("lease poll interval has to be larger than zero")
+		}
+		cfg.PollInterval = pollInterval
+		return nil
+	}
+}
+
+// WithLeaseSelf sets the address of this node, which breaks ties between nodes that claim the same key at the same time.
+func WithLeaseSelf(self netip.AddrPort) LeaserOption {
+	return func(cfg *LeaserConfig) error {
+		cfg.Self = self
+		return nil
+	}
+}
+
+// errLeaseYielded is passed to local waiters when a peer with precedence claimed the same key.
+var errLeaseYielded = errors.New("lease yielded to peer")
+
+// Lease is held by the request that fetches a key from upstream.
+type Lease struct {
+	leaser *Leaser
+	done   chan struct{}
+	err    error
+	key    string
+}
+
+// Leaser coordinates upstream fetches so that each key is fetched by a single request in the cluster.
+// A request that acquires the lease advertises the lease key while it fetches the key, other requests
+// wait for the fetch to complete and then get the content from the node that fetched it.
+type Leaser struct {
+	router        Router
+	leases        map[string]*Lease
+	waitTimeout   time.Duration
+	lookupTimeout time.Duration
+	pollInterval  time.Duration
+	self          netip.AddrPort
+	mx            sync.Mutex
+}
+
+func NewLeaser(router Router, opts ...LeaserOption) (*Leaser, error) {
+	cfg := LeaserConfig{
+		WaitTimeout:   10 * time.Second,
+		LookupTimeout: 500 * time.Millisecond,
+		PollInterval:  250 * time.Millisecond,
+	}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Leaser{
+		router:        router,
+		leases:        map[string]*Lease{},
+		waitTimeout:   cfg.WaitTimeout,
+		lookupTimeout: cfg.LookupTimeout,
+		pollInterval:  cfg.PollInterval,
+		self:          cfg.Self,
+	}, nil
+}
+
+// Acquire blocks until the caller may fetch the key from upstream or until another request has fetched it.
+// It returns a lease and true when the caller has to fetch the key, the lease has to be released once the
+// fetched content is advertised. It returns false when the key has been fetched by another request and can
+// be found through the router. Waiting is bounded by the wait timeout after which the caller fetches the key
+// itself, so a fetcher that stops responding never blocks other requests.
+func (l *Leaser) Acquire(ctx context.Context, key string) (*Lease, bool, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("key", key)
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, l.waitTimeout)
+	defer waitCancel()
+	for {
+		lease, owner := l.claim(ctx, key, waitCtx.Err() != nil)
+		if owner {
+			return lease, true, nil
+		}
+		if lease != nil {
+			// Another request on this node is fetching the key.
+			select {
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			case <-waitCtx.Done():
+				log.Info("timed out waiting for local fetch")
+				metrics.UpstreamLeasesTotal.WithLabelValues("timeout").Inc()
+				continue
+			case <-lease.done:
+				if lease.err == nil {
+					metrics.UpstreamLeasesTotal.WithLabelValues("local").Inc()
+					return nil, false, nil
+				}
+				continue
+			}
+		}
+
+		// A peer is fetching the key so the router is polled until the content is advertised or the lease is withdrawn.
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-waitCtx.Done():
+			log.Info("timed out waiting for peer fetch")
+			metrics.UpstreamLeasesTotal.WithLabelValues("timeout").Inc()
+			continue
+		case <-time.After(l.pollInterval):
+		}
+		if l.hasPeer(ctx, key) {
+			metrics.UpstreamLeasesTotal.WithLabelValues("peer").Inc()
+			return nil, false, nil
+		}
+	}
+}
+
+// claim returns the lease of a fetch in progress on this node or creates a new lease when no peer holds one.
+// It returns true when a new lease was created, in which case the lease key is advertised.
+// A nil lease and false is returned when a peer holds the lease. When forced the lease is created regardless of other fetches.
+// Peers that claim the key at the same time all advertise the lease key, so the lease key is looked up again after it is
+// advertised and only the node with the lowest address keeps the lease.
+func (l *Leaser) claim(ctx context.Context, key string, force bool) (*Lease, bool) {
+	if !force {
+		l.mx.Lock()
+		lease, ok := l.leases[key]
+		l.mx.Unlock()
+		if ok {
+			return lease, false
+		}
+		if l.hasPeer(ctx, LeaseKey(key)) {
+			return nil, false
+		}
+	}
+
+	l.mx.Lock()
+	if lease, ok := l.leases[key]; ok && !force {
+		l.mx.Unlock()
+		return lease, false
+	}
+	// A forced lease replaces a local lease that was not released in time, releasing the replaced lease does not withdraw the new one.
+	lease := &Lease{
+		leaser: l,
+		key:    key,
+		done:   make(chan struct{}),
+	}
+	l.leases[key] = lease
+	l.mx.Unlock()
+
+	err := l.router.Advertise(ctx, []string{LeaseKey(key)})
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "could not advertise lease", "key", key)
+	}
+	if !force && l.yields(ctx, key) {
+		logr.FromContextOrDiscard(ctx).Info("yielding lease to peer", "key", key)
+		lease.Release(ctx, errLeaseYielded)
+		return nil, false
+	}
+	metrics.UpstreamLeasesTotal.WithLabelValues("acquired").Inc()
+	return lease, true
+}
+
+// yields returns true when a peer with a lower address than this node advertises the lease key.
+func (l *Leaser) yields(ctx context.Context, key string) bool {
+	if !l.self.IsValid() {
+		return false
+	}
+	lookupCtx, lookupCancel := context.WithTimeout(ctx, l.lookupTimeout)
+	defer lookupCancel()
+	balancer, err := l.router.Lookup(lookupCtx, LeaseKey(key), 0)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "could not lookup lease", "key", key)
+		return false
+	}
+	peers := []netip.AddrPort{}
+	for {
+		peer, err := balancer.Next()
+		if err != nil || slices.Contains(peers, peer) {
+			return false
+		}
+		peers = append(peers, peer)
+		if peer.Compare(l.self) < 0 {
+			return true
+		}
+	}
+}
+
+// hasPeer returns true when a peer advertises the key.
+func (l *Leaser) hasPeer(ctx context.Context, key string) bool {
+	lookupCtx, lookupCancel := context.WithTimeout(ctx, l.lookupTimeout)
+	defer lookupCancel()
+	balancer, err := l.router.Lookup(lookupCtx, key, 1)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "could not lookup key", "key", key)
+		return false
+	}
+	_, err = balancer.Next()
+	return err == nil
+}
+
+// Release withdraws the lease and wakes up requests waiting for the fetch.
+// The error of the fetch is passed to local waiters so that one of them retries the fetch.
+// Withdrawing stops this node from providing the lease key, but records already stored by peers remain until they
+// expire. Peers that find such a record poll for the content, and fetch it themselves after the wait timeout when the
+// fetch failed.
+func (lease *Lease) Release(ctx context.Context, fetchErr error) {
+	// The lease is withdrawn even when the request that held it has been cancelled.
+	ctx = context.WithoutCancel(ctx)
+	l := lease.leaser
+	l.mx.Lock()
+	current, ok := l.leases[lease.key]
+	if ok && current == lease {
+		delete(l.leases, lease.key)
+	}
+	l.mx.Unlock()
+
+	if ok && current == lease {
+		err := l.router.Withdraw(ctx, []string{LeaseKey(lease.key)})
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "could not withdraw lease", "key", lease.key)
+		}
+	}
+	lease.err = fetchErr
+	close(lease.done)
+}
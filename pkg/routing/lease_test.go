@@ -0,0 +1,135 @@
+package routing
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaserOptions(t *testing.T) {
+	t.Parallel()
+
+	router := NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{})
+	_, err := NewLeaser(router, WithLeaseTimeouts(0, time.Second))
+	require.EqualError(t, err, "lease wait timeout has to be larger than zero")
+	_, err = NewLeaser(router, WithLeaseTimeouts(time.Second, 0))
+	require.EqualError(t, err, "lease lookup timeout has to be larger than zero")
+	_, err = NewLeaser(router, WithLeasePollInterval(0))
+	require.EqualError(t, err, "lease poll interval has to be larger than zero")
+	leaser, err := NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second), WithLeasePollInterval(time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, leaser.waitTimeout)
+	require.Equal(t, time.Second, leaser.lookupTimeout)
+	require.Equal(t, time.Millisecond, leaser.pollInterval)
+}
+
+func TestLeaserLocal(t *testing.T) {
+	t.Parallel()
+
+	router := NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	leaser, err := NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second))
+	require.NoError(t, err)
+
+	lease, owner, err := leaser.Acquire(t.Context(), "foo")
+	require.NoError(t, err)
+	require.True(t, owner)
+	_, ok := router.Get(LeaseKey("foo"))
+	require.True(t, ok)
+
+	// A failed fetch hands the lease to a waiting request.
+	waitCh := make(chan *Lease)
+	go func() {
+		lease, owner, err := leaser.Acquire(t.Context(), "foo")
+		if err != nil || !owner {
+			waitCh <- nil
+			return
+		}
+		waitCh <- lease
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lease.Release(t.Context(), errors.New("upstream failed"))
+	retryLease := <-waitCh
+	require.NotNil(t, retryLease)
+
+	// A successful fetch lets waiting requests get the content from the cluster.
+	doneCh := make(chan bool)
+	go func() {
+		_, owner, err := leaser.Acquire(t.Context(), "foo")
+		doneCh <- err == nil && !owner
+	}()
+	time.Sleep(50 * time.Millisecond)
+	retryLease.Release(t.Context(), nil)
+	require.True(t, <-doneCh)
+	peers, _ := router.Get(LeaseKey("foo"))
+	require.Empty(t, peers)
+}
+
+func TestLeaserPeer(t *testing.T) {
+	t.Parallel()
+
+	// Both leasers share the router to simulate two nodes in the same cluster.
+	router := NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	first, err := NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second), WithLeasePollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	second, err := NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second), WithLeasePollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+
+	lease, owner, err := first.Acquire(t.Context(), "foo")
+	require.NoError(t, err)
+	require.True(t, owner)
+
+	doneCh := make(chan bool)
+	go func() {
+		_, owner, err := second.Acquire(t.Context(), "foo")
+		doneCh <- err == nil && !owner
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err = router.Advertise(t.Context(), []string{"foo"})
+	require.NoError(t, err)
+	require.True(t, <-doneCh)
+	lease.Release(t.Context(), nil)
+}
+
+func TestLeaserTimeout(t *testing.T) {
+	t.Parallel()
+
+	router := NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:5000"))
+	first, err := NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second))
+	require.NoError(t, err)
+	second, err := NewLeaser(router, WithLeaseTimeouts(100*time.Millisecond, time.Second), WithLeasePollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+
+	_, owner, err := first.Acquire(t.Context(), "foo")
+	require.NoError(t, err)
+	require.True(t, owner)
+
+	// The peer never completes the fetch so the waiting request fetches the key itself.
+	start := time.Now()
+	lease, owner, err := second.Acquire(t.Context(), "foo")
+	require.NoError(t, err)
+	require.True(t, owner)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	lease.Release(t.Context(), nil)
+}
+
+func TestLeaserContention(t *testing.T) {
+	t.Parallel()
+
+	// Peers advertise the lease keys at the same time as this node.
+	router := NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.2:5000"))
+	router.Add(LeaseKey("foo"), netip.MustParseAddrPort("10.0.0.1:5000"))
+	router.Add(LeaseKey("bar"), netip.MustParseAddrPort("10.0.0.3:5000"))
+
+	leaser, err := NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second), WithLeaseSelf(netip.MustParseAddrPort("10.0.0.2:5000")))
+	require.NoError(t, err)
+	require.True(t, leaser.yields(t.Context(), "foo"))
+	require.False(t, leaser.yields(t.Context(), "bar"))
+
+	// Ties are not broken when the address of this node is unknown.
+	leaser, err = NewLeaser(router, WithLeaseTimeouts(time.Minute, time.Second))
+	require.NoError(t, err)
+	require.False(t, leaser.yields(t.Context(), "foo"))
+}
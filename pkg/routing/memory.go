@@ -64,6 +64,20 @@ func (m *MemoryRouter) Withdraw(ctx context.Context, keys []string) error {
 	return nil
 }
 
+func (m *MemoryRouter) Provided(ctx context.Context) ([]string, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	keys := []string{}
+	for key, peers := range m.resolver {
+		if slices.Contains(peers, m.self) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
 func (m *MemoryRouter) Add(key string, ap netip.AddrPort) {
 	m.mx.Lock()
 	defer m.mx.Unlock()
@@ -44,4 +44,13 @@ func TestMemoryRouter(t *testing.T) {
 	require.ErrorIs(t, err, ErrNoNext)
 	_, ok = r.Get("bar")
 	require.False(t, ok)
+
+	provided, err := r.Provided(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, provided)
+	err = r.Withdraw(t.Context(), []string{"foo"})
+	require.NoError(t, err)
+	provided, err = r.Provided(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, provided)
 }
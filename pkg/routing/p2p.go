@@ -9,11 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -84,6 +87,8 @@ type P2PRouter struct {
 	balancerGroup          *singleflight.Group
 	balancerCache          *expirable.LRU[string, *ClosableBalancer]
 	connectivityGate       *channel.Gate
+	provided               map[string]struct{}
+	providedMx             sync.Mutex
 	ip6Support, ip4Support bool
 	registryPort           uint16
 }
@@ -172,6 +177,7 @@ func NewP2PRouter(ctx context.Context, addr string, bs Bootstrapper, registryPor
 		balancerGroup:    &singleflight.Group{},
 		balancerCache:    expirable.NewLRU[string, *ClosableBalancer](0, nil, 5*time.Second),
 		connectivityGate: connectivityGate,
+		provided:         map[string]struct{}{},
 		ip6Support:       len(ip6Addrs) > 0,
 		ip4Support:       len(ip4Addrs) > 0,
 		registryPort:     uint16(registryPort),
@@ -264,6 +270,13 @@ func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer
 		return nil, err
 	}
 
+	// Leases are advertised and withdrawn while content is fetched, so lease lookups always query the DHT.
+	if IsLeaseKey(key) {
+		cb := NewClosableBalancer(NewRoundRobin())
+		r.findProviders(ctx, log, c, count, cb)
+		return cb, nil
+	}
+
 	bal, err, _ := r.balancerGroup.Do(c.String(), func() (any, error) {
 		cb, ok := r.balancerCache.Get(c.String())
 		if !ok {
@@ -287,55 +300,7 @@ func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer
 			r.balancerCache.Add(c.String(), cb)
 		}
 
-		addrInfoCh := r.kdht.FindProvidersAsync(ctx, c, count)
-		go func() {
-			defer cb.Close()
-
-			lookupTimer := prometheus.NewTimer(metrics.ResolveDurHistogram.WithLabelValues("libp2p"))
-			for addrInfo := range addrInfoCh {
-				lookupTimer.ObserveDuration()
-				log.Info("received provider from dht", "peerID", addrInfo.ID.String(), "numAddrs", len(addrInfo.Addrs))
-
-				// Skip self if found in provider store.
-				if addrInfo.ID == r.host.ID() {
-					continue
-				}
-
-				ip6Addrs, ip4Addrs := filterAndSplitAddrs(addrInfo.Addrs)
-				ipAddr, err := func() (netip.Addr, error) {
-					errs := []error{}
-					if r.ip6Support {
-						for _, addr := range ip6Addrs {
-							ipAddr, err := toIPAddr(addr)
-							if err != nil {
-								errs = append(errs, err)
-								continue
-							}
-							return ipAddr, nil
-						}
-					}
-					if r.ip4Support {
-						for _, addr := range ip4Addrs {
-							ipAddr, err := toIPAddr(addr)
-							if err != nil {
-								errs = append(errs, err)
-								continue
-							}
-							return ipAddr, nil
-						}
-					}
-					errs = append(errs, errors.New("could not get IP from address"))
-					return netip.Addr{}, errors.Join(errs...)
-				}()
-				if err != nil {
-					log.Error(err, "no suitable IP address found for peer")
-					continue
-				}
-				peer := netip.AddrPortFrom(ipAddr, r.registryPort)
-				cb.Add(peer)
-				log.Info("added peer to lookup balancer", "peer", peer.String(), "key", key)
-			}
-		}()
+		r.findProviders(ctx, log, c, count, cb)
 		return cb, nil
 	})
 	if err != nil {
@@ -345,6 +310,66 @@ func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer
 	return bal.(Balancer), nil
 }
 
+// findProviders adds the peers providing the CID to the balancer, which is closed once the query completes.
+func (r *P2PRouter) findProviders(ctx context.Context, log logr.Logger, c cid.Cid, count int, cb *ClosableBalancer) {
+	addrInfoCh := r.kdht.FindProvidersAsync(ctx, c, count)
+	go func() {
+		defer cb.Close()
+
+		lookupTimer := prometheus.NewTimer(metrics.ResolveDurHistogram.WithLabelValues("libp2p"))
+		for addrInfo := range addrInfoCh {
+			lookupTimer.ObserveDuration()
+			log.Info("received provider from dht", "peerID", addrInfo.ID.String(), "numAddrs", len(addrInfo.Addrs))
+
+			// Skip self if found in provider store.
+			if addrInfo.ID == r.host.ID() {
+				continue
+			}
+
+			peer, err := r.registryAddr(addrInfo.Addrs)
+			if err != nil {
+				log.Error(err, "no suitable IP address found for peer")
+				continue
+			}
+			cb.Add(peer)
+			log.Info("added peer to lookup balancer", "peer", peer.String())
+		}
+	}()
+}
+
+// Self returns the registry address of this node as it is returned by lookups of peers.
+func (r *P2PRouter) Self() (netip.AddrPort, error) {
+	return r.registryAddr(r.host.Addrs())
+}
+
+// registryAddr returns the registry address of the first suitable IP address, preferring IPv6 when supported.
+func (r *P2PRouter) registryAddr(addrs []ma.Multiaddr) (netip.AddrPort, error) {
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(addrs)
+	errs := []error{}
+	if r.ip6Support {
+		for _, addr := range ip6Addrs {
+			ipAddr, err := toIPAddr(addr)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return netip.AddrPortFrom(ipAddr, r.registryPort), nil
+		}
+	}
+	if r.ip4Support {
+		for _, addr := range ip4Addrs {
+			ipAddr, err := toIPAddr(addr)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return netip.AddrPortFrom(ipAddr, r.registryPort), nil
+		}
+	}
+	errs = append(errs, errors.New("could not get IP from address"))
+	return netip.AddrPort{}, errors.Join(errs...)
+}
+
 func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
 	if len(keys) == 0 {
 		return nil
@@ -366,6 +391,11 @@ func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
 	if err != nil {
 		return err
 	}
+	r.providedMx.Lock()
+	for _, key := range keys {
+		r.provided[key] = struct{}{}
+	}
+	r.providedMx.Unlock()
 	return nil
 }
 
@@ -385,9 +415,23 @@ func (r *P2PRouter) Withdraw(ctx context.Context, keys []string) error {
 	if err != nil {
 		return err
 	}
+	r.providedMx.Lock()
+	for _, key := range keys {
+		delete(r.provided, key)
+	}
+	r.providedMx.Unlock()
 	return nil
 }
 
+// Provided returns the keys that were advertised by the router since it was created, as the provider only keeps the
+// hashes of the keys.
+func (r *P2PRouter) Provided(ctx context.Context) ([]string, error) {
+	r.providedMx.Lock()
+	defer r.providedMx.Unlock()
+
+	return slices.Sorted(maps.Keys(r.provided)), nil
+}
+
 type Peer struct {
 	ID        string
 	Addresses []string
@@ -74,6 +74,9 @@ func TestP2PRouter(t *testing.T) {
 	advertisedKey := "will find key"
 	err = primaryRouter.Advertise(t.Context(), []string{advertisedKey})
 	require.NoError(t, err)
+	provided, err := primaryRouter.Provided(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{advertisedKey}, provided)
 
 	// Provider store should contain self.
 	c, err := createCid(advertisedKey)
@@ -14,4 +14,6 @@ type Router interface {
 	Advertise(ctx context.Context, keys []string) error
 	// Withdraw stops the broadcasting the availability of the given keys to the network.
 	Withdraw(ctx context.Context, keys []string) error
+	// Provided returns the keys that are advertised and not withdrawn.
+	Provided(ctx context.Context) ([]string, error)
 }
@@ -0,0 +1,185 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+// cacheWatchDelay is the duration that changes are collected for after a change is watched before the cache is
+// walked, so that a file that is written and renamed only causes a single walk.
+const cacheWatchDelay = time.Second
+
+// CacheEvent is the creation or deletion of a key advertised for the files of a cache directory.
+type CacheEvent struct {
+	Type oci.EventType
+	Key  string
+}
+
+type walkFunc func(ctx context.Context) ([]string, error)
+
+// cacheTracker advertises the keys of the files in a cache directory as they are created and deleted.
+type cacheTracker struct {
+	gauge   prometheus.Gauge
+	keys    map[string]struct{}
+	eventCh <-chan CacheEvent
+	walk    walkFunc
+	name    string
+}
+
+// newCacheTracker advertises the keys of the files in the cache directory and subscribes to changes of the keys.
+// Changes are watched with inotify where it is available, and the directory is walked at the rescan interval as
+// changes can be missed, for example when the inotify watch limit is reached. An error is returned when the initial
+// walk fails, in which case the keys are advertised once the directory is walked again.
+func newCacheTracker(ctx context.Context, router routing.Router, name, dir string, walk walkFunc, gauge prometheus.Gauge, rescanInterval time.Duration) (*cacheTracker, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("cache", name)
+
+	// The directory is watched before it is walked so that no changes are missed in between.
+	changeCh, err := watchDir(ctx, dir)
+	if err != nil {
+		log.Info("could not watch cache directory, changes are found when the directory is rescanned", "dir", dir, "error", err.Error())
+	}
+	t := &cacheTracker{
+		name:  name,
+		gauge: gauge,
+		walk:  walk,
+		keys:  map[string]struct{}{},
+	}
+	keys, walkErr := walk(ctx)
+	if walkErr != nil {
+		walkErr = fmt.Errorf("could not walk %s cache directory: %w", name, walkErr)
+		keys = nil
+	}
+	if len(keys) > 0 {
+		err := router.Advertise(ctx, keys)
+		if err != nil {
+			walkErr = fmt.Errorf("could not advertise %s keys: %w", name, err)
+			keys = nil
+		}
+	}
+	for _, key := range keys {
+		t.keys[key] = struct{}{}
+	}
+	t.gauge.Set(float64(len(t.keys)))
+	t.eventCh = subscribeCache(ctx, walk, changeCh, rescanInterval, keys)
+	return t, walkErr
+}
+
+// events returns the changes of the keys of the cache, which is nil when the cache is not tracked.
+func (t *cacheTracker) events() <-chan CacheEvent {
+	if t == nil {
+		return nil
+	}
+	return t.eventCh
+}
+
+// handleEvent advertises or withdraws the key of the event.
+func (t *cacheTracker) handleEvent(ctx context.Context, router routing.Router, event CacheEvent) error {
+	logr.FromContextOrDiscard(ctx).V(4).Info("cache event", "cache", t.name, "key", event.Key, "type", event.Type)
+	switch event.Type {
+	case oci.CreateEvent:
+		err := router.Advertise(ctx, []string{event.Key})
+		if err != nil {
+			return err
+		}
+		t.keys[event.Key] = struct{}{}
+	case oci.DeleteEvent:
+		err := router.Withdraw(ctx, []string{event.Key})
+		if err != nil {
+			return err
+		}
+		delete(t.keys, event.Key)
+	default:
+		return fmt.Errorf("unhandled event type %s", event.Type)
+	}
+	t.gauge.Set(float64(len(t.keys)))
+	return nil
+}
+
+// setKeys replaces the keys of the cache with the keys that are advertised after a reconciliation.
+func (t *cacheTracker) setKeys(keys []string) {
+	t.keys = map[string]struct{}{}
+	for _, key := range keys {
+		t.keys[key] = struct{}{}
+	}
+	t.gauge.Set(float64(len(t.keys)))
+}
+
+// subscribeCache walks the cache when it changes and at the rescan interval, and emits events for the difference
+// between walks.
+func subscribeCache(ctx context.Context, walk walkFunc, changeCh <-chan struct{}, rescanInterval time.Duration, keys []string) <-chan CacheEvent {
+	log := logr.FromContextOrDiscard(ctx)
+
+	prev := keys
+	eventCh := make(chan CacheEvent)
+	go func() {
+		defer close(eventCh)
+		ticker := time.NewTicker(rescanInterval)
+		defer ticker.Stop()
+		var delay <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-changeCh:
+				if !ok {
+					changeCh = nil
+					continue
+				}
+				if delay == nil {
+					delay = time.After(cacheWatchDelay)
+				}
+				continue
+			case <-delay:
+				delay = nil
+			case <-ticker.C:
+			}
+			curr, err := walk(ctx)
+			if err != nil {
+				log.Error(err, "could not walk cache directory")
+				continue
+			}
+			for _, event := range diffCacheKeys(prev, curr) {
+				select {
+				case <-ctx.Done():
+					return
+				case eventCh <- event:
+				}
+			}
+			prev = curr
+		}
+	}()
+	return eventCh
+}
+
+// diffCacheKeys returns the events for keys that are created and deleted between the walks.
+func diffCacheKeys(prev, curr []string) []CacheEvent {
+	prevKeys := map[string]struct{}{}
+	for _, key := range prev {
+		prevKeys[key] = struct{}{}
+	}
+	currKeys := map[string]struct{}{}
+	for _, key := range curr {
+		currKeys[key] = struct{}{}
+	}
+	events := []CacheEvent{}
+	for _, key := range slices.Sorted(maps.Keys(currKeys)) {
+		if _, ok := prevKeys[key]; !ok {
+			events = append(events, CacheEvent{Type: oci.CreateEvent, Key: key})
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(prevKeys)) {
+		if _, ok := currKeys[key]; !ok {
+			events = append(events, CacheEvent{Type: oci.DeleteEvent, Key: key})
+		}
+	}
+	return events
+}
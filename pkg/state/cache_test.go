@@ -0,0 +1,115 @@
+package state
+
+import (
+	"context"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+func TestDiffCacheKeys(t *testing.T) {
+	t.Parallel()
+
+	events := diffCacheKeys([]string{"a", "b", "b"}, []string{"c", "a", "d"})
+	expected := []CacheEvent{
+		{Type: oci.CreateEvent, Key: "c"},
+		{Type: oci.CreateEvent, Key: "d"},
+		{Type: oci.DeleteEvent, Key: "b"},
+	}
+	require.Equal(t, expected, events)
+	require.Empty(t, diffCacheKeys(nil, nil))
+}
+
+func TestCacheTracker(t *testing.T) {
+	t.Parallel()
+
+	//nolint: govet // Prioritize readability in tests.
+	tests := []struct {
+		name           string
+		rescanInterval time.Duration
+		watch          bool
+	}{
+		{
+			name:           "rescan",
+			rescanInterval: 50 * time.Millisecond,
+		},
+		{
+			name:           "watch",
+			rescanInterval: time.Hour,
+			watch:          true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if tt.watch && runtime.GOOS != "linux" {
+				t.Skip("directories are only watched on linux")
+			}
+
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), nil, 0o644))
+			walk := func(ctx context.Context) ([]string, error) {
+				keys := []string{}
+				err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+					if err != nil || d.IsDir() {
+						return err
+					}
+					rel, err := filepath.Rel(dir, p)
+					if err != nil {
+						return err
+					}
+					keys = append(keys, "test:"+filepath.ToSlash(rel))
+					return nil
+				})
+				return keys, err
+			}
+			self := netip.MustParseAddrPort("10.0.0.1:5000")
+			router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, self)
+			gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})
+
+			tracker, err := newCacheTracker(t.Context(), router, "test", dir, walk, gauge, tt.rescanInterval)
+			require.NoError(t, err)
+			peers, _ := router.Get("test:existing")
+			require.Equal(t, []netip.AddrPort{self}, peers)
+			require.Equal(t, float64(1), testutil.ToFloat64(gauge))
+
+			nextEvent := func() CacheEvent {
+				t.Helper()
+				select {
+				case event := <-tracker.events():
+					require.NoError(t, tracker.handleEvent(t.Context(), router, event))
+					return event
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for cache event")
+					return CacheEvent{}
+				}
+			}
+
+			// Files in directories created after the tracker started are found.
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub", "dir"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "dir", "added"), nil, 0o644))
+			require.Equal(t, CacheEvent{Type: oci.CreateEvent, Key: "test:sub/dir/added"}, nextEvent())
+			peers, _ = router.Get("test:sub/dir/added")
+			require.Equal(t, []netip.AddrPort{self}, peers)
+			require.Equal(t, float64(2), testutil.ToFloat64(gauge))
+
+			require.NoError(t, os.Remove(filepath.Join(dir, "existing")))
+			require.Equal(t, CacheEvent{Type: oci.DeleteEvent, Key: "test:existing"}, nextEvent())
+			peers, _ = router.Get("test:existing")
+			require.Empty(t, peers)
+			require.Equal(t, float64(1), testutil.ToFloat64(gauge))
+		})
+	}
+}
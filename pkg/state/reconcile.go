@@ -0,0 +1,117 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"clyde/pkg/metrics"
+	"clyde/pkg/oci"
+	"clyde/pkg/routing"
+)
+
+// ReconcileStatistics is the result of the last successful reconciliation.
+type ReconcileStatistics struct {
+	LastSuccess atomic.Int64
+	MissingKeys atomic.Int64
+	ExtraKeys   atomic.Int64
+}
+
+// reconcile advertises the keys of the store and the caches that the router is not providing, and withdraws the keys
+// that the router is providing for content that no longer exists. Keys of leases and of transfers that are being
+// relayed are advertised by their owners and are never withdrawn. The referrers index and the keys of the cache trackers
+// are replaced with the reconciled state.
+func reconcile(ctx context.Context, ociStore oci.Store, router routing.Router, cfg TrackerConfig, trackers ...*cacheTracker) error {
+	// The provided keys are read before the desired keys are listed, so that keys advertised for content that is added
+	// while the content is listed are not withdrawn.
+	provided, err := router.Provided(ctx)
+	if err != nil {
+		return err
+	}
+	desired, referrersIdx, err := listOCIKeys(ctx, ociStore, cfg.Filters)
+	if err != nil {
+		return err
+	}
+	cacheKeys := map[*cacheTracker][]string{}
+	for _, t := range trackers {
+		if t == nil {
+			continue
+		}
+		keys, err := t.walk(ctx)
+		if err != nil {
+			return fmt.Errorf("could not walk %s cache directory: %w", t.name, err)
+		}
+		cacheKeys[t] = keys
+		desired = append(desired, keys...)
+	}
+	missing, extra := diffKeys(desired, provided, func(key string) bool {
+		if routing.IsLeaseKey(key) {
+			return true
+		}
+		if cfg.Relay == nil {
+			return false
+		}
+		_, ok := cfg.Relay.Get(key)
+		return ok
+	})
+	metrics.ReconcileDriftKeys.WithLabelValues("missing").Set(float64(len(missing)))
+	metrics.ReconcileDriftKeys.WithLabelValues("extra").Set(float64(len(extra)))
+	if len(missing) > 0 || len(extra) > 0 {
+		logr.FromContextOrDiscard(ctx).Info("reconciling advertised keys", "missing", len(missing), "extra", len(extra))
+	}
+
+	err = router.Advertise(ctx, missing)
+	if err != nil {
+		return fmt.Errorf("could not advertise missing keys: %w", err)
+	}
+	metrics.ReconcileDriftKeysTotal.WithLabelValues("missing").Add(float64(len(missing)))
+	err = router.Withdraw(ctx, extra)
+	if err != nil {
+		return fmt.Errorf("could not withdraw extra keys: %w", err)
+	}
+	metrics.ReconcileDriftKeysTotal.WithLabelValues("extra").Add(float64(len(extra)))
+
+	cfg.ReferrersIndex.Replace(referrersIdx)
+	for t, keys := range cacheKeys {
+		t.setKeys(keys)
+	}
+	metrics.ReconcileLastSuccessTimestamp.SetToCurrentTime()
+	if cfg.ReconcileStats != nil {
+		cfg.ReconcileStats.LastSuccess.Store(time.Now().Unix())
+		cfg.ReconcileStats.MissingKeys.Store(int64(len(missing)))
+		cfg.ReconcileStats.ExtraKeys.Store(int64(len(extra)))
+	}
+	return nil
+}
+
+// diffKeys returns the sorted desired keys that are not provided, and the sorted provided keys that are not desired
+// and not ignored.
+func diffKeys(desired, provided []string, ignore func(key string) bool) ([]string, []string) {
+	desiredKeys := map[string]struct{}{}
+	for _, key := range desired {
+		desiredKeys[key] = struct{}{}
+	}
+	providedKeys := map[string]struct{}{}
+	for _, key := range provided {
+		providedKeys[key] = struct{}{}
+	}
+	missing := []string{}
+	for _, key := range slices.Sorted(maps.Keys(desiredKeys)) {
+		if _, ok := providedKeys[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	extra := []string{}
+	for _, key := range slices.Sorted(maps.Keys(providedKeys)) {
+		if _, ok := desiredKeys[key]; ok || ignore(key) {
+			continue
+		}
+		extra = append(extra, key)
+	}
+	return missing, extra
+}
@@ -0,0 +1,97 @@
+package state
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"clyde/pkg/metrics"
+	"clyde/pkg/oci"
+	"clyde/pkg/relay"
+	"clyde/pkg/routing"
+)
+
+func TestDiffKeys(t *testing.T) {
+	t.Parallel()
+
+	missing, extra := diffKeys([]string{"b", "a", "c", "a"}, []string{"c", "e", "d", "lease/f"}, routing.IsLeaseKey)
+	require.Equal(t, []string{"a", "b"}, missing)
+	require.Equal(t, []string{"d", "e"}, extra)
+}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	ociStore := oci.NewMemory()
+	b := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{},"layers":[]}`)
+	dgst := digest.FromBytes(b)
+	err := ociStore.Write(ocispec.Descriptor{Digest: dgst, MediaType: ocispec.MediaTypeImageManifest}, b)
+	require.NoError(t, err)
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	err = router.Advertise(t.Context(), []string{oci.CatalogKey, "stale", "pip:removed.whl", routing.LeaseKey("foo")})
+	require.NoError(t, err)
+	contentRelay, err := relay.NewRelay(router, relay.WithDir(t.TempDir()))
+	require.NoError(t, err)
+	_, err = contentRelay.Start(t.Context(), "relayed", 1, http.Header{})
+	require.NoError(t, err)
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})
+	tracker := &cacheTracker{
+		name:  "pip",
+		gauge: gauge,
+		keys:  map[string]struct{}{"pip:removed.whl": {}},
+		walk: func(ctx context.Context) ([]string, error) {
+			return []string{"pip:foo.whl"}, nil
+		},
+	}
+	stats := &ReconcileStatistics{}
+	referrersIdx := oci.NewReferrersIndex()
+	referrersIdx.Add(ocispec.Descriptor{Digest: "sha256:removed"}, "sha256:subject")
+	cfg := TrackerConfig{
+		Relay:          contentRelay,
+		ReconcileStats: stats,
+		ReferrersIndex: referrersIdx,
+	}
+	err = reconcile(t.Context(), ociStore, router, cfg, tracker, nil)
+	require.NoError(t, err)
+
+	provided, err := router.Provided(t.Context())
+	require.NoError(t, err)
+	expected := []string{oci.CatalogKey, routing.LeaseKey("foo"), "pip:foo.whl", "relayed", dgst.String()}
+	require.ElementsMatch(t, expected, provided)
+	require.False(t, referrersIdx.HasReferrers("sha256:subject"))
+	require.Equal(t, map[string]struct{}{"pip:foo.whl": {}}, tracker.keys)
+	require.InDelta(t, 1, testutil.ToFloat64(gauge), 0)
+	require.Equal(t, int64(2), stats.MissingKeys.Load())
+	require.Equal(t, int64(2), stats.ExtraKeys.Load())
+	require.Positive(t, stats.LastSuccess.Load())
+	require.InDelta(t, 2, testutil.ToFloat64(metrics.ReconcileDriftKeys.WithLabelValues("extra")), 0)
+
+	// Nothing drifts once the keys are reconciled.
+	err = reconcile(t.Context(), ociStore, router, cfg, tracker, nil)
+	require.NoError(t, err)
+	require.Zero(t, stats.MissingKeys.Load())
+	require.Zero(t, stats.ExtraKeys.Load())
+
+	// Keys advertised while the cache is walked are not withdrawn.
+	tracker.walk = func(ctx context.Context) ([]string, error) {
+		err := router.Advertise(ctx, []string{"pip:added.whl"})
+		if err != nil {
+			return nil, err
+		}
+		return []string{"pip:foo.whl"}, nil
+	}
+	err = reconcile(t.Context(), ociStore, router, cfg, tracker, nil)
+	require.NoError(t, err)
+	provided, err = router.Provided(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, provided, "pip:added.whl")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/go-logr/logr"
 
@@ -12,13 +13,19 @@ import (
 	"clyde/pkg/metrics"
 	"clyde/pkg/oci"
 	"clyde/pkg/pip"
+	"clyde/pkg/relay"
 	"clyde/pkg/routing"
 )
 
 type TrackerConfig struct {
-	Filters   []oci.Filter
-	PipClient pip.Pip
-	HfClient  hf.Hf
+	PipClient           pip.Pip
+	HfClient            hf.Hf
+	Relay               *relay.Relay
+	ReferrersIndex      *oci.ReferrersIndex
+	ReconcileStats      *ReconcileStatistics
+	Filters             []oci.Filter
+	CacheRescanInterval time.Duration
+	ReconcileInterval   time.Duration
 }
 
 type TrackerOption = option.Option[TrackerConfig]
@@ -44,78 +51,151 @@ func WithHfClient(hfClient hf.Hf) TrackerOption {
 	}
 }
 
+// WithCacheRescanInterval sets the interval at which the pip and Hugging Face cache directories are walked to find
+// changes that were not watched.
+func WithCacheRescanInterval(interval time.Duration) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("cache rescan interval %s has to be positive", interval)
+		}
+		cfg.CacheRescanInterval = interval
+		return nil
+	}
+}
+
+// WithReferrersIndex sets the index that the content referring to subjects is tracked in, so that it can be shared
+// with the registry serving referrers.
+func WithReferrersIndex(idx *oci.ReferrersIndex) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		cfg.ReferrersIndex = idx
+		return nil
+	}
+}
+
+// WithRelay sets the relay whose transfers in progress are advertised by the relay, so that reconciliation does not
+// withdraw their keys before the content is stored.
+func WithRelay(contentRelay *relay.Relay) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		cfg.Relay = contentRelay
+		return nil
+	}
+}
+
+// WithReconcileInterval sets the interval at which the advertised keys are reconciled with the contents of the store
+// and the caches.
+func WithReconcileInterval(interval time.Duration) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("reconcile interval %s has to be positive", interval)
+		}
+		cfg.ReconcileInterval = interval
+		return nil
+	}
+}
+
+// WithReconcileStatistics sets the statistics that the result of each reconciliation is recorded in.
+func WithReconcileStatistics(stats *ReconcileStatistics) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		cfg.ReconcileStats = stats
+		return nil
+	}
+}
+
 func Track(ctx context.Context, ociStore oci.Store, router routing.Router, opts ...TrackerOption) error {
-	cfg := TrackerConfig{}
+	cfg := TrackerConfig{
+		CacheRescanInterval: time.Minute,
+		ReconcileInterval:   10 * time.Minute,
+	}
 	err := option.Apply(&cfg, opts...)
 	if err != nil {
 		return err
 	}
+	if cfg.ReferrersIndex == nil {
+		cfg.ReferrersIndex = oci.NewReferrersIndex()
+	}
 
 	eventCh, err := ociStore.Subscribe(ctx)
 	if err != nil {
 		return err
 	}
 
-	keys := []string{}
-	imgs, err := ociStore.ListImages(ctx)
+	keys, referrersIdx, err := listOCIKeys(ctx, ociStore, cfg.Filters)
 	if err != nil {
 		return err
 	}
-	for _, img := range imgs {
-		if oci.MatchesFilter(img.Reference, cfg.Filters) {
-			continue
-		}
-		tagName, ok := img.TagName()
-		if ok {
-			keys = append(keys, tagName)
-			metrics.AdvertisedImageTags.WithLabelValues(img.Registry).Inc()
-		}
-		metrics.AdvertisedImageDigests.WithLabelValues(img.Registry).Inc()
-	}
-	contents, err := ociStore.ListContent(ctx)
-	if err != nil {
-		return err
-	}
-	for _, refs := range contents {
-		if allReferencesMatchFilter(refs, cfg.Filters) {
-			continue
-		}
-		for _, ref := range refs {
-			metrics.AdvertisedContentDigests.WithLabelValues(ref.Registry).Inc()
-		}
-		keys = append(keys, refs[0].Digest.String())
-	}
+	cfg.ReferrersIndex.Replace(referrersIdx)
 	err = router.Advertise(ctx, keys)
 	if err != nil {
 		return err
 	}
 
-	if _, err := syncPip(ctx, cfg.PipClient, router); err != nil {
-		logr.FromContextOrDiscard(ctx).Error(err, "errors during initial pip sync")
+	var pipTracker *cacheTracker
+	if cfg.PipClient == nil {
+		logr.FromContextOrDiscard(ctx).Info("pip client not configured, skipping pip sync")
+	} else {
+		pipTracker, err = newCacheTracker(ctx, router, "pip", cfg.PipClient.CacheDir(), cfg.PipClient.WalkPipDir, metrics.AdvertisedPipPackage.WithLabelValues("pip-cache"), cfg.CacheRescanInterval)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "errors during initial pip sync")
+		}
 	}
-	if _, err := syncHF(ctx, cfg.HfClient, router); err != nil {
-		logr.FromContextOrDiscard(ctx).Error(err, "errors during initial HF sync")
+	var hfTracker *cacheTracker
+	if cfg.HfClient == nil {
+		logr.FromContextOrDiscard(ctx).Info("Hugging Face client not configured, skipping HF sync")
+	} else {
+		hfTracker, err = newCacheTracker(ctx, router, "HF", cfg.HfClient.CacheDir(), cfg.HfClient.WalkHFCacheDir, metrics.AdvertisedHFModel.WithLabelValues("hf-cache"), cfg.CacheRescanInterval)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "errors during initial HF sync")
+		}
 	}
 
+	reconcileTicker := time.NewTicker(cfg.ReconcileInterval)
+	defer reconcileTicker.Stop()
+
 	logr.FromContextOrDiscard(ctx).Info("waiting for store events")
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-reconcileTicker.C:
+			err := reconcile(ctx, ociStore, router, cfg, pipTracker, hfTracker)
+			if err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "could not reconcile advertised keys")
+				continue
+			}
 		case event, ok := <-eventCh:
 			if !ok {
 				return errors.New("event channel closed")
 			}
-			err := handleEvent(ctx, router, event, cfg.Filters)
+			err := handleEvent(ctx, ociStore, router, event, cfg.Filters, cfg.ReferrersIndex)
 			if err != nil {
 				logr.FromContextOrDiscard(ctx).Error(err, "could not handle event")
 				continue
 			}
+		case event, ok := <-pipTracker.events():
+			if !ok {
+				return errors.New("pip event channel closed")
+			}
+			err := pipTracker.handleEvent(ctx, router, event)
+			if err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "could not handle pip event")
+				continue
+			}
+		case event, ok := <-hfTracker.events():
+			if !ok {
+				return errors.New("HF event channel closed")
+			}
+			err := hfTracker.handleEvent(ctx, router, event)
+			if err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "could not handle HF event")
+				continue
+			}
 		}
 	}
 }
 
-func handleEvent(ctx context.Context, router routing.Router, event oci.OCIEvent, filters []oci.Filter) error {
+// handleEvent advertises or withdraws the reference of the event.
+// The referrers key of a subject is advertised while any content referring to it exists.
+func handleEvent(ctx context.Context, ociStore oci.Store, router routing.Router, event oci.OCIEvent, filters []oci.Filter, referrersIdx *oci.ReferrersIndex) error {
 	if oci.MatchesFilter(event.Reference, filters) {
 		return nil
 	}
@@ -127,7 +207,18 @@ func handleEvent(ctx context.Context, router routing.Router, event oci.OCIEvent,
 		} else {
 			metrics.AdvertisedContentDigests.WithLabelValues(event.Reference.Registry).Inc()
 		}
-		err := router.Advertise(ctx, []string{event.Reference.Identifier()})
+		keys := []string{event.Reference.Identifier()}
+		if event.Reference.Digest != "" && event.Reference.Tag == "" {
+			desc, subject, err := oci.ReadReferrer(ctx, ociStore, event.Reference.Digest)
+			if err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "could not read content subject", "digest", event.Reference.Digest.String())
+			}
+			if subject != "" {
+				referrersIdx.Add(desc, subject)
+				keys = append(keys, oci.ReferrersKey(subject))
+			}
+		}
+		err := router.Advertise(ctx, keys)
 		if err != nil {
 			return err
 		}
@@ -138,7 +229,11 @@ func handleEvent(ctx context.Context, router routing.Router, event oci.OCIEvent,
 		} else {
 			metrics.AdvertisedContentDigests.WithLabelValues(event.Reference.Registry).Dec()
 		}
-		err := router.Withdraw(ctx, []string{event.Reference.Identifier()})
+		keys := []string{event.Reference.Identifier()}
+		if subject, ok := referrersIdx.Remove(event.Reference.Digest); ok && !referrersIdx.HasReferrers(subject) {
+			keys = append(keys, oci.ReferrersKey(subject))
+		}
+		err := router.Withdraw(ctx, keys)
 		if err != nil {
 			return err
 		}
@@ -148,73 +243,63 @@ func handleEvent(ctx context.Context, router routing.Router, event oci.OCIEvent,
 	}
 }
 
-func allReferencesMatchFilter(refs []oci.Reference, filters []oci.Filter) bool {
-	for _, ref := range refs {
-		if !oci.MatchesFilter(ref, filters) {
-			return false
-		}
-	}
-	return true
-}
-
-func syncPip(ctx context.Context, pipClient pip.Pip, router routing.Router) (int, error) {
-	log := logr.FromContextOrDiscard(ctx)
-
-	if pipClient == nil {
-		log.Info("pip client not configured, skipping pip sync")
-		return 0, nil
-	}
-
-	metrics.AdvertisedPipPackage.Reset()
-
-	pipKeys, err := pipClient.WalkPipDir(ctx)
+// listOCIKeys returns the keys of the images and content in the store and an index of the content that refers to
+// subjects. The advertised image and content gauges are set to the counts of the store.
+func listOCIKeys(ctx context.Context, ociStore oci.Store, filters []oci.Filter) ([]string, *oci.ReferrersIndex, error) {
+	// Every node takes part in listings merged across the cluster, even when it has no images.
+	keys := []string{oci.CatalogKey}
+	imgs, err := ociStore.ListImages(ctx)
 	if err != nil {
-		log.Error(err, "could not walk pip cache directory")
-		return 0, err
-	}
-
-	if len(pipKeys) == 0 {
-		metrics.AdvertisedPipPackage.WithLabelValues("pip-cache").Set(0)
-		return 0, nil
-	}
-
-	if err := router.Advertise(ctx, pipKeys); err != nil {
-		log.Error(err, "could not advertise pip keys")
-		return 0, fmt.Errorf("could not advertise pip keys: %w", err)
+		return nil, nil, err
 	}
-
-	metrics.AdvertisedPipPackage.WithLabelValues("pip-cache").Set(float64(len(pipKeys)))
-
-	return len(pipKeys), nil
-}
-
-func syncHF(ctx context.Context, hfClient hf.Hf, router routing.Router) (int, error) {
-	log := logr.FromContextOrDiscard(ctx)
-
-	if hfClient == nil {
-		log.Info("Hugging Face client not configured, skipping HF sync")
-		return 0, nil
+	metrics.AdvertisedImageTags.Reset()
+	metrics.AdvertisedImageDigests.Reset()
+	for _, img := range imgs {
+		if oci.MatchesFilter(img.Reference, filters) {
+			continue
+		}
+		tagName, ok := img.TagName()
+		if ok {
+			keys = append(keys, tagName)
+			metrics.AdvertisedImageTags.WithLabelValues(img.Registry).Inc()
+		}
+		metrics.AdvertisedImageDigests.WithLabelValues(img.Registry).Inc()
 	}
-
-	metrics.AdvertisedHFModel.Reset()
-
-	hfKeys, err := hfClient.WalkHFCacheDir(ctx)
+	contents, err := ociStore.ListContent(ctx)
 	if err != nil {
-		log.Error(err, "could not walk HF cache directory")
-		return 0, err
+		return nil, nil, err
 	}
-
-	if len(hfKeys) == 0 {
-		metrics.AdvertisedHFModel.WithLabelValues("hf-cache").Set(0)
-		return 0, nil
+	metrics.AdvertisedContentDigests.Reset()
+	referrersIdx := oci.NewReferrersIndex()
+	for _, refs := range contents {
+		if allReferencesMatchFilter(refs, filters) {
+			continue
+		}
+		for _, ref := range refs {
+			metrics.AdvertisedContentDigests.WithLabelValues(ref.Registry).Inc()
+		}
+		keys = append(keys, refs[0].Digest.String())
+		desc, subject, err := oci.ReadReferrer(ctx, ociStore, refs[0].Digest)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "could not read content subject", "digest", refs[0].Digest.String())
+			continue
+		}
+		if subject == "" {
+			continue
+		}
+		if !referrersIdx.HasReferrers(subject) {
+			keys = append(keys, oci.ReferrersKey(subject))
+		}
+		referrersIdx.Add(desc, subject)
 	}
+	return keys, referrersIdx, nil
+}
 
-	if err := router.Advertise(ctx, hfKeys); err != nil {
-		log.Error(err, "could not advertise HF keys")
-		return 0, fmt.Errorf("could not advertise HF keys: %w", err)
+func allReferencesMatchFilter(refs []oci.Reference, filters []oci.Filter) bool {
+	for _, ref := range refs {
+		if !oci.MatchesFilter(ref, filters) {
+			return false
+		}
 	}
-
-	metrics.AdvertisedHFModel.WithLabelValues("hf-cache").Set(float64(len(hfKeys)))
-
-	return len(hfKeys), nil
+	return true
 }
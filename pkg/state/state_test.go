@@ -102,6 +102,9 @@ func TestTrack(t *testing.T) {
 			})
 			time.Sleep(100 * time.Millisecond)
 
+			_, ok := router.Get(oci.CatalogKey)
+			require.True(t, ok, "Catalog key should be advertised")
+
 			// Check that all images are advertised by digest (this should always happen)
 			for _, img := range imgs {
 				peers, ok := router.Get(img.Digest.String())
@@ -131,3 +134,33 @@ func TestTrack(t *testing.T) {
 		})
 	}
 }
+
+func TestTrackReferrers(t *testing.T) {
+	t.Parallel()
+
+	ociStore := oci.NewMemory()
+	subjectB := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{},"layers":[]}`)
+	subjectDgst := digest.FromBytes(subjectB)
+	err := ociStore.Write(ocispec.Descriptor{Digest: subjectDgst, MediaType: ocispec.MediaTypeImageManifest}, subjectB)
+	require.NoError(t, err)
+	sigB := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.dev.cosign.artifact.sig.v1+json","config":{},"layers":[],"subject":{"digest":"` + subjectDgst.String() + `"}}`)
+	err = ociStore.Write(ocispec.Descriptor{Digest: digest.FromBytes(sigB), MediaType: ocispec.MediaTypeImageManifest}, sigB)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return Track(gCtx, ociStore, router)
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok := router.Get(oci.ReferrersKey(subjectDgst))
+	require.True(t, ok)
+	_, ok = router.Get(oci.ReferrersKey(digest.FromBytes(sigB)))
+	require.False(t, ok)
+
+	cancel()
+	err = g.Wait()
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// watchDir notifies the returned channel when files in the directory or its subdirectories are created, written,
+// moved or deleted. Subdirectories are watched as they are created. An error is returned when the directory can not
+// be watched, for example when the inotify watch limit is reached.
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// The file is non-blocking so that reads are interrupted when it is closed.
+	f := os.NewFile(uintptr(fd), "inotify")
+	w := &dirWatcher{
+		fd:   fd,
+		dirs: map[int32]string{},
+	}
+	err = w.addRecursive(dir)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	changeCh := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		defer close(changeCh)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			w.handleEvents(buf[:n])
+			select {
+			case changeCh <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changeCh, nil
+}
+
+type dirWatcher struct {
+	dirs map[int32]string
+	fd   int
+}
+
+// addRecursive watches the directory and all of its subdirectories.
+func (w *dirWatcher) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, watchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.dirs[int32(wd)] = p
+		return nil
+	})
+}
+
+// handleEvents watches directories that are created or moved into a watched directory.
+func (w *dirWatcher) handleEvents(buf []byte) {
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		wd := int32(binary.NativeEndian.Uint32(buf[0:4]))
+		mask := binary.NativeEndian.Uint32(buf[4:8])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:16]))
+		if len(buf) < syscall.SizeofInotifyEvent+nameLen {
+			return
+		}
+		name := strings.TrimRight(string(buf[syscall.SizeofInotifyEvent:syscall.SizeofInotifyEvent+nameLen]), "\x00")
+		buf = buf[syscall.SizeofInotifyEvent+nameLen:]
+
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, wd)
+			continue
+		}
+		if mask&syscall.IN_ISDIR == 0 || mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) == 0 {
+			continue
+		}
+		parent, ok := w.dirs[wd]
+		if !ok {
+			continue
+		}
+		// Changes in directories that can not be watched are found when the cache is rescanned.
+		//nolint: errcheck // Ignore error.
+		w.addRecursive(filepath.Join(parent, name))
+	}
+}
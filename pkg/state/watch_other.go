@@ -0,0 +1,13 @@
+//go:build !linux
+
+package state
+
+import (
+	"context"
+	"errors"
+)
+
+// watchDir is only supported on Linux, other platforms find changes when the cache is rescanned.
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	return nil, errors.ErrUnsupported
+}
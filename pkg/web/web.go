@@ -18,14 +18,16 @@ import (
 	"clyde/pkg/oci"
 	"clyde/pkg/registry"
 	"clyde/pkg/routing"
+	"clyde/pkg/state"
 )
 
 //go:embed templates/*
 var templatesFS embed.FS
 
 type WebConfig struct {
-	OCIClient *oci.Client
-	Filters   []oci.Filter
+	OCIClient      *oci.Client
+	ReconcileStats *state.ReconcileStatistics
+	Filters        []oci.Filter
 }
 
 type WebOption = option.Option[WebConfig]
@@ -44,14 +46,23 @@ func WithRegistryFilters(filters []oci.Filter) WebOption {
 	}
 }
 
+// WithReconcileStatistics shows the drift found by the last reconciliation of the advertised keys.
+func WithReconcileStatistics(stats *state.ReconcileStatistics) WebOption {
+	return func(cfg *WebConfig) error {
+		cfg.ReconcileStats = stats
+		return nil
+	}
+}
+
 type Web struct {
-	mirror    *url.URL
-	router    *routing.P2PRouter
-	ociClient *oci.Client
-	ociStore  oci.Store
-	tmpls     *template.Template
-	reg       *registry.Registry
-	filters   []oci.Filter
+	mirror         *url.URL
+	router         *routing.P2PRouter
+	ociClient      *oci.Client
+	ociStore       oci.Store
+	tmpls          *template.Template
+	reg            *registry.Registry
+	reconcileStats *state.ReconcileStatistics
+	filters        []oci.Filter
 }
 
 func NewWeb(router *routing.P2PRouter, ociStore oci.Store, reg *registry.Registry, mirror *url.URL, opts ...WebOption) (*Web, error) {
@@ -78,13 +89,14 @@ func NewWeb(router *routing.P2PRouter, ociStore oci.Store, reg *registry.Registr
 		return nil, err
 	}
 	return &Web{
-		router:    router,
-		ociClient: cfg.OCIClient,
-		ociStore:  ociStore,
-		filters:   cfg.Filters,
-		tmpls:     tmpls,
-		reg:       reg,
-		mirror:    mirror,
+		router:         router,
+		ociClient:      cfg.OCIClient,
+		ociStore:       ociStore,
+		filters:        cfg.Filters,
+		tmpls:          tmpls,
+		reg:            reg,
+		reconcileStats: cfg.ReconcileStats,
+		mirror:         mirror,
 	}, nil
 }
 
@@ -106,10 +118,13 @@ func (w *Web) indexHandler(rw httpx.ResponseWriter, req *http.Request) {
 
 func (w *Web) statsHandler(rw httpx.ResponseWriter, req *http.Request) {
 	data := struct {
-		LocalAddresses    []string
-		Images            []oci.Image
-		Peers             []routing.Peer
-		MirrorLastSuccess time.Duration
+		LocalAddresses       []string
+		Images               []oci.Image
+		Peers                []routing.Peer
+		MirrorLastSuccess    time.Duration
+		ReconcileLastSuccess time.Duration
+		ReconcileMissingKeys int64
+		ReconcileExtraKeys   int64
 	}{}
 
 	images, err := w.ociStore.ListImages(req.Context())
@@ -130,6 +145,15 @@ func (w *Web) statsHandler(rw httpx.ResponseWriter, req *http.Request) {
 		data.MirrorLastSuccess = time.Since(time.Unix(mirrorLastSuccess, 0))
 	}
 
+	if w.reconcileStats != nil {
+		reconcileLastSuccess := w.reconcileStats.LastSuccess.Load()
+		if reconcileLastSuccess > 0 {
+			data.ReconcileLastSuccess = time.Since(time.Unix(reconcileLastSuccess, 0))
+			data.ReconcileMissingKeys = w.reconcileStats.MissingKeys.Load()
+			data.ReconcileExtraKeys = w.reconcileStats.ExtraKeys.Load()
+		}
+	}
+
 	data.LocalAddresses = w.router.LocalAddresses()
 	peers, err := w.router.ListPeers()
 	if err != nil {
@@ -208,7 +232,13 @@ func (w *Web) measureHandler(rw httpx.ResponseWriter, req *http.Request) {
 
 	if len(res.LookupResults) > 0 {
 		// Pull the image and measure performance.
-		pullMetrics, err := w.ociClient.Pull(req.Context(), img, oci.WithPullMirror(w.mirror))
+		pullOpts := []oci.PullOption{
+			oci.WithPullMirror(w.mirror),
+		}
+		if store, ok := w.ociStore.(oci.WritableStore); ok {
+			pullOpts = append(pullOpts, oci.WithPullStore(store))
+		}
+		pullMetrics, err := w.ociClient.Pull(req.Context(), img, pullOpts...)
 		if err != nil {
 			rw.WriteError(http.StatusInternalServerError, NewHTMLResponseError(err))
 			return